@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The event store lives in memory, and only the copy of each event on the ledger is tamper-evident. So that the local
+// copy can be trusted too, every event stored is also appended to AUDIT_LOG_FILE as a line of JSON, with its private
+// section still encrypted as it is on the ledger. Each tenant's entries form a hash chain: an entry's hash is the
+// SHA-256 of the previous entry's hash, the entry's index, its kind and its payload, so altering, removing or
+// reordering an entry breaks every hash after it.
+//
+//Every AUDIT_ANCHOR_INTERVAL, the head of each tenant's chain (if an event has been stored since the last anchor) is
+// anchored by submitting it to the tenant's topic, as a message with no private section:
+//
+//	{"public":{"event":"auditAnchor","transactionId":"...","auditLog":{"tenant":"acme","index":1234,"hash":"..."}}}
+//
+//When the anchor reaches consensus, the subscriber adds it to the chain too. The verify-audit-log command then checks
+// the chains and proves each anchored entry against the anchors on the ledger, so that queries can be answered cheaply
+// from the local copy whilst the ledger backs its integrity:
+//
+//	go run . verify-audit-log --in audit-log.ndjson
+const auditAnchorEvent = "auditAnchor"
+
+type auditLogEntry struct {
+	Tenant       string          `json:"tenant"`
+	Index        uint64          `json:"index"` //from 1, for each tenant
+	PreviousHash string          `json:"previousHash"`
+	Hash         string          `json:"hash"`
+	Record       json.RawMessage `json:"record,omitempty"` //a stored event
+	Anchor       *auditAnchor    `json:"anchor,omitempty"` //an anchor that reached consensus
+}
+
+//an auditAnchor is a chain head that was anchored into a topic
+type auditAnchor struct {
+	Index              uint64 `json:"index"`
+	Hash               string `json:"hash"`
+	TopicId            string `json:"topicId"`
+	SequenceNumber     uint64 `json:"sequenceNumber"`
+	ConsensusTimestamp string `json:"consensusTimestamp"`
+	TransactionId      string `json:"transactionId"`
+}
+
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+
+	//each tenant's entry hashes (hex encoded) in index order, so anchors can be checked against them
+	hashes map[string][]string
+
+	//the events and anchors already in the log, so that replayed or backfilled messages aren't logged twice
+	logged map[string]bool
+
+	//the last index anchored for each tenant, whether or not the anchor has reached consensus yet
+	anchored map[string]uint64
+
+	//the index of each tenant's last stored event, as the anchors confirmed after it don't need anchoring themselves
+	recorded map[string]uint64
+}
+
+//the audit log is nil unless AUDIT_LOG_FILE is set
+var audit *auditLog
+
+//This function loads the audit log from AUDIT_LOG_FILE, checking every chain in it, and opens it to append to
+func loadAuditLog() {
+	auditFilePath := getEnv("AUDIT_LOG_FILE", "")
+	if auditFilePath == "" {
+		return
+	}
+
+	l := &auditLog{hashes: make(map[string][]string), logged: make(map[string]bool), anchored: make(map[string]uint64), recorded: make(map[string]uint64)}
+
+	entries, err := readAuditLog(auditFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		panic(fmt.Errorf("Unable to read audit log %v. Error: %v\n", auditFilePath, err))
+	}
+	for i, entry := range entries {
+		if err := checkAuditLogEntry(entry, l.hashes[entry.Tenant]); err != nil {
+			panic(fmt.Errorf("The audit log %v has been altered at line %v: %v. Check it with the verify-audit-log command\n", auditFilePath, i+1, err))
+		}
+		l.hashes[entry.Tenant] = append(l.hashes[entry.Tenant], entry.Hash)
+
+		if entry.Anchor != nil {
+			l.logged["anchor:"+entry.Anchor.TransactionId] = true
+			if entry.Anchor.Index > l.anchored[entry.Tenant] {
+				l.anchored[entry.Tenant] = entry.Anchor.Index
+			}
+		} else {
+			l.logged[gjson.GetBytes(entry.Record, "public.transactionId").String()] = true
+			l.recorded[entry.Tenant] = entry.Index
+		}
+	}
+
+	l.file, err = os.OpenFile(auditFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		panic(fmt.Errorf("Unable to open audit log %v. Error: %v\n", auditFilePath, err))
+	}
+
+	log.Printf("Appending to audit log %v (%v entries)\n", auditFilePath, len(entries))
+	audit = l
+}
+
+//This function adds a stored event to the tenant's chain, once. The event's private section should be encrypted
+func (l *auditLog) record(t *tenant, transactionId string, eventJson string) {
+	if l == nil {
+		return
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(eventJson)); err != nil {
+		log.Printf("Unable to add event %v to the audit log. Error: %v\n", transactionId, err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.logged[transactionId] {
+		return
+	}
+	l.logged[transactionId] = true
+	l.recorded[t.id] = l.append(auditLogEntry{Tenant: t.id, Record: compacted.Bytes()})
+}
+
+//This function adds an anchor that has reached consensus to the tenant's chain, checking that it matches the chain
+func (l *auditLog) confirmAnchor(t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) {
+	if l == nil {
+		return
+	}
+
+	message := gjson.ParseBytes(response.Message)
+	anchor := &auditAnchor{
+		Index:              message.Get("public.auditLog.index").Uint(),
+		Hash:               message.Get("public.auditLog.hash").String(),
+		TopicId:            topic.String(),
+		SequenceNumber:     response.SequenceNumber,
+		ConsensusTimestamp: formatConsensusTimestamp(response.ConsensusTimeStamp),
+		TransactionId:      message.Get("public.transactionId").String(),
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if message.Get("public.auditLog.tenant").String() != t.id || l.logged["anchor:"+anchor.TransactionId] {
+		return
+	}
+
+	//an anchor beyond the head of the chain can only be checked once the log has caught up, which verify-audit-log does
+	hashes := l.hashes[t.id]
+	if anchor.Index > uint64(len(hashes)) {
+		log.Printf("Unable to check entry %v of the audit log for tenant %v yet, as the log ends at entry %v\n", anchor.Index, t.id, len(hashes))
+		return
+	}
+	if anchor.Index == 0 || hashes[anchor.Index-1] != anchor.Hash {
+		go raiseAlert("audit_log", "critical", "The audit log for tenant %v doesn't match entry %v anchored in message %v on topic %v", t.id, anchor.Index, response.SequenceNumber, topic)
+		return
+	}
+
+	l.logged["anchor:"+anchor.TransactionId] = true
+	if anchor.Index > l.anchored[t.id] {
+		l.anchored[t.id] = anchor.Index
+	}
+	metrics.setGauge(series("hcs_audit_log_anchored_index", "tenant", t.id), "The index of the last audit log entry anchored into the tenant's topic", float64(anchor.Index))
+
+	l.append(auditLogEntry{Tenant: t.id, Anchor: anchor})
+}
+
+//This function links an entry onto the end of its tenant's chain and writes it out, returning its index. It must be
+// called with the mutex held
+func (l *auditLog) append(entry auditLogEntry) uint64 {
+	hashes := l.hashes[entry.Tenant]
+	entry.Index = uint64(len(hashes)) + 1
+	if len(hashes) > 0 {
+		entry.PreviousHash = hashes[len(hashes)-1]
+	}
+	entry.Hash = hex.EncodeToString(auditLogEntryHash(entry))
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		//an entry that can't be written would leave a gap in the chain, so it is better to stop
+		panic(fmt.Errorf("Unable to write to the audit log. Error: %v\n", err))
+	}
+
+	l.hashes[entry.Tenant] = append(hashes, entry.Hash)
+	metrics.setGauge(series("hcs_audit_log_index", "tenant", entry.Tenant), "The index of the last entry in the tenant's audit log", float64(entry.Index))
+	return entry.Index
+}
+
+//This function starts the background loop that anchors the head of each tenant's chain into its topic
+func startAuditAnchoring() {
+	if audit == nil {
+		return
+	}
+
+	interval := parseDurationEnv("AUDIT_ANCHOR_INTERVAL", time.Hour)
+	go func() {
+		for {
+			time.Sleep(interval)
+			audit.anchor()
+		}
+	}()
+}
+
+//This function submits the head of each tenant's chain that has moved on since it was last anchored
+func (l *auditLog) anchor() {
+	for _, t := range tenants {
+		index, hash, due := l.due(t)
+		if !due {
+			continue
+		}
+
+		topic := t.topics[0]
+		txnId := hedera.NewTransactionID(t.payerAccount)
+		message := fmt.Sprintf(`{"public":{"event":"%v","transactionId":"%v","auditLog":{"tenant":"%v","index":%v,"hash":"%v"}}}`, auditAnchorEvent, txnId, t.id, index, hash)
+
+		if err := submitMessage(t, topic, txnId, []byte(message)); err != nil {
+			go raiseAlert("audit_anchor", "warning", "Unable to anchor entry %v of the audit log for tenant %v into topic %v: %v", index, t.id, topic.topicId, err)
+			continue
+		}
+		recordTransactionFee(t, topic, txnId, []feeAttribution{{eventId: txnId.String(), event: auditAnchorEvent}})
+
+		l.mutex.Lock()
+		if index > l.anchored[t.id] {
+			l.anchored[t.id] = index
+		}
+		l.mutex.Unlock()
+		log.Printf("Anchored entry %v of the audit log for tenant %v into topic %v\n", index, t.id, topic.topicId)
+	}
+}
+
+//This function returns the head of the tenant's chain, and whether it needs anchoring. It only does once an event has
+// been stored since the last anchor, otherwise confirming each anchor would make the next one due, and an idle tenant
+// would be anchored every interval forever
+func (l *auditLog) due(t *tenant) (index uint64, hash string, due bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	index = uint64(len(l.hashes[t.id]))
+	if index > 0 {
+		hash = l.hashes[t.id][index-1]
+	}
+	return index, hash, l.recorded[t.id] > l.anchored[t.id]
+}
+
+//This function returns the hash of an entry, which covers the previous entry's hash, the entry's index, its kind and
+// its payload
+func auditLogEntryHash(entry auditLogEntry) []byte {
+	previousHash, _ := hex.DecodeString(entry.PreviousHash)
+
+	kind, payload := "record", []byte(entry.Record)
+	if entry.Anchor != nil {
+		kind = "anchor"
+		payload, _ = json.Marshal(entry.Anchor)
+	} else {
+		var compacted bytes.Buffer
+		if json.Compact(&compacted, entry.Record) == nil {
+			payload = compacted.Bytes()
+		}
+	}
+
+	hash := sha256.New()
+	hash.Write(previousHash)
+	_ = binary.Write(hash, binary.BigEndian, entry.Index)
+	hash.Write([]byte(kind))
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
+//This function checks that an entry follows on from the entries before it in its tenant's chain
+func checkAuditLogEntry(entry auditLogEntry, previousHashes []string) error {
+	if entry.Index != uint64(len(previousHashes))+1 {
+		return fmt.Errorf("entry %v for tenant %v should be entry %v", entry.Index, entry.Tenant, len(previousHashes)+1)
+	}
+
+	previousHash := ""
+	if len(previousHashes) > 0 {
+		previousHash = previousHashes[len(previousHashes)-1]
+	}
+	if entry.PreviousHash != previousHash {
+		return fmt.Errorf("entry %v for tenant %v doesn't follow on from the entry before it", entry.Index, entry.Tenant)
+	}
+
+	if expected := hex.EncodeToString(auditLogEntryHash(entry)); entry.Hash != expected {
+		return fmt.Errorf("entry %v for tenant %v has the hash %v, but its contents hash to %v", entry.Index, entry.Tenant, entry.Hash, expected)
+	}
+	return nil
+}
+
+func readAuditLog(filepath string) ([]auditLogEntry, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []auditLogEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var entry auditLogEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+//an auditLogSummary is what verify-audit-log found for one tenant's chain
+type auditLogSummary struct {
+	Tenant      string `json:"tenant"`
+	Entries     int    `json:"entries"`
+	Head        string `json:"head"`
+	Anchors     int    `json:"anchors"`     //anchors found on the ledger and checked
+	AnchoredTo  uint64 `json:"anchoredTo"`  //the last entry proven by an anchor on the ledger
+	Unanchored  int    `json:"unanchored"`  //entries after the last anchor, which can't be proven yet
+	ChainBroken bool   `json:"chainBroken"` //whether the chain itself is broken
+}
+
+type auditLogReport struct {
+	Source      string            `json:"source"`
+	GeneratedAt string            `json:"generatedAt"`
+	Result      string            `json:"result"` //pass or fail
+	Tenants     []auditLogSummary `json:"tenants"`
+	Failures    []string          `json:"failures"`
+}
+
+//This function runs the verify-audit-log command, which checks each tenant's chain in an audit log and proves it
+// against the anchors on the ledger. The anchors are read from the mirror node's REST API at MIRROR_REST_URL, or from
+// a mirror REST dump given with --topic-messages (as read by the verify command)
+func verifyAuditLogCommand(args []string) {
+	flags := flag.NewFlagSet("verify-audit-log", flag.ExitOnError)
+	in := flags.String("in", getEnv("AUDIT_LOG_FILE", ""), "the audit log to verify")
+	topicMessages := flags.String("topic-messages", "", "a mirror REST dump (a file or URL) to read the anchors from, rather than MIRROR_REST_URL")
+	apiKey := flags.String("api-key", "", "the API key to send when fetching --topic-messages from our own web-server")
+	_ = flags.Parse(args)
+
+	if *in == "" {
+		panic(fmt.Errorf("Please give the audit log to verify with --in\n"))
+	}
+
+	entries, err := readAuditLog(*in)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read audit log %v. Error: %v\n", *in, err))
+	}
+
+	report := auditLogReport{Source: *in, GeneratedAt: time.Now().UTC().Format(time.RFC3339), Result: "pass", Failures: []string{}}
+	fail := func(format string, args ...interface{}) {
+		report.Result = "fail"
+		report.Failures = append(report.Failures, fmt.Sprintf(format, args...))
+	}
+
+	//check the chains, keeping each tenant's hashes and the topics its events and anchors arrived on
+	hashes := make(map[string][]string)
+	broken := make(map[string]bool)
+	topics := make(map[string]string) //map[topicId]tenant
+	for i, entry := range entries {
+		if broken[entry.Tenant] {
+			continue
+		}
+		if err := checkAuditLogEntry(entry, hashes[entry.Tenant]); err != nil {
+			fail("line %v: %v", i+1, err)
+			broken[entry.Tenant] = true
+			continue
+		}
+		hashes[entry.Tenant] = append(hashes[entry.Tenant], entry.Hash)
+
+		topic := gjson.GetBytes(entry.Record, "hcs.topicId").String()
+		if entry.Anchor != nil {
+			topic = entry.Anchor.TopicId
+		}
+		if topic != "" {
+			topics[topic] = entry.Tenant
+		}
+	}
+
+	//find the anchors on the ledger
+	var messages []mirrorTopicMessage
+	if *topicMessages != "" {
+		messages, err = readTopicMessages(*topicMessages, *apiKey)
+		if err != nil {
+			panic(fmt.Errorf("Unable to read topic messages from %v. Error: %v\n", *topicMessages, err))
+		}
+	} else {
+		client := newMirrorRestClient()
+		if client.baseUrl == "" {
+			panic(fmt.Errorf("Please set MIRROR_REST_URL in demo.env, or give the topic messages with --topic-messages\n"))
+		}
+		for topic := range topics {
+			err = client.eachTopicMessage(context.Background(), topic, nil, func(message mirrorTopicMessage) bool {
+				messages = append(messages, message)
+				return true
+			})
+			if err != nil {
+				panic(fmt.Errorf("Unable to read the messages on topic %v from %v. Error: %v\n", topic, client.baseUrl, err))
+			}
+		}
+	}
+
+	summaries := make(map[string]*auditLogSummary)
+	for tenantId, tenantHashes := range hashes {
+		summaries[tenantId] = &auditLogSummary{Tenant: tenantId, Entries: len(tenantHashes), Head: tenantHashes[len(tenantHashes)-1], ChainBroken: broken[tenantId]}
+	}
+	for tenantId := range broken {
+		if summaries[tenantId] == nil {
+			summaries[tenantId] = &auditLogSummary{Tenant: tenantId, ChainBroken: true}
+		}
+	}
+
+	for _, message := range messages {
+		anchor := gjson.ParseBytes(message.Message)
+		if anchor.Get("public.event").String() != auditAnchorEvent {
+			continue
+		}
+
+		//an anchor only counts on the topic that its tenant's events arrived on
+		tenantId := anchor.Get("public.auditLog.tenant").String()
+		if owner, exists := topics[message.TopicId]; !exists || owner != tenantId {
+			continue
+		}
+		summary := summaries[tenantId]
+		index := anchor.Get("public.auditLog.index").Uint()
+		hash := anchor.Get("public.auditLog.hash").String()
+		summary.Anchors++
+
+		tenantHashes := hashes[tenantId]
+		switch {
+		case index == 0:
+			fail("the anchor in message %v on topic %v has no index", message.SequenceNumber, message.TopicId)
+		case index > uint64(len(tenantHashes)):
+			if !broken[tenantId] {
+				fail("entry %v for tenant %v was anchored in message %v on topic %v, but the log ends at entry %v", index, tenantId, message.SequenceNumber, message.TopicId, len(tenantHashes))
+			}
+		case tenantHashes[index-1] != hash:
+			fail("entry %v for tenant %v hashes to %v, but %v was anchored in message %v on topic %v", index, tenantId, tenantHashes[index-1], hash, message.SequenceNumber, message.TopicId)
+		case index > summary.AnchoredTo:
+			summary.AnchoredTo = index
+		}
+	}
+
+	for _, summary := range summaries {
+		summary.Unanchored = summary.Entries - int(summary.AnchoredTo)
+		report.Tenants = append(report.Tenants, *summary)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].Tenant < report.Tenants[j].Tenant
+	})
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(reportJson))
+
+	for _, summary := range report.Tenants {
+		fmt.Fprintf(os.Stderr, "Tenant %v: %v entries, proven up to entry %v by %v anchor(s), %v not yet anchored\n", summary.Tenant, summary.Entries, summary.AnchoredTo, summary.Anchors, summary.Unanchored)
+	}
+	fmt.Fprintf(os.Stderr, "The audit log %v: %v with %v failure(s)\n", *in, strings.ToUpper(report.Result), len(report.Failures))
+	if report.Result != "pass" {
+		os.Exit(1)
+	}
+}
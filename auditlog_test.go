@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//This function opens a fresh audit log in a temporary directory, returning it and its path
+func testAuditLog(t *testing.T) (*auditLog, string) {
+	saved := audit
+	t.Cleanup(func() {
+		audit.file.Close()
+		audit = saved
+	})
+
+	auditFilePath := filepath.Join(t.TempDir(), "audit-log.ndjson")
+	t.Setenv("AUDIT_LOG_FILE", auditFilePath)
+	loadAuditLog()
+	return audit, auditFilePath
+}
+
+//This function returns the message that reaches consensus when the head of the tenant's chain is anchored
+func testAnchorResponse(te *tenant, index uint64, hash string, sequenceNumber uint64) hedera.MirrorConsensusTopicResponse {
+	message := fmt.Sprintf(`{"public":{"event":"%v","transactionId":"%v","auditLog":{"tenant":"%v","index":%v,"hash":"%v"}}}`, auditAnchorEvent, testTransactionId(1000+int(sequenceNumber)), te.id, index, hash)
+	return hedera.MirrorConsensusTopicResponse{Message: []byte(message), SequenceNumber: sequenceNumber, ConsensusTimeStamp: time.Unix(1590000000, int64(sequenceNumber))}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	te := testTenant("0.0.1234")
+	l, auditFilePath := testAuditLog(t)
+
+	for i := 1; i <= 3; i++ {
+		l.record(te, testTransactionId(i), string(testEvent(testTransactionId(i), "start")))
+	}
+	l.record(te, testTransactionId(2), string(testEvent(testTransactionId(2), "start"))) //logged once only
+	index, hash, _ := l.due(te)
+	l.confirmAnchor(te, te.topics[0].topicId, testAnchorResponse(te, index, hash, 4))
+
+	entries, err := readAuditLog(auditFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[3].Anchor == nil || entries[3].Anchor.Index != 3 {
+		t.Fatalf("expected three events and an anchor of entry 3, got %v entries", len(entries))
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(entries []auditLogEntry) []auditLogEntry
+		failsAt int //the line the chain breaks at, or 0 if it is intact
+	}{
+		{
+			name:   "untouched",
+			tamper: func(entries []auditLogEntry) []auditLogEntry { return entries },
+		},
+		{
+			name: "an event altered",
+			tamper: func(entries []auditLogEntry) []auditLogEntry {
+				entries[1].Record = json.RawMessage(testEvent(testTransactionId(2), "complete"))
+				return entries
+			},
+			failsAt: 2,
+		},
+		{
+			name: "an event removed",
+			tamper: func(entries []auditLogEntry) []auditLogEntry {
+				return append(entries[:1], entries[2:]...)
+			},
+			failsAt: 2,
+		},
+		{
+			name: "events reordered",
+			tamper: func(entries []auditLogEntry) []auditLogEntry {
+				entries[0], entries[1] = entries[1], entries[0]
+				return entries
+			},
+			failsAt: 1,
+		},
+		{
+			name: "an anchor altered",
+			tamper: func(entries []auditLogEntry) []auditLogEntry {
+				entries[3].Anchor.SequenceNumber++
+				return entries
+			},
+			failsAt: 4,
+		},
+		{
+			name: "an event altered and its hash recomputed",
+			tamper: func(entries []auditLogEntry) []auditLogEntry {
+				entries[2].Record = json.RawMessage(testEvent(testTransactionId(3), "complete"))
+				entries[2].Hash = fmt.Sprintf("%x", auditLogEntryHash(entries[2]))
+				return entries
+			},
+			failsAt: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			copied := make([]auditLogEntry, len(entries))
+			for i, entry := range entries {
+				copied[i] = entry
+				if entry.Anchor != nil {
+					anchor := *entry.Anchor
+					copied[i].Anchor = &anchor
+				}
+			}
+
+			failsAt := 0
+			var hashes []string
+			for i, entry := range test.tamper(copied) {
+				if err := checkAuditLogEntry(entry, hashes); err != nil {
+					failsAt = i + 1
+					break
+				}
+				hashes = append(hashes, entry.Hash)
+			}
+			if failsAt != test.failsAt {
+				t.Errorf("the chain broke at line %v, expected %v", failsAt, test.failsAt)
+			}
+		})
+	}
+}
+
+func TestAuditLogAnchorDue(t *testing.T) {
+	te := testTenant("0.0.1234")
+	l, _ := testAuditLog(t)
+
+	if _, _, due := l.due(te); due {
+		t.Errorf("an empty log shouldn't be due for anchoring")
+	}
+
+	l.record(te, testTransactionId(1), string(testEvent(testTransactionId(1), "start")))
+	index, hash, due := l.due(te)
+	if !due || index != 1 {
+		t.Fatalf("expected entry 1 to be due for anchoring, got entry %v due %v", index, due)
+	}
+
+	//anchor it, as anchor() does, and confirm the anchor once it reaches consensus
+	l.anchored[te.id] = index
+	l.confirmAnchor(te, te.topics[0].topicId, testAnchorResponse(te, index, hash, 2))
+	if index, _, due := l.due(te); due || index != 2 {
+		t.Errorf("an idle tenant shouldn't be due for anchoring again after its anchor is confirmed, got entry %v due %v", index, due)
+	}
+
+	l.record(te, testTransactionId(2), string(testEvent(testTransactionId(2), "start")))
+	if index, _, due := l.due(te); !due || index != 3 {
+		t.Errorf("expected entry 3 to be due for anchoring, got entry %v due %v", index, due)
+	}
+
+	//after a restart, the log is loaded with the anchor confirmed but not the event after it
+	l.anchored[te.id] = 3
+	l.confirmAnchor(te, te.topics[0].topicId, testAnchorResponse(te, 3, l.hashes[te.id][2], 3))
+	l.file.Close()
+	loadAuditLog()
+	if index, _, due := audit.due(te); due || index != 4 {
+		t.Errorf("after loading the log, expected entry 4 not to be due for anchoring, got entry %v due %v", index, due)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//A backfill rebuilds part of the event store, for example after a change to the decryption or the message format. It
+// is run by the web-server itself, as the event store lives in its memory, for the requesting tenant's topics. POST
+// /backfill with from and to (and optionally topic) replays that range from the mirror node, or POST a mirror REST
+// export (a page, an array or one message per line) as the body with source=upload to use that instead.
+//
+//Every message goes through the same steps as live traffic: a running hash check (on a chain of its own, starting
+// with the first message of the backfill), decryption, and the event store in both sequence and consensus order.
+// Messages that are already in the store are replaced rather than added again, so a backfill can be repeated safely.
+//
+//Anyone can compute a running hash, so an upload is only as good as the running hashes it is checked against. Each
+// topic's part of the upload must end at a message whose running hash matches the head of the saved chain (see
+// runninghash.go) or the mirror node's, which vouches for every message before it, and its chain is started from the
+// running hash of the message before its first, from the saved chain or the mirror node. If there is no such message
+// to start from, the first message only starts the chain and is skipped, and if the last message can't be checked the
+// topic's messages are all rejected.
+//
+//Progress is streamed back as a line of JSON every second or so, and the backfill command wraps all of this up with a
+// progress display:
+//
+//	go run . backfill --from 2020-01-01 --to 2020-02-01 --api-key ...
+//	go run . backfill --in https://testnet.mirrornode.hedera.com/api/v1/topics/0.0.1234/messages --api-key ...
+const backfillProgressInterval = time.Second
+
+type backfillProgress struct {
+	TopicId            string `json:"topicId,omitempty"`
+	Processed          int    `json:"processed"`
+	Total              int    `json:"total,omitempty"` //only known for an upload
+	Rejected           int    `json:"rejected"`
+	Skipped            int    `json:"skipped"`
+	SequenceNumber     uint64 `json:"sequenceNumber,omitempty"`
+	ConsensusTimestamp string `json:"consensusTimestamp,omitempty"`
+	Done               bool   `json:"done,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+//only one backfill runs at a time
+var backfillRunning int32
+
+func backfillHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(rw, "a backfill must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	from, err := parseConsensusTime(params.Get("from"))
+	var to int64
+	if err == nil {
+		to, err = parseConsensusTime(params.Get("to"))
+	}
+	var topic string
+	if err == nil {
+		topic, err = resolveExportTopic([]*tenant{t}, params.Get("topic"))
+	}
+
+	upload := params.Get("source") == "upload"
+	var uploaded []mirrorTopicMessage
+	if err == nil && upload {
+		var body []byte
+		body, err = ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 256<<20))
+		if err == nil {
+			uploaded, err = decodeTopicMessages(body)
+		}
+	} else if err == nil && from == 0 && to == 0 {
+		err = fmt.Errorf("a backfill from the mirror node needs a from or to time")
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&backfillRunning, 0, 1) {
+		http.Error(rw, "a backfill is already running", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&backfillRunning, 0)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := rw.(http.Flusher)
+	encoder := json.NewEncoder(rw)
+
+	progress := backfillProgress{Total: len(uploaded)}
+	lastReport := time.Now()
+	report := func(force bool) {
+		if !force && time.Since(lastReport) < backfillProgressInterval {
+			return
+		}
+		lastReport = time.Now()
+		_ = encoder.Encode(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	chain := newRunningHashChain()
+	source := "mirror node " + mirrorAddress
+	if upload {
+		source = "the uploaded export"
+	}
+	process := func(topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) {
+		progress.TopicId = topic.String()
+		progress.SequenceNumber = response.SequenceNumber
+		progress.ConsensusTimestamp = response.ConsensusTimeStamp.UTC().Format(time.RFC3339Nano)
+
+		if backfillResponse(chain, source, t, topic, response) {
+			progress.Processed++
+		} else {
+			progress.Rejected++
+		}
+		report(false)
+	}
+
+	if upload {
+		var uploadedTopics []*uploadedTopic
+		byTopic := make(map[string]*uploadedTopic)
+		for _, message := range uploaded {
+			messageTopic, response, err := message.response()
+			inRange := err == nil && response.ConsensusTimeStamp.UnixNano() >= from && (to == 0 || response.ConsensusTimeStamp.UnixNano() < to)
+			_, topicErr := resolveExportTopic([]*tenant{t}, message.TopicId)
+			if !inRange || topicErr != nil || (topic != "" && message.TopicId != topic) {
+				progress.Skipped++
+				continue
+			}
+
+			if byTopic[message.TopicId] == nil {
+				byTopic[message.TopicId] = &uploadedTopic{topic: messageTopic}
+				uploadedTopics = append(uploadedTopics, byTopic[message.TopicId])
+			}
+			byTopic[message.TopicId].responses = append(byTopic[message.TopicId].responses, response)
+		}
+
+		for _, uploadedTopic := range uploadedTopics {
+			responses, err := uploadedTopic.anchor(r.Context(), chain)
+			if err != nil {
+				log.Printf("Rejected the %v uploaded messages on topic %v. Error: %v\n", len(uploadedTopic.responses), uploadedTopic.topic, err)
+				progress.TopicId = uploadedTopic.topic.String()
+				progress.Rejected += len(uploadedTopic.responses)
+				progress.Error = err.Error()
+				continue
+			}
+
+			progress.Skipped += len(uploadedTopic.responses) - len(responses)
+			for _, response := range responses {
+				process(uploadedTopic.topic, response)
+			}
+		}
+	} else {
+		var fromTime, toTime time.Time
+		if from != 0 {
+			fromTime = time.Unix(0, from)
+		}
+		if to != 0 {
+			toTime = time.Unix(0, to)
+		}
+
+		for _, tenantTopic := range t.topics {
+			if topic != "" && tenantTopic.topicId.String() != topic {
+				continue
+			}
+			topicId := tenantTopic.topicId
+			err = replayTopic(topicId, fromTime, toTime, func(response hedera.MirrorConsensusTopicResponse) {
+				process(topicId, response)
+			})
+			if err != nil {
+				progress.Error = err.Error()
+				break
+			}
+		}
+	}
+
+	progress.Done = true
+	report(true)
+}
+
+//an uploadedTopic is one topic's messages in an upload
+type uploadedTopic struct {
+	topic     hedera.ConsensusTopicID
+	responses []hedera.MirrorConsensusTopicResponse
+}
+
+//This function ties the topic's uploaded messages to running hashes we can trust, checking the last of them against
+// the saved chain or the mirror node and starting the backfill's chain from the message before the first. It returns
+// the messages to backfill, in sequence number order, or an error if the upload can't be trusted
+func (u *uploadedTopic) anchor(ctx context.Context, chain *runningHashChain) ([]hedera.MirrorConsensusTopicResponse, error) {
+	responses := u.responses
+	sort.SliceStable(responses, func(i, j int) bool { return responses[i].SequenceNumber < responses[j].SequenceNumber })
+	first, last := responses[0], responses[len(responses)-1]
+
+	topicId := u.topic.String()
+	head, saved := runningHashes.head(topicId)
+	client := newMirrorRestClient()
+
+	//the last message vouches for everything before it, as long as its running hash is one we already trust
+	switch {
+	case saved && head.SequenceNumber == last.SequenceNumber:
+		if hex.EncodeToString(last.RunningHash) != head.RunningHash {
+			return nil, fmt.Errorf("message %v has running hash %x, but was verified with %v", last.SequenceNumber, last.RunningHash, head.RunningHash)
+		}
+	case client.baseUrl != "":
+		_, mirrorResponse, err := mirrorTopicResponse(ctx, client, topicId, last.SequenceNumber)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check message %v against %v: %v", last.SequenceNumber, client.baseUrl, err)
+		}
+		if !bytes.Equal(last.RunningHash, mirrorResponse.RunningHash) {
+			return nil, fmt.Errorf("message %v has running hash %x, but %v has %x", last.SequenceNumber, last.RunningHash, client.baseUrl, mirrorResponse.RunningHash)
+		}
+	default:
+		return nil, fmt.Errorf("message %v can't be checked, as it isn't the head of the saved running hash chain and MIRROR_REST_URL isn't set", last.SequenceNumber)
+	}
+
+	//the first message of a topic follows on from nothing, and any other from the running hash before it
+	switch {
+	case first.SequenceNumber == 1:
+	case saved && head.SequenceNumber == first.SequenceNumber-1:
+		chain.seed(head)
+	case client.baseUrl != "":
+		previousTopic, previous, err := mirrorTopicResponse(ctx, client, topicId, first.SequenceNumber-1)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch message %v from %v to start the running hash chain: %v", first.SequenceNumber-1, client.baseUrl, err)
+		}
+		chain.seed(newRunningHashLink(previousTopic, previous))
+	default:
+		//without the running hash before it, the first message can't be checked, so it only starts the chain
+		chain.seed(newRunningHashLink(u.topic, first))
+		responses = responses[1:]
+	}
+
+	return responses, nil
+}
+
+//This function fetches a topic message from the mirror node's REST API
+func mirrorTopicResponse(ctx context.Context, client *mirrorRestClient, topic string, sequenceNumber uint64) (hedera.ConsensusTopicID, hedera.MirrorConsensusTopicResponse, error) {
+	message, err := client.topicMessage(ctx, topic, sequenceNumber)
+	if err != nil {
+		return hedera.ConsensusTopicID{}, hedera.MirrorConsensusTopicResponse{}, err
+	}
+	return message.response()
+}
+
+//This function handles a backfilled message in the same way as a live one, checking it against the backfill's own
+// running hash chain
+func backfillResponse(chain *runningHashChain, source string, t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) bool {
+	if !chain.verify(source, topic, response) {
+		return false
+	}
+
+	for _, messageJson := range storeTopicResponse(t, topic, response) {
+		eventStore.putOrdered(messageJson)
+	}
+	return true
+}
+
+//This function runs the backfill command, which asks the running web-server to backfill and shows its progress
+func backfillCommand(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:"+portToUse, "the web-server to backfill")
+	apiKey := flags.String("api-key", "", "the API key of the tenant to backfill")
+	fromString := flags.String("from", "", "backfill from this RFC3339 time, date or unix nanosecond timestamp")
+	toString := flags.String("to", "", "backfill up to (but not including) this RFC3339 time, date or unix nanosecond timestamp")
+	topic := flags.String("topic", "", "only backfill this topic ID or routed topic name")
+	in := flags.String("in", "", "backfill from this mirror REST export (a file or a URL to fetch page by page) rather than the mirror node")
+	_ = flags.Parse(args)
+
+	params := url.Values{}
+	params.Set("from", *fromString)
+	params.Set("to", *toString)
+	params.Set("topic", *topic)
+
+	var body io.Reader
+	if *in != "" {
+		messages, err := readTopicMessages(*in, "")
+		if err != nil {
+			panic(fmt.Errorf("Unable to read the export %v. Error: %v\n", *in, err))
+		}
+		export, err := json.Marshal(messages)
+		if err != nil {
+			panic(err)
+		}
+		body = bytes.NewReader(export)
+		params.Set("source", "upload")
+	}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimRight(*server, "/")+"/backfill?"+params.Encode(), body)
+	if err != nil {
+		panic(fmt.Errorf("Unable to build the backfill request. Error: %v\n", err))
+	}
+	if *apiKey != "" {
+		request.Header.Set("X-Api-Key", *apiKey)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		panic(fmt.Errorf("Unable to reach %v. Error: %v\n", *server, err))
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		panic(fmt.Errorf("The backfill was refused (%v): %v\n", response.Status, strings.TrimSpace(string(message))))
+	}
+
+	var progress backfillProgress
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &progress); err != nil {
+			continue
+		}
+
+		counted := fmt.Sprintf("%v", progress.Processed)
+		if progress.Total > 0 {
+			counted = fmt.Sprintf("%v/%v", progress.Processed+progress.Rejected+progress.Skipped, progress.Total)
+		}
+		fmt.Fprintf(os.Stderr, "\rBackfilling %v: %v messages, up to #%v at %v (%v rejected, %v skipped)   ", progress.TopicId, counted, progress.SequenceNumber, progress.ConsensusTimestamp, progress.Rejected, progress.Skipped)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+
+	switch {
+	case !progress.Done:
+		panic(fmt.Errorf("The connection to %v closed before the backfill finished. It is safe to run it again\n", *server))
+	case progress.Error != "":
+		panic(fmt.Errorf("The backfill stopped after %v messages. Error: %v\n", progress.Processed, progress.Error))
+	}
+
+	fmt.Printf("Backfilled %v messages (%v rejected by the running hash check, %v skipped)\n", progress.Processed, progress.Rejected, progress.Skipped)
+	if progress.Rejected > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadedTopicAnchor(t *testing.T) {
+	consensus, responses := testConsensus(t, "0.0.1", 5)
+	mirror := httptest.NewServer(http.HandlerFunc(consensus.restHandler))
+	defer mirror.Close()
+
+	altered := responses[4]
+	altered.RunningHash = append([]byte(nil), altered.RunningHash...)
+	altered.RunningHash[0] ^= 1
+
+	tests := []struct {
+		name      string
+		mirror    bool
+		savedHead int //the sequence number of the saved chain's head, if any
+		uploaded  []int
+		expected  []uint64 //the sequence numbers to backfill, or nil if the upload is rejected
+	}{
+		{name: "from the first message, ending at the saved head", savedHead: 5, uploaded: []int{1, 2, 3, 4, 5}, expected: []uint64{1, 2, 3, 4, 5}},
+		{name: "without the message before the first", savedHead: 5, uploaded: []int{3, 4, 5}, expected: []uint64{4, 5}},
+		{name: "started from the mirror node", mirror: true, uploaded: []int{3, 4}, expected: []uint64{3, 4}},
+		{name: "started from the saved head", mirror: true, savedHead: 2, uploaded: []int{3, 4}, expected: []uint64{3, 4}},
+		{name: "an altered last message against the saved head", savedHead: 5, uploaded: []int{4, -5}},
+		{name: "an altered last message against the mirror node", mirror: true, uploaded: []int{4, -5}},
+		{name: "a last message that can't be checked", savedHead: 5, uploaded: []int{1, 2, 3}},
+		{name: "ending before the saved head, checked against the mirror node", mirror: true, savedHead: 5, uploaded: []int{1, 2, 3}, expected: []uint64{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestPipeline(t, testTopics("0.0.1"))
+			if test.mirror {
+				t.Setenv("MIRROR_REST_URL", mirror.URL)
+			} else {
+				t.Setenv("MIRROR_REST_URL", "")
+			}
+			if test.savedHead > 0 {
+				runningHashes.seed(newRunningHashLink(testTopics("0.0.1")[0].topicId, responses[test.savedHead-1]))
+			}
+
+			upload := &uploadedTopic{topic: testTopics("0.0.1")[0].topicId}
+			for _, sequenceNumber := range test.uploaded {
+				if sequenceNumber < 0 {
+					upload.responses = append(upload.responses, altered)
+				} else {
+					upload.responses = append(upload.responses, responses[sequenceNumber-1])
+				}
+			}
+
+			chain := newRunningHashChain()
+			anchored, err := upload.anchor(context.Background(), chain)
+			if test.expected == nil {
+				if err == nil {
+					t.Fatalf("expected the upload to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var backfilled []uint64
+			for _, response := range anchored {
+				if !chain.verify("the upload", upload.topic, response) {
+					t.Fatalf("message %v failed the running hash check", response.SequenceNumber)
+				}
+				backfilled = append(backfilled, response.SequenceNumber)
+			}
+			if len(backfilled) != len(test.expected) {
+				t.Fatalf("backfilled %v, expected %v", backfilled, test.expected)
+			}
+			for i := range backfilled {
+				if backfilled[i] != test.expected[i] {
+					t.Fatalf("backfilled %v, expected %v", backfilled, test.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Whilst a fee budget is exceeded and FEE_BUDGET_ACTION is batch, events are collected per topic and submitted together
+// as a single message, so that one transaction fee covers many events. A batch message looks like
+//
+//	{"public":{"transactionId":"0.0.1234@1590000000.000000000","keyId":"..."},"batch":[{"public":{...}},{"public":{...}}],"private":"..."}
+//
+//Each event keeps its public section in the batch, but their private sections are gathered into a JSON array which is
+// gzipped and encrypted as one, with the tenant's active key (recorded in the batch's public.keyId). Encrypted one by
+// one, each private section would carry its own nonce and tag, and its ciphertext wouldn't compress, so a message
+// would barely hold one event.
+//
+//The batch's transaction ID is generated when the batch is opened, so that each event can be given its ID straight
+// away ("<batch transaction ID>-<index>"). A batch is submitted once it has been open for BATCH_INTERVAL, or as soon as
+// adding another event would take it over BATCH_MAX_BYTES. The subscriber splits batch messages back into their events.
+//
+//A batch that can't be submitted is tried again, with the same transaction ID so that the IDs its events were given
+// stay valid, and if it still can't be submitted its events are anchored locally under those IDs instead (see
+// budget.go), so that an event that has been acknowledged is never lost.
+//
+//Messages are submitted unchunked, so a batch can be no larger than the HCS message size limit
+const maxMessageBytes = 1024
+
+//how many times a batch is submitted before its events are anchored locally, waiting batchRetryWait longer each time
+const batchSubmitAttempts = 3
+const batchRetryWait = 2 * time.Second
+
+//the most a batch's private sections can decompress to, so that a message can't be made to decompress without limit
+const maxBatchPrivateBytes = 1024 * 1024
+
+type eventBatch struct {
+	t            *tenant
+	topic        routedTopic
+	txnId        hedera.TransactionID
+	openedAt     time.Time
+	events       []string //each event's public section
+	privates     []string //each event's private section, unencrypted until the batch message is built
+	attributions []feeAttribution
+}
+
+type eventBatcher struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	maxBytes int
+	batches  map[string]*eventBatch //by topic ID
+	submit   func(batch *eventBatch)
+
+	//send submits a batch message and records its fee, and is retried batchSubmitAttempts times, retryWait apart
+	send      func(batch *eventBatch, message string) error
+	retryWait time.Duration
+}
+
+var batcher *eventBatcher
+
+//This function creates the batcher and starts the background loop that submits each batch once its interval is up
+func startEventBatcher() {
+	b := &eventBatcher{
+		interval: parseDurationEnv("BATCH_INTERVAL", 10*time.Second),
+		maxBytes: int(parseFloatEnv("BATCH_MAX_BYTES", maxMessageBytes)),
+		batches:  make(map[string]*eventBatch),
+
+		send:      (*eventBatch).send,
+		retryWait: batchRetryWait,
+	}
+	b.submit = b.submitBatch
+
+	if b.maxBytes > maxMessageBytes {
+		panic(fmt.Errorf("BATCH_MAX_BYTES in demo.env should be no more than %v, the largest message HCS accepts\n", maxMessageBytes))
+	}
+
+	//the batch's transaction ID is generated when it is opened, so it must be submitted before the ID expires
+	if b.interval > maxTransactionValidDuration/2 {
+		panic(fmt.Errorf("BATCH_INTERVAL in demo.env should be no more than %v\n", maxTransactionValidDuration/2))
+	}
+
+	batcher = b
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+
+			b.mutex.Lock()
+			var due []*eventBatch
+			for key, batch := range b.batches {
+				if time.Since(batch.openedAt) >= b.interval {
+					due = append(due, batch)
+					delete(b.batches, key)
+				}
+			}
+			b.mutex.Unlock()
+
+			for _, batch := range due {
+				b.submit(batch)
+			}
+		}
+	}()
+}
+
+//This function adds an event (with its private section still to be encrypted, as the batch's private sections are
+// encrypted together) to the topic's open batch, returning the event with its ID
+func (b *eventBatcher) add(t *tenant, topic routedTopic, jsonString string, private string, attribution feeAttribution) (string, error) {
+	b.mutex.Lock()
+
+	key := topic.topicId.String()
+	batch := b.batches[key]
+
+	//give the event its ID in the open batch, and submit the batch first if the event won't fit into it
+	eventJson, err := batch.withEvent(jsonString)
+	if err == nil && batch != nil && len(batch.messageWith(eventJson, private)) > b.maxBytes {
+		delete(b.batches, key)
+		go b.submit(batch)
+		batch = nil
+	}
+
+	if batch == nil {
+		batch = newEventBatch(t, topic)
+		eventJson, err = batch.withEvent(jsonString)
+		if err == nil && len(batch.messageWith(eventJson, private)) > b.maxBytes {
+			err = fmt.Errorf("the event is too large to batch into a message of at most %v bytes", b.maxBytes)
+		}
+		if err == nil {
+			b.batches[key] = batch
+		}
+	}
+
+	if err != nil {
+		b.mutex.Unlock()
+		return "", err
+	}
+
+	attribution.eventId = gjson.Get(eventJson, "public.transactionId").String()
+	batch.events = append(batch.events, eventJson)
+	batch.privates = append(batch.privates, private)
+	batch.attributions = append(batch.attributions, attribution)
+	b.mutex.Unlock()
+
+	eventStore.markPending(attribution.eventId, t.id)
+
+	metrics.addCounter(series("hcs_batched_events_total", "tenant", t.id), "Events submitted in batches whilst a fee budget was exceeded", 1)
+	return eventJson, nil
+}
+
+//This function opens a new batch for a topic
+func newEventBatch(t *tenant, topic routedTopic) *eventBatch {
+	return &eventBatch{t: t, topic: topic, txnId: hedera.NewTransactionID(t.payerAccount), openedAt: time.Now()}
+}
+
+//This function returns the event as it would be in the batch: with the ID it would have as the next event, and
+// without its private section, which goes into the batch's
+func (batch *eventBatch) withEvent(jsonString string) (string, error) {
+	if batch == nil {
+		return "", nil
+	}
+	jsonString, err := sjson.Delete(jsonString, "private")
+	if err != nil {
+		return "", err
+	}
+	return sjson.Set(jsonString, "public.transactionId", fmt.Sprintf("%v-%v", batch.txnId, len(batch.events)))
+}
+
+//This function returns the batch message carrying the batch's events
+func (batch *eventBatch) message() string {
+	return batchMessage(batch.t, batch.txnId, batch.events, batch.privates)
+}
+
+//This function returns the batch message as it would be with another event added, to see whether the event fits
+func (batch *eventBatch) messageWith(eventJson string, private string) string {
+	events := append(append([]string(nil), batch.events...), eventJson)
+	privates := append(append([]string(nil), batch.privates...), private)
+	return batchMessage(batch.t, batch.txnId, events, privates)
+}
+
+//This function builds a batch message, compressing and encrypting the events' private sections together
+func batchMessage(t *tenant, txnId hedera.TransactionID, events []string, privates []string) string {
+	var compressed bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = writer.Write([]byte("[" + strings.Join(privates, ",") + "]"))
+	if err = writer.Close(); err != nil {
+		panic(err)
+	}
+
+	keyId, encryptedText := t.keyring.encrypt(compressed.String())
+	public := fmt.Sprintf(`{"transactionId":"%v"}`, txnId)
+	if keyId != "" {
+		public, err = sjson.Set(public, "keyId", keyId)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return fmt.Sprintf(`{"public":%v,"batch":[%v],"private":"%v"}`, public, strings.Join(events, ","), hex.EncodeToString(encryptedText))
+}
+
+//This function decrypts and decompresses the private sections of a batch message's events, in the order of its
+// events
+func batchPrivateSections(keys keyring, message gjson.Result) ([]gjson.Result, error) {
+	if !message.Get("private").Exists() {
+		return nil, fmt.Errorf("the batch has no private section")
+	}
+
+	encrypted, err := hex.DecodeString(message.Get("private").String())
+	if err != nil {
+		return nil, fmt.Errorf("the batch's private section is not hex encoded: %v", err)
+	}
+
+	keyId := message.Get("public.keyId").String()
+	compressed, err := keys.decrypt(keyId, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the batch's private section with key %q: %v", keyId, strings.TrimSpace(err.Error()))
+	}
+
+	reader, err := gzip.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("the batch's private section is not gzipped: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxBatchPrivateBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress the batch's private section: %v", err)
+	}
+	if len(decompressed) > maxBatchPrivateBytes {
+		return nil, fmt.Errorf("the batch's private section decompresses to more than %v bytes", maxBatchPrivateBytes)
+	}
+
+	privates := gjson.ParseBytes(decompressed)
+	if !gjson.ValidBytes(decompressed) || !privates.IsArray() {
+		return nil, fmt.Errorf("the batch's private section does not decrypt to a JSON array")
+	}
+	if events := message.Get("batch").Array(); len(privates.Array()) != len(events) {
+		return nil, fmt.Errorf("the batch has %v private sections for %v events", len(privates.Array()), len(events))
+	}
+	return privates.Array(), nil
+}
+
+//This function submits a batch as a single message, retrying it and then anchoring its events locally if it can't be
+func (b *eventBatcher) submitBatch(batch *eventBatch) {
+	message := batch.message()
+
+	var err error
+	for attempt := 1; attempt <= batchSubmitAttempts; attempt++ {
+		if err = b.send(batch, message); err == nil {
+			return
+		}
+
+		log.Printf("Unable to submit a batch of %v events to topic %v (attempt %v of %v). Error: %v\n", len(batch.events), batch.topic.topicId, attempt, batchSubmitAttempts, err)
+		metrics.addCounter(series("hcs_batch_errors_total", "tenant", batch.t.id), "Batch submissions that failed", 1)
+		if attempt < batchSubmitAttempts {
+			time.Sleep(time.Duration(attempt) * b.retryWait)
+		}
+	}
+
+	go raiseAlert("batch_submit_failed", "critical", "Unable to submit a batch of %v events for tenant %v to topic %v, so they have been anchored locally. Error: %v", len(batch.events), batch.t.id, batch.topic.topicId, err)
+	for index := range batch.events {
+		batch.anchorLocally(index)
+	}
+}
+
+//This function submits the batch message, and records its fee once it reaches consensus
+func (batch *eventBatch) send(message string) error {
+	err := submitMessage(batch.t, batch.topic, batch.txnId, []byte(message))
+	if err != nil {
+		return err
+	}
+
+	recordTransactionFee(batch.t, batch.topic, batch.txnId, batch.attributions)
+	return nil
+}
+
+//This function anchors one of the batch's events locally under the ID it was given, with its private section
+// encrypted on its own as the event would have been outside of a batch
+func (batch *eventBatch) anchorLocally(index int) {
+	eventJson := batch.events[index]
+	keyId, encryptedText := batch.t.keyring.encrypt(batch.privates[index])
+
+	var err error
+	if keyId != "" {
+		eventJson, err = sjson.Set(eventJson, "public.keyId", keyId)
+	}
+	if err == nil {
+		eventJson, err = sjson.Set(eventJson, "private", hex.EncodeToString(encryptedText))
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	eventId := gjson.Get(eventJson, "public.transactionId").String()
+	anchorLocallyAs(batch.t, eventId, eventJson, batch.privates[index])
+	log.Printf("Anchored event %v locally as its batch couldn't be submitted\n", eventId)
+}
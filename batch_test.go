@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventBatcherFitsSeveralEventsPerMessage(t *testing.T) {
+	te := testTenant("0.0.1234")
+	useTestPipeline(t, te.topics)
+
+	submitted := make(chan *eventBatch, 100)
+	b := &eventBatcher{
+		interval: time.Hour,
+		maxBytes: maxMessageBytes,
+		batches:  make(map[string]*eventBatch),
+		submit:   func(batch *eventBatch) { submitted <- batch },
+	}
+
+	//events as the web-server builds them, with the private section still to be encrypted
+	const count = 20
+	for i := 0; i < count; i++ {
+		private := fmt.Sprintf(`{"secretMessage":"","videoCurrentTime":"%v","videoDuration":"596","videoUrl":"https://example.com/videos/big-buck-bunny.mp4","userAgent":"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_4) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.61 Safari/537.36","campaign":"spring"}`, i*30)
+		event := fmt.Sprintf(`{"public":{"event":"progress","timestamp":"%v","tzOffset":"-60"},"private":""}`, 1590000000000+i)
+		if _, err := b.add(te, te.topics[0], event, private, feeAttribution{event: "progress"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, batch := range b.batches {
+		b.submit(batch)
+	}
+
+	var decoded []string
+	messages := 0
+	for len(decoded) < count {
+		messages++
+		var batch *eventBatch
+		select {
+		case batch = <-submitted:
+		case <-time.After(time.Second):
+			t.Fatalf("only %v of the %v events were submitted", len(decoded), count)
+		}
+		if messages >= count {
+			t.Fatalf("%v events took %v messages", len(decoded)+len(batch.events), messages)
+		}
+
+		message := batch.message()
+		if len(message) > maxMessageBytes {
+			t.Errorf("a batch message of %v events is %v bytes, more than the %v HCS accepts", len(batch.events), len(message), maxMessageBytes)
+		}
+
+		response := hedera.MirrorConsensusTopicResponse{Message: []byte(message), SequenceNumber: uint64(messages), ConsensusTimeStamp: time.Now()}
+		events := decodeTopicResponse(te, te.topics[0].topicId, response)
+		if len(events) != len(batch.events) {
+			t.Fatalf("decoded %v events from a batch of %v", len(events), len(batch.events))
+		}
+		decoded = append(decoded, events...)
+	}
+	t.Logf("%v events were batched into %v messages", count, messages)
+
+	//the batches are submitted concurrently, so each event is matched up by its timestamp
+	for _, event := range decoded {
+		i := gjson.Get(event, "public.timestamp").Int() - 1590000000000
+		if currentTime := gjson.Get(event, "private.videoCurrentTime").String(); currentTime != fmt.Sprint(i*30) {
+			t.Errorf("event %v decoded with videoCurrentTime %q, expected %v", i, currentTime, i*30)
+		}
+		if !gjson.Get(event, "hcs.batchTransactionId").Exists() {
+			t.Errorf("event %v decoded without its batch's transaction ID", i)
+		}
+	}
+}
+
+func TestEventBatcherAnchorsLocallyWhenSubmitFails(t *testing.T) {
+	te := testTenant("0.0.1234")
+	useTestPipeline(t, te.topics)
+	t.Setenv("LOCAL_ANCHOR_FILE", filepath.Join(t.TempDir(), "local-anchors.ndjson"))
+
+	tests := []struct {
+		name     string
+		failures int //how many times the batch fails to submit before it succeeds
+		anchored bool
+	}{
+		{name: "submitted first time", failures: 0},
+		{name: "submitted when retried", failures: batchSubmitAttempts - 1},
+		{name: "anchored locally", failures: batchSubmitAttempts, anchored: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			b := &eventBatcher{
+				interval: time.Hour,
+				maxBytes: maxMessageBytes,
+				batches:  make(map[string]*eventBatch),
+				send: func(batch *eventBatch, message string) error {
+					attempts++
+					if attempts <= test.failures {
+						return fmt.Errorf("submit failed")
+					}
+					return nil
+				},
+			}
+			b.submit = b.submitBatch
+
+			var eventIds []string
+			for i := 0; i < 2; i++ {
+				event := fmt.Sprintf(`{"public":{"event":"start","timestamp":"%v","tzOffset":"0"},"private":""}`, 1590000000000+i)
+				eventJson, err := b.add(te, te.topics[0], event, fmt.Sprintf(`{"videoCurrentTime":"%v"}`, i), feeAttribution{event: "start"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				eventIds = append(eventIds, gjson.Get(eventJson, "public.transactionId").String())
+			}
+			for _, batch := range b.batches {
+				b.submit(batch)
+			}
+
+			expected := test.failures + 1
+			if test.anchored {
+				expected = batchSubmitAttempts
+			}
+			if attempts != expected {
+				t.Errorf("the batch was submitted %v times, expected %v", attempts, expected)
+			}
+
+			for i, eventId := range eventIds {
+				messageJson, pending, tenantId := eventStore.lookup(eventId)
+				switch {
+				case tenantId != te.id:
+					t.Errorf("event %v was lost, found for tenant %q", eventId, tenantId)
+				case test.anchored && (pending || gjson.Get(messageJson, "hcs.anchor").String() != "local"):
+					t.Errorf("expected event %v to be anchored locally under the ID it was given, pending %v", eventId, pending)
+				case test.anchored && gjson.Get(messageJson, "private.videoCurrentTime").String() != fmt.Sprint(i):
+					t.Errorf("event %v was anchored with private section %v", eventId, gjson.Get(messageJson, "private"))
+				case !test.anchored && !pending:
+					t.Errorf("expected event %v to be waiting for consensus", eventId)
+				}
+			}
+		})
+	}
+}
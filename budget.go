@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Every call to /track costs a transaction fee, so a spike in traffic (or someone abusing the endpoint) could drain the
+// operator account. The budget guard totals the actual fees from the fee ledger (see fees.go) over the current
+// minute and day, overall and per tenant, and once a budget is exceeded the circuit breaker opens until the window
+// resets. Budgets are configured in the demo.env file with:
+//
+//	FEE_BUDGET_PER_MINUTE_HBAR             the most to spend in any one minute
+//	FEE_BUDGET_PER_DAY_HBAR                the most to spend in any one day (UTC)
+//	FEE_BUDGET_PER_TENANT_PER_DAY_HBAR     the most each tenant can spend in a day, unless set for the tenant in the
+//	                                       TENANTS_FILE with dailyBudgetHbar
+//	FEE_BUDGET_ACTION                      what to do whilst a budget is exceeded: reject, batch or local
+//
+//A budget of 0 is unlimited. Whilst the breaker is open, events are either rejected with a 429, collected into batches
+// that are submitted as a single message (see batch.go), or anchored locally without being submitted at all.
+//
+//As fees are only known once a transaction reaches consensus, the spend lags a few seconds behind the traffic
+const (
+	budgetActionReject = "reject"
+	budgetActionBatch  = "batch"
+	budgetActionLocal  = "local"
+)
+
+//a budgetWindow is the spend against one of the budgets in its current window, and when the window resets
+type budgetWindow struct {
+	Budget       string    `json:"budget"`
+	Tenant       string    `json:"tenant,omitempty"`
+	LimitTinybar int64     `json:"limitTinybar"`
+	SpentTinybar int64     `json:"spentTinybar"`
+	LimitHbar    string    `json:"limitHbar"`
+	SpentHbar    string    `json:"spentHbar"`
+	Exceeded     bool      `json:"exceeded"`
+	ResetsAt     time.Time `json:"resetsAt"`
+}
+
+type budgetGuard struct {
+	mutex  sync.Mutex
+	action string
+
+	//limits in tinybar, where 0 is unlimited
+	minuteLimit     int64
+	dayLimit        int64
+	tenantDayLimits map[string]int64
+
+	//spend in tinybar, by unix minute, by day and by day and tenant
+	minuteSpend    map[int64]int64
+	daySpend       map[string]int64
+	tenantDaySpend map[string]int64
+
+	firing map[string]bool
+}
+
+var budget = &budgetGuard{
+	action:          budgetActionReject,
+	tenantDayLimits: make(map[string]int64),
+	minuteSpend:     make(map[int64]int64),
+	daySpend:        make(map[string]int64),
+	tenantDaySpend:  make(map[string]int64),
+	firing:          make(map[string]bool),
+}
+
+//This function loads the budgets. It must be called after loadTenants and before loadFeeLedger, which adds the fees
+// from previous runs to the spend
+func loadBudget() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.action = getEnv("FEE_BUDGET_ACTION", budgetActionReject)
+	if budget.action != budgetActionReject && budget.action != budgetActionBatch && budget.action != budgetActionLocal {
+		panic(fmt.Errorf("FEE_BUDGET_ACTION in demo.env should be %v, %v or %v, not %v\n", budgetActionReject, budgetActionBatch, budgetActionLocal, budget.action))
+	}
+
+	budget.minuteLimit = hbarToTinybar(parseFloatEnv("FEE_BUDGET_PER_MINUTE_HBAR", 0))
+	budget.dayLimit = hbarToTinybar(parseFloatEnv("FEE_BUDGET_PER_DAY_HBAR", 0))
+
+	tenantDayLimit := hbarToTinybar(parseFloatEnv("FEE_BUDGET_PER_TENANT_PER_DAY_HBAR", 0))
+	for _, t := range tenants {
+		budget.tenantDayLimits[t.id] = tenantDayLimit
+		if t.dailyBudget != nil {
+			budget.tenantDayLimits[t.id] = hbarToTinybar(*t.dailyBudget)
+		}
+	}
+}
+
+//This function adds a fee from the ledger to the spend
+func (g *budgetGuard) recordSpend(record feeRecord) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	minute := record.ConsensusTimestamp.Unix() / 60
+	day := record.ConsensusTimestamp.UTC().Format("2006-01-02")
+
+	g.minuteSpend[minute] += record.FeeTinybar
+	g.daySpend[day] += record.FeeTinybar
+	g.tenantDaySpend[day+"/"+record.Tenant] += record.FeeTinybar
+
+	//forget the spend from windows that have passed
+	now := time.Now().UTC()
+	for m := range g.minuteSpend {
+		if m < now.Unix()/60-1 {
+			delete(g.minuteSpend, m)
+		}
+	}
+	yesterday := now.Add(-24 * time.Hour).Format("2006-01-02")
+	for d := range g.daySpend {
+		if d < yesterday {
+			delete(g.daySpend, d)
+		}
+	}
+	for key := range g.tenantDaySpend {
+		if key[:len("2006-01-02")] < yesterday {
+			delete(g.tenantDaySpend, key)
+		}
+	}
+}
+
+//This function returns the state of every budget that applies to the tenant
+func (g *budgetGuard) windows(t *tenant) []budgetWindow {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now().UTC()
+	minuteEnd := now.Truncate(time.Minute).Add(time.Minute)
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	day := now.Format("2006-01-02")
+
+	windows := []budgetWindow{
+		newBudgetWindow("minute", "", g.minuteLimit, g.minuteSpend[now.Unix()/60], minuteEnd),
+		newBudgetWindow("day", "", g.dayLimit, g.daySpend[day], dayEnd),
+		newBudgetWindow("tenant-day", t.id, g.tenantDayLimits[t.id], g.tenantDaySpend[day+"/"+t.id], dayEnd),
+	}
+
+	//raise an alert as each budget is exceeded, and resolve it once the window resets
+	for _, window := range windows {
+		key := window.Budget + "/" + window.Tenant
+		metrics.setGauge(series("hcs_budget_spent_tinybar", "budget", window.Budget, "tenant", window.Tenant), "Fees spent in the current budget window, in tinybar", float64(window.SpentTinybar))
+		metrics.setGauge(series("hcs_budget_exceeded", "budget", window.Budget, "tenant", window.Tenant), "Whether the budget is exceeded, opening the circuit breaker", boolToFloat(window.Exceeded))
+
+		if window.Exceeded != g.firing[key] {
+			g.firing[key] = window.Exceeded
+			severity := "critical"
+			if !window.Exceeded {
+				severity = "resolved"
+			}
+			go raiseAlert("fee_budget", severity, "The %v fee budget %v has spent %v of its %v hbar (action: %v)", window.Budget, window.Tenant, window.SpentHbar, window.LimitHbar, g.action)
+		}
+	}
+
+	return windows
+}
+
+func newBudgetWindow(name string, tenantId string, limit int64, spent int64, resetsAt time.Time) budgetWindow {
+	return budgetWindow{
+		Budget:       name,
+		Tenant:       tenantId,
+		LimitTinybar: limit,
+		SpentTinybar: spent,
+		LimitHbar:    tinybarToHbarString(limit),
+		SpentHbar:    tinybarToHbarString(spent),
+		Exceeded:     limit > 0 && spent >= limit,
+		ResetsAt:     resetsAt,
+	}
+}
+
+//This function checks the budgets for a tenant, returning the exceeded budget that resets last if the breaker is open
+func (g *budgetGuard) check(t *tenant) (budgetWindow, bool) {
+	var breach budgetWindow
+	open := false
+
+	for _, window := range g.windows(t) {
+		if window.Exceeded && (!open || window.ResetsAt.After(breach.ResetsAt)) {
+			breach = window
+			open = true
+		}
+	}
+
+	return breach, open
+}
+
+//a budgetExceededError is returned when an event is rejected because a budget has been exceeded
+type budgetExceededError struct {
+	window budgetWindow
+}
+
+func (e budgetExceededError) Error() string {
+	return fmt.Sprintf("the %v fee budget has been exceeded, please try again later", e.window.Budget)
+}
+
+//This function returns the number of seconds until the exceeded budget resets
+func (e budgetExceededError) retryAfter() int {
+	return int(time.Until(e.window.ResetsAt).Seconds()) + 1
+}
+
+func hbarToTinybar(hbar float64) int64 {
+	return int64(math.Round(hbar * 100000000))
+}
+
+//events anchored locally are given an ID that can't clash with a transaction ID
+var localAnchorCounter uint64
+
+//This function anchors an event locally rather than submitting it, appending it (still encrypted) to
+// LOCAL_ANCHOR_FILE so that it isn't lost, and adding it to the event store so that it can be retrieved. It returns the
+// event with its local ID
+func anchorLocally(t *tenant, jsonString string, privateJson string) string {
+	localId := fmt.Sprintf("local-%v-%v.%v", t.id, time.Now().UnixNano(), atomic.AddUint64(&localAnchorCounter, 1))
+
+	jsonString, err := sjson.Set(jsonString, "public.transactionId", localId)
+	if err != nil {
+		panic(err)
+	}
+
+	anchorLocallyAs(t, localId, jsonString, privateJson)
+	log.Printf("Anchored event %v locally as a fee budget has been exceeded\n", gjson.Get(jsonString, "public.event"))
+	return jsonString
+}
+
+//This function anchors an event locally under the ID it already has, which for an event that couldn't be submitted
+// in its batch is the ID its client was given (see batch.go)
+func anchorLocallyAs(t *tenant, eventId string, jsonString string, privateJson string) {
+	now := time.Now()
+
+	anchorFile := getEnv("LOCAL_ANCHOR_FILE", "local-anchors.ndjson")
+	file, err := os.OpenFile(anchorFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.Write([]byte(jsonString + "\n"))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		panic(fmt.Errorf("Unable to anchor event %v locally in %v. Error: %v\n", eventId, anchorFile, err))
+	}
+
+	storedJson, err := sjson.SetRaw(jsonString, "hcs", fmt.Sprintf(`{"tenant":"%v","anchor":"local","localTimestamp":%v}`, t.id, now.UnixNano()))
+	if err == nil {
+		storedJson, err = sjson.SetRaw(storedJson, "private", privateJson)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	eventStore.putAnchored(eventId, storedJson)
+	if audit != nil {
+		auditJson, err := sjson.Set(storedJson, "private", gjson.Get(jsonString, "private").String())
+		if err != nil {
+			panic(err)
+		}
+		audit.record(t, eventId, auditJson)
+	}
+	metrics.addCounter(series("hcs_local_anchored_events_total", "tenant", t.id), "Events anchored locally whilst a fee budget was exceeded", 1)
+}
+
+//a budgetStatus is the response of the /budget/status endpoint
+type budgetStatus struct {
+	State   string         `json:"state"` //closed whilst events are being submitted as normal, open whilst a budget is exceeded
+	Action  string         `json:"action"`
+	Budgets []budgetWindow `json:"budgets"`
+}
+
+//This handler reports the state of the circuit breaker and the budgets for the requesting tenant
+func budgetStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	status := budgetStatus{State: "closed", Action: budget.action, Budgets: budget.windows(t)}
+	for _, window := range status.Budgets {
+		if window.Exceeded {
+			status.State = "open"
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(status)
+}
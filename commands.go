@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+//a command is a sub-command of the demo application that can be run instead of the web-server, e.g.
+// "go run . signer-daemon"
+type command struct {
+	description string
+	run         func(args []string)
+}
+
+//this map holds every sub-command the demo application supports, keyed on the name used on the command line
+var commands = map[string]command{
+	"signer-daemon": {
+		description: "run a reference signing daemon holding the operator and topic keys",
+		run:         signerDaemonCommand,
+	},
+	"topic": {
+		description: "create, inspect, update, rotate the submit key of or delete a topic",
+		run:         topicCommand,
+	},
+	"build-topic-create": {
+		description: "build an unsigned topic create transaction, e.g. with threshold admin and submit keys",
+		run:         buildTopicCreateCommand,
+	},
+	"build-topic-update": {
+		description: "build an unsigned topic update transaction for offline signing",
+		run:         buildTopicUpdateCommand,
+	},
+	"build-topic-delete": {
+		description: "build an unsigned topic delete transaction for offline signing",
+		run:         buildTopicDeleteCommand,
+	},
+	"sign-transaction": {
+		description: "sign a transaction file with a private key (can be run offline)",
+		run:         signTransactionCommand,
+	},
+	"submit-transaction": {
+		description: "add the operator signature to a signed transaction file and submit it",
+		run:         submitTransactionCommand,
+	},
+	"export": {
+		description: "replay the topics from the mirror node into an NDJSON, CSV or Parquet export",
+		run:         exportCommand,
+	},
+	"verify": {
+		description: "check a dump of topic messages offline and write a signed pass/fail report",
+		run:         verifyCommand,
+	},
+	"verify-report": {
+		description: "check the signature on a report written by verify",
+		run:         verifyReportCommand,
+	},
+	"mirror-simulator": {
+		description: "run a local mirror node with injectable faults, serving recorded or newly submitted messages",
+		run:         mirrorSimulatorCommand,
+	},
+	"replay-fixtures": {
+		description: "feed a recording of mirror node responses back through the subscriber, e.g. as a regression test",
+		run:         replayFixturesCommand,
+	},
+	"backfill": {
+		description: "ask the running web-server to rebuild its event store for a time range or from a mirror REST export",
+		run:         backfillCommand,
+	},
+	"explorer-password": {
+		description: "hash a password for an account in EXPLORER_USERS_FILE",
+		run:         explorerPasswordCommand,
+	},
+	"verify-audit-log": {
+		description: "check the audit log's hash chains against the anchors on the ledger",
+		run:         verifyAuditLogCommand,
+	},
+	"fee-report": {
+		description: "write a daily or monthly chargeback report of transaction fees as CSV or JSON",
+		run:         feeReportCommand,
+	},
+}
+
+//This function looks up and runs the named sub-command, printing the list of available commands if it doesn't exist
+func runCommand(name string, args []string) {
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage()
+		return
+	}
+
+	cmd, exists := commands[name]
+	if !exists {
+		fmt.Printf("Unknown command %v\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+
+	cmd.run(args)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Usage: go run . [command] [arguments]\n\nRunning without a command starts the demo web-server. Available commands:\n\n")
+	for _, name := range names {
+		fmt.Printf("  %-24v %v\n", name, commands[name].description)
+	}
+}
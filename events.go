@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//An eventFilter picks out the processed events a client is interested in. Every filter is optional, and an event has
+// to match all of the filters that are set. A tenant can only ever see its own events, so the tenant filter is always
+// the requesting tenant
+type eventFilter struct {
+	tenant   string
+	topic    string //topic ID
+	event    string //public.event
+	session  string //private.session
+	videoUrl string //private.videoUrl
+
+	//consensus timestamps in unix nanoseconds from (inclusive) and to (exclusive), and a range of sequence numbers
+	// (inclusive). Zero leaves that end of the range open
+	fromTimestamp int64
+	toTimestamp   int64
+	fromSequence  uint64
+	toSequence    uint64
+}
+
+//returned when a client asks for events belonging to another tenant
+var errOtherTenant = errors.New("events can only be read by the tenant they belong to")
+
+//This function reads the filters from the query parameters of a request. The topic can be given as a topic ID or as
+// the name of one of the tenant's routed topics, and the from and to times as RFC3339 times, dates or unix nanoseconds
+func parseEventFilter(t *tenant, params url.Values) (eventFilter, error) {
+	filter := eventFilter{
+		tenant:   t.id,
+		event:    params.Get("event"),
+		session:  params.Get("session"),
+		videoUrl: params.Get("videoUrl"),
+	}
+
+	var err error
+	if filter.fromTimestamp, err = parseConsensusTime(params.Get("from")); err != nil {
+		return eventFilter{}, err
+	}
+	if filter.toTimestamp, err = parseConsensusTime(params.Get("to")); err != nil {
+		return eventFilter{}, err
+	}
+	if filter.fromSequence, err = parseSequenceNumber(params.Get("fromSequence")); err != nil {
+		return eventFilter{}, err
+	}
+	if filter.toSequence, err = parseSequenceNumber(params.Get("toSequence")); err != nil {
+		return eventFilter{}, err
+	}
+
+	if tenantId := params.Get("tenant"); tenantId != "" && tenantId != t.id {
+		return eventFilter{}, errOtherTenant
+	}
+
+	if topic := params.Get("topic"); topic != "" {
+		for _, tenantTopic := range t.topics {
+			if topic == tenantTopic.name || topic == tenantTopic.topicId.String() {
+				filter.topic = tenantTopic.topicId.String()
+			}
+		}
+		if filter.topic == "" {
+			return eventFilter{}, fmt.Errorf("unknown topic %q", topic)
+		}
+	}
+
+	return filter, nil
+}
+
+func (f eventFilter) matches(messageJson string) bool {
+	message := gjson.Parse(messageJson)
+	consensusTimestamp := message.Get("hcs.consensusTimestamp").Int()
+	sequenceNumber := message.Get("hcs.sequenceNumber").Uint()
+
+	return message.Get("hcs.tenant").String() == f.tenant &&
+		(f.topic == "" || message.Get("hcs.topicId").String() == f.topic) &&
+		(f.event == "" || message.Get("public.event").String() == f.event) &&
+		(f.session == "" || message.Get("private.session").String() == f.session) &&
+		(f.videoUrl == "" || message.Get("private.videoUrl").String() == f.videoUrl) &&
+		(f.fromTimestamp == 0 || consensusTimestamp >= f.fromTimestamp) &&
+		(f.toTimestamp == 0 || consensusTimestamp < f.toTimestamp) &&
+		(f.fromSequence == 0 || sequenceNumber >= f.fromSequence) &&
+		(f.toSequence == 0 || sequenceNumber <= f.toSequence)
+}
+
+func parseConsensusTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if nanoseconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return nanoseconds, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UnixNano(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unable to parse %q as an RFC3339 time, a date (2006-01-02) or unix nanoseconds", value)
+}
+
+func parseSequenceNumber(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	sequenceNumber, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence number %q", value)
+	}
+	return sequenceNumber, nil
+}
+
+//This function writes the response for a filter that couldn't be parsed
+func writeEventFilterError(rw http.ResponseWriter, err error) {
+	if err == errOtherTenant {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(rw, err.Error(), http.StatusBadRequest)
+}
+
+//GET /events returns the processed events matching the filters, in consensus timestamp order, a page at a time:
+//
+//	{"events": [...], "nextCursor": "...", "hasMore": true}
+//
+//Passing nextCursor back as the cursor parameter returns the next page. Once hasMore is false the cursor can still be
+// used later to pick up any events that have arrived since. Events only appear once they have been merged into
+// consensus order (see merge.go)
+const (
+	defaultEventsPageSize = 100
+	maxEventsPageSize     = 1000
+)
+
+type eventsPage struct {
+	Events     []json.RawMessage `json:"events"`
+	NextCursor string            `json:"nextCursor"`
+	HasMore    bool              `json:"hasMore"`
+}
+
+func eventsQueryHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	filter, err := parseEventFilter(t, params)
+	if err != nil {
+		writeEventFilterError(rw, err)
+		return
+	}
+
+	limit := defaultEventsPageSize
+	if limitParam := params.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxEventsPageSize {
+			http.Error(rw, fmt.Sprintf("limit should be between 1 and %v", maxEventsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//the cursor is the last message in the consensus ordered view that has been read. Without one, start from the
+	// first event in the time range (as every message on a topic comes after the key with a blank topic)
+	after := orderedKey{ConsensusTimestamp: filter.fromTimestamp}
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err = decodeEventsCursor(cursor)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page := eventsPage{Events: []json.RawMessage{}}
+	done := false
+	for !done {
+		messages := eventStore.orderedAfter(after, maxEventsPageSize)
+		if len(messages) == 0 {
+			break
+		}
+
+		for _, messageJson := range messages {
+			//everything from here on is past the end of the time range
+			if filter.toTimestamp != 0 && gjson.Get(messageJson, "hcs.consensusTimestamp").Int() >= filter.toTimestamp {
+				done = true
+				break
+			}
+
+			if len(page.Events) == limit {
+				page.HasMore = true
+				done = true
+				break
+			}
+
+			after = orderedKeyOf(messageJson)
+			if filter.matches(messageJson) {
+				page.Events = append(page.Events, json.RawMessage(messageJson))
+			}
+		}
+	}
+
+	page.NextCursor = encodeEventsCursor(after)
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(page)
+}
+
+//Cursors hold the key of the last message read, rather than its position, so that messages backfilled into the
+// middle of the consensus ordered view don't make pages skip or repeat events
+func encodeEventsCursor(key orderedKey) string {
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeEventsCursor(cursor string) (orderedKey, error) {
+	var key orderedKey
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(decoded, &key)
+	}
+	if err != nil {
+		return orderedKey{}, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return key, nil
+}
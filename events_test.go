@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventsCursor(t *testing.T) {
+	tests := []struct {
+		name string
+		key  orderedKey
+	}{
+		{name: "the zero key", key: orderedKey{}},
+		{name: "a message", key: orderedKey{ConsensusTimestamp: 1590000000123456789, TopicId: "0.0.1234", TransactionId: "0.0.5@1590000000.000000001"}},
+		{name: "a batched event", key: orderedKey{ConsensusTimestamp: 1590000000123456789, TopicId: "0.0.1234", TransactionId: "0.0.5@1590000000.000000001-12"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor := encodeEventsCursor(test.key)
+			decoded, err := decodeEventsCursor(cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded != test.key {
+				t.Errorf("cursor %v decoded as %+v, expected %+v", cursor, decoded, test.key)
+			}
+		})
+	}
+
+	for _, cursor := range []string{"not a cursor", "bm90IGpzb24", "eyJjIjoiMSJ9"} {
+		if _, err := decodeEventsCursor(cursor); err == nil {
+			t.Errorf("expected cursor %q to be invalid", cursor)
+		}
+	}
+}
+
+func TestOrderedHandlerPages(t *testing.T) {
+	useTestPipeline(t, testTopics("0.0.1"))
+	saved := tenants
+	t.Cleanup(func() { tenants = saved })
+	tenants = []*tenant{testTenant("0.0.1")}
+
+	//another tenant's messages are passed over, but still move the cursor on
+	for i := 1; i <= maxEventsPageSize+1; i++ {
+		eventStore.putOrdered(testOrderedMessage(int64(2*i), "0.0.1", fmt.Sprintf("event-%v", i)))
+	}
+	eventStore.putOrdered(strings.Replace(testOrderedMessage(int64(2*maxEventsPageSize+3), "0.0.2", "other"), `"default"`, `"acme"`, 1))
+
+	read := func(cursor string) ([]string, string) {
+		recorder := httptest.NewRecorder()
+		orderedHandler(recorder, httptest.NewRequest(http.MethodGet, "/ordered?cursor="+cursor, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("/ordered responded %v: %v", recorder.Code, recorder.Body)
+		}
+		var ids []string
+		for _, message := range gjson.Parse(recorder.Body.String()).Array() {
+			ids = append(ids, message.Get("public.transactionId").String())
+		}
+		return ids, recorder.Header().Get("X-Next-Cursor")
+	}
+
+	first, cursor := read("")
+	if len(first) != maxEventsPageSize || first[0] != "event-1" {
+		t.Fatalf("the first page has %v messages starting with %v", len(first), first[0])
+	}
+
+	//a message backfilled before the cursor mustn't make the next page repeat a message
+	eventStore.putOrdered(testOrderedMessage(1, "0.0.1", "backfilled"))
+
+	next, cursor := read(cursor)
+	if expected := []string{fmt.Sprintf("event-%v", maxEventsPageSize+1)}; !reflect.DeepEqual(next, expected) {
+		t.Errorf("the next page is %v, expected %v", next, expected)
+	}
+
+	last, _ := read(cursor)
+	if len(last) != 0 {
+		t.Errorf("expected no more messages, got %v", last)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"github.com/tidwall/gjson"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//the event store holds every processed message keyed on its transaction ID. The subscriber for each topic writes to
+// it from its own goroutine whilst the page handlers read from it, so access is guarded by a mutex. It also holds the
+// messages from every topic merged into consensus timestamp order (see merge.go), and each topic's messages in
+// sequence number order for the streaming endpoints, which subscribe to be told about each message as it arrives.
+// Events that have been submitted but not yet processed are kept as pending, so /retrieve can tell them apart from
+// transaction IDs it has never seen
+type memoryEventStore struct {
+	mutex       sync.RWMutex
+	events      map[string]string   //map[transactionId]messageDataAsJson
+	ordered     []string            //messageDataAsJson in consensus timestamp order
+	byTopic     map[string][]string //map[topicId]messageDataAsJson in sequence number order
+	pending     map[string]string   //map[transactionId]tenantId
+	waiters     map[string][]chan string
+	subscribers map[chan string]string //map[subscriber]tenantId
+
+	//every topic message exactly as it arrived from the mirror node, in sequence number order (see topicmessages.go)
+	topicMessages map[string][]mirrorTopicMessage
+}
+
+func newMemoryEventStore() *memoryEventStore {
+	return &memoryEventStore{
+		events:      make(map[string]string),
+		byTopic:     make(map[string][]string),
+		pending:     make(map[string]string),
+		waiters:     make(map[string][]chan string),
+		subscribers: make(map[chan string]string),
+
+		topicMessages: make(map[string][]mirrorTopicMessage),
+	}
+}
+
+func (s *memoryEventStore) put(transactionId string, messageJson string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.events[transactionId] = messageJson
+}
+
+func (s *memoryEventStore) get(transactionId string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messageJson, exists := s.events[transactionId]
+	return messageJson, exists
+}
+
+//This function stores a message that has reached consensus on a topic, and passes it on to every subscriber. A
+// subscriber that has fallen so far behind that its channel is full is dropped (its channel is closed), so that one
+// slow client can't hold up the subscribers.
+//
+//Storing a message that is already there replaces it, and older messages (such as those being backfilled) are put in
+// their place by sequence number. Subscribers are only told about messages that are the latest on their topic
+func (s *memoryEventStore) putConfirmed(topic string, transactionId string, messageJson string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.events[transactionId] = messageJson
+	var latest bool
+	s.byTopic[topic], latest = insertInOrder(s.byTopic[topic], messageJson, "hcs.sequenceNumber")
+	delete(s.pending, transactionId)
+
+	for _, waiter := range s.waiters[transactionId] {
+		waiter <- messageJson
+	}
+	delete(s.waiters, transactionId)
+
+	if !latest {
+		return
+	}
+
+	tenantId := gjson.Get(messageJson, "hcs.tenant").String()
+	for subscriber, subscriberTenantId := range s.subscribers {
+		if subscriberTenantId != tenantId {
+			continue
+		}
+
+		select {
+		case subscriber <- messageJson:
+		default:
+			delete(s.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+//This function records that an event has been submitted for a tenant, and is waiting to reach consensus
+func (s *memoryEventStore) markPending(transactionId string, tenantId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.events[transactionId]; !exists {
+		s.pending[transactionId] = tenantId
+	}
+}
+
+//This function stores an event that was anchored locally rather than reaching consensus, in place of any pending
+// entry for it, and hands it to anyone waiting to retrieve it. Subscribers aren't told, as they follow consensus
+func (s *memoryEventStore) putAnchored(transactionId string, messageJson string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.events[transactionId] = messageJson
+	delete(s.pending, transactionId)
+
+	for _, waiter := range s.waiters[transactionId] {
+		waiter <- messageJson
+	}
+	delete(s.waiters, transactionId)
+}
+
+//This function looks up an event under a single lock, returning the stored message if it has reached consensus or
+// whether it is still pending otherwise, along with the tenant it belongs to. Looking up both at once means an event
+// that reaches consensus in between can't be mistaken for one that was never submitted
+func (s *memoryEventStore) lookup(transactionId string) (messageJson string, pending bool, tenantId string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if messageJson, exists := s.events[transactionId]; exists {
+		return messageJson, false, gjson.Get(messageJson, "hcs.tenant").String()
+	}
+
+	tenantId, pending = s.pending[transactionId]
+	return "", pending, tenantId
+}
+
+//This function waits until the message with the transaction ID has been stored, or the context is done
+func (s *memoryEventStore) waitFor(ctx context.Context, transactionId string) (string, bool) {
+	s.mutex.Lock()
+	if messageJson, exists := s.events[transactionId]; exists {
+		s.mutex.Unlock()
+		return messageJson, true
+	}
+
+	waiter := make(chan string, 1)
+	s.waiters[transactionId] = append(s.waiters[transactionId], waiter)
+	s.mutex.Unlock()
+
+	select {
+	case messageJson := <-waiter:
+		return messageJson, true
+
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		waiters := s.waiters[transactionId]
+		for i := range waiters {
+			if waiters[i] == waiter {
+				s.waiters[transactionId] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(s.waiters[transactionId]) == 0 {
+			delete(s.waiters, transactionId)
+		}
+		return "", false
+	}
+}
+
+//This function returns a channel that receives each of a tenant's messages as it reaches consensus, buffering up to
+// the given number of messages. Other tenants' messages never take up room in the buffer
+func (s *memoryEventStore) subscribe(tenantId string, buffer int) chan string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subscriber := make(chan string, buffer)
+	s.subscribers[subscriber] = tenantId
+	return subscriber
+}
+
+func (s *memoryEventStore) unsubscribe(subscriber chan string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, subscribed := s.subscribers[subscriber]; subscribed {
+		delete(s.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+//This function returns the messages that reached consensus on each topic after the sequence number given by after,
+// in consensus timestamp order
+func (s *memoryEventStore) confirmedAfter(after func(topic string) uint64) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var messages []string
+	for topic, topicMessages := range s.byTopic {
+		sequenceNumber := after(topic)
+		start := sort.Search(len(topicMessages), func(i int) bool {
+			return gjson.Get(topicMessages[i], "hcs.sequenceNumber").Uint() > sequenceNumber
+		})
+		messages = append(messages, topicMessages[start:]...)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return gjson.Get(messages[i], "hcs.consensusTimestamp").Int() < gjson.Get(messages[j], "hcs.consensusTimestamp").Int()
+	})
+
+	return messages
+}
+
+//an orderedKey is a message's place in the consensus ordered view. Messages with the same consensus timestamp (such as
+// the events in a batch) are ordered by topic and then transaction ID, so every message has a fixed place that a
+// cursor can refer to, however many messages are backfilled before it
+type orderedKey struct {
+	ConsensusTimestamp int64  `json:"c"`
+	TopicId            string `json:"t"`
+	TransactionId      string `json:"i"`
+}
+
+func orderedKeyOf(messageJson string) orderedKey {
+	message := gjson.Parse(messageJson)
+	return orderedKey{
+		ConsensusTimestamp: message.Get("hcs.consensusTimestamp").Int(),
+		TopicId:            message.Get("hcs.topicId").String(),
+		TransactionId:      message.Get("public.transactionId").String(),
+	}
+}
+
+func (k orderedKey) before(other orderedKey) bool {
+	if k.ConsensusTimestamp != other.ConsensusTimestamp {
+		return k.ConsensusTimestamp < other.ConsensusTimestamp
+	}
+	if k.TopicId != other.TopicId {
+		return k.TopicId < other.TopicId
+	}
+	return transactionIdBefore(k.TransactionId, other.TransactionId)
+}
+
+//This function orders transaction IDs, keeping the events of a batch ("<batch>-<index>") in index order
+func transactionIdBefore(a string, b string) bool {
+	aSeparator, bSeparator := strings.LastIndex(a, "-"), strings.LastIndex(b, "-")
+	if aSeparator >= 0 && bSeparator >= 0 && a[:aSeparator] == b[:bSeparator] {
+		aIndex, aErr := strconv.Atoi(a[aSeparator+1:])
+		bIndex, bErr := strconv.Atoi(b[bSeparator+1:])
+		if aErr == nil && bErr == nil {
+			return aIndex < bIndex
+		}
+	}
+	return a < b
+}
+
+//This function adds a message to the consensus ordered view. Messages normally arrive in order and go on the end, but
+// a backfilled message is put in its place (or replaces itself if it is already there)
+func (s *memoryEventStore) putOrdered(messageJson string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := orderedKeyOf(messageJson)
+	i := sort.Search(len(s.ordered), func(i int) bool {
+		return !orderedKeyOf(s.ordered[i]).before(key)
+	})
+	if i < len(s.ordered) && orderedKeyOf(s.ordered[i]) == key {
+		s.ordered[i] = messageJson
+		return
+	}
+
+	s.ordered = append(s.ordered, "")
+	copy(s.ordered[i+1:], s.ordered[i:])
+	s.ordered[i] = messageJson
+}
+
+//This function returns up to limit messages from the consensus ordered view that come after the key. The zero key
+// comes before every message
+func (s *memoryEventStore) orderedAfter(after orderedKey, limit int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	start := sort.Search(len(s.ordered), func(i int) bool {
+		return after.before(orderedKeyOf(s.ordered[i]))
+	})
+
+	end := start + limit
+	if end > len(s.ordered) {
+		end = len(s.ordered)
+	}
+	return append([]string(nil), s.ordered[start:end]...)
+}
+
+//This function puts a message into a list kept in order of the given field, after any messages with the same value,
+// or replaces the message with the same transaction ID if it is already there. It returns the list, and whether the
+// message went on the end
+func insertInOrder(messages []string, messageJson string, orderPath string) ([]string, bool) {
+	value := gjson.Get(messageJson, orderPath).Int()
+	transactionId := gjson.Get(messageJson, "public.transactionId").String()
+
+	i := sort.Search(len(messages), func(i int) bool {
+		return gjson.Get(messages[i], orderPath).Int() >= value
+	})
+	for ; i < len(messages) && gjson.Get(messages[i], orderPath).Int() == value; i++ {
+		if gjson.Get(messages[i], "public.transactionId").String() == transactionId {
+			messages[i] = messageJson
+			return messages, false
+		}
+	}
+
+	messages = append(messages, "")
+	copy(messages[i+1:], messages[i:])
+	messages[i] = messageJson
+	return messages, i == len(messages)-1
+}
+
+//This function returns up to limit messages from the consensus ordered view that come before the key, in order
+func (s *memoryEventStore) orderedBefore(before orderedKey, limit int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	end := sort.Search(len(s.ordered), func(i int) bool {
+		return !orderedKeyOf(s.ordered[i]).before(before)
+	})
+
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return append([]string(nil), s.ordered[start:end]...)
+}
+
+//This function returns the events carried by a topic message, which is more than one for a batch message
+func (s *memoryEventStore) eventsInMessage(topic string, sequenceNumber uint64) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := s.byTopic[topic]
+	i := sort.Search(len(messages), func(i int) bool {
+		return gjson.Get(messages[i], "hcs.sequenceNumber").Uint() >= sequenceNumber
+	})
+
+	var events []string
+	for ; i < len(messages) && gjson.Get(messages[i], "hcs.sequenceNumber").Uint() == sequenceNumber; i++ {
+		events = append(events, messages[i])
+	}
+	return events
+}
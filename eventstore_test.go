@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTransactionIdBefore(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		before bool
+	}{
+		{"0.0.5@1590000000.000000001", "0.0.5@1590000000.000000002", true},
+		{"0.0.5@1590000000.000000002", "0.0.5@1590000000.000000001", false},
+		{"0.0.5@1590000000.000000001", "0.0.5@1590000000.000000001", false},
+		{"0.0.5@1590000000.000000001-2", "0.0.5@1590000000.000000001-10", true}, //by index, not as strings
+		{"0.0.5@1590000000.000000001-10", "0.0.5@1590000000.000000001-2", false},
+		{"0.0.5@1590000000.000000001-9", "0.0.5@1590000000.000000002-0", true}, //different batches
+		{"0.0.5@1590000000.000000001", "0.0.5@1590000000.000000001-0", true},
+		{"0.0.5@1590000000.000000001-x", "0.0.5@1590000000.000000001-10", false},
+	}
+
+	for _, test := range tests {
+		if before := transactionIdBefore(test.a, test.b); before != test.before {
+			t.Errorf("transactionIdBefore(%v, %v) is %v, expected %v", test.a, test.b, before, test.before)
+		}
+	}
+}
+
+func TestOrderedKeyBefore(t *testing.T) {
+	key := orderedKey{ConsensusTimestamp: 2, TopicId: "0.0.2", TransactionId: "0.0.5@1590000000.000000001-2"}
+
+	tests := []struct {
+		name   string
+		other  orderedKey
+		before bool
+		after  bool
+	}{
+		{
+			name:  "the same key",
+			other: key,
+		},
+		{
+			name:   "a later consensus timestamp",
+			other:  orderedKey{ConsensusTimestamp: 3, TopicId: "0.0.1", TransactionId: "0.0.5@1590000000.000000000"},
+			before: true,
+		},
+		{
+			name:  "an earlier consensus timestamp",
+			other: orderedKey{ConsensusTimestamp: 1, TopicId: "0.0.3", TransactionId: "0.0.5@1590000000.000000009"},
+			after: true,
+		},
+		{
+			name:   "the same consensus timestamp on a later topic",
+			other:  orderedKey{ConsensusTimestamp: 2, TopicId: "0.0.3", TransactionId: "0.0.5@1590000000.000000000"},
+			before: true,
+		},
+		{
+			name:   "a later event in the same batch",
+			other:  orderedKey{ConsensusTimestamp: 2, TopicId: "0.0.2", TransactionId: "0.0.5@1590000000.000000001-10"},
+			before: true,
+		},
+		{
+			name:  "an earlier event in the same batch",
+			other: orderedKey{ConsensusTimestamp: 2, TopicId: "0.0.2", TransactionId: "0.0.5@1590000000.000000001-1"},
+			after: true,
+		},
+		{
+			name:  "the zero key comes before every message",
+			other: orderedKey{},
+			after: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if before := key.before(test.other); before != test.before {
+				t.Errorf("before is %v, expected %v", before, test.before)
+			}
+			if after := test.other.before(key); after != test.after {
+				t.Errorf("after is %v, expected %v", after, test.after)
+			}
+		})
+	}
+}
+
+//This function returns a processed message as the subscriber stores it
+func testOrderedMessage(consensusTimestamp int64, topic string, transactionId string) string {
+	return fmt.Sprintf(`{"public":{"transactionId":"%v"},"hcs":{"tenant":"default","topicId":"%v","consensusTimestamp":%v}}`, transactionId, topic, consensusTimestamp)
+}
+
+func TestOrderedViewBackfill(t *testing.T) {
+	store := newMemoryEventStore()
+	store.putOrdered(testOrderedMessage(1, "0.0.1", "a"))
+	store.putOrdered(testOrderedMessage(3, "0.0.1", "c"))
+	store.putOrdered(testOrderedMessage(4, "0.0.1", "d"))
+
+	//a client reads the first page and keeps the cursor
+	page := store.orderedAfter(orderedKey{}, 2)
+	cursor := orderedKeyOf(page[len(page)-1])
+
+	//messages are then backfilled before and after the cursor, and one is delivered again
+	store.putOrdered(testOrderedMessage(2, "0.0.1", "b"))
+	store.putOrdered(testOrderedMessage(3, "0.0.0", "c0"))
+	store.putOrdered(testOrderedMessage(3, "0.0.2", "c2"))
+	store.putOrdered(testOrderedMessage(4, "0.0.1", "d"))
+
+	var all []string
+	for _, messageJson := range store.orderedAfter(orderedKey{}, 100) {
+		all = append(all, orderedKeyOf(messageJson).TransactionId)
+	}
+	if expected := []string{"a", "b", "c0", "c", "c2", "d"}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("the ordered view is %v, expected %v", all, expected)
+	}
+
+	//the next page carries on from the message the cursor refers to, wherever it now is
+	var next []string
+	for _, messageJson := range store.orderedAfter(cursor, 100) {
+		next = append(next, orderedKeyOf(messageJson).TransactionId)
+	}
+	if expected := []string{"c2", "d"}; !reflect.DeepEqual(next, expected) {
+		t.Errorf("the next page is %v, expected %v", next, expected)
+	}
+}
+
+func TestEventStoreLookup(t *testing.T) {
+	store := newMemoryEventStore()
+	store.markPending("a", "acme")
+
+	if messageJson, pending, tenantId := store.lookup("a"); messageJson != "" || !pending || tenantId != "acme" {
+		t.Errorf("expected a to be pending for acme, got %q pending %v tenant %v", messageJson, pending, tenantId)
+	}
+
+	confirmed := `{"hcs":{"tenant":"acme","sequenceNumber":1}}`
+	store.putConfirmed("0.0.1", "a", confirmed)
+	if messageJson, pending, tenantId := store.lookup("a"); messageJson != confirmed || pending || tenantId != "acme" {
+		t.Errorf("expected a to be confirmed for acme, got %q pending %v tenant %v", messageJson, pending, tenantId)
+	}
+
+	if messageJson, pending, tenantId := store.lookup("b"); messageJson != "" || pending || tenantId != "" {
+		t.Errorf("expected b to be unknown, got %q pending %v tenant %v", messageJson, pending, tenantId)
+	}
+}
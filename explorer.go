@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"strings"
+)
+
+//An ExplorerLinker builds links to topics, messages and transactions on a block explorer. The demo originally linked to
+// a single hardcoded explorer, which has since shut down, so the explorer is now chosen with EXPLORER in demo.env:
+//
+//	hashscan     https://hashscan.io (the default)
+//	dragonglass  https://app.dragonglass.me
+//	mirror       the mirror node's REST API at MIRROR_REST_URL, which shows the raw JSON
+//	self         our own explorer pages, at EXPLORER_BASE_URL (or relative to this web-server if blank)
+//	custom       the EXPLORER_TOPIC_URL, EXPLORER_MESSAGE_URL and EXPLORER_TRANSACTION_URL templates
+//
+//The public explorers link to the network given by EXPLORER_NETWORK (testnet, previewnet or mainnet)
+type ExplorerLinker interface {
+	TopicUrl(topicId string) string
+	MessageUrl(topicId string, sequenceNumber uint64) string
+	TransactionUrl(transactionId string) string
+}
+
+//templateLinker fills in URL templates, which can use these placeholders:
+//
+//	{network}            the network, e.g. testnet
+//	{topicId}            the topic ID, e.g. 0.0.1234
+//	{sequenceNumber}     the message's sequence number
+//	{transactionId}      the transaction ID in the SDK's form, e.g. 0.0.1234@1590000000.123456789
+//	{restTransactionId}  the transaction ID in the mirror REST API's form, e.g. 0.0.1234-1590000000-123456789
+type templateLinker struct {
+	network     string
+	topic       string
+	message     string
+	transaction string
+}
+
+func (l templateLinker) fill(template string, placeholders ...string) string {
+	return strings.NewReplacer(append([]string{"{network}", l.network}, placeholders...)...).Replace(template)
+}
+
+func (l templateLinker) TopicUrl(topicId string) string {
+	return l.fill(l.topic, "{topicId}", topicId)
+}
+
+func (l templateLinker) MessageUrl(topicId string, sequenceNumber uint64) string {
+	return l.fill(l.message, "{topicId}", topicId, "{sequenceNumber}", fmt.Sprint(sequenceNumber))
+}
+
+func (l templateLinker) TransactionUrl(transactionId string) string {
+	return l.fill(l.transaction, "{transactionId}", transactionId, "{restTransactionId}", restTransactionId(transactionId))
+}
+
+//the URL templates for each public explorer. Explorers that use a different host for each network are given one
+// template per network
+var explorerTemplates = map[string]map[string]templateLinker{
+	"hashscan": {
+		"": {
+			topic:       "https://hashscan.io/{network}/topic/{topicId}",
+			message:     "https://hashscan.io/{network}/topic/{topicId}/message/{sequenceNumber}",
+			transaction: "https://hashscan.io/{network}/transaction/{restTransactionId}",
+		},
+	},
+	"dragonglass": {
+		"mainnet": {
+			topic:       "https://app.dragonglass.me/hedera/topics/{topicId}",
+			message:     "https://app.dragonglass.me/hedera/topics/{topicId}/messages/{sequenceNumber}",
+			transaction: "https://app.dragonglass.me/hedera/transactions/{restTransactionId}",
+		},
+		"testnet": {
+			topic:       "https://testnet.dragonglass.me/hedera/topics/{topicId}",
+			message:     "https://testnet.dragonglass.me/hedera/topics/{topicId}/messages/{sequenceNumber}",
+			transaction: "https://testnet.dragonglass.me/hedera/transactions/{restTransactionId}",
+		},
+	},
+}
+
+//the explorer used for all links in the application, set up by loadExplorer (and hashscan's testnet until then)
+var explorer ExplorerLinker = func() templateLinker {
+	templates := explorerTemplates["hashscan"][""]
+	templates.network = "testnet"
+	return templates
+}()
+
+//This function sets up the explorer from the environment
+func loadExplorer() {
+	provider := getEnv("EXPLORER", "hashscan")
+	network := getEnv("EXPLORER_NETWORK", "testnet")
+
+	switch provider {
+	case "mirror":
+		mirrorRestUrl := strings.TrimRight(getEnv("MIRROR_REST_URL", ""), "/")
+		if mirrorRestUrl == "" {
+			panic(fmt.Errorf("EXPLORER=\"mirror\" needs MIRROR_REST_URL to be set in the demo.env file.\n"))
+		}
+		explorer = templateLinker{
+			network:     network,
+			topic:       mirrorRestUrl + "/api/v1/topics/{topicId}",
+			message:     mirrorRestUrl + "/api/v1/topics/{topicId}/messages/{sequenceNumber}",
+			transaction: mirrorRestUrl + "/api/v1/transactions/{restTransactionId}",
+		}
+
+	case "self":
+		//the web-server's own explorer pages (see explorerui.go)
+		baseUrl := strings.TrimRight(getEnv("EXPLORER_BASE_URL", ""), "/")
+		explorer = templateLinker{
+			network:     network,
+			topic:       baseUrl + "/explorer/topics/{topicId}",
+			message:     baseUrl + "/explorer/topics/{topicId}/messages/{sequenceNumber}",
+			transaction: baseUrl + "/explorer/events/{transactionId}",
+		}
+
+	case "custom":
+		if getEnv("EXPLORER_MESSAGE_URL", "") == "" {
+			panic(fmt.Errorf("EXPLORER=\"custom\" needs at least EXPLORER_MESSAGE_URL to be set in the demo.env file.\n"))
+		}
+		explorer = templateLinker{
+			network:     network,
+			topic:       getEnv("EXPLORER_TOPIC_URL", ""),
+			message:     getEnv("EXPLORER_MESSAGE_URL", ""),
+			transaction: getEnv("EXPLORER_TRANSACTION_URL", ""),
+		}
+
+	default:
+		networks, exists := explorerTemplates[provider]
+		if !exists {
+			panic(fmt.Errorf("Unknown EXPLORER %q in demo.env. Please use hashscan, dragonglass, mirror, self or custom.\n", provider))
+		}
+		templates, exists := networks[network]
+		if !exists {
+			templates, exists = networks[""]
+		}
+		if !exists {
+			panic(fmt.Errorf("The %v explorer doesn't support EXPLORER_NETWORK %q.\n", provider, network))
+		}
+		templates.network = network
+		explorer = templates
+	}
+}
+
+//This function returns the link to a processed message on the explorer. The event may have been routed to any of our
+// topics, so the link uses the topic the message arrived on
+func explorerMessageUrl(hcsResponse string) string {
+	return explorer.MessageUrl(gjson.Get(hcsResponse, "hcs.topicId").String(), gjson.Get(hcsResponse, "hcs.sequenceNumber").Uint())
+}
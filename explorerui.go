@@ -0,0 +1,829 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/pbkdf2"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The web-server has a built-in explorer for browsing the event store, rendered from the templates in explorer.html:
+//
+//	/explorer/                                   a searchable list of events, newest first
+//	/explorer/events/{transactionId}             an event's public, encrypted and decrypted sections side by side,
+//	                                             along with the consensus details of the message that carried it (a
+//	                                             batch's transaction ID goes to the message page listing its events)
+//	/explorer/topics/                            an overview of each of the tenant's topics
+//	/explorer/topics/{topicId}/messages/{number}  the events carried by a topic message
+//
+//Everyone has to log in, using the accounts in the JSON file named by EXPLORER_USERS_FILE (the explorer is switched off
+// without one), e.g.
+//
+//	{
+//	  "users": [
+//	    {"username": "alice", "passwordHash": "pbkdf2-sha256$...", "tenant": "acme", "role": "auditor"},
+//	    {"username": "bob", "passwordHash": "pbkdf2-sha256$...", "tenant": "acme", "role": "viewer"}
+//	  ]
+//	}
+//
+//Each account only sees its own tenant's events. Only the roles in EXPLORER_DECRYPT_ROLES ("auditor" by default) see
+// the decrypted private sections or can search on them, and everyone else sees the private section encrypted, as it
+// is on the ledger. Password hashes are made with the explorer-password command.
+//
+//A client that fails to log in EXPLORER_LOGIN_ATTEMPTS times (5 by default) in a row, or that many times in a row for
+// the same username, can't try again for EXPLORER_LOGIN_LOCKOUT (15m by default), so passwords can't be guessed
+// through the login page
+type explorerUsersFile struct {
+	Users []struct {
+		Username     string `json:"username"`
+		PasswordHash string `json:"passwordHash"`
+		Tenant       string `json:"tenant"` //defaults to the default tenant
+		Role         string `json:"role"`
+	} `json:"users"`
+}
+
+type explorerAccount struct {
+	username     string
+	passwordHash string
+	t            *tenant
+	role         string
+	canDecrypt   bool
+}
+
+const (
+	explorerSessionCookie      = "explorer_session"
+	explorerPasswordIterations = 100000
+	explorerEventsPageSize     = 50
+	explorerMirrorTimeout      = 5 * time.Second
+	explorerPasswordKeySize    = 32
+	explorerMinPasswordKeySize = 16
+)
+
+//the explorer's accounts by username, which is nil when the explorer is switched off
+var explorerAccounts map[string]*explorerAccount
+var explorerPages *template.Template
+var explorerSessionTtl time.Duration
+
+//the logged in sessions, keyed on the random token in their cookie
+type explorerSession struct {
+	account *explorerAccount
+	expires time.Time
+}
+
+var explorerSessions = struct {
+	mutex    sync.Mutex
+	sessions map[string]explorerSession
+}{sessions: make(map[string]explorerSession)}
+
+//the failed logins in a row for each client address and each username, and until when they are locked out. The count
+// starts again once there has been no failure for EXPLORER_LOGIN_LOCKOUT
+type explorerLoginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var explorerLoginAttempts = struct {
+	mutex    sync.Mutex
+	failures map[string]*explorerLoginFailures
+}{failures: make(map[string]*explorerLoginFailures)}
+
+//explorerPage holds everything the templates in explorer.html can show. Each page only fills in its own part
+type explorerPage struct {
+	Title      string
+	Username   string
+	Role       string
+	Tenant     string
+	CanDecrypt bool
+	Error      string
+
+	//the login page
+	Next string
+
+	//the event list
+	Search   map[string]string
+	Events   []explorerEventRow
+	OlderUrl string
+
+	//the event detail page
+	Event *explorerEventDetail
+
+	//the topic overview
+	Topics []explorerTopicOverview
+}
+
+type explorerEventRow struct {
+	Url            string
+	TransactionId  string
+	Event          string
+	TopicId        string
+	SequenceNumber uint64
+	ConsensusTime  string
+}
+
+type explorerEventDetail struct {
+	TransactionId       string
+	BatchTransactionId  string
+	TopicId             string
+	SequenceNumber      uint64
+	ConsensusTimestamp  string //seconds.nanoseconds, as the mirror node gives it
+	ConsensusTime       string
+	RunningHash         string //hex encoded
+	RunningHashVerified bool
+	ReceiptStatus       string
+	ReceiptSource       string
+	KeyId               string
+	Public              string //indented JSON
+	Encrypted           string //hex encoded, as it is on the ledger
+	Decrypted           string //indented JSON, only for the roles that can decrypt
+	MessageUrl          string
+	TransactionUrl      string
+	TopicUrl            string
+}
+
+type explorerTopicOverview struct {
+	Name                   string
+	TopicId                string
+	Messages               int
+	LastSequenceNumber     uint64
+	LastConsensusTime      string
+	VerifiedSequenceNumber uint64
+	VerifiedRunningHash    string
+	Memo                   string
+	AdminKey               string
+	SubmitKey              string
+	AutoRenewAccount       string
+	AutoRenewPeriod        string
+	Deleted                bool
+	InfoError              string
+	EventsUrl              string
+	ExplorerUrl            string
+}
+
+//This function loads the explorer's accounts from EXPLORER_USERS_FILE and its templates, leaving the explorer switched
+// off if there is no users file
+func loadExplorerUi() {
+	usersFilePath := getEnv("EXPLORER_USERS_FILE", "")
+	if usersFilePath == "" {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(usersFilePath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read EXPLORER_USERS_FILE %v. Error: %v\n", usersFilePath, err))
+	}
+	var usersFile explorerUsersFile
+	if err = json.Unmarshal(contents, &usersFile); err != nil {
+		panic(fmt.Errorf("Unable to decode EXPLORER_USERS_FILE %v. Error: %v\n", usersFilePath, err))
+	}
+
+	explorerSessionTtl, err = time.ParseDuration(getEnv("EXPLORER_SESSION_TTL", "12h"))
+	if err != nil || explorerSessionTtl <= 0 {
+		panic(fmt.Errorf("EXPLORER_SESSION_TTL in demo.env should be a duration such as 12h.\n"))
+	}
+
+	var decryptRoles []string
+	for _, role := range strings.Split(getEnv("EXPLORER_DECRYPT_ROLES", "auditor"), ",") {
+		decryptRoles = append(decryptRoles, strings.TrimSpace(role))
+	}
+
+	accounts := make(map[string]*explorerAccount)
+	for _, user := range usersFile.Users {
+		if user.Username == "" || accounts[user.Username] != nil {
+			panic(fmt.Errorf("Every user in EXPLORER_USERS_FILE needs a username of their own (%q).\n", user.Username))
+		}
+		if _, _, _, err := parseExplorerPasswordHash(user.PasswordHash); err != nil {
+			panic(fmt.Errorf("Invalid passwordHash for explorer user %v (make one with the explorer-password command). Error: %v\n", user.Username, err))
+		}
+
+		tenantId := user.Tenant
+		if tenantId == "" {
+			tenantId = defaultTenantId
+		}
+		t, exists := tenantById(tenantId)
+		if !exists {
+			panic(fmt.Errorf("Explorer user %v belongs to unknown tenant %q.\n", user.Username, tenantId))
+		}
+
+		accounts[user.Username] = &explorerAccount{
+			username:     user.Username,
+			passwordHash: user.PasswordHash,
+			t:            t,
+			role:         user.Role,
+			canDecrypt:   containsString(decryptRoles, user.Role),
+		}
+	}
+
+	explorerPages, err = template.ParseFiles("explorer.html")
+	if err != nil {
+		panic(fmt.Errorf("Unable to load the explorer templates. Error: %v\n", err))
+	}
+
+	explorerAccounts = accounts
+	log.Printf("Serving the explorer at /explorer/ for %v users\n", len(accounts))
+}
+
+func explorerHandler(rw http.ResponseWriter, r *http.Request) {
+	if explorerAccounts == nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	//the pages show decrypted data, so they must never be cached or framed by another site
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Frame-Options", "DENY")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/explorer/"), "/")
+	if path == "login" {
+		explorerLoginHandler(rw, r)
+		return
+	}
+
+	account, ok := explorerSessionAccount(r)
+	if !ok {
+		http.Redirect(rw, r, "/explorer/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "logout":
+		explorerLogoutHandler(rw, r)
+	case path == "" || path == "events":
+		explorerEventsHandler(rw, r, account)
+	case len(parts) == 2 && parts[0] == "events":
+		explorerEventHandler(rw, r, account, parts[1])
+	case parts[0] == "topics" && len(parts) <= 2:
+		explorerTopicsHandler(rw, r, account, strings.Join(parts[1:], ""))
+	case len(parts) == 4 && parts[0] == "topics" && parts[2] == "messages":
+		explorerMessageHandler(rw, r, account, parts[1], parts[3])
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func explorerLoginHandler(rw http.ResponseWriter, r *http.Request) {
+	page := explorerPage{Title: "Log in", Next: r.URL.Query().Get("next")}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page.Next = r.PostForm.Get("next")
+
+		username := r.PostForm.Get("username")
+		throttled := []string{"address " + explorerClientAddress(r), "username " + username}
+		if explorerLoginLockedOut(throttled) {
+			page.Error = "Too many failed logins, please try again later"
+			renderExplorerPage(rw, http.StatusTooManyRequests, "login", page)
+			return
+		}
+
+		account, ok := checkExplorerLogin(username, r.PostForm.Get("password"))
+		explorerLoginAttempted(throttled, ok)
+		if !ok {
+			page.Error = "Incorrect username or password"
+			renderExplorerPage(rw, http.StatusUnauthorized, "login", page)
+			return
+		}
+
+		token := make([]byte, 32)
+		if _, err := rand.Read(token); err != nil {
+			panic(err)
+		}
+		session := explorerSession{account: account, expires: time.Now().Add(explorerSessionTtl)}
+
+		explorerSessions.mutex.Lock()
+		explorerSessions.sessions[hex.EncodeToString(token)] = session
+		explorerSessions.mutex.Unlock()
+
+		http.SetCookie(rw, &http.Cookie{
+			Name:     explorerSessionCookie,
+			Value:    hex.EncodeToString(token),
+			Path:     "/explorer/",
+			Expires:  session.expires,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		//only ever send the user on to another explorer page, so the login can't be used to redirect elsewhere
+		next := page.Next
+		if !strings.HasPrefix(next, "/explorer/") || strings.HasPrefix(next, "/explorer/login") {
+			next = "/explorer/"
+		}
+		http.Redirect(rw, r, next, http.StatusSeeOther)
+		return
+	}
+
+	renderExplorerPage(rw, http.StatusOK, "login", page)
+}
+
+func explorerLogoutHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "log out with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(explorerSessionCookie); err == nil {
+		explorerSessions.mutex.Lock()
+		delete(explorerSessions.sessions, cookie.Value)
+		explorerSessions.mutex.Unlock()
+	}
+
+	http.SetCookie(rw, &http.Cookie{Name: explorerSessionCookie, Value: "", Path: "/explorer/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(rw, r, "/explorer/login", http.StatusSeeOther)
+}
+
+//This function returns the account logged in to the session in the request's cookie, forgetting expired sessions
+func explorerSessionAccount(r *http.Request) (*explorerAccount, bool) {
+	cookie, err := r.Cookie(explorerSessionCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	explorerSessions.mutex.Lock()
+	defer explorerSessions.mutex.Unlock()
+
+	now := time.Now()
+	for token, session := range explorerSessions.sessions {
+		if now.After(session.expires) {
+			delete(explorerSessions.sessions, token)
+		}
+	}
+
+	session, exists := explorerSessions.sessions[cookie.Value]
+	return session.account, exists
+}
+
+//This function returns the address a request came from, without its port
+func explorerClientAddress(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+//This function returns whether logins are locked out for any of the client address and username
+func explorerLoginLockedOut(keys []string) bool {
+	explorerLoginAttempts.mutex.Lock()
+	defer explorerLoginAttempts.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if failures, exists := explorerLoginAttempts.failures[key]; exists && now.Before(failures.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+//This function records a login attempt for the client address and username, locking them out after too many
+// failures in a row
+func explorerLoginAttempted(keys []string, succeeded bool) {
+	explorerLoginAttempts.mutex.Lock()
+	defer explorerLoginAttempts.mutex.Unlock()
+
+	now := time.Now()
+	lockout := parseDurationEnv("EXPLORER_LOGIN_LOCKOUT", 15*time.Minute)
+	for key, failures := range explorerLoginAttempts.failures {
+		if now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) > lockout {
+			delete(explorerLoginAttempts.failures, key)
+		}
+	}
+
+	for _, key := range keys {
+		if succeeded {
+			delete(explorerLoginAttempts.failures, key)
+			continue
+		}
+
+		failures, exists := explorerLoginAttempts.failures[key]
+		if !exists {
+			failures = &explorerLoginFailures{}
+			explorerLoginAttempts.failures[key] = failures
+		}
+		failures.count++
+		failures.lastFailure = now
+		if failures.count >= int(parseFloatEnv("EXPLORER_LOGIN_ATTEMPTS", 5)) {
+			failures.count = 0
+			failures.lockedUntil = now.Add(lockout)
+			log.Printf("Locked out explorer logins for %v after too many failures\n", key)
+			metrics.addCounter(series("hcs_explorer_login_lockouts_total"), "Explorer logins locked out after too many failures", 1)
+		}
+	}
+}
+
+//This function checks a username and password, taking as long for an unknown username as for a known one
+func checkExplorerLogin(username string, password string) (*explorerAccount, bool) {
+	account := explorerAccounts[username]
+	passwordHash := "pbkdf2-sha256$" + strconv.Itoa(explorerPasswordIterations) + "$00$" + strings.Repeat("00", explorerPasswordKeySize)
+	if account != nil {
+		passwordHash = account.passwordHash
+	}
+
+	iterations, salt, key, err := parseExplorerPasswordHash(passwordHash)
+	if err != nil {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New), key) != 1 || account == nil {
+		return nil, false
+	}
+	return account, true
+}
+
+//This function hashes a password for EXPLORER_USERS_FILE, as pbkdf2-sha256$iterations$salt$key
+func hashExplorerPassword(password string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key := pbkdf2.Key([]byte(password), salt, explorerPasswordIterations, explorerPasswordKeySize, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%v$%x$%x", explorerPasswordIterations, salt, key)
+}
+
+func parseExplorerPasswordHash(passwordHash string) (int, []byte, []byte, error) {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, fmt.Errorf("the hash should look like pbkdf2-sha256$iterations$salt$key")
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid iterations %q", parts[1])
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("the salt is not hex encoded")
+	}
+	key, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("the key is not hex encoded")
+	}
+	if len(key) < explorerMinPasswordKeySize {
+		return 0, nil, nil, fmt.Errorf("the key should be at least %v bytes", explorerMinPasswordKeySize)
+	}
+	return iterations, salt, key, nil
+}
+
+//This function renders one of the templates in explorer.html
+func renderExplorerPage(rw http.ResponseWriter, status int, name string, page explorerPage) {
+	var body bytes.Buffer
+	if err := explorerPages.ExecuteTemplate(&body, name, page); err != nil {
+		log.Printf("Unable to render explorer page %v. Error: %v\n", name, err)
+		http.Error(rw, "unable to render the page", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	_, _ = body.WriteTo(rw)
+}
+
+func newExplorerPage(account *explorerAccount, title string) explorerPage {
+	return explorerPage{
+		Title:      title,
+		Username:   account.username,
+		Role:       account.role,
+		Tenant:     account.t.id,
+		CanDecrypt: account.canDecrypt,
+	}
+}
+
+//This function shows the events matching the search, newest first. The search takes the same filters as /events
+// (see events.go) along with a transaction ID to go straight to
+func explorerEventsHandler(rw http.ResponseWriter, r *http.Request, account *explorerAccount) {
+	page := newExplorerPage(account, "Events")
+	params := r.URL.Query()
+
+	page.Search = make(map[string]string)
+	for _, name := range []string{"transactionId", "event", "topic", "from", "to", "fromSequence", "toSequence", "session", "videoUrl"} {
+		page.Search[name] = params.Get(name)
+	}
+
+	if transactionId := strings.TrimSpace(params.Get("transactionId")); transactionId != "" {
+		if _, exists := tenantEvent(account.t, transactionId); exists {
+			http.Redirect(rw, r, explorerEventPath(transactionId), http.StatusSeeOther)
+			return
+		}
+		page.Error = fmt.Sprintf("There is no event with the transaction ID %v", transactionId)
+	}
+
+	//searching on the private section would give away what it holds
+	if !account.canDecrypt && (params.Get("session") != "" || params.Get("videoUrl") != "") {
+		page.Error = "Your role can't search the private sections of events"
+		renderExplorerPage(rw, http.StatusForbidden, "events", page)
+		return
+	}
+
+	filter, err := parseEventFilter(account.t, params)
+	if err != nil {
+		page.Error = err.Error()
+		renderExplorerPage(rw, http.StatusBadRequest, "events", page)
+		return
+	}
+
+	//walk back through the consensus ordered view from the cursor, which is the oldest event shown so far (or from the
+	// end of the time range, as every message on a topic comes after the key with a blank topic)
+	before := orderedKey{ConsensusTimestamp: math.MaxInt64}
+	if filter.toTimestamp != 0 {
+		before.ConsensusTimestamp = filter.toTimestamp
+	}
+	if cursor := params.Get("before"); cursor != "" {
+		before, err = decodeEventsCursor(cursor)
+		if err != nil {
+			page.Error = err.Error()
+			renderExplorerPage(rw, http.StatusBadRequest, "events", page)
+			return
+		}
+	}
+
+	done, hasOlder := false, false
+	for !done {
+		messages := eventStore.orderedBefore(before, maxEventsPageSize)
+		if len(messages) == 0 {
+			break
+		}
+
+		for i := len(messages) - 1; i >= 0; i-- {
+			//everything from here back is before the time range
+			if filter.fromTimestamp != 0 && gjson.Get(messages[i], "hcs.consensusTimestamp").Int() < filter.fromTimestamp {
+				done = true
+				break
+			}
+
+			if len(page.Events) == explorerEventsPageSize {
+				hasOlder = true
+				done = true
+				break
+			}
+
+			before = orderedKeyOf(messages[i])
+			if filter.matches(messages[i]) {
+				page.Events = append(page.Events, newExplorerEventRow(messages[i]))
+			}
+		}
+	}
+
+	if hasOlder {
+		older := url.Values{}
+		for name, value := range page.Search {
+			if value != "" && name != "transactionId" {
+				older.Set(name, value)
+			}
+		}
+		older.Set("before", encodeEventsCursor(before))
+		page.OlderUrl = "/explorer/events?" + older.Encode()
+	}
+
+	renderExplorerPage(rw, http.StatusOK, "events", page)
+}
+
+func newExplorerEventRow(messageJson string) explorerEventRow {
+	event := gjson.Parse(messageJson)
+	transactionId := event.Get("public.transactionId").String()
+
+	return explorerEventRow{
+		Url:            explorerEventPath(transactionId),
+		TransactionId:  transactionId,
+		Event:          event.Get("public.event").String(),
+		TopicId:        event.Get("hcs.topicId").String(),
+		SequenceNumber: event.Get("hcs.sequenceNumber").Uint(),
+		ConsensusTime:  time.Unix(0, event.Get("hcs.consensusTimestamp").Int()).UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func explorerEventPath(transactionId string) string {
+	return "/explorer/events/" + url.PathEscape(transactionId)
+}
+
+func explorerMessagePath(topicId string, sequenceNumber uint64) string {
+	return fmt.Sprintf("/explorer/topics/%v/messages/%v", url.PathEscape(topicId), sequenceNumber)
+}
+
+//This function shows a single event, along with the consensus details of the message that carried it
+func explorerEventHandler(rw http.ResponseWriter, r *http.Request, account *explorerAccount, transactionId string) {
+	messageJson, exists := tenantEvent(account.t, transactionId)
+
+	//a batch's transaction carried several events, which are listed on the page of the message it submitted. Links to
+	// a batched event's transaction on this explorer (see explorer.go) come here
+	if first, isBatch := tenantEvent(account.t, transactionId+"-0"); !exists && isBatch && gjson.Get(first, "hcs.batchTransactionId").String() == transactionId {
+		http.Redirect(rw, r, explorerMessagePath(gjson.Get(first, "hcs.topicId").String(), gjson.Get(first, "hcs.sequenceNumber").Uint()), http.StatusSeeOther)
+		return
+	}
+
+	if !exists {
+		page := newExplorerPage(account, "Event not found")
+		page.Error = fmt.Sprintf("There is no event with the transaction ID %v", transactionId)
+		renderExplorerPage(rw, http.StatusNotFound, "error", page)
+		return
+	}
+
+	event := gjson.Parse(messageJson)
+	detail := &explorerEventDetail{
+		TransactionId:      transactionId,
+		BatchTransactionId: event.Get("hcs.batchTransactionId").String(),
+		TopicId:            event.Get("hcs.topicId").String(),
+		SequenceNumber:     event.Get("hcs.sequenceNumber").Uint(),
+		ConsensusTime:      time.Unix(0, event.Get("hcs.consensusTimestamp").Int()).UTC().Format(time.RFC3339Nano),
+		KeyId:              event.Get("public.keyId").String(),
+		Public:             indentExplorerJson(event.Get("public").Raw),
+	}
+	detail.MessageUrl = explorer.MessageUrl(detail.TopicId, detail.SequenceNumber)
+	detail.TopicUrl = explorer.TopicUrl(detail.TopicId)
+
+	//the private section is only shown decrypted to the roles that are allowed to see it
+	if account.canDecrypt {
+		detail.Decrypted = indentExplorerJson(event.Get("private").Raw)
+	}
+
+	//the encrypted section and running hash come from the message as it arrived from the mirror node
+	if message, found := eventStore.topicMessage(detail.TopicId, detail.SequenceNumber); found {
+		detail.ConsensusTimestamp = message.ConsensusTimestamp
+		detail.RunningHash = hex.EncodeToString(message.RunningHash)
+		detail.Encrypted = encryptedSection(message.Message, transactionId)
+	}
+	if head, exists := runningHashes.head(detail.TopicId); exists && detail.SequenceNumber <= head.SequenceNumber {
+		detail.RunningHashVerified = true
+	}
+
+	//a batched event was carried by its batch's transaction
+	carryingTransactionId := transactionId
+	if detail.BatchTransactionId != "" {
+		carryingTransactionId = detail.BatchTransactionId
+	}
+	detail.TransactionUrl = explorer.TransactionUrl(carryingTransactionId)
+
+	ctx, cancel := context.WithTimeout(r.Context(), explorerMirrorTimeout)
+	defer cancel()
+	detail.ReceiptStatus, detail.ReceiptSource = explorerReceiptStatus(ctx, carryingTransactionId)
+
+	page := newExplorerPage(account, "Event "+transactionId)
+	page.Event = detail
+	renderExplorerPage(rw, http.StatusOK, "event", page)
+}
+
+//This function returns an event's private section as it is in the message on the ledger, picking the event out of a
+// batch message. The events of a batch share the batch's private section, which is encrypted as one
+func encryptedSection(message []byte, transactionId string) string {
+	if batch := gjson.GetBytes(message, "batch"); batch.IsArray() {
+		for _, event := range batch.Array() {
+			if event.Get("public.transactionId").String() == transactionId {
+				return gjson.GetBytes(message, "private").String()
+			}
+		}
+		return ""
+	}
+	return gjson.GetBytes(message, "private").String()
+}
+
+//This function returns the status of the transaction that carried an event, and where the status came from
+func explorerReceiptStatus(ctx context.Context, transactionId string) (string, string) {
+	client := newMirrorRestClient()
+	if client.baseUrl != "" {
+		if transaction, err := client.transaction(ctx, transactionId); err == nil {
+			return transaction.Result, "from the mirror node"
+		}
+	}
+
+	//only a successful transaction puts a message on the topic
+	return "SUCCESS", "implied by the message reaching consensus"
+}
+
+func indentExplorerJson(raw string) string {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(raw), "", "  "); err != nil {
+		return raw
+	}
+	return indented.String()
+}
+
+//This function shows an overview of the tenant's topics, or of just one of them
+func explorerTopicsHandler(rw http.ResponseWriter, r *http.Request, account *explorerAccount, only string) {
+	page := newExplorerPage(account, "Topics")
+	client := newMirrorRestClient()
+
+	for _, tenantTopic := range account.t.topics {
+		topicId := tenantTopic.topicId.String()
+		if only != "" && only != topicId {
+			continue
+		}
+
+		overview := explorerTopicOverview{
+			Name:        tenantTopic.name,
+			TopicId:     topicId,
+			EventsUrl:   "/explorer/events?topic=" + url.QueryEscape(topicId),
+			ExplorerUrl: explorer.TopicUrl(topicId),
+		}
+
+		if last, count, exists := eventStore.lastTopicMessage(topicId); exists {
+			overview.Messages = count
+			overview.LastSequenceNumber = last.SequenceNumber
+			if consensusTimestamp, err := parseConsensusTimestamp(last.ConsensusTimestamp); err == nil {
+				overview.LastConsensusTime = consensusTimestamp.UTC().Format(time.RFC3339Nano)
+			}
+		}
+		if head, exists := runningHashes.head(topicId); exists {
+			overview.VerifiedSequenceNumber = head.SequenceNumber
+			overview.VerifiedRunningHash = head.RunningHash
+		}
+
+		if client.baseUrl == "" {
+			overview.InfoError = "The topic's details need MIRROR_REST_URL to be set"
+		} else {
+			ctx, cancel := context.WithTimeout(r.Context(), explorerMirrorTimeout)
+			info, err := client.topicInfo(ctx, topicId)
+			cancel()
+			if err != nil {
+				overview.InfoError = fmt.Sprintf("Unable to look up the topic's details: %v", err)
+			} else {
+				overview.Memo = info.Memo
+				overview.AutoRenewAccount = info.AutoRenewAccount
+				overview.AutoRenewPeriod = (time.Duration(info.AutoRenewPeriod) * time.Second).String()
+				overview.Deleted = info.Deleted
+				if info.AdminKey != nil {
+					overview.AdminKey = info.AdminKey.Key
+				}
+				if info.SubmitKey != nil {
+					overview.SubmitKey = info.SubmitKey.Key
+				}
+			}
+		}
+
+		page.Topics = append(page.Topics, overview)
+	}
+
+	if only != "" && len(page.Topics) == 0 {
+		page.Error = fmt.Sprintf("Topic %v does not belong to this tenant", only)
+		renderExplorerPage(rw, http.StatusNotFound, "error", page)
+		return
+	}
+
+	renderExplorerPage(rw, http.StatusOK, "topics", page)
+}
+
+//This function shows the events carried by a topic message, going straight to the event if there is only one
+func explorerMessageHandler(rw http.ResponseWriter, r *http.Request, account *explorerAccount, topic string, sequenceNumberString string) {
+	page := newExplorerPage(account, "Message "+sequenceNumberString+" on topic "+topic)
+
+	sequenceNumber, err := strconv.ParseUint(sequenceNumberString, 10, 64)
+	if err == nil {
+		topic, err = resolveExportTopic([]*tenant{account.t}, topic)
+	}
+	if err != nil || topic == "" {
+		page.Error = fmt.Sprintf("There is no message %v on this tenant's topic %v", sequenceNumberString, topic)
+		renderExplorerPage(rw, http.StatusNotFound, "error", page)
+		return
+	}
+
+	events := eventStore.eventsInMessage(topic, sequenceNumber)
+	switch len(events) {
+	case 0:
+		page.Error = fmt.Sprintf("Message %v on topic %v is not in the event store", sequenceNumber, topic)
+		renderExplorerPage(rw, http.StatusNotFound, "error", page)
+	case 1:
+		http.Redirect(rw, r, explorerEventPath(gjson.Get(events[0], "public.transactionId").String()), http.StatusSeeOther)
+	default:
+		for _, messageJson := range events {
+			page.Events = append(page.Events, newExplorerEventRow(messageJson))
+		}
+		renderExplorerPage(rw, http.StatusOK, "events", page)
+	}
+}
+
+//This function runs the explorer-password command, which hashes a password (read from standard input) for
+// EXPLORER_USERS_FILE
+func explorerPasswordCommand(args []string) {
+	flags := flag.NewFlagSet("explorer-password", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	fmt.Fprintf(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		panic(fmt.Errorf("Please enter a password to hash. Error: %v\n", err))
+	}
+
+	fmt.Println(hashExplorerPassword(password))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//This function switches the explorer on for a test with an auditor and a viewer for acme, and an auditor for globex,
+// each with the password "password"
+func useTestExplorer(t *testing.T) (*tenant, *tenant) {
+	useTestPipeline(t, testTopics("0.0.1", "0.0.2"))
+
+	savedAccounts, savedPages, savedTtl := explorerAccounts, explorerPages, explorerSessionTtl
+	t.Cleanup(func() {
+		explorerAccounts, explorerPages, explorerSessionTtl = savedAccounts, savedPages, savedTtl
+		explorerSessions.sessions = make(map[string]explorerSession)
+		explorerLoginAttempts.failures = make(map[string]*explorerLoginFailures)
+	})
+	t.Setenv("MIRROR_REST_URL", "")
+
+	acme, globex := testTenant("0.0.1"), testTenant("0.0.2")
+	acme.id, globex.id = "acme", "globex"
+
+	//a low iteration count keeps the tests quick
+	passwordHash := "pbkdf2-sha256$1$73616c74$120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"
+	explorerAccounts = map[string]*explorerAccount{
+		"alice": {username: "alice", passwordHash: passwordHash, t: acme, role: "auditor", canDecrypt: true},
+		"bob":   {username: "bob", passwordHash: passwordHash, t: acme, role: "viewer"},
+		"carol": {username: "carol", passwordHash: passwordHash, t: globex, role: "auditor", canDecrypt: true},
+	}
+	explorerPages = template.Must(template.ParseFiles("explorer.html"))
+	explorerSessionTtl = time.Hour
+
+	for _, event := range []struct {
+		t             *tenant
+		topic         string
+		transactionId string
+	}{{acme, "0.0.1", testTransactionId(1)}, {globex, "0.0.2", testTransactionId(2)}} {
+		messageJson := fmt.Sprintf(`{"public":{"event":"start","transactionId":"%v"},"private":{"session":"session-%v","videoUrl":"secret-%v.mp4"},"hcs":{"tenant":"%v","topicId":"%v","sequenceNumber":1,"consensusTimestamp":1590000000000000000}}`, event.transactionId, event.t.id, event.t.id, event.t.id, event.topic)
+		eventStore.putConfirmed(event.topic, event.transactionId, messageJson)
+		eventStore.putOrdered(messageJson)
+	}
+
+	//a batch of two events, sent by acme in one message
+	batchTransactionId := testTransactionId(3)
+	for index := 0; index < 2; index++ {
+		messageJson := fmt.Sprintf(`{"public":{"event":"start","transactionId":"%v-%v"},"private":{},"hcs":{"tenant":"acme","topicId":"0.0.1","sequenceNumber":2,"consensusTimestamp":1590000001000000000,"batchTransactionId":"%v"}}`, batchTransactionId, index, batchTransactionId)
+		eventStore.putConfirmed("0.0.1", fmt.Sprintf("%v-%v", batchTransactionId, index), messageJson)
+		eventStore.putOrdered(messageJson)
+	}
+	return acme, globex
+}
+
+//This function logs in to the explorer, returning the response
+func explorerLogin(username string, password string, remoteAddr string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}, "next": {"/explorer/events"}}
+	request := httptest.NewRequest(http.MethodPost, "/explorer/login", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	explorerHandler(recorder, request)
+	return recorder
+}
+
+//This function requests an explorer page as a logged in user
+func explorerGet(t *testing.T, username string, path string) *httptest.ResponseRecorder {
+	login := explorerLogin(username, "password", "192.0.2.1:1234")
+	if login.Code != http.StatusSeeOther {
+		t.Fatalf("%v couldn't log in: %v", username, login.Code)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, cookie := range login.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	explorerHandler(recorder, request)
+	return recorder
+}
+
+func TestExplorerPasswordHash(t *testing.T) {
+	//the PBKDF2-HMAC-SHA256 test vectors from RFC 7914 section 11
+	tests := []struct {
+		password     string
+		passwordHash string
+	}{
+		{password: "passwd", passwordHash: "pbkdf2-sha256$1$73616c74$55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{password: "Password", passwordHash: "pbkdf2-sha256$80000$4e61436c$4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.password, func(t *testing.T) {
+			explorerAccounts = map[string]*explorerAccount{"alice": {username: "alice", passwordHash: test.passwordHash}}
+			defer func() { explorerAccounts = nil }()
+
+			if _, ok := checkExplorerLogin("alice", test.password); !ok {
+				t.Errorf("the password doesn't match its RFC 7914 hash")
+			}
+			if _, ok := checkExplorerLogin("alice", test.password+"!"); ok {
+				t.Errorf("a different password matched")
+			}
+		})
+	}
+
+	//a hash made by the explorer-password command checks out, and a key too short to be safe is refused
+	explorerAccounts = map[string]*explorerAccount{"alice": {username: "alice", passwordHash: hashExplorerPassword("hunter2")}}
+	defer func() { explorerAccounts = nil }()
+	if _, ok := checkExplorerLogin("alice", "hunter2"); !ok {
+		t.Errorf("the password doesn't match its hash")
+	}
+	if _, _, _, err := parseExplorerPasswordHash("pbkdf2-sha256$1$00$"); err == nil {
+		t.Errorf("expected a hash without a key to be invalid")
+	}
+}
+
+func TestExplorerLogin(t *testing.T) {
+	useTestExplorer(t)
+	t.Setenv("EXPLORER_LOGIN_ATTEMPTS", "3")
+
+	if response := explorerLogin("alice", "wrong", "192.0.2.1:1234"); response.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong password got %v, expected %v", response.Code, http.StatusUnauthorized)
+	}
+	if response := explorerLogin("nobody", "password", "192.0.2.1:1234"); response.Code != http.StatusUnauthorized {
+		t.Errorf("an unknown username got %v, expected %v", response.Code, http.StatusUnauthorized)
+	}
+
+	response := explorerLogin("alice", "password", "192.0.2.1:1234")
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/explorer/events" {
+		t.Fatalf("logging in got %v to %v, expected a redirect to /explorer/events", response.Code, response.Header().Get("Location"))
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != explorerSessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected an HttpOnly session cookie, got %v", cookies)
+	}
+
+	//the session logs the user in until it expires
+	request := httptest.NewRequest(http.MethodGet, "/explorer/", nil)
+	request.AddCookie(cookies[0])
+	if account, ok := explorerSessionAccount(request); !ok || account.username != "alice" {
+		t.Errorf("the session isn't logged in as alice")
+	}
+	explorerSessions.mutex.Lock()
+	session := explorerSessions.sessions[cookies[0].Value]
+	session.expires = time.Now().Add(-time.Second)
+	explorerSessions.sessions[cookies[0].Value] = session
+	explorerSessions.mutex.Unlock()
+	if _, ok := explorerSessionAccount(request); ok {
+		t.Errorf("an expired session is still logged in")
+	}
+
+	//without a session, every page sends the user to log in
+	recorder := httptest.NewRecorder()
+	explorerHandler(recorder, httptest.NewRequest(http.MethodGet, "/explorer/events", nil))
+	if recorder.Code != http.StatusSeeOther || !strings.HasPrefix(recorder.Header().Get("Location"), "/explorer/login") {
+		t.Errorf("without a session got %v to %v, expected a redirect to the login page", recorder.Code, recorder.Header().Get("Location"))
+	}
+}
+
+func TestExplorerLoginThrottling(t *testing.T) {
+	useTestExplorer(t)
+	t.Setenv("EXPLORER_LOGIN_ATTEMPTS", "3")
+	t.Setenv("EXPLORER_LOGIN_LOCKOUT", "1h")
+
+	//guessing from one address locks it out, even with the right password
+	for i := 0; i < 3; i++ {
+		explorerLogin("alice", fmt.Sprintf("guess-%v", i), "192.0.2.1:1234")
+	}
+	if response := explorerLogin("bob", "password", "192.0.2.1:1234"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("a locked out address got %v, expected %v", response.Code, http.StatusTooManyRequests)
+	}
+
+	//and guessing one username's password from many addresses locks that username out
+	for i := 0; i < 3; i++ {
+		explorerLogin("carol", "guess", fmt.Sprintf("198.51.100.%v:1234", i))
+	}
+	if response := explorerLogin("carol", "password", "203.0.113.1:1234"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("a locked out username got %v, expected %v", response.Code, http.StatusTooManyRequests)
+	}
+	if response := explorerLogin("bob", "password", "203.0.113.1:1234"); response.Code != http.StatusSeeOther {
+		t.Errorf("another username from another address got %v, expected %v", response.Code, http.StatusSeeOther)
+	}
+
+	//a successful login starts the count again
+	explorerLogin("bob", "guess", "203.0.113.2:1234")
+	explorerLogin("bob", "guess", "203.0.113.2:1234")
+	explorerLogin("bob", "password", "203.0.113.2:1234")
+	explorerLogin("bob", "guess", "203.0.113.2:1234")
+	if response := explorerLogin("bob", "password", "203.0.113.2:1234"); response.Code != http.StatusSeeOther {
+		t.Errorf("logging in after a success got %v, expected %v", response.Code, http.StatusSeeOther)
+	}
+}
+
+func TestExplorerRolesAndTenants(t *testing.T) {
+	useTestExplorer(t)
+
+	tests := []struct {
+		name     string
+		username string
+		path     string
+		status   int
+		shows    []string
+		hides    []string
+	}{
+		{name: "an auditor sees the decrypted section", username: "alice", path: explorerEventPath(testTransactionId(1)), status: http.StatusOK, shows: []string{"secret-acme.mp4"}},
+		{name: "a viewer sees only the encrypted section", username: "bob", path: explorerEventPath(testTransactionId(1)), status: http.StatusOK, hides: []string{"secret-acme.mp4", "session-acme"}},
+		{name: "an auditor can search the private sections", username: "alice", path: "/explorer/events?session=session-acme", status: http.StatusOK, shows: []string{testTransactionId(1)}},
+		{name: "a viewer can't search the private sections", username: "bob", path: "/explorer/events?session=session-acme", status: http.StatusForbidden, hides: []string{testTransactionId(1)}},
+		{name: "a viewer can't search by video either", username: "bob", path: "/explorer/events?videoUrl=secret-acme.mp4", status: http.StatusForbidden, hides: []string{testTransactionId(1)}},
+		{name: "the event list only holds the tenant's events", username: "alice", path: "/explorer/events", status: http.StatusOK, shows: []string{testTransactionId(1)}, hides: []string{testTransactionId(2)}},
+		{name: "another tenant's event isn't found", username: "alice", path: explorerEventPath(testTransactionId(2)), status: http.StatusNotFound, hides: []string{"secret-globex.mp4"}},
+		{name: "another tenant's topic isn't found", username: "alice", path: "/explorer/topics/0.0.2", status: http.StatusNotFound},
+		{name: "another tenant's message isn't found", username: "alice", path: "/explorer/topics/0.0.2/messages/1", status: http.StatusNotFound},
+		{name: "a batch's transaction goes to its message", username: "alice", path: explorerEventPath(testTransactionId(3)), status: http.StatusSeeOther},
+		{name: "a batch's message lists its events", username: "alice", path: explorerMessagePath("0.0.1", 2), status: http.StatusOK, shows: []string{testTransactionId(3) + "-0", testTransactionId(3) + "-1"}},
+		{name: "another tenant's batch isn't found", username: "carol", path: explorerEventPath(testTransactionId(3)), status: http.StatusNotFound},
+		{name: "each tenant sees its own events", username: "carol", path: explorerEventPath(testTransactionId(2)), status: http.StatusOK, shows: []string{"secret-globex.mp4"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := explorerGet(t, test.username, test.path)
+			if response.Code != test.status {
+				t.Fatalf("got %v, expected %v: %v", response.Code, test.status, response.Body)
+			}
+			if test.status == http.StatusSeeOther && response.Header().Get("Location") != explorerMessagePath("0.0.1", 2) {
+				t.Errorf("redirected to %v, expected %v", response.Header().Get("Location"), explorerMessagePath("0.0.1", 2))
+			}
+			body := response.Body.String()
+			for _, shown := range test.shows {
+				if !strings.Contains(body, shown) {
+					t.Errorf("expected the page to show %q", shown)
+				}
+			}
+			for _, hidden := range test.hides {
+				if strings.Contains(body, hidden) {
+					t.Errorf("expected the page not to show %q", hidden)
+				}
+			}
+		})
+	}
+}
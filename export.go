@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/parquet-go/parquet-go"
+	"github.com/tidwall/gjson"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Exports dump the audit trail as NDJSON, CSV or Parquet, one row per event, for compliance. The export command always
+// replays the topics from the mirror node, whilst /events/export reads the web-server's event store unless it is given
+// source=mirror. Both take:
+//
+//	format           ndjson (the default), csv or parquet
+//	columns          a comma separated list of the columns to include (see exportColumns)
+//	include-private  include the decrypted private fields, which are left out by default
+//	redact           a comma separated list of columns whose values are replaced with REDACTED
+//	from, to         a consensus time window
+//	topic            a topic ID or routed topic name to export, rather than every topic
+//
+//A mirror replay exports each topic in turn, in sequence number order, whilst the event store is exported in
+// consensus timestamp order
+
+//an exportColumn is a column that can be exported, read from the processed event JSON
+type exportColumn struct {
+	name    string
+	path    string
+	private bool
+}
+
+var exportColumns = []exportColumn{
+	{name: "consensusTimestamp", path: "hcs.consensusTimestamp"},
+	{name: "sequenceNumber", path: "hcs.sequenceNumber"},
+	{name: "topicId", path: "hcs.topicId"},
+	{name: "tenant", path: "hcs.tenant"},
+	{name: "batchTransactionId", path: "hcs.batchTransactionId"},
+	{name: "transactionId", path: "public.transactionId"},
+	{name: "event", path: "public.event"},
+	{name: "timestamp", path: "public.timestamp"},
+	{name: "timezoneOffset", path: "public.tzOffset"},
+	{name: "keyId", path: "public.keyId"},
+	{name: "additionalInfo", path: "private.secretMessage", private: true},
+	{name: "videoCurrentTime", path: "private.videoCurrentTime", private: true},
+	{name: "videoDuration", path: "private.videoDuration", private: true},
+	{name: "videoUrl", path: "private.videoUrl", private: true},
+	{name: "userAgent", path: "private.userAgent", private: true},
+	{name: "campaign", path: "private.campaign", private: true},
+	{name: "advertiser", path: "private.advertiser", private: true},
+	{name: "session", path: "private.session", private: true},
+}
+
+const redactedValue = "REDACTED"
+
+type exportOptions struct {
+	format         string
+	columns        []exportColumn
+	redact         map[string]bool
+	fromTimestamp  int64
+	toTimestamp    int64
+	topic          string
+	includePrivate bool
+}
+
+//This function builds the export options from the names of the columns to include and to redact. Without any
+// columns, every public column is included, along with every private column if includePrivate is set
+func newExportOptions(format string, columnNames string, redactNames string, includePrivate bool) (exportOptions, error) {
+	options := exportOptions{format: format, redact: make(map[string]bool), includePrivate: includePrivate}
+
+	if format != "ndjson" && format != "csv" && format != "parquet" {
+		return exportOptions{}, fmt.Errorf("unknown format %q, should be ndjson, csv or parquet", format)
+	}
+
+	for _, name := range splitList(columnNames) {
+		column, exists := findExportColumn(name)
+		if !exists {
+			return exportOptions{}, fmt.Errorf("unknown column %q", name)
+		}
+		if column.private && !includePrivate {
+			return exportOptions{}, fmt.Errorf("column %q is private, so the private fields must be included to export it", name)
+		}
+		options.columns = append(options.columns, column)
+	}
+
+	if len(options.columns) == 0 {
+		for _, column := range exportColumns {
+			if !column.private || includePrivate {
+				options.columns = append(options.columns, column)
+			}
+		}
+	}
+
+	for _, name := range splitList(redactNames) {
+		if _, exists := findExportColumn(name); !exists {
+			return exportOptions{}, fmt.Errorf("unknown column %q", name)
+		}
+		options.redact[name] = true
+	}
+
+	return options, nil
+}
+
+func findExportColumn(name string) (exportColumn, bool) {
+	for _, column := range exportColumns {
+		if column.name == name {
+			return column, true
+		}
+	}
+	return exportColumn{}, false
+}
+
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+//This function returns the row for an event, or false if it is outside the time window
+func (o exportOptions) row(messageJson string) ([]string, bool) {
+	message := gjson.Parse(messageJson)
+
+	consensusTimestamp := message.Get("hcs.consensusTimestamp").Int()
+	if (o.fromTimestamp != 0 && consensusTimestamp < o.fromTimestamp) || (o.toTimestamp != 0 && consensusTimestamp >= o.toTimestamp) {
+		return nil, false
+	}
+	if o.topic != "" && message.Get("hcs.topicId").String() != o.topic {
+		return nil, false
+	}
+
+	row := make([]string, len(o.columns))
+	for i, column := range o.columns {
+		switch {
+		case o.redact[column.name]:
+			row[i] = redactedValue
+		case column.name == "consensusTimestamp":
+			row[i] = time.Unix(0, consensusTimestamp).UTC().Format(time.RFC3339Nano)
+		default:
+			row[i] = message.Get(column.path).String()
+		}
+	}
+	return row, true
+}
+
+//an exportWriter writes the rows of an export in one of the formats
+type exportWriter interface {
+	write(row []string) error
+	close() error
+}
+
+func newExportWriter(w io.Writer, options exportOptions) (exportWriter, error) {
+	names := make([]string, len(options.columns))
+	for i, column := range options.columns {
+		names[i] = column.name
+	}
+
+	switch options.format {
+	case "csv":
+		writer := &csvExportWriter{writer: csv.NewWriter(w)}
+		return writer, writer.writer.Write(names)
+	case "parquet":
+		return newParquetExportWriter(w, names), nil
+	}
+	return &ndjsonExportWriter{encoder: json.NewEncoder(w), names: names}, nil
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+	names   []string
+}
+
+func (n *ndjsonExportWriter) write(row []string) error {
+	object := make(map[string]string, len(row))
+	for i, value := range row {
+		object[n.names[i]] = value
+	}
+	return n.encoder.Encode(object)
+}
+
+func (n *ndjsonExportWriter) close() error {
+	return nil
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (c *csvExportWriter) write(row []string) error {
+	return c.writer.Write(row)
+}
+
+func (c *csvExportWriter) close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+//every column is written to Parquet as a string. Parquet orders the columns of a group by name, so each value is
+// written to the column index of its name in that order
+type parquetExportWriter struct {
+	writer        *parquet.Writer
+	columnIndexes []int
+}
+
+func newParquetExportWriter(w io.Writer, names []string) *parquetExportWriter {
+	group := parquet.Group{}
+	for _, name := range names {
+		group[name] = parquet.String()
+	}
+
+	sortedNames := append([]string(nil), names...)
+	sort.Strings(sortedNames)
+
+	columnIndexes := make([]int, len(names))
+	for i, name := range names {
+		columnIndexes[i] = sort.SearchStrings(sortedNames, name)
+	}
+
+	return &parquetExportWriter{
+		writer:        parquet.NewWriter(w, parquet.NewSchema("event", group)),
+		columnIndexes: columnIndexes,
+	}
+}
+
+func (p *parquetExportWriter) write(row []string) error {
+	values := make(parquet.Row, len(row))
+	for i, value := range row {
+		values[p.columnIndexes[i]] = parquet.ByteArrayValue([]byte(value)).Level(0, 0, p.columnIndexes[i])
+	}
+	_, err := p.writer.WriteRows([]parquet.Row{values})
+	return err
+}
+
+func (p *parquetExportWriter) close() error {
+	return p.writer.Close()
+}
+
+//This function exports the events in the event store for a tenant, paging through the consensus ordered view by key
+// so that messages being backfilled at the same time don't make it skip or repeat events
+func exportFromStore(t *tenant, options exportOptions, writer exportWriter) error {
+	after := orderedKey{ConsensusTimestamp: options.fromTimestamp}
+
+	for {
+		messages := eventStore.orderedAfter(after, 1000)
+		if len(messages) == 0 {
+			return nil
+		}
+		after = orderedKeyOf(messages[len(messages)-1])
+
+		for _, messageJson := range messages {
+			if gjson.Get(messageJson, "hcs.tenant").String() != t.id {
+				continue
+			}
+			if row, ok := options.row(messageJson); ok {
+				if err := writer.write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+//This function exports a tenant's topics by replaying them from the mirror node
+func exportFromMirror(t *tenant, options exportOptions, writer exportWriter) error {
+	var from, to time.Time
+	if options.fromTimestamp != 0 {
+		from = time.Unix(0, options.fromTimestamp)
+	}
+	if options.toTimestamp != 0 {
+		to = time.Unix(0, options.toTimestamp)
+	}
+
+	for _, topic := range t.topics {
+		if options.topic != "" && options.topic != topic.topicId.String() {
+			continue
+		}
+
+		var writeErr error
+		err := replayTopic(topic.topicId, from, to, func(response hedera.MirrorConsensusTopicResponse) {
+			for _, messageJson := range decodeTopicResponse(t, topic.topicId, response) {
+				if row, ok := options.row(messageJson); ok && writeErr == nil {
+					writeErr = writer.write(row)
+				}
+			}
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//This function resolves a topic given as a topic ID or routed topic name, across the given tenants
+func resolveExportTopic(exportTenants []*tenant, topic string) (string, error) {
+	if topic == "" {
+		return "", nil
+	}
+	for _, t := range exportTenants {
+		for _, tenantTopic := range t.topics {
+			if topic == tenantTopic.name || topic == tenantTopic.topicId.String() {
+				return tenantTopic.topicId.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown topic %q", topic)
+}
+
+//This function runs the export command, which replays the topics from the mirror node into an export file
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "the export format: ndjson, csv or parquet")
+	columns := flags.String("columns", "", "a comma separated list of the columns to export (defaults to all of them)")
+	includePrivate := flags.Bool("include-private", false, "include the decrypted private fields")
+	redact := flags.String("redact", "", "a comma separated list of the columns to redact")
+	fromString := flags.String("from", "", "only export events from this RFC3339 time, date or unix nanosecond timestamp")
+	toString := flags.String("to", "", "only export events before this RFC3339 time, date or unix nanosecond timestamp")
+	topic := flags.String("topic", "", "only export this topic ID or routed topic name")
+	tenantId := flags.String("tenant", "", "only export this tenant's topics")
+	outFile := flags.String("out", "", "the file to write the export to (defaults to standard output)")
+	_ = flags.Parse(args)
+
+	//the replay only reads the topics, so it doesn't need the submit keys and must never create a topic
+	if os.Getenv("TOPIC_ID") == "" {
+		panic(fmt.Errorf("There is no TOPIC_ID in demo.env to export\n"))
+	}
+	loadOperatorConfig()
+	topicId = mustParseTopicFlag(os.Getenv("TOPIC_ID"))
+	loadMirrorConfig()
+	loadRoutes()
+	loadTenants()
+
+	options, err := newExportOptions(*format, *columns, *redact, *includePrivate)
+	if err == nil {
+		options.fromTimestamp, err = parseConsensusTime(*fromString)
+	}
+	if err == nil {
+		options.toTimestamp, err = parseConsensusTime(*toString)
+	}
+
+	exportTenants := tenants
+	if err == nil && *tenantId != "" {
+		t, exists := tenantById(*tenantId)
+		if !exists {
+			err = fmt.Errorf("unknown tenant %q", *tenantId)
+		}
+		exportTenants = []*tenant{t}
+	}
+	if err == nil {
+		options.topic, err = resolveExportTopic(exportTenants, *topic)
+	}
+	if err != nil {
+		panic(fmt.Errorf("Unable to export. Error: %v\n", err))
+	}
+
+	output := io.Writer(os.Stdout)
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			panic(fmt.Errorf("Unable to create %v. Error: %v\n", *outFile, err))
+		}
+		defer file.Close()
+		output = file
+	}
+
+	writer, err := newExportWriter(output, options)
+	if err == nil {
+		for _, t := range exportTenants {
+			if err = exportFromMirror(t, options, writer); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil {
+		panic(fmt.Errorf("Unable to export. Error: %v\n", err))
+	}
+}
+
+//This handler exports the requesting tenant's events, from the event store or (with source=mirror) a mirror replay
+func exportHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+
+	options, err := newExportOptions(format, params.Get("columns"), params.Get("redact"), params.Get("includePrivate") == "true")
+	if err == nil {
+		options.fromTimestamp, err = parseConsensusTime(params.Get("from"))
+	}
+	if err == nil {
+		options.toTimestamp, err = parseConsensusTime(params.Get("to"))
+	}
+	if err == nil {
+		options.topic, err = resolveExportTopic([]*tenant{t}, params.Get("topic"))
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentTypes := map[string]string{"ndjson": "application/x-ndjson", "csv": "text/csv", "parquet": "application/vnd.apache.parquet"}
+	rw.Header().Set("Content-Type", contentTypes[format])
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="events-%v.%v"`, t.id, format))
+
+	writer, err := newExportWriter(rw, options)
+	if err == nil {
+		if params.Get("source") == "mirror" {
+			err = exportFromMirror(t, options, writer)
+		} else {
+			err = exportFromStore(t, options, writer)
+		}
+	}
+	if err == nil {
+		err = writer.close()
+	}
+
+	//the response has already started, so all we can do is log the error and cut the export short
+	if err != nil {
+		log.Printf("Unable to export events for tenant %v. Error: %v\n", t.id, err)
+	}
+}
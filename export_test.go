@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/parquet-go/parquet-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//This function returns the names of the columns in the export options
+func exportColumnNames(options exportOptions) []string {
+	var names []string
+	for _, column := range options.columns {
+		names = append(names, column.name)
+	}
+	return names
+}
+
+func TestNewExportOptions(t *testing.T) {
+	var publicColumns, allColumns []string
+	for _, column := range exportColumns {
+		if !column.private {
+			publicColumns = append(publicColumns, column.name)
+		}
+		allColumns = append(allColumns, column.name)
+	}
+
+	tests := []struct {
+		name           string
+		format         string
+		columns        string
+		redact         string
+		includePrivate bool
+		expected       []string //the names of the columns, or nil if the options should be rejected
+	}{
+		{name: "every public column by default", format: "ndjson", expected: publicColumns},
+		{name: "every column with the private fields", format: "csv", includePrivate: true, expected: allColumns},
+		{name: "the columns given, in order", format: "parquet", columns: " event, transactionId ,,", expected: []string{"event", "transactionId"}},
+		{name: "a private column with the private fields", format: "csv", columns: "transactionId,campaign", includePrivate: true, expected: []string{"transactionId", "campaign"}},
+		{name: "a private column without the private fields", format: "csv", columns: "transactionId,campaign"},
+		{name: "an unknown column", format: "csv", columns: "transactionId,password"},
+		{name: "redacting an unknown column", format: "csv", redact: "password"},
+		{name: "an unknown format", format: "xml"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := newExportOptions(test.format, test.columns, test.redact, test.includePrivate)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected the options to be rejected, got columns %v", exportColumnNames(options))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := exportColumnNames(options); !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected columns %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+//This function returns the processed JSON of count events that have reached consensus on a topic, as the event store
+// holds them
+func testExportMessages(t *testing.T, topic string, count int) []string {
+	te := testTenant(topic)
+	_, responses := testConsensus(t, topic, count)
+
+	var messageJsons []string
+	for _, response := range responses {
+		messageJsons = append(messageJsons, decodeTopicResponse(te, te.topics[0].topicId, response)...)
+	}
+	if len(messageJsons) != count {
+		t.Fatalf("expected %v events, got %v", count, len(messageJsons))
+	}
+	return messageJsons
+}
+
+func TestExportRow(t *testing.T) {
+	messageJson := testExportMessages(t, "0.0.1", 1)[0]
+	consensusTimestamp := gjson.Get(messageJson, "hcs.consensusTimestamp").Int()
+	formattedTimestamp := time.Unix(0, consensusTimestamp).UTC().Format(time.RFC3339Nano)
+
+	options, err := newExportOptions("csv", "consensusTimestamp,transactionId,event,videoUrl,userAgent", "userAgent", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		fromTimestamp int64
+		toTimestamp   int64
+		topic         string
+		expected      []string //or nil if the event should be left out
+	}{
+		{name: "without a window", expected: []string{formattedTimestamp, testTransactionId(1), "start", "video.mp4", redactedValue}},
+		{name: "from its consensus timestamp", fromTimestamp: consensusTimestamp, expected: []string{formattedTimestamp, testTransactionId(1), "start", "video.mp4", redactedValue}},
+		{name: "to just after its consensus timestamp", toTimestamp: consensusTimestamp + 1, expected: []string{formattedTimestamp, testTransactionId(1), "start", "video.mp4", redactedValue}},
+		{name: "from just after its consensus timestamp", fromTimestamp: consensusTimestamp + 1},
+		{name: "to its consensus timestamp", toTimestamp: consensusTimestamp},
+		{name: "its topic", topic: "0.0.1", expected: []string{formattedTimestamp, testTransactionId(1), "start", "video.mp4", redactedValue}},
+		{name: "another topic", topic: "0.0.2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options.fromTimestamp, options.toTimestamp, options.topic = test.fromTimestamp, test.toTimestamp, test.topic
+
+			row, ok := options.row(messageJson)
+			if ok != (test.expected != nil) {
+				t.Fatalf("expected the event to be included: %v, got %v", test.expected != nil, ok)
+			}
+			if ok && !reflect.DeepEqual(row, test.expected) {
+				t.Errorf("expected row %q, got %q", test.expected, row)
+			}
+		})
+	}
+}
+
+func TestParquetColumnIndexes(t *testing.T) {
+	writer := newParquetExportWriter(io.Discard, []string{"transactionId", "event", "consensusTimestamp", "videoUrl"})
+	if expected := []int{2, 1, 0, 3}; !reflect.DeepEqual(writer.columnIndexes, expected) {
+		t.Errorf("expected column indexes %v, got %v", expected, writer.columnIndexes)
+	}
+}
+
+//This function reads an export back into a row of values by column name for each event
+func readExport(t *testing.T, format string, names []string, exported []byte) []map[string]string {
+	var rows []map[string]string
+
+	switch format {
+	case "ndjson":
+		decoder := json.NewDecoder(bytes.NewReader(exported))
+		for decoder.More() {
+			var row map[string]string
+			if err := decoder.Decode(&row); err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, row)
+		}
+
+	case "csv":
+		records, err := csv.NewReader(bytes.NewReader(exported)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 || !reflect.DeepEqual(records[0], names) {
+			t.Fatalf("expected a header of %v, got %v", names, records)
+		}
+		for _, record := range records[1:] {
+			row := make(map[string]string)
+			for i, value := range record {
+				row[names[i]] = value
+			}
+			rows = append(rows, row)
+		}
+
+	case "parquet":
+		reader := parquet.NewReader(bytes.NewReader(exported))
+		defer reader.Close()
+
+		columns := reader.Schema().Columns()
+		for {
+			values := make([]parquet.Row, 1)
+			n, err := reader.ReadRows(values)
+			if n == 1 {
+				row := make(map[string]string)
+				for _, value := range values[0] {
+					row[strings.Join(columns[value.Column()], ".")] = value.String()
+				}
+				rows = append(rows, row)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return rows
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	te := testTenant("0.0.1")
+	useTestPipeline(t, te.topics)
+
+	messageJsons := testExportMessages(t, "0.0.1", 3)
+	for _, messageJson := range messageJsons {
+		eventStore.putOrdered(messageJson)
+	}
+	//another tenant's event, which is never exported
+	otherTenant, err := sjson.Set(testOrderedMessage(gjson.Get(messageJsons[1], "hcs.consensusTimestamp").Int()+1, "0.0.2", "0.0.5@1590000000.000000009"), "hcs.tenant", "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventStore.putOrdered(otherTenant)
+
+	//exported from the second event onwards, with the columns out of Parquet's name order
+	names := []string{"transactionId", "event", "sequenceNumber", "consensusTimestamp", "videoUrl", "userAgent"}
+	var expected []map[string]string
+	for i, messageJson := range messageJsons[1:] {
+		expected = append(expected, map[string]string{
+			"transactionId":      testTransactionId(i + 2),
+			"event":              "start",
+			"sequenceNumber":     gjson.Get(messageJson, "hcs.sequenceNumber").String(),
+			"consensusTimestamp": time.Unix(0, gjson.Get(messageJson, "hcs.consensusTimestamp").Int()).UTC().Format(time.RFC3339Nano),
+			"videoUrl":           redactedValue,
+			"userAgent":          "test",
+		})
+	}
+
+	for _, format := range []string{"ndjson", "csv", "parquet"} {
+		t.Run(format, func(t *testing.T) {
+			options, err := newExportOptions(format, strings.Join(names, ","), "videoUrl", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options.fromTimestamp = gjson.Get(messageJsons[1], "hcs.consensusTimestamp").Int()
+
+			var exported bytes.Buffer
+			writer, err := newExportWriter(&exported, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = exportFromStore(te, options, writer); err != nil {
+				t.Fatal(err)
+			}
+			if err = writer.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if rows := readExport(t, format, names, exported.Bytes()); !reflect.DeepEqual(rows, expected) {
+				t.Errorf("expected %v, got %v", expected, rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Every event we track is a paid transaction, so to know what each tenant costs we fetch the record of every message
+// submit transaction once it reaches consensus and keep the actual fee charged, attributed to the tenant, campaign and
+// event type. The fees are appended as JSON lines to FEE_LEDGER_FILE (if set) so that chargeback reports can be
+// produced at any time with the fee-report command, or from /fees/report whilst the web-server is running.
+//
+//Note that fetching a transaction record is itself a (very small) paid query, which isn't included in the ledger
+type feeRecord struct {
+	TransactionId      string    `json:"transactionId"`
+	BatchTransactionId string    `json:"batchTransactionId,omitempty"`
+	Tenant             string    `json:"tenant"`
+	Campaign           string    `json:"campaign"`
+	Event              string    `json:"event"`
+	TopicId            string    `json:"topicId"`
+	ConsensusTimestamp time.Time `json:"consensusTimestamp"`
+	FeeTinybar         int64     `json:"feeTinybar"`
+}
+
+type feeLedger struct {
+	mutex   sync.Mutex
+	records []feeRecord
+	file    string
+}
+
+var fees = &feeLedger{}
+
+//This function loads the fee ledger from FEE_LEDGER_FILE, so reports include the fees from previous runs
+func loadFeeLedger() {
+	ledger := &feeLedger{file: getEnv("FEE_LEDGER_FILE", "")}
+
+	if ledger.file != "" {
+		file, err := os.Open(ledger.file)
+		if err != nil && !os.IsNotExist(err) {
+			panic(fmt.Errorf("Unable to open fee ledger %v. Error: %v\n", ledger.file, err))
+		}
+
+		if err == nil {
+			scanner := bufio.NewScanner(file)
+			for line := 1; scanner.Scan(); line++ {
+				if len(scanner.Bytes()) == 0 {
+					continue
+				}
+
+				var record feeRecord
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					panic(fmt.Errorf("Unable to decode line %v of fee ledger %v. Error: %v\n", line, ledger.file, err))
+				}
+				ledger.records = append(ledger.records, record)
+			}
+			_ = file.Close()
+
+			if err := scanner.Err(); err != nil {
+				panic(fmt.Errorf("Unable to read fee ledger %v. Error: %v\n", ledger.file, err))
+			}
+		}
+	}
+
+	fees = ledger
+
+	//the spend budgets are tracked from the same fees, including those from previous runs
+	for _, record := range ledger.records {
+		budget.recordSpend(record)
+	}
+}
+
+//a feeAttribution is an event that a transaction's fee is charged to. A batch transaction carries several events, so
+// its fee is split evenly between them
+type feeAttribution struct {
+	eventId  string //the event's public.transactionId
+	campaign string
+	event    string
+}
+
+//This function fetches the record of a submitted transaction in the background, once it has reached consensus, and
+// adds its fee to the ledger, split between the events it carried
+func recordTransactionFee(t *tenant, topic routedTopic, txnId hedera.TransactionID, attributions []feeAttribution) {
+	go func() {
+		record, err := txnId.GetRecord(newClient())
+		if err != nil {
+			log.Printf("Unable to fetch the record of transaction %v, so its fee won't be accounted for. Error: %v\n", txnId, err)
+			metrics.addCounter(series("hcs_fee_record_errors_total", "tenant", t.id), "Transactions whose fee could not be fetched", 1)
+			return
+		}
+
+		for _, entry := range attributeFee(t, topic, txnId, attributions, record.TransactionFee.AsTinybar(), record.ConsensusTimestamp) {
+			fees.add(entry)
+		}
+	}()
+}
+
+//This function splits a transaction's fee evenly between the events it carried, the first event picking up any
+// remainder, so a batch's fee is charged back to each of its events' campaigns
+func attributeFee(t *tenant, topic routedTopic, txnId hedera.TransactionID, attributions []feeAttribution, fee int64, consensusTimestamp time.Time) []feeRecord {
+	share := fee / int64(len(attributions))
+
+	entries := make([]feeRecord, 0, len(attributions))
+	for i, attribution := range attributions {
+		feeShare := share
+		if i == 0 {
+			feeShare += fee - share*int64(len(attributions))
+		}
+
+		entry := feeRecord{
+			TransactionId:      attribution.eventId,
+			Tenant:             t.id,
+			Campaign:           attribution.campaign,
+			Event:              attribution.event,
+			TopicId:            topic.topicId.String(),
+			ConsensusTimestamp: consensusTimestamp.UTC(),
+			FeeTinybar:         feeShare,
+		}
+		if attribution.eventId != txnId.String() {
+			entry.BatchTransactionId = txnId.String()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+//This function adds a fee to the ledger, appending it to the ledger file
+func (l *feeLedger) add(record feeRecord) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.records = append(l.records, record)
+	budget.recordSpend(record)
+	metrics.addCounter(series("hcs_fees_tinybar_total", "tenant", record.Tenant), "Transaction fees paid, in tinybar", float64(record.FeeTinybar))
+
+	if l.file == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to write the fee for transaction %v to %v. Error: %v\n", record.TransactionId, l.file, err)
+	}
+}
+
+//a chargebackLine is the total fees for one tenant, campaign and event type over a day or month
+type chargebackLine struct {
+	Period       string `json:"period"`
+	Tenant       string `json:"tenant"`
+	Campaign     string `json:"campaign"`
+	Event        string `json:"event"`
+	Transactions int    `json:"transactions"`
+	FeeTinybar   int64  `json:"feeTinybar"`
+	FeeHbar      string `json:"feeHbar"`
+}
+
+//the layout used to name each period of a chargeback report, by the name of the period
+var chargebackPeriods = map[string]string{
+	"daily":   "2006-01-02",
+	"monthly": "2006-01",
+}
+
+//This function totals the fees in the ledger between from (inclusive) and to (exclusive) by period, tenant, campaign
+// and event type. A zero from or to leaves that end of the range open, and an empty tenant includes every tenant
+func (l *feeLedger) chargebackReport(period string, from time.Time, to time.Time, tenant string) ([]chargebackLine, error) {
+	layout, exists := chargebackPeriods[period]
+	if !exists {
+		return nil, fmt.Errorf("unknown period %q, should be daily or monthly", period)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	totals := make(map[chargebackLine]*chargebackLine)
+	for _, record := range l.records {
+		if (!from.IsZero() && record.ConsensusTimestamp.Before(from)) || (!to.IsZero() && !record.ConsensusTimestamp.Before(to)) {
+			continue
+		}
+		if tenant != "" && record.Tenant != tenant {
+			continue
+		}
+
+		key := chargebackLine{Period: record.ConsensusTimestamp.UTC().Format(layout), Tenant: record.Tenant, Campaign: record.Campaign, Event: record.Event}
+		if totals[key] == nil {
+			line := key
+			totals[key] = &line
+		}
+		totals[key].Transactions++
+		totals[key].FeeTinybar += record.FeeTinybar
+	}
+
+	lines := make([]chargebackLine, 0, len(totals))
+	for _, line := range totals {
+		line.FeeHbar = tinybarToHbarString(line.FeeTinybar)
+		lines = append(lines, *line)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Campaign != b.Campaign {
+			return a.Campaign < b.Campaign
+		}
+		return a.Event < b.Event
+	})
+
+	return lines, nil
+}
+
+//This function writes a chargeback report as CSV or JSON
+func writeChargebackReport(w io.Writer, lines []chargebackLine, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(lines)
+
+	case "csv":
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"period", "tenant", "campaign", "event", "transactions", "feeTinybar", "feeHbar"})
+		for _, line := range lines {
+			_ = writer.Write([]string{line.Period, line.Tenant, line.Campaign, line.Event, strconv.Itoa(line.Transactions), strconv.FormatInt(line.FeeTinybar, 10), line.FeeHbar})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+
+	return fmt.Errorf("unknown format %q, should be csv or json", format)
+}
+
+func tinybarToHbarString(tinybar int64) string {
+	sign := ""
+	if tinybar < 0 {
+		sign = "-"
+		tinybar = -tinybar
+	}
+	return fmt.Sprintf("%v%d.%08d", sign, tinybar/100000000, tinybar%100000000)
+}
+
+//This function parses the from and to dates of a report, which can be given as a date (2006-01-02), a month (2006-01)
+// or an RFC3339 time
+func parseReportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01", time.RFC3339} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse %q as a date (2006-01-02), month (2006-01) or RFC3339 time", value)
+}
+
+//This function runs the fee-report command, which writes a chargeback report from the fee ledger
+func feeReportCommand(args []string) {
+	flags := flag.NewFlagSet("fee-report", flag.ExitOnError)
+	period := flags.String("period", "daily", "the period to total fees over: daily or monthly")
+	format := flags.String("format", "csv", "the report format: csv or json")
+	fromString := flags.String("from", "", "only include fees from this date, month or RFC3339 time")
+	toString := flags.String("to", "", "only include fees before this date, month or RFC3339 time")
+	tenant := flags.String("tenant", "", "only include fees for this tenant")
+	outFile := flags.String("out", "", "the file to write the report to (defaults to standard output)")
+	_ = flags.Parse(args)
+
+	from, err := parseReportTime(*fromString)
+	if err != nil {
+		panic(fmt.Errorf("Invalid --from. Error: %v\n", err))
+	}
+	to, err := parseReportTime(*toString)
+	if err != nil {
+		panic(fmt.Errorf("Invalid --to. Error: %v\n", err))
+	}
+
+	loadFeeLedger()
+	lines, err := fees.chargebackReport(*period, from, to, *tenant)
+	if err != nil {
+		panic(fmt.Errorf("Unable to produce fee report. Error: %v\n", err))
+	}
+
+	output := io.Writer(os.Stdout)
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			panic(fmt.Errorf("Unable to create %v. Error: %v\n", *outFile, err))
+		}
+		defer file.Close()
+		output = file
+	}
+
+	err = writeChargebackReport(output, lines, *format)
+	if err != nil {
+		panic(fmt.Errorf("Unable to write fee report. Error: %v\n", err))
+	}
+}
+
+//This handler returns a chargeback report for the requesting tenant, taking the same period, format, from and to
+// parameters as the fee-report command
+func feeReportHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	period := params.Get("period")
+	if period == "" {
+		period = "daily"
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	from, err := parseReportTime(params.Get("from"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseReportTime(params.Get("to"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines, err := fees.chargebackReport(period, from, to, t.id)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format {
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chargeback-%v-%v.csv"`, t.id, period))
+	case "json":
+		rw.Header().Set("Content-Type", "application/json")
+	default:
+		http.Error(rw, fmt.Sprintf("unknown format %q, should be csv or json", format), http.StatusBadRequest)
+		return
+	}
+
+	_ = writeChargebackReport(rw, lines, format)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashgraph/hedera-sdk-go"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//This function returns a tenant with the given ID, submitting to the given topic
+func testFeeTenant(id string, topicId string) *tenant {
+	t := testTenant(topicId)
+	t.id = id
+	return t
+}
+
+func testFeeTransactionId(n int) hedera.TransactionID {
+	return hedera.NewTransactionIDWithValidStart(hedera.AccountID{Account: 5}, time.Unix(1590000000, int64(n)))
+}
+
+//This function points the fee ledger's budget at a fresh one for a test, so that the fees it adds aren't spent
+func useTestBudget(t *testing.T) {
+	saved := budget
+	t.Cleanup(func() {
+		budget = saved
+	})
+
+	budget = &budgetGuard{
+		action:          budgetActionReject,
+		tenantDayLimits: make(map[string]int64),
+		minuteSpend:     make(map[int64]int64),
+		daySpend:        make(map[string]int64),
+		tenantDaySpend:  make(map[string]int64),
+		firing:          make(map[string]bool),
+	}
+}
+
+func TestAttributeFee(t *testing.T) {
+	acme := testFeeTenant("acme", "0.0.1")
+	txnId := testFeeTransactionId(1)
+	consensusTimestamp := time.Date(2020, 5, 20, 18, 40, 0, 0, time.FixedZone("BST", 3600))
+
+	tests := []struct {
+		name         string
+		attributions []feeAttribution
+		fee          int64
+		expected     []feeRecord
+	}{
+		{
+			name:         "a single event is charged the whole fee",
+			attributions: []feeAttribution{{eventId: txnId.String(), campaign: "spring", event: "start"}},
+			fee:          100,
+			expected: []feeRecord{
+				{TransactionId: txnId.String(), Tenant: "acme", Campaign: "spring", Event: "start", TopicId: "0.0.1", ConsensusTimestamp: consensusTimestamp.UTC(), FeeTinybar: 100},
+			},
+		},
+		{
+			name: "a batch's fee is split between its events, the first picking up the remainder",
+			attributions: []feeAttribution{
+				{eventId: txnId.String() + "-0", campaign: "spring", event: "start"},
+				{eventId: txnId.String() + "-1", campaign: "spring", event: "end"},
+				{eventId: txnId.String() + "-2", campaign: "summer", event: "start"},
+			},
+			fee: 100,
+			expected: []feeRecord{
+				{TransactionId: txnId.String() + "-0", BatchTransactionId: txnId.String(), Tenant: "acme", Campaign: "spring", Event: "start", TopicId: "0.0.1", ConsensusTimestamp: consensusTimestamp.UTC(), FeeTinybar: 34},
+				{TransactionId: txnId.String() + "-1", BatchTransactionId: txnId.String(), Tenant: "acme", Campaign: "spring", Event: "end", TopicId: "0.0.1", ConsensusTimestamp: consensusTimestamp.UTC(), FeeTinybar: 33},
+				{TransactionId: txnId.String() + "-2", BatchTransactionId: txnId.String(), Tenant: "acme", Campaign: "summer", Event: "start", TopicId: "0.0.1", ConsensusTimestamp: consensusTimestamp.UTC(), FeeTinybar: 33},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := attributeFee(acme, acme.topics[0], txnId, test.attributions, test.fee, consensusTimestamp)
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, entries)
+			}
+
+			var total int64
+			for _, entry := range entries {
+				total += entry.FeeTinybar
+			}
+			if total != test.fee {
+				t.Errorf("expected the shares to add up to %v, got %v", test.fee, total)
+			}
+		})
+	}
+}
+
+//This function returns a ledger holding the fees of a batch for acme and single events for acme and globex, over
+// two days in May and one in June
+func testFeeLedger(t *testing.T) *feeLedger {
+	useTestBudget(t)
+
+	acme, globex := testFeeTenant("acme", "0.0.1"), testFeeTenant("globex", "0.0.2")
+	batchId, acmeId, globexId, juneId := testFeeTransactionId(1), testFeeTransactionId(2), testFeeTransactionId(3), testFeeTransactionId(4)
+
+	ledger := &feeLedger{}
+	var entries []feeRecord
+	entries = append(entries, attributeFee(acme, acme.topics[0], batchId, []feeAttribution{
+		{eventId: batchId.String() + "-0", campaign: "spring", event: "start"},
+		{eventId: batchId.String() + "-1", campaign: "spring", event: "start"},
+		{eventId: batchId.String() + "-2", campaign: "spring", event: "end"},
+	}, 100000001, time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC))...)
+	entries = append(entries, attributeFee(acme, acme.topics[0], acmeId, []feeAttribution{{eventId: acmeId.String(), campaign: "spring", event: "start"}}, 50, time.Date(2020, 5, 21, 12, 0, 0, 0, time.UTC))...)
+	entries = append(entries, attributeFee(globex, globex.topics[0], globexId, []feeAttribution{{eventId: globexId.String(), campaign: "launch", event: "start"}}, 70, time.Date(2020, 5, 20, 13, 0, 0, 0, time.UTC))...)
+	entries = append(entries, attributeFee(acme, acme.topics[0], juneId, []feeAttribution{{eventId: juneId.String(), campaign: "spring", event: "end"}}, 20, time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))...)
+	for _, entry := range entries {
+		ledger.add(entry)
+	}
+	return ledger
+}
+
+func TestChargebackReport(t *testing.T) {
+	ledger := testFeeLedger(t)
+
+	tests := []struct {
+		name     string
+		period   string
+		from, to time.Time
+		tenant   string
+		expected []chargebackLine
+	}{
+		{
+			name:   "daily, for every tenant",
+			period: "daily",
+			expected: []chargebackLine{
+				{Period: "2020-05-20", Tenant: "acme", Campaign: "spring", Event: "end", Transactions: 1, FeeTinybar: 33333333, FeeHbar: "0.33333333"},
+				{Period: "2020-05-20", Tenant: "acme", Campaign: "spring", Event: "start", Transactions: 2, FeeTinybar: 66666668, FeeHbar: "0.66666668"},
+				{Period: "2020-05-20", Tenant: "globex", Campaign: "launch", Event: "start", Transactions: 1, FeeTinybar: 70, FeeHbar: "0.00000070"},
+				{Period: "2020-05-21", Tenant: "acme", Campaign: "spring", Event: "start", Transactions: 1, FeeTinybar: 50, FeeHbar: "0.00000050"},
+				{Period: "2020-06-01", Tenant: "acme", Campaign: "spring", Event: "end", Transactions: 1, FeeTinybar: 20, FeeHbar: "0.00000020"},
+			},
+		},
+		{
+			name:   "monthly, for one tenant",
+			period: "monthly",
+			tenant: "acme",
+			expected: []chargebackLine{
+				{Period: "2020-05", Tenant: "acme", Campaign: "spring", Event: "end", Transactions: 1, FeeTinybar: 33333333, FeeHbar: "0.33333333"},
+				{Period: "2020-05", Tenant: "acme", Campaign: "spring", Event: "start", Transactions: 3, FeeTinybar: 66666718, FeeHbar: "0.66666718"},
+				{Period: "2020-06", Tenant: "acme", Campaign: "spring", Event: "end", Transactions: 1, FeeTinybar: 20, FeeHbar: "0.00000020"},
+			},
+		},
+		{
+			name:   "between from (inclusive) and to (exclusive)",
+			period: "monthly",
+			from:   time.Date(2020, 5, 20, 13, 0, 0, 0, time.UTC),
+			to:     time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+			expected: []chargebackLine{
+				{Period: "2020-05", Tenant: "acme", Campaign: "spring", Event: "start", Transactions: 1, FeeTinybar: 50, FeeHbar: "0.00000050"},
+				{Period: "2020-05", Tenant: "globex", Campaign: "launch", Event: "start", Transactions: 1, FeeTinybar: 70, FeeHbar: "0.00000070"},
+			},
+		},
+		{
+			name:     "for a tenant without fees",
+			period:   "daily",
+			tenant:   "initech",
+			expected: []chargebackLine{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := ledger.chargebackReport(test.period, test.from, test.to, test.tenant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(lines, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, lines)
+			}
+		})
+	}
+
+	if _, err := ledger.chargebackReport("weekly", time.Time{}, time.Time{}, ""); err == nil {
+		t.Errorf("expected a weekly report to be rejected")
+	}
+}
+
+func TestWriteChargebackReport(t *testing.T) {
+	lines, err := testFeeLedger(t).chargebackReport("monthly", time.Time{}, time.Time{}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeChargebackReport(&out, lines, "csv"); err != nil {
+			t.Fatal(err)
+		}
+		expected := "period,tenant,campaign,event,transactions,feeTinybar,feeHbar\n" +
+			"2020-05,acme,spring,end,1,33333333,0.33333333\n" +
+			"2020-05,acme,spring,start,3,66666718,0.66666718\n" +
+			"2020-06,acme,spring,end,1,20,0.00000020\n"
+		if out.String() != expected {
+			t.Errorf("expected %q, got %q", expected, out.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeChargebackReport(&out, lines, "json"); err != nil {
+			t.Fatal(err)
+		}
+		var decoded []chargebackLine
+		if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, lines) {
+			t.Errorf("expected %+v, got %+v", lines, decoded)
+		}
+		if !bytes.Contains(out.Bytes(), []byte(`"feeHbar": "0.66666718"`)) {
+			t.Errorf("expected the fees in hbar as strings, got %v", out.String())
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if err := writeChargebackReport(&bytes.Buffer{}, lines, "xml"); err == nil {
+			t.Errorf("expected the xml format to be rejected")
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+//To reproduce a problem seen in production, the web-server can record every response it gets from the mirror node to
+// MIRROR_RECORD_FILE, one line of JSON per response. Each line is a topic message in the mirror REST API's JSON (see
+// topicmessages.go) along with the tenant it was received for, so a recording can also be checked with verify or
+// served by the mirror-simulator.
+//
+//The replay-fixtures command then feeds a recording back through the same pipeline as the subscriber (running hash
+// check, decryption, the event store and the merger) one response at a time, and writes the resulting events in
+// consensus order as NDJSON. With --expect, the output is compared against an earlier run instead, which makes a
+// recording into a regression test:
+//
+//	go run . replay-fixtures --in incident.ndjson --out events.ndjson
+//	go run . replay-fixtures --in incident.ndjson --expect events.ndjson
+type mirrorFixture struct {
+	Tenant string `json:"tenant"`
+	mirrorTopicMessage
+}
+
+type mirrorRecorder struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+//the recorder is nil unless MIRROR_RECORD_FILE is set
+var recorder *mirrorRecorder
+
+func loadMirrorRecorder() {
+	recordFilePath := getEnv("MIRROR_RECORD_FILE", "")
+	if recordFilePath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(recordFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		panic(fmt.Errorf("Unable to open mirror recording %v. Error: %v\n", recordFilePath, err))
+	}
+
+	log.Printf("Recording mirror node responses to %v\n", recordFilePath)
+	recorder = &mirrorRecorder{file: file}
+}
+
+//This function records a response from the mirror node, if recording is switched on
+func (r *mirrorRecorder) record(t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) {
+	if r == nil {
+		return
+	}
+
+	line, err := json.Marshal(mirrorFixture{Tenant: t.id, mirrorTopicMessage: newMirrorTopicMessage(topic, response)})
+	if err != nil {
+		panic(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, err = r.file.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("Unable to record message %v on topic %v. Error: %v\n", response.SequenceNumber, topic, err)
+	}
+}
+
+func readMirrorFixtures(filepath string) ([]mirrorFixture, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var fixtures []mirrorFixture
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var fixture mirrorFixture
+		err = json.Unmarshal(scanner.Bytes(), &fixture)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, scanner.Err()
+}
+
+//This function runs the replay-fixtures command
+func replayFixturesCommand(args []string) {
+	flags := flag.NewFlagSet("replay-fixtures", flag.ExitOnError)
+	in := flags.String("in", "", "the recording to replay")
+	outFile := flags.String("out", "", "the file to write the resulting events to (defaults to standard output)")
+	expectFile := flags.String("expect", "", "compare the resulting events with this file rather than writing them")
+	_ = flags.Parse(args)
+
+	if *in == "" {
+		panic(fmt.Errorf("Please give the recording to replay with --in\n"))
+	}
+	if os.Getenv("TOPIC_ID") == "" {
+		panic(fmt.Errorf("There is no TOPIC_ID in demo.env for the recording's tenants\n"))
+	}
+
+	fixtures, err := readMirrorFixtures(*in)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read recording %v. Error: %v\n", *in, err))
+	}
+
+	//a replay must not depend on anything saved by a previous run, on the mirror node, or on how quickly it runs, so
+	// the checkpoints and running hash chain start afresh, messages missing from the recording aren't fetched, and the
+	// merger only releases what every topic has moved past (and the rest at the end)
+	_ = os.Setenv("CHECKPOINT_FILE", "")
+	_ = os.Setenv("MIRROR_REST_URL", "")
+	_ = os.Setenv("MERGE_LAG", "876000h")
+
+	loadConfig()
+	loadRoutes()
+	loadTenants()
+
+	var output bytes.Buffer
+	startTopicMerger(allTopics(), func(message mergedMessage) {
+		for _, messageJson := range message.messageJsons {
+			eventStore.putOrdered(messageJson)
+			output.WriteString(messageJson + "\n")
+		}
+	})
+
+	for i, fixture := range fixtures {
+		t, exists := tenantById(fixture.Tenant)
+		if !exists {
+			panic(fmt.Errorf("Response %v in %v is for unknown tenant %q\n", i+1, *in, fixture.Tenant))
+		}
+		topic, response, err := fixture.response()
+		if err != nil {
+			panic(fmt.Errorf("Unable to read response %v in %v. Error: %v\n", i+1, *in, err))
+		}
+
+		hcsMessageResponseHandler(t, topic, "recording "+*in, response)
+	}
+	orderedMerger.flush()
+
+	fmt.Fprintf(os.Stderr, "Replayed %v responses into %v events\n", len(fixtures), bytes.Count(output.Bytes(), []byte("\n")))
+
+	if *expectFile != "" {
+		expected, err := ioutil.ReadFile(*expectFile)
+		if err != nil {
+			panic(fmt.Errorf("Unable to read %v. Error: %v\n", *expectFile, err))
+		}
+
+		expectedLines := bytes.Split(bytes.TrimRight(expected, "\n"), []byte("\n"))
+		actualLines := bytes.Split(bytes.TrimRight(output.Bytes(), "\n"), []byte("\n"))
+		for i := 0; i < len(expectedLines) || i < len(actualLines); i++ {
+			var expectedLine, actualLine []byte
+			if i < len(expectedLines) {
+				expectedLine = expectedLines[i]
+			}
+			if i < len(actualLines) {
+				actualLine = actualLines[i]
+			}
+			if !bytes.Equal(expectedLine, actualLine) {
+				fmt.Printf("Event %v differs from %v\nexpected: %s\nactual:   %s\n", i+1, *expectFile, expectedLine, actualLine)
+				os.Exit(1)
+			}
+		}
+
+		fmt.Printf("The replay matches %v\n", *expectFile)
+		return
+	}
+
+	destination := io.Writer(os.Stdout)
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			panic(fmt.Errorf("Unable to create %v. Error: %v\n", *outFile, err))
+		}
+		defer file.Close()
+		destination = file
+	}
+	_, _ = destination.Write(output.Bytes())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"testing"
+	"time"
+)
+
+//the fixtures shared by the tests of every feature
+
+const testEncryptionKey = "A32-ByteEncryptionKeyForAES-256!"
+
+//This function returns a tenant with the given topics and a single encryption key, as made up from demo.env
+func testTenant(topicIds ...string) *tenant {
+	topics := testTopics(topicIds...)
+	return &tenant{
+		id:      defaultTenantId,
+		topics:  topics,
+		route:   func(string) routedTopic { return topics[0] },
+		keyring: keyring{activeKeyId: "", keys: map[string]string{"": testEncryptionKey}},
+	}
+}
+
+//This function builds an event as the web-server submits it, with its private section encrypted
+func testEvent(transactionId string, event string) []byte {
+	private := `{"secretMessage":"","videoCurrentTime":"1","videoDuration":"10","videoUrl":"video.mp4","userAgent":"test"}`
+	return []byte(fmt.Sprintf(`{"public":{"event":"%v","timestamp":"1590000000000","tzOffset":"0","transactionId":"%v"},"private":"%v"}`, event, transactionId, hex.EncodeToString(encryptText(private, testEncryptionKey))))
+}
+
+//transactions are given a valid start from just before the tests run, so that they are still valid when they reach
+// consensus in the simulator's fake
+var testValidStart = time.Now().Add(-10 * time.Second).Unix()
+
+func testTransactionId(n int) string {
+	return fmt.Sprintf("0.0.5@%v.%09d", testValidStart, n)
+}
+
+//This function reaches consensus on count events in the simulator's in-memory consensus fake, returning the mirror
+// node's responses for them
+func testConsensus(t *testing.T, topic string, count int) (*memoryConsensus, []hedera.MirrorConsensusTopicResponse) {
+	consensus := newMemoryConsensus()
+	var responses []hedera.MirrorConsensusTopicResponse
+	for i := 1; i <= count; i++ {
+		simulated, err := consensus.submit(topic, testEvent(testTransactionId(i), "start"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, response, err := simulated.restMessage(topic).response()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	return consensus, responses
+}
+
+//This function points the web-server's globals at a fresh event store, merger and running hash chain for a test
+func useTestPipeline(t *testing.T, topics []routedTopic) {
+	savedStore, savedMerger, savedChain := eventStore, orderedMerger, runningHashes
+	t.Cleanup(func() {
+		eventStore, orderedMerger, runningHashes = savedStore, savedMerger, savedChain
+	})
+
+	eventStore = newMemoryEventStore()
+	orderedMerger = newTopicMerger(topics, time.Hour, func(message mergedMessage) {
+		for _, messageJson := range message.messageJsons {
+			eventStore.putOrdered(messageJson)
+		}
+	})
+	runningHashes = newRunningHashChain()
+}
+
+//This function returns a routed topic named after each of the topic IDs
+func testTopics(ids ...string) []routedTopic {
+	var topics []routedTopic
+	for _, id := range ids {
+		topicId, err := hedera.TopicIDFromString(id)
+		if err != nil {
+			panic(err)
+		}
+		topics = append(topics, routedTopic{name: id, topicId: topicId})
+	}
+	return topics
+}
+
+//This function generates count private keys, returning them along with their public keys as strings
+func testKeys(t *testing.T, count int) ([]string, []string) {
+	var privateKeys, publicKeys []string
+	for i := 0; i < count; i++ {
+		privateKey, err := hedera.GenerateEd25519PrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKeys = append(privateKeys, privateKey.String())
+		publicKeys = append(publicKeys, privateKey.PublicKey().String())
+	}
+	return privateKeys, publicKeys
+}
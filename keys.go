@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"strconv"
+	"strings"
+)
+
+//Topic admin and submit keys can either be a single Ed25519 public key, or a threshold key where a number of the
+// listed keys must sign. Threshold keys are written as "<threshold>:<key>,<key>,...", so a 2-of-3 admin key would be
+//
+//	2:302a300506032b6570032100...,302a300506032b6570032100...,302a300506032b6570032100...
+//
+//and an any-of-N submit key (allowing each producer to have its own submit key) would start with "1:"
+type keySpec struct {
+	Threshold int      `json:"threshold"`
+	Keys      []string `json:"keys"`
+}
+
+//This function parses a key specification into its threshold and list of keys, checking each key is valid
+func parseKeySpec(spec string) (keySpec, error) {
+	spec = strings.TrimSpace(spec)
+	parsed := keySpec{Threshold: 1}
+
+	if separator := strings.Index(spec, ":"); separator >= 0 {
+		threshold, err := strconv.Atoi(spec[:separator])
+		if err != nil {
+			return parsed, fmt.Errorf("unable to parse threshold in key spec %v: %v", spec, err)
+		}
+		parsed.Threshold = threshold
+		spec = spec[separator+1:]
+	}
+
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		_, err := hedera.Ed25519PublicKeyFromString(key)
+		if err != nil {
+			return parsed, fmt.Errorf("unable to convert %v into Hedera Ed25519 Public Key: %v", key, err)
+		}
+		parsed.Keys = append(parsed.Keys, key)
+	}
+
+	if len(parsed.Keys) == 0 {
+		return parsed, fmt.Errorf("key spec contains no keys")
+	}
+
+	if parsed.Threshold < 1 || parsed.Threshold > len(parsed.Keys) {
+		return parsed, fmt.Errorf("threshold %v is invalid for %v keys", parsed.Threshold, len(parsed.Keys))
+	}
+
+	return parsed, nil
+}
+
+//This function converts the spec into the key type expected by the SDK. A single key with a threshold of one is kept
+// as a plain Ed25519 key rather than being wrapped in a threshold key
+func (k keySpec) PublicKey() hedera.PublicKey {
+	if len(k.Keys) == 1 {
+		return parsePublicKey(k.Keys[0])
+	}
+
+	thresholdKey := hedera.NewThresholdKey(uint32(k.Threshold))
+	for _, key := range k.Keys {
+		thresholdKey.Add(parsePublicKey(key))
+	}
+
+	return thresholdKey
+}
+
+func (k keySpec) String() string {
+	if len(k.Keys) == 1 {
+		return k.Keys[0]
+	}
+	return fmt.Sprintf("%v:%v", k.Threshold, strings.Join(k.Keys, ","))
+}
+
+//This function counts how many of the spec's keys appear in the given list of public keys
+func (k keySpec) signedCount(signedBy []string) int {
+	count := 0
+	for _, key := range k.Keys {
+		for _, signer := range signedBy {
+			if parsePublicKey(key).String() == parsePublicKey(signer).String() {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+//This function returns the spec for the current topic admin key. TOPIC_ADMIN_KEYS holds the public key spec, however
+// if it hasn't been set we fall back to deriving a single key spec from TOPIC_ADMIN_KEY
+func currentAdminKeySpec() (keySpec, bool) {
+	if spec := getEnv("TOPIC_ADMIN_KEYS", ""); spec != "" {
+		parsed, err := parseKeySpec(spec)
+		if err != nil {
+			panic(fmt.Errorf("Unable to parse TOPIC_ADMIN_KEYS in demo.env. Error: %v\n", err))
+		}
+		return parsed, true
+	}
+
+	if privateKeyString := getEnv("TOPIC_ADMIN_KEY", ""); privateKeyString != "" {
+		privateKey, err := hedera.Ed25519PrivateKeyFromString(privateKeyString)
+		if err == nil {
+			return keySpec{Threshold: 1, Keys: []string{privateKey.PublicKey().String()}}, true
+		}
+	}
+
+	return keySpec{}, false
+}
+
+//This function parses a key spec given on the command line, panicking with a helpful message if it is invalid
+func mustParseKeySpec(flagName string, spec string) keySpec {
+	parsed, err := parseKeySpec(spec)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse --%v. Error: %v\n", flagName, err))
+	}
+	return parsed
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeySpec(t *testing.T) {
+	_, keys := testKeys(t, 3)
+
+	tests := []struct {
+		name     string
+		spec     string
+		expected keySpec
+		err      string //part of the error expected, or blank if the spec is valid
+	}{
+		{
+			name:     "a single key",
+			spec:     keys[0],
+			expected: keySpec{Threshold: 1, Keys: keys[:1]},
+		},
+		{
+			name:     "a threshold key",
+			spec:     "2:" + strings.Join(keys, ","),
+			expected: keySpec{Threshold: 2, Keys: keys},
+		},
+		{
+			name:     "spaces and blank entries are ignored",
+			spec:     fmt.Sprintf(" 1: %v , ,%v ", keys[0], keys[1]),
+			expected: keySpec{Threshold: 1, Keys: keys[:2]},
+		},
+		{
+			name: "a threshold of zero",
+			spec: "0:" + strings.Join(keys, ","),
+			err:  "threshold 0 is invalid for 3 keys",
+		},
+		{
+			name: "a threshold above the number of keys",
+			spec: "3:" + strings.Join(keys[:2], ","),
+			err:  "threshold 3 is invalid for 2 keys",
+		},
+		{
+			name: "a threshold that isn't a number",
+			spec: "two:" + strings.Join(keys, ","),
+			err:  "unable to parse threshold",
+		},
+		{
+			name: "no keys",
+			spec: "1:",
+			err:  "key spec contains no keys",
+		},
+		{
+			name: "a key that isn't a public key",
+			spec: "1:" + keys[0] + ",not-a-key",
+			err:  "unable to convert not-a-key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseKeySpec(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Errorf("parsed %+v, expected %+v", parsed, test.expected)
+			}
+
+			//the spec is written back out the way it is read
+			reparsed, err := parseKeySpec(parsed.String())
+			if err != nil || !reflect.DeepEqual(reparsed, parsed) {
+				t.Errorf("%v parsed back as %+v (%v)", parsed, reparsed, err)
+			}
+		})
+	}
+}
+
+func TestThresholdSigning(t *testing.T) {
+	privateKeys, publicKeys := testKeys(t, 3)
+	spec := keySpec{Threshold: 2, Keys: publicKeys}
+	message := []byte("transaction body")
+
+	tests := []struct {
+		name     string
+		signWith []int //the private keys held by the signers
+		signed   int
+		complete bool
+	}{
+		{name: "no signers", signed: 0},
+		{name: "one of two required", signWith: []int{1}, signed: 1},
+		{name: "the threshold reached", signWith: []int{0, 2}, signed: 2, complete: true},
+		{name: "every key", signWith: []int{0, 1, 2}, signed: 3, complete: true},
+		{name: "the same key twice only counts once", signWith: []int{1, 1}, signed: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var signedBy []string
+			if len(test.signWith) > 0 {
+				var held []string
+				for _, i := range test.signWith {
+					held = append(held, privateKeys[i])
+				}
+				t.Setenv("SIGNER", "local")
+				t.Setenv("TOPIC_ADMIN_KEY", strings.Join(held, ","))
+
+				signers, err := loadSigners(adminKeyName, "TOPIC_ADMIN_KEY")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, signer := range signers {
+					signature, err := signer.Sign(message)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !ed25519.Verify(signer.PublicKey().Bytes(), message, signature) {
+						t.Errorf("the signature from %v doesn't verify", signer.PublicKey())
+					}
+					signedBy = append(signedBy, signer.PublicKey().String())
+				}
+			}
+
+			signed := spec.signedCount(signedBy)
+			if signed != test.signed || (signed >= spec.Threshold) != test.complete {
+				t.Errorf("%v of the %v required keys signed, expected %v", signed, spec.Threshold, test.signed)
+			}
+		})
+	}
+}
+
+func TestSignerDaemonToken(t *testing.T) {
+	privateKeys, publicKeys := testKeys(t, 1)
+	privateKey, err := hedera.Ed25519PrivateKeyFromString(privateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(signerDaemonHandler(map[string]hedera.Ed25519PrivateKey{submitKeyName: privateKey}, "daemon-token"))
+	defer server.Close()
+
+	tests := []struct {
+		token string
+		ok    bool
+	}{
+		{"daemon-token", true},
+		{"", false},
+		{"another-token", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("SIGNER_TOKEN", test.token)
+		signer, err := newRemoteSigner(server.URL, submitKeyName)
+		if (err == nil) != test.ok {
+			t.Errorf("with token %q, expected ok %v, got error %v", test.token, test.ok, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if publicKey := signer.PublicKey().String(); publicKey != publicKeys[0] {
+			t.Errorf("the daemon served public key %v, expected %v", publicKey, publicKeys[0])
+		}
+		message := []byte("message")
+		signature, err := signer.Sign(message)
+		if err != nil || !ed25519.Verify(signer.PublicKey().Bytes(), message, signature) {
+			t.Errorf("expected a valid signature from the daemon, got error %v", err)
+		}
+	}
+}
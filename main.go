@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -18,6 +19,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,14 +27,15 @@ import (
 //set some global references so we can reduce duplicate work across functions
 const portToUse = "8080"
 
-//set up references to the Operator information
+//set up references to the Operator information. The operator key is only ever used through a Signer, which may be
+// backed by a key in this process or by a separate signing daemon (see signer.go)
 var operatorAccount hedera.AccountID
-var operatorPrivateKey hedera.Ed25519PrivateKey
+var operatorSigner Signer
 
-//topic information
+//topic information. The topic admin key is deliberately not loaded here, as admin operations are built, signed
+// offline and then submitted using the commands in offline.go
 var topicId hedera.ConsensusTopicID
-var submitPrivateKey hedera.Ed25519PrivateKey
-var adminPrivateKey hedera.Ed25519PrivateKey
+var submitSigners []Signer
 
 //message encryption key
 var encryptionKey string
@@ -45,23 +48,36 @@ var mirrorAddress string
 // message. As our subscriber receives topic updates, it begins to fill this map with the responses based on the
 // transactionID. Once we have received the response for a transactionID the client is looking for, we can return the
 // message data to the client and then close that connection.
-var eventStore = make(map[string]string) //map[transactionId]messageDataAsJson
+var eventStore = newMemoryEventStore() //map[transactionId]messageDataAsJson
 
-//The init function runs before the main function is called, and allows us to set up some default values for the demo
+//any error from loading the demo.env file. This is only reported when the configuration is needed, so that commands
+// such as sign-transaction can run on an offline machine that has no demo.env file
+var envLoadErr error
+
+//The init function runs before the main function is called, and loads the demo.env file so that both the web-server
+// and any sub-commands can read their configuration from the environment
 func init() {
 	//load environment variables from the demo.env file
-	err := godotenv.Load("demo.env")
-	if err != nil {
-		panic(fmt.Errorf("Unable to load enviroment variables from demo.env file. Error:\n%v\n", err))
+	envLoadErr = godotenv.Load("demo.env")
+}
+
+//This function loads just the operator information, for commands that need to pay for transactions but don't need
+// the rest of the topic configuration (e.g. because they are creating a new topic)
+func loadOperatorConfig() {
+	if envLoadErr != nil {
+		panic(fmt.Errorf("Unable to load enviroment variables from demo.env file. Error:\n%v\n", envLoadErr))
 	}
 
+	var err error
+
 	//Get the Operator information that should have been set by godotenv
 	OPERATOR_ID := os.Getenv("OPERATOR_ID")
 	OPERATOR_KEY := os.Getenv("OPERATOR_KEY")
+	SIGNER := getEnv("SIGNER", "local")
 
 	//if either piece of Operator information is blank (either because its not set by godotenv or the value in the .env
-	// file is blank), then throw an error
-	if OPERATOR_ID == "" || OPERATOR_KEY == "" {
+	// file is blank), then throw an error. The key is only required when we are signing locally
+	if OPERATOR_ID == "" || (OPERATOR_KEY == "" && SIGNER == "local") {
 		panic(fmt.Errorf("Please ensure the OPERATOR_ID and OPERATOR_KEY have been updated in the demo.env file.\nOPERATOR_ID: %v\nOPERATOR_KEY: %v\n", OPERATOR_ID, OPERATOR_KEY))
 	}
 
@@ -71,24 +87,32 @@ func init() {
 		panic(fmt.Errorf("Unable to convert OPERATOR_ID in demo.env into Hedera AccountID. Please check the format in the demo.env file.\n"))
 	}
 
-	operatorPrivateKey, err = hedera.Ed25519PrivateKeyFromString(OPERATOR_KEY)
+	operatorSigner, err = loadSigner(operatorKeyName, "OPERATOR_KEY")
 	if err != nil {
-		panic(fmt.Errorf("Unable to convert OPERATOR_KEY in demo.env into Hedera Ed25519 Private Key. Please check the format in the demo.env file.\n"))
+		panic(fmt.Errorf("Unable to load the operator signer. Error: %v\n", err))
 	}
+}
+
+//This function sets up the default values for the demo from the environment. It is called by the web-server and by
+// any sub-commands that need to talk to the network
+func loadConfig() {
+	loadOperatorConfig()
+
+	var err error
+	SIGNER := getEnv("SIGNER", "local")
 
 	TOPIC_ID := os.Getenv("TOPIC_ID")
 
 	if TOPIC_ID == "" {
 		//if there isnt already a topic set in the demo.env file, create one to use and then save the details
-		createTopic()
+		printAdminKeyWarning(createTopic("AdsDax HCS demo topic"))
 	} else {
-		//check that the rest of the topic information that we will need such as the submit key and
-		// the admin key exist
+		//check that the rest of the topic information that we will need such as the submit key exists (again, only
+		// when we hold the keys locally)
 		TOPIC_SUBMIT_KEY := os.Getenv("TOPIC_SUBMIT_KEY")
-		TOPIC_ADMIN_KEY := os.Getenv("TOPIC_ADMIN_KEY")
 
-		if TOPIC_SUBMIT_KEY == "" || TOPIC_ADMIN_KEY == "" {
-			panic(fmt.Errorf("Please ensure the Topic information has been set correctly, or clear the information in the demo.env file so that a new topic will be created automatically.\nTOPIC_ID: %v\nTOPIC_SUBMIT_KEY: %v\nTOPIC_ADMIN_KEY: %v\n", TOPIC_ID, TOPIC_SUBMIT_KEY, TOPIC_ADMIN_KEY))
+		if SIGNER == "local" && TOPIC_SUBMIT_KEY == "" {
+			panic(fmt.Errorf("Please ensure the Topic information has been set correctly, or clear the information in the demo.env file so that a new topic will be created automatically.\nTOPIC_ID: %v\nTOPIC_SUBMIT_KEY: %v\n", TOPIC_ID, TOPIC_SUBMIT_KEY))
 		}
 
 		//as all of the topic information appears to be correct, load our global variables.
@@ -97,17 +121,20 @@ func init() {
 			panic(fmt.Errorf("Unable to convert TOPIC_ID in demo.env into Hedera TopicID. Please check the format in the demo.env file.\n"))
 		}
 
-		adminPrivateKey, err = hedera.Ed25519PrivateKeyFromString(TOPIC_ADMIN_KEY)
-		if err != nil {
-			panic(fmt.Errorf("Unable to convert TOPIC_ADMIN_KEY in demo.env into Hedera Ed25519 Private Key. Please check the format in the demo.env file.\n"))
-		}
-
-		submitPrivateKey, err = hedera.Ed25519PrivateKeyFromString(TOPIC_SUBMIT_KEY)
+		//TOPIC_SUBMIT_KEY can hold several comma separated keys when the topic has a threshold submit key that needs
+		// more than one signature
+		submitSigners, err = loadSigners(submitKeyName, "TOPIC_SUBMIT_KEY")
 		if err != nil {
-			panic(fmt.Errorf("Unable to convert TOPIC_ADMIN_KEY in demo.env into Hedera Ed25519 Private Key. Please check the format in the demo.env file.\n"))
+			panic(fmt.Errorf("Unable to load the topic submit signer. Error: %v\n", err))
 		}
 	}
 
+	loadMirrorConfig()
+}
+
+//This function loads the settings for reading the topics back from the mirror node. It is called by loadConfig, and
+// by sub-commands that only read the topics and so must never create one
+func loadMirrorConfig() {
 	//Check the mirror node address is set so we can subscribe to updates for our topic
 	MIRROR_ADDRESS := os.Getenv("MIRROR_ADDR")
 	if MIRROR_ADDRESS == "" {
@@ -126,14 +153,55 @@ func init() {
 }
 
 func main() {
+	//if a sub-command has been given (e.g. "go run . signer-daemon") then run that instead of the web-server
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
 
+	loadConfig()
+	loadRoutes()
+	loadTenants()
+	loadBudget()
+	loadFeeLedger()
+	loadExplorer()
+	loadExplorerUi()
 
 	//set up http handlers for routes we will use in the demo
 	http.HandleFunc("/", demoPageHandler)
 	http.HandleFunc("/track", trackingHandler)
 	http.HandleFunc("/retrieve", retrieveHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/ordered", orderedHandler)
+	http.HandleFunc("/fees/report", feeReportHandler)
+	http.HandleFunc("/budget/status", budgetStatusHandler)
+	http.HandleFunc("/events", eventsQueryHandler)
+	http.HandleFunc("/events/stream", eventStreamHandler)
+	http.HandleFunc("/events/export", exportHandler)
+	http.HandleFunc("/ws", trackingSocketHandler)
+	http.HandleFunc("/api/v1/topics/", topicMessagesHandler)
+	http.HandleFunc("/backfill", backfillHandler)
+	http.HandleFunc("/explorer/", explorerHandler)
+
+	//merge the messages from all of our topics into consensus timestamp order, and then start the subscribers (which
+	// replay their topics into the event store if CHECKPOINT_FILE has checkpoints to resume from)
+	startTopicMerger(allTopics(), func(message mergedMessage) {
+		for _, messageJson := range message.messageJsons {
+			eventStore.putOrdered(messageJson)
+		}
+	})
 
+	//the subscribers check every message against the running hash chain, and raise an alert if one doesn't match
+	loadNotifier()
+	loadAuditLog()
+	loadRunningHashChain()
+	loadMirrorRecorder()
 	subscribeToTopicUpdates()
+	startEventBatcher()
+	startAuditAnchoring()
+
+	//keep an eye on the topic's expiry and the auto-renew account's balance so the audit trail can't silently lapse
+	startTopicMonitor()
 
 	fmt.Printf("Now listening on localhost:" + portToUse + "\n")
 	log.Fatal(http.ListenAndServe(":" + portToUse, nil))
@@ -143,8 +211,14 @@ func main() {
 	HELPER FUNCTIONS
 */
 
-//This function is used to quickly generate a topic, and then save the details in the demo.env file for future use
-func createTopic() {
+//This function is used to quickly generate a topic, and then save the details in the demo.env file for future use. The
+// private admin key is returned rather than saved, as only its public key is written to the demo.env file
+func createTopic(memo string) hedera.Ed25519PrivateKey {
+
+	//the keys are generated in this process, so we can't create a topic when the keys are meant to live elsewhere
+	if getEnv("SIGNER", "local") != "local" {
+		panic(fmt.Errorf("TOPIC_ID is blank, but topics can only be created automatically when SIGNER is local. Please create the topic where your keys are held and set TOPIC_ID in the demo.env file.\n"))
+	}
 
 	//first generate some keys to use as admin and submit keys
 	adminKey, err := hedera.GenerateEd25519PrivateKey()
@@ -158,13 +232,12 @@ func createTopic() {
 	}
 
 	//Get the *client we use to interact with the Hedera Hashgraph network
-	client := hedera.ClientForTestnet()
-	client.SetOperator(operatorAccount, operatorPrivateKey)
+	client := newClient()
 
 	//Build the Topic Create transaction, setting the keypairs we will use as well as some required values
 	builtTxn, err := hedera.NewConsensusTopicCreateTransaction().
 		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
-		SetTopicMemo("AdsDax HCS demo topic").
+		SetTopicMemo(memo).
 		SetAdminKey(adminKey.PublicKey()).
 		SetSubmitKey(submitKey.PublicKey()).
 		SetAutoRenewAccountID(operatorAccount).
@@ -176,11 +249,12 @@ func createTopic() {
 	}
 
 	//Now sign and submit the transaction as the operator (who pays for the transaction) and the admin (required)
-	txnId, err := builtTxn.
-		SignWith(operatorPrivateKey.PublicKey(), operatorPrivateKey.Sign).
-		SignWith(adminKey.PublicKey(), adminKey.Sign).
-		Execute(client)
+	signedTxn, err := signTransaction(builtTxn, operatorSigner, newLocalSigner(adminKey))
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to sign HCS Topic Create transaction: %v\n", err))
+	}
 
+	txnId, err := signedTxn.Execute(client)
 	if err != nil {
 		panic(fmt.Errorf("Error when attempting to execute HCS Topic Create transaction: %v\n", err))
 	}
@@ -200,14 +274,25 @@ func createTopic() {
 
 	writeMap["TOPIC_ID"] = receipt.GetConsensusTopicID().String()
 	writeMap["TOPIC_SUBMIT_KEY"] = submitKey.String()
-	writeMap["TOPIC_ADMIN_KEY"] = adminKey.String()
+
+	//the admin key isn't needed by the web-server, so only its public key is kept. Any private admin key left over
+	// from a previous topic is cleared, as it no longer manages anything
+	writeMap["TOPIC_ADMIN_KEY"] = ""
+	writeMap["TOPIC_ADMIN_KEYS"] = adminKey.PublicKey().String()
 
 	niceWrite(writeMap, "demo.env")
 
 	//finally, populate the global variables with these new values for use in the rest of the application
 	topicId = receipt.GetConsensusTopicID()
-	adminPrivateKey = adminKey
-	submitPrivateKey = submitKey
+	submitSigners = []Signer{newLocalSigner(submitKey)}
+
+	return adminKey
+}
+
+//This function shows a newly created topic's private admin key. It isn't saved anywhere, so it has to be stored
+// somewhere safe now. It goes to stderr, so that it isn't captured along with a command's output
+func printAdminKeyWarning(adminKey hedera.Ed25519PrivateKey) {
+	fmt.Fprintf(os.Stderr, "Created topic %v. Its admin key has not been saved anywhere, so please store it offline now, as it is needed to update or delete the topic (see sign-transaction):\n\n  %v\n\n", topicId, adminKey.String())
 }
 
 //This function is used to nicely write environment variables back to the .env file without losing any comments
@@ -219,6 +304,7 @@ func niceWrite (writeMap map[string]string, filepath string) {
 	}
 
 	fileLines := strings.Split(string(fileContents), "\n")
+	written := make(map[string]bool)
 
 	for lineNumber, lineContent := range fileLines {
 		if len(lineContent) == 0 || string(lineContent[0]) == "#" {
@@ -227,22 +313,34 @@ func niceWrite (writeMap map[string]string, filepath string) {
 		}
 
 		for writeKey, writeValue := range writeMap {
-			writeKeyLength := len(writeKey)
+			//match on the key and the equals sign, so that writing TOPIC_ADMIN_KEY doesn't also overwrite TOPIC_ADMIN_KEYS
+			writeKeyLength := len(writeKey) + 1
 
 			if len(lineContent) < writeKeyLength {
 				//skip this write key if the length of the current line is less than that of the write key
 				continue
-			} else if string(lineContent[0:writeKeyLength]) == writeKey {
+			} else if string(lineContent[0:writeKeyLength]) == writeKey+"=" {
 				//this line matches our write key, so update it with the new value
 				fileLines[lineNumber] = fmt.Sprintf("%v=\"%v\"", writeKey, writeValue)
+				written[writeKey] = true
 			}
 		}
 	}
 
-	//merge the fileLines array using strings.Join() and add the newlines back in, then write it back to the filepath
-	err = ioutil.WriteFile(filepath, []byte(strings.Join(fileLines, "\n")), 0644)
-	if err != nil {
-		panic(fmt.Errorf("An error occured when attempting to write environment data to file (%v).Data: %v,\n Error: %v\n", filepath, writeMap, err))
+	//add any keys that weren't already in the file to the end, so that older demo.env files pick up new settings
+	for writeKey, writeValue := range writeMap {
+		if !written[writeKey] {
+			fileLines = append(fileLines, fmt.Sprintf("%v=\"%v\"", writeKey, writeValue))
+		}
+	}
+
+	//merge the fileLines array using strings.Join() and add the newlines back in, then write it back to the filepath. The
+	// file is written to a temporary file and renamed into place, so a crash never leaves a half written config behind
+	writeFileAtomically(filepath, []byte(strings.Join(fileLines, "\n")), 0644)
+
+	//keep the environment of this process in step with the file
+	for writeKey, writeValue := range writeMap {
+		_ = os.Setenv(writeKey, writeValue)
 	}
 }
 
@@ -273,40 +371,55 @@ func encryptText (message string, cipherKey string) []byte {
 
 //This function takes an encoded byte array and encryption key and returns the unencrypted message
 func decryptText (encryptedText []byte, encryptionKey string) string {
+	decryptedMessage, err := tryDecryptText(encryptedText, encryptionKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return decryptedMessage
+}
+
+//This function is the same as decryptText, but returns an error rather than panicking, for when we receive messages
+// that we may not have the key for (such as from another tenant, or after a key has been retired)
+func tryDecryptText(encryptedText []byte, encryptionKey string) (string, error) {
 
 	bKey := []byte(encryptionKey)
 
 	aesCipherBlock, err := aes.NewCipher(bKey)
 	if err != nil {
-		panic(fmt.Errorf("An error occured generating AES cipher with key length %v (should be 16, 24 or 32). Error: %v\n", len(bKey), err))
+		return "", fmt.Errorf("An error occured generating AES cipher with key length %v (should be 16, 24 or 32). Error: %v\n", len(bKey), err)
 	}
 
 	gcmWrapper, err := cipher.NewGCM(aesCipherBlock)
 	if err != nil {
-		panic(fmt.Errorf("An error occured generating GCM wrapped cipher. Error: %v\n", err))
+		return "", fmt.Errorf("An error occured generating GCM wrapped cipher. Error: %v\n", err)
 	}
 
 	nonceSize := gcmWrapper.NonceSize()
 	if len(encryptedText) < nonceSize {
-		panic(fmt.Errorf("An error decrypting text. The length of the text is too short compared to the size of the nonce\n"))
+		return "", fmt.Errorf("An error decrypting text. The length of the text is too short compared to the size of the nonce\n")
 	}
 
 	nonce, encryptedMessage := encryptedText[:nonceSize], encryptedText[nonceSize:]
 	decryptedMessage, err := gcmWrapper.Open(nil, nonce, encryptedMessage, nil)
 	if err != nil {
-		panic(fmt.Errorf("An error occured when trying to decrypt the message. Error: %v\n", err))
+		return "", fmt.Errorf("An error occured when trying to decrypt the message. Error: %v\n", err)
 	}
 
-	return string(decryptedMessage)
+	return string(decryptedMessage), nil
 }
 
-//this function handles subscribing to our topic to receive messages as they pass through consensus. The messages
-// are handed off to the hcsMessageResponseHandler function, with any errors going ot the hcsMessageErrorHandler
+//this function handles subscribing to our topics to receive messages as they pass through consensus. The messages
+// are handed off to the hcsMessageResponseHandler function, with any errors going ot the hcsMessageErrorHandler. When
+// events are routed to several topics (see routing.go) we subscribe to each of them, and all of their messages end up
+// in the same eventStore
 func subscribeToTopicUpdates() {
 
-	//set up the client
-	client := hedera.ClientForTestnet()
-	client.SetOperator(operatorAccount, operatorPrivateKey)
+	//with MIRROR_ADDRESSES set, each topic is followed on several mirror nodes at once and a message is only handled
+	// once enough of them agree on it (see quorum.go)
+	if subscribeWithQuorum() {
+		return
+	}
 
 	//get the mirror address as set in the demo.env file
 	mirrorClient, err := hedera.NewMirrorClient(mirrorAddress)
@@ -314,10 +427,13 @@ func subscribeToTopicUpdates() {
 		panic(err)
 	}
 
-	//Set up which topics we want to listen to and then begin listening for updates
-	_, err = hedera.NewMirrorConsensusTopicQuery().
-		SetTopicID(topicId).
-		Subscribe(mirrorClient, hcsMessageResponseHandler, hcsMessageErrorHandler)
+	//Set up which topics we want to listen to and then begin listening for updates. Each tenant's messages are only
+	// ever handled with that tenant's keys
+	for _, t := range tenants {
+		for _, topic := range t.topics {
+			subscribeToTopic(mirrorClient, t, topic.topicId)
+		}
+	}
 
 	/*
 		NOTE:
@@ -336,14 +452,139 @@ func subscribeToTopicUpdates() {
 	 */
 }
 
-//This function handles the messages our listener receives after they've been passed through the Consensus Service
-func hcsMessageResponseHandler (response hedera.MirrorConsensusTopicResponse) {
+//This function subscribes to a single topic on behalf of a tenant, replaying it from the start if we are resuming
+func subscribeToTopic(mirrorClient hedera.MirrorClient, t *tenant, topic hedera.ConsensusTopicID) {
+	_, err := resumeTopicQuery(topic).
+		Subscribe(mirrorClient, func(response hedera.MirrorConsensusTopicResponse) {
+			hcsMessageResponseHandler(t, topic, "mirror node "+mirrorAddress, response)
+		}, hcsMessageErrorHandler)
+
+	if err != nil {
+		panic(fmt.Errorf("Unable to subscribe to topic %v. Error: %v\n", topic, err))
+	}
+}
+
+//This function builds the query for a topic's messages. The event store lives in memory, so when we are resuming after
+// a restart (the merger has a checkpoint for the topic, or there is a saved running hash chain) the topic is replayed
+// from its start to fill the store back up. The merger puts the messages up to its checkpoint straight back into the
+// ordered view, and the running hash chain is rebuilt up to its saved head before carrying on from it. Otherwise we
+// start from now
+func resumeTopicQuery(topic hedera.ConsensusTopicID) *hedera.MirrorConsensusTopicQuery {
+	query := hedera.NewMirrorConsensusTopicQuery().
+		SetTopicID(topic)
+
+	_, checkpointed := orderedMerger.checkpoint(topic.String())
+	if _, chained := runningHashes.head(topic.String()); checkpointed || chained {
+		query = query.SetStartTime(time.Unix(0, 0))
+	}
+
+	return query
+}
+
+//This function handles the messages our listener receives after they've been passed through the Consensus Service. The
+// source is the mirror node the message came from (or the mirror nodes that agreed on it, see quorum.go)
+func hcsMessageResponseHandler (t *tenant, topic hedera.ConsensusTopicID, source string, response hedera.MirrorConsensusTopicResponse) {
+	//record the response exactly as we received it, if MIRROR_RECORD_FILE is set (see fixtures.go)
+	recorder.record(t, topic, response)
+
+	//if the mirror node has skipped some messages, fetch and handle them first (see runninghash.go)
+	fillRunningHashGap(t, topic, response.SequenceNumber)
+
+	handleTopicResponse(t, topic, source, response)
+}
+
+//This function checks a message against its running hash before trusting anything in it (see runninghash.go), and
+// then stores it and hands it to the merger, returning whether it passed the check
+func handleTopicResponse(t *tenant, topic hedera.ConsensusTopicID, source string, response hedera.MirrorConsensusTopicResponse) bool {
+	if !runningHashes.verify(source, topic, response) {
+		return false
+	}
+
+	events := storeTopicResponse(t, topic, response)
+
+	orderedMerger.add(mergedMessage{
+		topic:              topic.String(),
+		consensusTimestamp: response.ConsensusTimeStamp,
+		sequenceNumber:     response.SequenceNumber,
+		messageJsons:       events,
+	})
+	return true
+}
+
+//This function decodes a message that has passed its running hash check and stores it in the event store, returning
+// its events
+func storeTopicResponse(t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) []string {
+	events := decodeTopicResponse(t, topic, response)
+
+	//keep the message as it arrived too, so it can be checked against its running hash
+	eventStore.putTopicMessage(newMirrorTopicMessage(topic, response))
+
+	for _, jsonString := range events {
+		//store the data in our event store, keyed on its transaction ID, so we can pass it to the client
+		transactionId := gjson.Get(jsonString, "public.transactionId").String()
+		eventStore.putConfirmed(topic.String(), transactionId, jsonString)
+
+		//and chain it onto the audit log, with its private section encrypted as it is on the ledger
+		if audit != nil {
+			auditJson, err := sjson.Set(jsonString, "private", encryptedSection(response.Message, transactionId))
+			if err != nil {
+				panic(err)
+			}
+			audit.record(t, transactionId, auditJson)
+		}
+	}
+
+	return events
+}
+
+//This function decodes and decrypts the events in a message received on one of a tenant's topics
+func decodeTopicResponse(t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) []string {
+	message := string(response.Message) //The message is a byte array, so convert it into a readable string
+
+	//an audit log anchor (see auditlog.go) carries no event of its own
+	if gjson.Get(message, "public.event").String() == auditAnchorEvent {
+		audit.confirmAnchor(t, topic, response)
+		return nil
+	}
+
+	//a batch message (sent whilst a fee budget is exceeded, see budget.go) carries several events, each of which is
+	// processed as if it had arrived in its own message, with its private section from the batch's
+	events := []string{message}
+	batchTransactionId := ""
+	if batch := gjson.Get(message, "batch"); batch.IsArray() {
+		privates, err := batchPrivateSections(t.keyring, gjson.Parse(message))
+		if err != nil {
+			log.Printf("Unable to decrypt batch message %v on topic %v for tenant %v. Error: %v\n", response.SequenceNumber, topic, t.id, err)
+			return nil
+		}
+
+		events = nil
+		for i, event := range batch.Array() {
+			eventJson, err := sjson.SetRaw(event.Raw, "private", privates[i].Raw)
+			if err != nil {
+				panic(err)
+			}
+			events = append(events, eventJson)
+		}
+		batchTransactionId = gjson.Get(message, "public.transactionId").String()
+	}
+
+	var decoded []string
+	for _, event := range events {
+		if jsonString, ok := decodeEventMessage(t, topic, response, event, batchTransactionId); ok {
+			decoded = append(decoded, jsonString)
+		}
+	}
+	return decoded
+}
+
+//This function adds the consensus information to a single event that arrived on a topic and decrypts it
+func decodeEventMessage(t *tenant, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse, message string, batchTransactionId string) (string, bool) {
 
 	//Get additional information that the Hedera Consensus Service sends alongside our message, such as the consensus
 	// timestamp and sequence number
 	consensusTimestamp := response.ConsensusTimeStamp
 	sequenceNumber := response.SequenceNumber
-	message := string(response.Message) //The message is a byte array, so convert it into a readable string
 
 	//As the demo messages are JSON based, we can use the Go "sjson" module to add the extra information we have
 	// alongside the original message
@@ -351,12 +592,24 @@ func hcsMessageResponseHandler (response hedera.MirrorConsensusTopicResponse) {
 		message, //this is the JSON string we want to append data to
 		"hcs", //this is the path we want to add it to, but we just want to add it to the top level of the JSON
 		//below is the JSON string we want to insert
-		fmt.Sprintf(`{"consensusTimestamp":%v,"consensusTimestampReadable":"%v","sequenceNumber":%v}`, consensusTimestamp.UnixNano(), consensusTimestamp.Format("2006-01-02 15:04:05.99999999"), sequenceNumber))
+		fmt.Sprintf(`{"tenant":"%v","topicId":"%v","consensusTimestamp":%v,"consensusTimestampReadable":"%v","sequenceNumber":%v}`, t.id, topic, consensusTimestamp.UnixNano(), consensusTimestamp.Format("2006-01-02 15:04:05.99999999"), sequenceNumber))
 
 	if err != nil {
 		panic(err)
 	}
 
+	if batchTransactionId != "" {
+		jsonString, err = sjson.Set(jsonString, "hcs.batchTransactionId", batchTransactionId)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//the private sections of a batch's events have already been decrypted together
+	if gjson.Get(jsonString, "private").IsObject() {
+		return jsonString, true
+	}
+
 	//Now we can go about decrypting the private data we have stored in the message. First, we need to decode the
 	// base64 encoding we added to the private message
 	decryptionString, err := hex.DecodeString(gjson.Get(jsonString, "private").String())
@@ -364,8 +617,13 @@ func hcsMessageResponseHandler (response hedera.MirrorConsensusTopicResponse) {
 		panic(err)
 	}
 
-	//decrypt the encrypted section of the message
-	decryptedText := decryptText(decryptionString, encryptionKey)
+	//decrypt the encrypted section of the message with the tenant's key. Anything we can't decrypt (such as a message
+	// written with a key that isn't in the tenant's keyring) is logged and skipped rather than taking down the server
+	decryptedText, err := t.keyring.decrypt(gjson.Get(jsonString, "public.keyId").String(), decryptionString)
+	if err != nil {
+		log.Printf("Unable to decrypt message %v on topic %v for tenant %v. Error: %v\n", sequenceNumber, topic, t.id, err)
+		return "", false
+	}
 
 	//now update our json string to replace the encrypted private section with the decrypted contents
 	jsonString, err = sjson.SetRaw(jsonString, "private", decryptedText)
@@ -373,10 +631,7 @@ func hcsMessageResponseHandler (response hedera.MirrorConsensusTopicResponse) {
 		panic(err)
 	}
 
-	//fetch the transaction ID from the json data and store the data in our event store so we can pass it to the client
-	txnId := gjson.Get(jsonString, "public.transactionId").String()
-
-	eventStore[txnId] = jsonString
+	return jsonString, true
 }
 
 //This is just a simple error handler for any errors our HCS subscriber throws. You may wish to use more complex error
@@ -402,6 +657,9 @@ type HcsMessageStruct struct {
 		VideoDuration    string `json:"videoDuration"`
 		VideoUrl	     string `json:"videoUrl"`
 		UserAgent        string `json:"userAgent"`
+		Campaign         string `json:"campaign,omitempty"`
+		Advertiser       string `json:"advertiser,omitempty"`
+		Session          string `json:"session,omitempty"`
 	} `json:"private"`
 }
 
@@ -415,34 +673,92 @@ type templateData struct {}
 */
 
 func retrieveHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
 
-	//fetch the transaction ID that is attached to the request and URL decode it
-	transactionId, err := url.QueryUnescape(strings.Split(r.URL.RawQuery, "?")[0])
-	if err != nil {
-		panic(err)
+	//many transaction IDs can be looked up at once by POSTing them (see retrieve.go)
+	if r.Method == http.MethodPost {
+		retrieveBatchHandler(rw, r, t)
+		return
 	}
 
-	urlPrefix := fmt.Sprintf("https://explorer.kabuto.sh/testnet/topic/%v/message/", topicId.String())
+	//fetch the transaction ID that is attached to the request and URL decode it. It can also be given as the
+	// transactionId parameter, alongside a timeout. A bare ID comes first, so anything after the first & (such as the
+	// apiKey parameter) isn't part of it
+	params := r.URL.Query()
+	transactionId := params.Get("transactionId")
+	if transactionId == "" {
+		var err error
+		transactionId, err = url.QueryUnescape(strings.SplitN(r.URL.RawQuery, "&", 2)[0])
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	//check if the transactionId exists in our event store and return the data
-	if hcsResponse, exists := eventStore[transactionId]; exists {
-		sequenceNumber := gjson.Get(hcsResponse, "hcs.sequenceNumber")
-		fmt.Fprint(rw, fmt.Sprintf(`{"url":"%v%v","message":%v}`, urlPrefix, sequenceNumber, hcsResponse))
-	} else {
-		//if the data isnt in the event store yet, then keep looking every 250ms until we find it (keeps the client
-		// connection open so avoids the need for polling on the client side)
-		for {
-			time.Sleep(250 * time.Millisecond)
-			if hcsResponse, exists := eventStore[transactionId]; exists {
-				sequenceNumber := gjson.Get(hcsResponse, "hcs.sequenceNumber")
-				fmt.Fprint(rw, fmt.Sprintf(`{"url":"%v%v","message":%v}`, urlPrefix, sequenceNumber, hcsResponse))
-				break
-			}
+	timeout, err := retrieveTimeout(params.Get("timeout"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//check if the transactionId exists in our event store and return the data. Events belonging to another tenant are
+	// treated as if they don't exist
+	hcsResponse, pending, tenantId := eventStore.lookup(transactionId)
+	if hcsResponse != "" && tenantId == t.id {
+		fmt.Fprint(rw, retrieveResponse(hcsResponse))
+		return
+	}
+
+	//if we never submitted the event (or have forgotten it since a restart), it may still be on the mirror node, but
+	// otherwise there is nothing to wait for
+	if !pending || tenantId != t.id {
+		hcsResponse, err := retrieveFromMirror(r.Context(), t, transactionId)
+		switch err {
+		case nil:
+			fmt.Fprint(rw, retrieveResponse(hcsResponse))
+		case errMirrorLookupsLimited:
+			rw.Header().Set("Retry-After", "60")
+			http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(rw, fmt.Sprintf("unknown transaction ID %v", transactionId), http.StatusNotFound)
 		}
+		return
+	}
+
+	//if the data isnt in the event store yet, then wait for it (keeps the client connection open so avoids the need
+	// for polling on the client side), until the timeout or until the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if hcsResponse, exists := eventStore.waitFor(ctx, transactionId); exists {
+		fmt.Fprint(rw, retrieveResponse(hcsResponse))
+		return
+	}
+
+	if r.Context().Err() != nil {
+		return
 	}
+
+	//the event is still on its way, so the client should ask again
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Retry-After", "1")
+	rw.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(rw, `{"transactionId":"%v","status":"pending"}`, transactionId)
+}
+
+//This function wraps a processed message with a link to it on the explorer (see explorer.go)
+func retrieveResponse(hcsResponse string) string {
+	return fmt.Sprintf(`{"url":"%v","message":%v}`, explorerMessageUrl(hcsResponse), hcsResponse)
 }
 
 func trackingHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireSubmittingTenant(rw, r)
+	if !ok {
+		return
+	}
 
 	//Process the URL to get the query parameters that are sent from the client
 	params, err := url.ParseQuery(strings.Split(r.URL.String(), "?")[1])
@@ -450,6 +766,41 @@ func trackingHandler(rw http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	jsonString, err := trackEvent(t, params)
+	switch err := err.(type) {
+	case nil:
+	case missingParamError:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	case budgetExceededError:
+		rw.Header().Set("Retry-After", strconv.Itoa(err.retryAfter()))
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		panic(err)
+	}
+
+	fmt.Fprint(rw, jsonString)
+}
+
+//the parameters every tracking event must have
+var requiredTrackParams = []string{"event", "localTimestamp", "tzOffset", "additionalInfo", "videoCT", "videoDuration", "videoUrl", "userAgent"}
+
+type missingParamError string
+
+func (e missingParamError) Error() string {
+	return fmt.Sprintf("missing parameter %v", string(e))
+}
+
+//This function builds, encrypts and submits a tracking event for a tenant from its parameters, returning the message
+// that was submitted
+func trackEvent(t *tenant, params url.Values) (string, error) {
+	for _, name := range requiredTrackParams {
+		if len(params[name]) == 0 {
+			return "", missingParamError(name)
+		}
+	}
+
 	//create an instance of our message struct and populate the values
 	message := HcsMessageStruct{}
 
@@ -468,6 +819,11 @@ func trackingHandler(rw http.ResponseWriter, r *http.Request) {
 	message.Private.VideoUrl = params["videoUrl"][0]
 	message.Private.UserAgent = params["userAgent"][0]
 
+	//the campaign, advertiser and session are optional, and can be used to route or shard events across topics
+	message.Private.Campaign = params.Get("campaign")
+	message.Private.Advertiser = params.Get("advertiser")
+	message.Private.Session = params.Get("session")
+
 	//marshal the struct into a JSON string
 	json, err := json.Marshal(message)
 	if err != nil {
@@ -475,8 +831,18 @@ func trackingHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 	jsonString := string(json)
 
-	//encrypt the "private" field of the JSON data
-	encryptedText := encryptText(gjson.Get(jsonString, "private").String(), encryptionKey)
+	//pick the topic this event should be submitted to, before the private section gets encrypted
+	topic := t.route(jsonString)
+
+	//encrypt the "private" field of the JSON data with the tenant's active key, recording which key was used so that
+	// the key can be rotated later
+	keyId, encryptedText := t.keyring.encrypt(gjson.Get(jsonString, "private").String())
+	if keyId != "" {
+		jsonString, err = sjson.Set(jsonString, "public.keyId", keyId)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	//replace the "private" section of the JSON data with the AES-256 encrypted data (which we additionally encode as
 	// a base64 string to aid in portability and readability when trying to render the encoded message data)
@@ -485,13 +851,21 @@ func trackingHandler(rw http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	//Get the client so we can talk to the network
-	client := hedera.ClientForTestnet()
-	client.SetOperator(operatorAccount, operatorPrivateKey)
+	//if a fee budget has been exceeded, stop paying for a transaction per event (see budget.go)
+	if breach, exceeded := budget.check(t); exceeded {
+		switch budget.action {
+		case budgetActionBatch:
+			return batcher.add(t, topic, jsonString, gjson.Get(string(json), "private").Raw, feeAttribution{campaign: message.Private.Campaign, event: message.Public.Event})
+		case budgetActionLocal:
+			return anchorLocally(t, jsonString, gjson.Get(string(json), "private").Raw), nil
+		default:
+			return "", budgetExceededError{breach}
+		}
+	}
 
 	//in order to know the transaction ID before we submit the message, we generate one, which we can then add to the
-	// message itself
-	txnId := hedera.NewTransactionID(operatorAccount)
+	// message itself. The tenant's payer account pays for the transaction
+	txnId := hedera.NewTransactionID(t.payerAccount)
 
 	//add the transactionID to the public information
 	jsonString, err = sjson.Set(jsonString, "public.transactionId", txnId.String())
@@ -499,28 +873,100 @@ func trackingHandler(rw http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	err = submitMessage(t, topic, txnId, []byte(jsonString))
+	if err != nil {
+		return "", err
+	}
+
+	eventStore.markPending(txnId.String(), t.id)
+
+	//fetch the actual fee once the transaction reaches consensus, so it can be charged back to the tenant
+	recordTransactionFee(t, topic, txnId, []feeAttribution{{eventId: txnId.String(), campaign: message.Private.Campaign, event: message.Public.Event}})
+
+	return jsonString, nil
+}
+
+//This function builds, signs and submits a message to a topic, paid for by the tenant's payer account
+func submitMessage(t *tenant, topic routedTopic, txnId hedera.TransactionID, message []byte) error {
+
+	//Get the client so we can talk to the network
+	client := newClient()
+
 	//build the message transaction,
 	builtTxn, err := hedera.NewConsensusMessageSubmitTransaction().
-		SetTopicID(topicId).
+		SetTopicID(topic.topicId).
 		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
-		SetMessage([]byte(jsonString)).
+		SetMessage(message).
 		SetTransactionID(txnId).
 		Build(client)
 
 	if err != nil {
-		panic(fmt.Errorf("Error when attempting to build HCS message submit transaction for topic %v: %v\n", topicId, err))
+		return fmt.Errorf("Error when attempting to build HCS message submit transaction for topic %v: %v\n", topic.topicId, err)
 	}
 
-	_, err = builtTxn.
-		SignWith(submitPrivateKey.PublicKey(), submitPrivateKey.Sign).
-		SignWith(operatorPrivateKey.PublicKey(), operatorPrivateKey.Sign).
-		Execute(client)
-
+	signedTxn, err := signTransaction(builtTxn, topic.submitSigners...)
+	if err == nil {
+		signedTxn, err = signTransaction(signedTxn, t.payerSigner)
+	}
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error when attempting to sign HCS message submit transaction for topic %v: %v\n", topic.topicId, err)
 	}
 
-	fmt.Fprint(rw, jsonString)
+	_, err = signedTxn.Execute(client)
+	return err
+}
+
+//This handler returns up to 1000 of the tenant's messages from every topic in consensus timestamp order as a JSON
+// array, after the message given by the "cursor" parameter. The cursor for the next page is returned in the
+// X-Next-Cursor header, and like the cursors for /events (see events.go) it holds the last message read rather than a
+// position, so messages backfilled into the view don't make pages skip or repeat messages
+func orderedHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	var after orderedKey
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		after, err = decodeEventsCursor(cursor)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//only the requesting tenant's messages are returned, but the cursor moves past every tenant's
+	var messages []string
+	for len(messages) < maxEventsPageSize {
+		page := eventStore.orderedAfter(after, maxEventsPageSize)
+		if len(page) == 0 {
+			break
+		}
+
+		for _, messageJson := range page {
+			if len(messages) == maxEventsPageSize {
+				break
+			}
+			after = orderedKeyOf(messageJson)
+			if gjson.Get(messageJson, "hcs.tenant").String() == t.id {
+				messages = append(messages, messageJson)
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Next-Cursor", encodeEventsCursor(after))
+	fmt.Fprint(rw, "["+strings.Join(messages, ",")+"]")
+}
+
+//This function fetches an event from the event store, only if it belongs to the given tenant
+func tenantEvent(t *tenant, transactionId string) (string, bool) {
+	messageJson, exists := eventStore.get(transactionId)
+	if !exists || gjson.Get(messageJson, "hcs.tenant").String() != t.id {
+		return "", false
+	}
+	return messageJson, true
 }
 
 func demoPageHandler(rw http.ResponseWriter, r *http.Request) {
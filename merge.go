@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//When we subscribe to more than one topic (shards or routed topics), each subscriber delivers its own topic's messages
+// in order, but the topics interleave arbitrarily. Consensus timestamps are assigned by the same network for every
+// topic though, so we can merge the topics back into a single globally ordered view.
+//
+//The merger buffers messages and only releases a message once every topic has moved past its consensus timestamp
+// (the "watermark"), so nothing can arrive later with an earlier timestamp. An idle topic would hold everything up, so
+// a topic that hasn't delivered anything for MERGE_LAG is assumed to have caught up to MERGE_LAG ago. Idleness goes by
+// when the topic's messages arrived rather than their consensus timestamps, so that whilst the subscribers are
+// catching up (resuming after a restart, or behind a slow mirror node) the busy topics still hold the watermark back.
+//
+//As messages are released, a checkpoint is kept for each topic. If CHECKPOINT_FILE is set, the checkpoints are saved
+// there, and after a restart the subscribers replay their topics from the start to fill the event store back up (it
+// only lives in memory). The replayed messages up to each checkpoint were released in order before the restart, so
+// they go straight back into the ordered view, and the merger carries on from the checkpoints
+type mergedMessage struct {
+	topic              string
+	consensusTimestamp time.Time
+	sequenceNumber     uint64
+	messageJsons       []string //a batch message carries several events
+}
+
+type topicCheckpoint struct {
+	ConsensusTimestamp int64  `json:"consensusTimestamp"` //unix nanoseconds
+	SequenceNumber     uint64 `json:"sequenceNumber"`
+}
+
+type topicMerger struct {
+	mutex       sync.Mutex
+	lag         time.Duration
+	buffered    []mergedMessage
+	lastSeen    map[string]time.Time //the latest consensus timestamp from each topic
+	lastArrival map[string]time.Time //when each topic last delivered a message
+	checkpoints map[string]topicCheckpoint
+	dirty       bool
+
+	checkpointFile string
+	onRelease      func(message mergedMessage)
+}
+
+var orderedMerger *topicMerger
+
+//This function creates the merger for the given topics, loading any saved checkpoints, and starts the background
+// loop which releases messages from idle topics and saves the checkpoints
+func startTopicMerger(topics []routedTopic, onRelease func(message mergedMessage)) {
+	merger := newTopicMerger(topics, parseDurationEnv("MERGE_LAG", 5*time.Second), onRelease)
+	merger.checkpointFile = getEnv("CHECKPOINT_FILE", "")
+
+	if merger.checkpointFile != "" {
+		fileContents, err := ioutil.ReadFile(merger.checkpointFile)
+		if err == nil {
+			err = json.Unmarshal(fileContents, &merger.checkpoints)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			panic(fmt.Errorf("Unable to load checkpoints from %v. Error: %v\n", merger.checkpointFile, err))
+		}
+	}
+
+	orderedMerger = merger
+
+	go func() {
+		for {
+			time.Sleep(500 * time.Millisecond)
+			merger.release()
+			merger.saveCheckpoints()
+		}
+	}()
+}
+
+//This function creates a merger for the given topics. A topic that hasn't delivered anything yet counts as having
+// arrived now, so each subscriber has MERGE_LAG to deliver its first message before the others are released past it
+func newTopicMerger(topics []routedTopic, lag time.Duration, onRelease func(message mergedMessage)) *topicMerger {
+	merger := &topicMerger{
+		lag:         lag,
+		lastSeen:    make(map[string]time.Time),
+		lastArrival: make(map[string]time.Time),
+		checkpoints: make(map[string]topicCheckpoint),
+		onRelease:   onRelease,
+	}
+
+	now := time.Now()
+	for _, topic := range topics {
+		merger.lastSeen[topic.topicId.String()] = time.Time{}
+		merger.lastArrival[topic.topicId.String()] = now
+	}
+
+	return merger
+}
+
+//This function returns the saved checkpoint for a topic, which is where its subscriber should resume from
+func (m *topicMerger) checkpoint(topic string) (topicCheckpoint, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	checkpoint, exists := m.checkpoints[topic]
+	return checkpoint, exists
+}
+
+//This function adds a message from one of the topic subscribers
+func (m *topicMerger) add(message mergedMessage) {
+	m.mutex.Lock()
+
+	if message.consensusTimestamp.After(m.lastSeen[message.topic]) {
+		m.lastSeen[message.topic] = message.consensusTimestamp
+	}
+	m.lastArrival[message.topic] = time.Now()
+
+	//anything at or before the checkpoint was released before a restart, and is being replayed, so it goes straight
+	// back into its place in the ordered view
+	if checkpoint, exists := m.checkpoints[message.topic]; exists && message.sequenceNumber <= checkpoint.SequenceNumber {
+		m.onRelease(message)
+		m.mutex.Unlock()
+		return
+	}
+
+	m.buffered = append(m.buffered, message)
+	m.mutex.Unlock()
+
+	m.release()
+}
+
+//This function releases, in consensus timestamp order, every buffered message at or before the watermark
+func (m *topicMerger) release() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	//the watermark is the earliest point any topic could still deliver a message for. A topic that is still
+	// delivering can only be relied on up to its own latest message, however far behind that is, whilst one that has
+	// gone quiet will only deliver messages which reach consensus from now on
+	idleCutoff := time.Now().Add(-m.lag)
+	var watermark time.Time
+	first := true
+	for topic, seen := range m.lastSeen {
+		if m.lastArrival[topic].Before(idleCutoff) && seen.Before(idleCutoff) {
+			seen = idleCutoff
+		}
+		if first || seen.Before(watermark) {
+			watermark = seen
+			first = false
+		}
+	}
+
+	m.releaseUpTo(watermark)
+}
+
+//This function releases every buffered message whatever the watermark, such as at the end of a replay
+func (m *topicMerger) flush() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.releaseUpTo(time.Unix(1<<62, 0))
+}
+
+//This function releases, in consensus timestamp order, every buffered message at or before the watermark. It must be
+// called with the mutex held
+func (m *topicMerger) releaseUpTo(watermark time.Time) {
+	sort.Slice(m.buffered, func(i, j int) bool {
+		if !m.buffered[i].consensusTimestamp.Equal(m.buffered[j].consensusTimestamp) {
+			return m.buffered[i].consensusTimestamp.Before(m.buffered[j].consensusTimestamp)
+		}
+		return m.buffered[i].topic < m.buffered[j].topic
+	})
+
+	released := 0
+	for _, message := range m.buffered {
+		if message.consensusTimestamp.After(watermark) {
+			break
+		}
+
+		m.onRelease(message)
+		m.checkpoints[message.topic] = topicCheckpoint{ConsensusTimestamp: message.consensusTimestamp.UnixNano(), SequenceNumber: message.sequenceNumber}
+		m.dirty = true
+		released++
+	}
+
+	m.buffered = m.buffered[released:]
+	metrics.setGauge("hcs_merge_buffered_messages", "Messages waiting to be released in consensus order", float64(len(m.buffered)))
+}
+
+//This function writes the checkpoints to the checkpoint file, if they have changed since they were last saved
+func (m *topicMerger) saveCheckpoints() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.checkpointFile == "" || !m.dirty {
+		return
+	}
+
+	fileContents, err := json.MarshalIndent(m.checkpoints, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFileAtomically(m.checkpointFile, fileContents, 0644)
+	m.dirty = false
+}
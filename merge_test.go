@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopicMergerRelease(t *testing.T) {
+	lag := 5 * time.Second
+	now := time.Now()
+	old := now.Add(-24 * time.Hour) //consensus timestamps from a day ago, as when catching up
+
+	type delivery struct {
+		topic              string
+		consensusTimestamp time.Time
+	}
+
+	tests := []struct {
+		name        string
+		deliveries  []delivery
+		lastArrival map[string]time.Time //overrides when a topic last delivered
+		released    []string             //topic@offset in minutes, in release order
+	}{
+		{
+			name: "catching up holds back the topic that is ahead",
+			deliveries: []delivery{
+				{"0.0.1", old.Add(1 * time.Minute)},
+				{"0.0.1", old.Add(3 * time.Minute)},
+				{"0.0.2", old.Add(2 * time.Minute)},
+			},
+			released: []string{"0.0.1@1", "0.0.2@2"},
+		},
+		{
+			name: "a topic that has gone quiet doesn't hold back the others",
+			deliveries: []delivery{
+				{"0.0.2", old.Add(1 * time.Minute)},
+				{"0.0.1", old.Add(2 * time.Minute)},
+				{"0.0.1", old.Add(3 * time.Minute)},
+			},
+			lastArrival: map[string]time.Time{"0.0.2": now.Add(-time.Minute)},
+			released:    []string{"0.0.2@1", "0.0.1@2", "0.0.1@3"},
+		},
+		{
+			name: "a topic that hasn't delivered yet holds back the others for the lag",
+			deliveries: []delivery{
+				{"0.0.1", old.Add(1 * time.Minute)},
+			},
+			released: nil,
+		},
+		{
+			name: "a topic that hasn't delivered within the lag is assumed to have caught up",
+			deliveries: []delivery{
+				{"0.0.1", old.Add(1 * time.Minute)},
+				{"0.0.1", old.Add(2 * time.Minute)},
+			},
+			lastArrival: map[string]time.Time{"0.0.2": now.Add(-time.Minute)},
+			released:    []string{"0.0.1@1", "0.0.1@2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var released []string
+			merger := newTopicMerger(testTopics("0.0.1", "0.0.2"), lag, func(message mergedMessage) {
+				released = append(released, fmt.Sprintf("%v@%v", message.topic, int(message.consensusTimestamp.Sub(old).Minutes())))
+			})
+
+			for i, delivery := range test.deliveries {
+				merger.add(mergedMessage{topic: delivery.topic, consensusTimestamp: delivery.consensusTimestamp, sequenceNumber: uint64(i + 1)})
+			}
+			for topic, arrival := range test.lastArrival {
+				merger.lastArrival[topic] = arrival
+			}
+			merger.release()
+
+			if !reflect.DeepEqual(released, test.released) {
+				t.Errorf("released %v, expected %v", released, test.released)
+			}
+		})
+	}
+}
+
+func TestTopicMergerReleasesReplayedMessagesUpToTheCheckpoint(t *testing.T) {
+	var released []uint64
+	merger := newTopicMerger(testTopics("0.0.1", "0.0.2"), 5*time.Second, func(message mergedMessage) {
+		released = append(released, message.sequenceNumber)
+	})
+	merger.checkpoints["0.0.1"] = topicCheckpoint{SequenceNumber: 2}
+
+	//the topic is replayed from its start after a restart, and 0.0.2 hasn't delivered anything yet
+	start := time.Now().Add(-time.Hour)
+	for sequenceNumber := uint64(1); sequenceNumber <= 3; sequenceNumber++ {
+		merger.add(mergedMessage{topic: "0.0.1", consensusTimestamp: start.Add(time.Duration(sequenceNumber) * time.Second), sequenceNumber: sequenceNumber})
+	}
+
+	if !reflect.DeepEqual(released, []uint64{1, 2}) {
+		t.Errorf("released %v, expected the messages up to the checkpoint", released)
+	}
+	if len(merger.buffered) != 1 || merger.buffered[0].sequenceNumber != 3 {
+		t.Errorf("buffered %v, expected message 3 to wait for the watermark", merger.buffered)
+	}
+}
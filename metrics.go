@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//This is a very small metrics registry which serves its values on /metrics in the Prometheus text format. Series are
+// keyed on their full name including any labels, e.g. hcs_topic_seconds_until_expiry{topic="0.0.1234"}, with the help
+// text and type recorded against the name without labels
+type metricsRegistry struct {
+	mutex  sync.Mutex
+	values map[string]float64
+	help   map[string]string
+	types  map[string]string
+}
+
+var metrics = &metricsRegistry{
+	values: make(map[string]float64),
+	help:   make(map[string]string),
+	types:  make(map[string]string),
+}
+
+//This function sets a gauge to the given value
+func (m *metricsRegistry) setGauge(series string, help string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.describe(series, help, "gauge")
+	m.values[series] = value
+}
+
+//This function adds to a counter, creating it if it doesn't exist yet
+func (m *metricsRegistry) addCounter(series string, help string, delta float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.describe(series, help, "counter")
+	m.values[series] += delta
+}
+
+func (m *metricsRegistry) describe(series string, help string, metricType string) {
+	name := metricName(series)
+	m.help[name] = help
+	m.types[name] = metricType
+}
+
+//This function returns the metric name without any labels
+func metricName(series string) string {
+	if labelStart := strings.Index(series, "{"); labelStart >= 0 {
+		return series[:labelStart]
+	}
+	return series
+}
+
+//This function builds a series name with labels, e.g. series("hcs_fees", "tenant", "acme") gives hcs_fees{tenant="acme"}
+func series(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", labels[i], labels[i+1]))
+	}
+	return fmt.Sprintf("%v{%v}", name, strings.Join(pairs, ","))
+}
+
+func metricsHandler(rw http.ResponseWriter, r *http.Request) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	//group the series by metric name so that each name's HELP and TYPE lines are written once
+	seriesByName := make(map[string][]string)
+	for s := range metrics.values {
+		name := metricName(s)
+		seriesByName[name] = append(seriesByName[name], s)
+	}
+
+	names := make([]string, 0, len(seriesByName))
+	for name := range seriesByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(rw, "# HELP %v %v\n# TYPE %v %v\n", name, metrics.help[name], name, metrics.types[name])
+
+		sort.Strings(seriesByName[name])
+		for _, s := range seriesByName[name] {
+			fmt.Fprintf(rw, "%v %v\n", s, metrics.values[s])
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Alongside the gRPC subscription, the mirror node has a REST API for looking up history: a topic's messages (by
+// sequence number, by consensus timestamp or page by page), transactions by ID and a topic's details. The client
+// below talks to MIRROR_REST_URL, which can also be the mirror-simulator's HTTP listener for testing. Leaving it blank
+// switches off the lookups.
+//
+//Lists come back a page at a time, with links.next pointing at the next page, which the client follows for us
+type mirrorRestClient struct {
+	baseUrl    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+//a mirrorTransaction is a transaction in the mirror node REST API's JSON
+type mirrorTransaction struct {
+	ConsensusTimestamp  string `json:"consensus_timestamp"`
+	TransactionId       string `json:"transaction_id"` //in the REST API's 0.0.1234-1590000000-123456789 form
+	ValidStartTimestamp string `json:"valid_start_timestamp"`
+	Name                string `json:"name"`
+	Result              string `json:"result"`
+	EntityId            string `json:"entity_id"`
+	ChargedTxFee        int64  `json:"charged_tx_fee"`
+	MemoBase64          string `json:"memo_base64"`
+}
+
+type mirrorTransactionsPage struct {
+	Transactions []mirrorTransaction `json:"transactions"`
+	Links        struct {
+		Next *string `json:"next"`
+	} `json:"links"`
+}
+
+//a mirrorKey is a key in the mirror node REST API's JSON
+type mirrorKey struct {
+	Type string `json:"_type"`
+	Key  string `json:"key"`
+}
+
+//a mirrorTopicInfo is a topic's details in the mirror node REST API's JSON
+type mirrorTopicInfo struct {
+	TopicId          string     `json:"topic_id"`
+	Memo             string     `json:"memo"`
+	AdminKey         *mirrorKey `json:"admin_key"`
+	SubmitKey        *mirrorKey `json:"submit_key"`
+	AutoRenewAccount string     `json:"auto_renew_account"`
+	AutoRenewPeriod  int64      `json:"auto_renew_period"`
+	CreatedTimestamp string     `json:"created_timestamp"`
+	Deleted          bool       `json:"deleted"`
+}
+
+//errMirrorNotFound is returned when the mirror node doesn't have what was asked for
+var errMirrorNotFound = fmt.Errorf("not found on the mirror node")
+
+func newMirrorRestClient() *mirrorRestClient {
+	return &mirrorRestClient{
+		baseUrl:    strings.TrimRight(getEnv("MIRROR_REST_URL", ""), "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+//This function GETs a path (or a full URL, such as a links.next) from the REST API and decodes the JSON response
+func (c *mirrorRestClient) get(ctx context.Context, pathOrUrl string, params url.Values, into interface{}) error {
+	base, err := url.Parse(c.baseUrl + "/")
+	if err != nil {
+		return fmt.Errorf("invalid MIRROR_REST_URL %q: %v", c.baseUrl, err)
+	}
+	requestUrl, err := base.Parse(pathOrUrl)
+	if err != nil {
+		return err
+	}
+	if len(params) > 0 {
+		requestUrl.RawQuery = params.Encode()
+	}
+
+	request, err := http.NewRequest(http.MethodGet, requestUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if c.apiKey != "" {
+		request.Header.Set("X-Api-Key", c.apiKey)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return errMirrorNotFound
+	case response.StatusCode != http.StatusOK:
+		return fmt.Errorf("%v returned %v: %v", requestUrl, response.Status, strings.TrimSpace(string(body)))
+	}
+
+	err = json.Unmarshal(body, into)
+	if err != nil {
+		return fmt.Errorf("unable to decode %v: %v", requestUrl, err)
+	}
+	return nil
+}
+
+//This function calls onMessage for each of a topic's messages matching the params (such as sequencenumber=gt:10 or
+// timestamp=gte:1590000000), following the pages until they run out or onMessage returns false
+func (c *mirrorRestClient) eachTopicMessage(ctx context.Context, topic string, params url.Values, onMessage func(message mirrorTopicMessage) bool) error {
+	return c.eachTopicMessageFrom(ctx, fmt.Sprintf("api/v1/topics/%v/messages", topic), params, onMessage)
+}
+
+func (c *mirrorRestClient) eachTopicMessageFrom(ctx context.Context, pathOrUrl string, params url.Values, onMessage func(message mirrorTopicMessage) bool) error {
+	for pathOrUrl != "" {
+		var page mirrorTopicMessagesPage
+		if err := c.get(ctx, pathOrUrl, params, &page); err != nil {
+			return err
+		}
+
+		for _, message := range page.Messages {
+			if !onMessage(message) {
+				return nil
+			}
+		}
+
+		//the next link carries its own query
+		pathOrUrl, params = "", nil
+		if page.Links.Next != nil && len(page.Messages) > 0 {
+			pathOrUrl = *page.Links.Next
+		}
+	}
+	return nil
+}
+
+//This function looks up a single topic message by sequence number
+func (c *mirrorRestClient) topicMessage(ctx context.Context, topic string, sequenceNumber uint64) (mirrorTopicMessage, error) {
+	var message mirrorTopicMessage
+	err := c.get(ctx, fmt.Sprintf("api/v1/topics/%v/messages/%v", topic, sequenceNumber), nil, &message)
+	return message, err
+}
+
+//This function looks up a single topic message by its consensus timestamp (in the seconds.nanoseconds form)
+func (c *mirrorRestClient) topicMessageAt(ctx context.Context, consensusTimestamp string) (mirrorTopicMessage, error) {
+	var message mirrorTopicMessage
+	err := c.get(ctx, fmt.Sprintf("api/v1/topics/messages/%v", consensusTimestamp), nil, &message)
+	return message, err
+}
+
+//This function looks up a transaction by its ID, in either the SDK's 0.0.1234@1590000000.123456789 form or the REST
+// API's own form
+func (c *mirrorRestClient) transaction(ctx context.Context, transactionId string) (mirrorTransaction, error) {
+	var page mirrorTransactionsPage
+	err := c.get(ctx, "api/v1/transactions/"+restTransactionId(transactionId), nil, &page)
+	if err != nil {
+		return mirrorTransaction{}, err
+	}
+	if len(page.Transactions) == 0 {
+		return mirrorTransaction{}, errMirrorNotFound
+	}
+
+	//a transaction ID can be reused by a failed transaction, so prefer the one that succeeded
+	for _, transaction := range page.Transactions {
+		if transaction.Result == "SUCCESS" {
+			return transaction, nil
+		}
+	}
+	return page.Transactions[0], nil
+}
+
+//This function looks up a topic's details
+func (c *mirrorRestClient) topicInfo(ctx context.Context, topic string) (mirrorTopicInfo, error) {
+	var info mirrorTopicInfo
+	err := c.get(ctx, "api/v1/topics/"+topic, nil, &info)
+	return info, err
+}
+
+//This function converts a transaction ID from the SDK's 0.0.1234@1590000000.123456789 form into the REST API's
+// 0.0.1234-1590000000-123456789 form
+func restTransactionId(transactionId string) string {
+	parts := strings.SplitN(transactionId, "@", 2)
+	if len(parts) != 2 {
+		return transactionId
+	}
+	return parts[0] + "-" + strings.Replace(parts[1], ".", "-", 1)
+}
+
+//When /retrieve falls back to the mirror node, the message it finds is checked against the running hash of the
+// message before it, which only shows that the mirror node agrees with itself. So it is only stored (in the same way
+// as a backfilled message, see backfill.go) if the messages after it, up to the head of the verified running hash
+// chain, chain on to the head's running hash. Otherwise the event is returned without being stored, for example
+// because it arrived after the head or too far behind it.
+//
+//Every lookup is a request to the mirror node on behalf of a client, so each tenant can make at most
+// MIRROR_LOOKUPS_PER_MINUTE of them, and an ID the mirror node doesn't have is remembered as missing for
+// MIRROR_NOT_FOUND_TTL rather than looked up again
+const (
+	mirrorRetrieveMaxChain   = 1000 //the most messages fetched to chain a message up to the head
+	mirrorNotFoundMaxEntries = 100000
+)
+
+//errMirrorLookupsLimited is returned when a tenant has made too many lookups on the mirror node
+var errMirrorLookupsLimited = fmt.Errorf("too many lookups on the mirror node, please try again shortly")
+
+type mirrorLookupLimiter struct {
+	mutex    sync.Mutex
+	notFound map[string]time.Time //when each missing tenant and ID can be looked up again
+	windows  map[string]time.Time //the start of each tenant's current minute of lookups
+	counts   map[string]int       //the lookups each tenant has made in its current minute
+}
+
+var mirrorLookups = &mirrorLookupLimiter{notFound: make(map[string]time.Time), windows: make(map[string]time.Time), counts: make(map[string]int)}
+
+//This function returns whether a tenant can look up a transaction ID on the mirror node, counting the lookup if so
+func (l *mirrorLookupLimiter) allow(tenantId string, transactionId string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if retryAt, missing := l.notFound[tenantId+" "+transactionId]; missing {
+		if now.Before(retryAt) {
+			return errMirrorNotFound
+		}
+		delete(l.notFound, tenantId+" "+transactionId)
+	}
+
+	if now.Sub(l.windows[tenantId]) >= time.Minute {
+		l.windows[tenantId], l.counts[tenantId] = now, 0
+	}
+	if l.counts[tenantId] >= int(parseFloatEnv("MIRROR_LOOKUPS_PER_MINUTE", 60)) {
+		metrics.addCounter(series("hcs_mirror_lookups_limited_total", "tenant", tenantId), "Lookups on the mirror node refused because the tenant had made too many", 1)
+		return errMirrorLookupsLimited
+	}
+	l.counts[tenantId]++
+	return nil
+}
+
+//This function remembers that the mirror node doesn't have a transaction ID for a tenant
+func (l *mirrorLookupLimiter) missing(tenantId string, transactionId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if len(l.notFound) >= mirrorNotFoundMaxEntries {
+		for key, retryAt := range l.notFound {
+			if now.After(retryAt) {
+				delete(l.notFound, key)
+			}
+		}
+	}
+	if len(l.notFound) < mirrorNotFoundMaxEntries {
+		l.notFound[tenantId+" "+transactionId] = now.Add(parseDurationEnv("MIRROR_NOT_FOUND_TTL", 5*time.Minute))
+	}
+}
+
+//This function looks for an event that isn't in the event store on the mirror node, for /retrieve. The event's
+// transaction is looked up to find the message that carried it, which is checked as described above. Batched events
+// are found through their batch's transaction. It returns errMirrorNotFound if the event can't be found (or isn't the
+// tenant's), and errMirrorLookupsLimited if the tenant has made too many lookups
+func retrieveFromMirror(ctx context.Context, t *tenant, transactionId string) (string, error) {
+	carryingTransactionId := transactionId
+	if at := strings.Index(transactionId, "@"); at >= 0 {
+		if dash := strings.LastIndex(transactionId, "-"); dash > at {
+			carryingTransactionId = transactionId[:dash]
+		}
+	}
+	if _, _, err := parseTransactionId(carryingTransactionId); err != nil {
+		return "", errMirrorNotFound
+	}
+
+	client := newMirrorRestClient()
+	if client.baseUrl == "" {
+		return "", errMirrorNotFound
+	}
+	if err := mirrorLookups.allow(t.id, transactionId); err != nil {
+		return "", err
+	}
+
+	messageJson, found := lookUpOnMirror(ctx, client, t, carryingTransactionId, transactionId)
+	if !found {
+		if ctx.Err() == nil {
+			mirrorLookups.missing(t.id, transactionId)
+		}
+		return "", errMirrorNotFound
+	}
+	return messageJson, nil
+}
+
+//This function fetches the message carrying an event from the mirror node and returns the event, storing it only if
+// the message chains on to the head of the verified running hash chain
+func lookUpOnMirror(ctx context.Context, client *mirrorRestClient, t *tenant, carryingTransactionId string, transactionId string) (string, bool) {
+	transaction, err := client.transaction(ctx, carryingTransactionId)
+	if err != nil || transaction.Result != "SUCCESS" || transaction.Name != "CONSENSUSSUBMITMESSAGE" {
+		return "", false
+	}
+	if _, err := resolveExportTopic([]*tenant{t}, transaction.EntityId); err != nil {
+		return "", false
+	}
+
+	message, err := client.topicMessageAt(ctx, transaction.ConsensusTimestamp)
+	if err != nil {
+		return "", false
+	}
+	topic, response, err := message.response()
+	if err != nil {
+		return "", false
+	}
+
+	//an audit log anchor carries no event, and mustn't be confirmed on the mirror node's word
+	if gjson.GetBytes(response.Message, "public.event").String() == auditAnchorEvent {
+		return "", false
+	}
+
+	chain := newRunningHashChain()
+	if message.SequenceNumber > 1 {
+		_, previous, err := mirrorTopicResponse(ctx, client, message.TopicId, message.SequenceNumber-1)
+		if err != nil || !chain.verify(client.baseUrl, topic, previous) {
+			return "", false
+		}
+	}
+	if !chain.verify(client.baseUrl, topic, response) {
+		return "", false
+	}
+
+	if chainsToHead(ctx, client, chain, topic, response) {
+		for _, messageJson := range storeTopicResponse(t, topic, response) {
+			eventStore.putOrdered(messageJson)
+		}
+		return tenantEvent(t, transactionId)
+	}
+
+	for _, messageJson := range decodeTopicResponse(t, topic, response) {
+		if gjson.Get(messageJson, "public.transactionId").String() == transactionId {
+			return messageJson, true
+		}
+	}
+	return "", false
+}
+
+//This function checks that a message from the mirror node chains on to the head of the verified running hash chain,
+// by fetching the messages after it from the mirror node and adding them to its chain
+func chainsToHead(ctx context.Context, client *mirrorRestClient, chain *runningHashChain, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) bool {
+	head, exists := runningHashes.head(topic.String())
+	if !exists || response.SequenceNumber > head.SequenceNumber || head.SequenceNumber-response.SequenceNumber > mirrorRetrieveMaxChain {
+		return false
+	}
+
+	reached := response.SequenceNumber == head.SequenceNumber
+	if !reached {
+		params := url.Values{"sequencenumber": {fmt.Sprintf("gt:%v", response.SequenceNumber)}}
+		err := client.eachTopicMessage(ctx, topic.String(), params, func(message mirrorTopicMessage) bool {
+			_, next, err := message.response()
+			if err != nil || !chain.verify(client.baseUrl, topic, next) {
+				return false
+			}
+			reached = next.SequenceNumber == head.SequenceNumber
+			return !reached
+		})
+		if err != nil {
+			return false
+		}
+	}
+
+	link, _ := chain.head(topic.String())
+	return reached && link.RunningHash == head.RunningHash
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetrieveFromMirror(t *testing.T) {
+	consensus, responses := testConsensus(t, "0.0.1", 5)
+	var requests int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		consensus.restHandler(rw, r)
+	}))
+	defer mirror.Close()
+
+	head := newRunningHashLink(testTopics("0.0.1")[0].topicId, responses[4])
+	alteredHead := head
+	alteredHead.RunningHash = "00" + alteredHead.RunningHash[2:]
+
+	tests := []struct {
+		name   string
+		head   *runningHashLink
+		stored bool
+	}{
+		{name: "chained to the head", head: &head, stored: true},
+		{name: "without a verified chain", stored: false},
+		{name: "not chained to the head", head: &alteredHead, stored: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestPipeline(t, testTopics("0.0.1"))
+			useTestMirrorLookups(t)
+			t.Setenv("MIRROR_REST_URL", mirror.URL)
+
+			if test.head != nil {
+				runningHashes.seed(*test.head)
+			}
+
+			messageJson, err := retrieveFromMirror(context.Background(), testTenant("0.0.1"), testTransactionId(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if orderedKeyOf(messageJson).TransactionId != testTransactionId(3) {
+				t.Errorf("retrieved %v, expected event %v", messageJson, testTransactionId(3))
+			}
+			if _, stored := eventStore.get(testTransactionId(3)); stored != test.stored {
+				t.Errorf("the event was stored: %v, expected %v", stored, test.stored)
+			}
+		})
+	}
+
+	t.Run("an unknown transaction ID", func(t *testing.T) {
+		useTestPipeline(t, testTopics("0.0.1"))
+		useTestMirrorLookups(t)
+		t.Setenv("MIRROR_REST_URL", mirror.URL)
+
+		atomic.StoreInt32(&requests, 0)
+		for i := 0; i < 3; i++ {
+			if _, err := retrieveFromMirror(context.Background(), testTenant("0.0.1"), testTransactionId(99)); err != errMirrorNotFound {
+				t.Fatalf("expected %v, got %v", errMirrorNotFound, err)
+			}
+		}
+		if requests != 1 {
+			t.Errorf("made %v requests to the mirror node, expected the missing ID to be looked up once", requests)
+		}
+	})
+
+	t.Run("too many lookups", func(t *testing.T) {
+		useTestPipeline(t, testTopics("0.0.1"))
+		useTestMirrorLookups(t)
+		t.Setenv("MIRROR_REST_URL", mirror.URL)
+		t.Setenv("MIRROR_LOOKUPS_PER_MINUTE", "2")
+
+		for i, expected := range []error{errMirrorNotFound, errMirrorNotFound, errMirrorLookupsLimited} {
+			if _, err := retrieveFromMirror(context.Background(), testTenant("0.0.1"), testTransactionId(100+i)); err != expected {
+				t.Errorf("lookup %v: expected %v, got %v", i+1, expected, err)
+			}
+		}
+	})
+}
+
+//This function gives a test its own limits on lookups on the mirror node
+func useTestMirrorLookups(t *testing.T) {
+	saved := mirrorLookups
+	t.Cleanup(func() { mirrorLookups = saved })
+	mirrorLookups = &mirrorLookupLimiter{notFound: make(map[string]time.Time), windows: make(map[string]time.Time), counts: make(map[string]int)}
+}
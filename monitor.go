@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"time"
+)
+
+//The topic is created with an auto-renew period funded by the auto-renew account (the operator by default). If the
+// topic reaches its expiration time and the auto-renew account can't pay for the renewal, the topic is deleted and
+// the audit trail lapses. The monitor periodically checks the topic's expiry and the auto-renew account's balance,
+// exposes both as metrics and raises alerts well before either becomes a problem.
+//
+//It is configured in the demo.env file with:
+//
+//	MONITOR_INTERVAL          how often to check, as a Go duration (default 5m)
+//	MONITOR_EXPIRY_WARNING    alert when the topic expires sooner than this (default 168h)
+//	MONITOR_MIN_BALANCE_HBAR  alert when the auto-renew account holds less than this many hbar (default 10)
+type topicMonitor struct {
+	interval      time.Duration
+	expiryWarning time.Duration
+	minBalance    hedera.Hbar
+
+	//the severity of the alerts that are currently firing (keyed on alert name and topic), so that we only notify when
+	// an alert starts, changes severity or is resolved
+	firing map[string]string
+}
+
+//This function starts the monitor in the background for each of our topics
+func startTopicMonitor() {
+	monitor := topicMonitor{
+		interval:      parseDurationEnv("MONITOR_INTERVAL", 5*time.Minute),
+		expiryWarning: parseDurationEnv("MONITOR_EXPIRY_WARNING", 7*24*time.Hour),
+		minBalance:    hedera.NewHbar(parseFloatEnv("MONITOR_MIN_BALANCE_HBAR", 10)),
+		firing:        make(map[string]string),
+	}
+
+	go func() {
+		for {
+			for _, topic := range allTopics() {
+				monitor.check(topic.topicId)
+			}
+			time.Sleep(monitor.interval)
+		}
+	}()
+}
+
+//This function runs a single check of the topic, updating the metrics and raising or resolving alerts
+func (m *topicMonitor) check(topic hedera.ConsensusTopicID) {
+	client := newClient()
+
+	info, err := getTopicInfo(client, topic)
+	if err != nil {
+		m.setFiring(topic, "topic_info_unavailable", "warning", true, "Unable to query info for topic %v: %v", topic, err)
+		return
+	}
+	m.setFiring(topic, "topic_info_unavailable", "warning", false, "Topic %v info is available again", topic)
+
+	untilExpiry := time.Until(info.ExpirationTime)
+	metrics.setGauge(series("hcs_topic_seconds_until_expiry", "topic", topic.String()), "Seconds until the topic expires", untilExpiry.Seconds())
+	metrics.setGauge(series("hcs_topic_sequence_number", "topic", topic.String()), "The topic's latest sequence number", float64(info.SequenceNumber))
+
+	//a funded auto-renew account will extend the topic when it expires, so the expiry is only critical when there is no
+	// auto-renew account or its balance is too low
+	expirySeverity := "critical"
+	defer func() {
+		m.setFiring(topic, "topic_expiry", expirySeverity, untilExpiry < m.expiryWarning,
+			"Topic %v expires at %v (in %v)", topic, info.ExpirationTime.Format(time.RFC3339), untilExpiry.Round(time.Minute))
+	}()
+
+	//without an auto-renew account, nothing will renew the topic when it expires
+	if info.AutoRenewAccountID == nil {
+		m.setFiring(topic, "topic_no_auto_renew", "critical", true, "Topic %v has no auto-renew account, so will lapse at %v", topic, info.ExpirationTime.Format(time.RFC3339))
+		return
+	}
+	m.setFiring(topic, "topic_no_auto_renew", "critical", false, "Topic %v has an auto-renew account", topic)
+
+	renewAccount := *info.AutoRenewAccountID
+	balance, err := hedera.NewAccountBalanceQuery().
+		SetAccountID(renewAccount).
+		Execute(client)
+
+	if err != nil {
+		expirySeverity = "warning"
+		m.setFiring(topic, "auto_renew_balance_unavailable", "warning", true, "Unable to query the balance of auto-renew account %v: %v", renewAccount, err)
+		return
+	}
+	m.setFiring(topic, "auto_renew_balance_unavailable", "warning", false, "The balance of auto-renew account %v is available again", renewAccount)
+
+	metrics.setGauge(series("hcs_account_balance_tinybar", "account", renewAccount.String()), "The balance of the account in tinybar", float64(balance.AsTinybar()))
+
+	lowBalance := balance.AsTinybar() < m.minBalance.AsTinybar()
+	if !lowBalance {
+		expirySeverity = "warning"
+	}
+	m.setFiring(topic, "auto_renew_balance", "critical", lowBalance,
+		"Auto-renew account %v for topic %v holds %v, below the minimum of %v", renewAccount, topic, balance, m.minBalance)
+}
+
+//This function records whether an alert is firing, notifying when it starts firing, changes severity and when it is
+// resolved
+func (m *topicMonitor) setFiring(topic hedera.ConsensusTopicID, name string, severity string, firing bool, format string, args ...interface{}) {
+	metrics.setGauge(series("hcs_alert_firing", "alert", name, "topic", topic.String()), "Whether the alert is currently firing", boolToFloat(firing))
+
+	firingKey := name + "/" + topic.String()
+	firingSeverity := ""
+	if firing {
+		firingSeverity = severity
+	}
+	if firingSeverity == m.firing[firingKey] {
+		return
+	}
+	m.firing[firingKey] = firingSeverity
+
+	if !firing {
+		severity = "resolved"
+	}
+	raiseAlert(name, severity, format, args...)
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+//These helpers read optional durations and numbers from the environment, panicking if they are malformed
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse %v in demo.env as a duration (e.g. 5m or 168h). Error: %v\n", key, err))
+	}
+	return duration
+}
+
+func parseFloatEnv(key string, defaultValue float64) float64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	var parsed float64
+	_, err := fmt.Sscanf(value, "%g", &parsed)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse %v in demo.env as a number. Error: %v\n", key, err))
+	}
+	return parsed
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+//An Alert is raised when something needs a human to look at it, such as the topic getting close to expiring
+type Alert struct {
+	Name     string    `json:"name"`     //a stable name for the condition, e.g. topic_expiry
+	Severity string    `json:"severity"` //warning, critical or resolved
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+//A Notifier delivers alerts somewhere a human will see them
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+//logNotifier writes alerts to the application log, and is always used
+type logNotifier struct{}
+
+func (logNotifier) Notify(alert Alert) error {
+	log.Printf("ALERT [%v] %v: %v\n", alert.Severity, alert.Name, alert.Message)
+	return nil
+}
+
+//webhookNotifier POSTs each alert as JSON to a URL, such as a chat or paging integration
+type webhookNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (n webhookNotifier) Notify(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	response, err := n.httpClient.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook %v responded with status %v", n.url, response.Status)
+	}
+	return nil
+}
+
+//multiNotifier sends each alert to all of its notifiers
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(alert Alert) error {
+	var lastErr error
+	for _, notifier := range m {
+		err := notifier.Notify(alert)
+		if err != nil {
+			log.Printf("Unable to deliver alert %v. Error: %v\n", alert.Name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+//the notifier used for all alerts in the application, set up by loadNotifier
+var notifier Notifier = logNotifier{}
+
+//This function sets up the notifier from the environment. Alerts are always logged, and are also sent to
+// ALERT_WEBHOOK_URL if it is set
+func loadNotifier() {
+	notifiers := multiNotifier{logNotifier{}}
+
+	if webhookUrl := getEnv("ALERT_WEBHOOK_URL", ""); webhookUrl != "" {
+		notifiers = append(notifiers, webhookNotifier{url: webhookUrl, httpClient: &http.Client{Timeout: 10 * time.Second}})
+	}
+
+	notifier = notifiers
+}
+
+//This function raises an alert, filling in the time
+func raiseAlert(name string, severity string, format string, args ...interface{}) {
+	_ = notifier.Notify(Alert{Name: name, Severity: severity, Message: fmt.Sprintf(format, args...), Time: time.Now()})
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/hashgraph/hedera-sdk-go/proto"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+//The topic admin key is only needed for rare administrative changes, so rather than loading it into the web-server
+// these commands let the change be prepared online, signed on an air-gapped machine and then submitted:
+//
+//	go run . build-topic-update --memo "new memo" --out update.txn      (online, no admin key needed)
+//	go run . sign-transaction --in update.txn --key-file admin.key      (offline, holds the admin key)
+//	go run . submit-transaction --in update.txn                         (online, operator pays the fee)
+//
+//When the topic uses threshold keys, sign-transaction is run once by each party and submit-transaction refuses to
+// submit until enough of them have signed.
+//
+//Transactions are only valid for 180 seconds after their valid start time, so --valid-start can be used to schedule
+// the transaction far enough in the future to allow time for it to be carried to and from the offline machines
+
+//the maximum period a transaction remains valid for after its valid start time
+const maxTransactionValidDuration = 180 * time.Second
+
+//This is the format of the files passed between the build, sign and submit commands. Alongside the transaction bytes
+// we record which keys must sign (and how many of each) and which keys have signed so far. The list of signers is only
+// a note for the people passing the file around, as the signatures in the transaction itself are what get counted
+type transactionFile struct {
+	Kind               string                 `json:"kind"`        //topicCreate, topicUpdate or topicDelete
+	Transaction        string                 `json:"transaction"` //hex encoded transaction bytes
+	Description        string                 `json:"description"`
+	RequiredSignatures []signatureRequirement `json:"requiredSignatures,omitempty"`
+	SignedBy           []string               `json:"signedBy,omitempty"`
+}
+
+type signatureRequirement struct {
+	Name string  `json:"name"`
+	Keys keySpec `json:"keys"`
+}
+
+//This function returns a line for each signature requirement showing how many valid signatures the transaction holds
+func (f transactionFile) signatureProgress(txn hedera.Transaction) ([]string, bool) {
+	var progress []string
+	complete := true
+
+	for _, requirement := range f.RequiredSignatures {
+		signed := requirement.Keys.signedCount(transactionSignedBy(txn, requirement.Keys.Keys))
+		if signed < requirement.Keys.Threshold {
+			complete = false
+		}
+		progress = append(progress, fmt.Sprintf("%v: %v of %v required signatures", requirement.Name, signed, requirement.Keys.Threshold))
+	}
+
+	return progress, complete
+}
+
+//This function returns which of the given public keys have a valid signature on the transaction's body
+func transactionSignedBy(txn hedera.Transaction, keys []string) []string {
+	txnBytes, err := txn.MarshalBinary()
+	if err != nil {
+		panic(fmt.Errorf("Unable to serialise transaction %v. Error: %v\n", txn.ID(), err))
+	}
+
+	var pb proto.Transaction
+	if err = protobuf.Unmarshal(txnBytes, &pb); err != nil {
+		panic(fmt.Errorf("Unable to decode transaction %v. Error: %v\n", txn.ID(), err))
+	}
+
+	var signedBy []string
+	for _, key := range keys {
+		keyBytes := parsePublicKey(key).Bytes()
+		for _, pair := range pb.GetSigMap().GetSigPair() {
+			if bytes.HasPrefix(keyBytes, pair.GetPubKeyPrefix()) && ed25519.Verify(keyBytes, pb.GetBodyBytes(), pair.GetEd25519()) {
+				signedBy = append(signedBy, key)
+				break
+			}
+		}
+	}
+	return signedBy
+}
+
+//This function parses the topic given with --topic (which defaults to TOPIC_ID). Commands that change an existing
+// topic use this rather than loadConfig, which would create a new topic when TOPIC_ID is blank
+func mustParseTopicFlag(topicString string) hedera.ConsensusTopicID {
+	if topicString == "" {
+		panic(fmt.Errorf("Please give the topic with --topic, or set TOPIC_ID in the demo.env file.\n"))
+	}
+
+	topic, err := hedera.TopicIDFromString(topicString)
+	if err != nil {
+		panic(fmt.Errorf("Unable to convert %v into Hedera TopicID. Error: %v\n", topicString, err))
+	}
+	return topic
+}
+
+//This function parses the flags shared by the build-* commands and returns the transaction ID to build with
+func parseBuildFlags(flags *flag.FlagSet, args []string) (hedera.TransactionID, string) {
+	validStart := flags.String("valid-start", "", "when the transaction becomes valid, as RFC3339 (defaults to now)")
+	outFile := flags.String("out", "", "file to write the unsigned transaction to")
+
+	_ = flags.Parse(args)
+
+	if *outFile == "" {
+		panic(fmt.Errorf("Please provide a file to write the transaction to with --out\n"))
+	}
+
+	if *validStart == "" {
+		return hedera.NewTransactionID(operatorAccount), *outFile
+	}
+
+	startTime, err := time.Parse(time.RFC3339, *validStart)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse --valid-start %v as an RFC3339 timestamp. Error: %v\n", *validStart, err))
+	}
+
+	return hedera.NewTransactionIDWithValidStart(operatorAccount, startTime), *outFile
+}
+
+//This function returns the signature requirement for the current admin key, if we know what it is
+func currentAdminRequirement() []signatureRequirement {
+	spec, known := currentAdminKeySpec()
+	if !known {
+		fmt.Printf("Warning: TOPIC_ADMIN_KEYS is not set, so the required admin signatures can't be checked before submitting.\n")
+		return nil
+	}
+	return []signatureRequirement{{Name: "current admin key", Keys: spec}}
+}
+
+//This command builds an unsigned topic create transaction. Unlike the automatic topic creation on startup, this allows
+// threshold admin and submit keys to be used, and the new admin key has to sign before the topic can be created
+func buildTopicCreateCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("build-topic-create", flag.ExitOnError)
+	memo := flags.String("memo", "AdsDax HCS demo topic", "the topic memo")
+	adminKey := flags.String("admin-key", "", "the admin key spec, e.g. 2:<key>,<key>,<key>")
+	submitKey := flags.String("submit-key", "", "the submit key spec, e.g. 1:<key>,<key>")
+	txnId, outFile := parseBuildFlags(flags, args)
+
+	if *adminKey == "" || *submitKey == "" {
+		panic(fmt.Errorf("Please provide both --admin-key and --submit-key\n"))
+	}
+
+	adminSpec := mustParseKeySpec("admin-key", *adminKey)
+	submitSpec := mustParseKeySpec("submit-key", *submitKey)
+
+	builtTxn, err := hedera.NewConsensusTopicCreateTransaction().
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
+		SetTransactionID(txnId).
+		SetTransactionValidDuration(maxTransactionValidDuration).
+		SetTopicMemo(*memo).
+		SetAdminKey(adminSpec.PublicKey()).
+		SetSubmitKey(submitSpec.PublicKey()).
+		SetAutoRenewAccountID(operatorAccount).
+		SetAutoRenewPeriod(7776000 * time.Second).
+		Build(newClient())
+
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to build HCS Topic Create transaction: %v\n", err))
+	}
+
+	writeTransactionFile(transactionFile{
+		Kind:               "topicCreate",
+		Description:        fmt.Sprintf("create topic with admin key %v and submit key %v", adminSpec, submitSpec),
+		RequiredSignatures: []signatureRequirement{{Name: "new admin key", Keys: adminSpec}},
+	}, builtTxn, outFile)
+	fmt.Printf("Wrote unsigned topic create transaction %v to %v\n", builtTxn.ID(), outFile)
+}
+
+//This command builds an unsigned topic update transaction and writes it to a file for offline signing
+func buildTopicUpdateCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("build-topic-update", flag.ExitOnError)
+	topicString := flags.String("topic", os.Getenv("TOPIC_ID"), "the topic to update (defaults to TOPIC_ID)")
+	memo := flags.String("memo", "", "the new topic memo")
+	adminKey := flags.String("admin-key", "", "the new admin key spec")
+	submitKey := flags.String("submit-key", "", "the new submit key spec")
+	txnId, outFile := parseBuildFlags(flags, args)
+	topic := mustParseTopicFlag(*topicString)
+
+	updateTxn := hedera.NewConsensusTopicUpdateTransaction().
+		SetTopicID(topic).
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
+		SetTransactionID(txnId).
+		SetTransactionValidDuration(maxTransactionValidDuration)
+
+	//any admin changes must be signed by the current admin key, and replacing the admin key must also be signed by
+	// the new admin key
+	requirements := currentAdminRequirement()
+	var changes []string
+
+	if *memo != "" {
+		updateTxn = updateTxn.SetTopicMemo(*memo)
+		changes = append(changes, fmt.Sprintf("memo %q", *memo))
+	}
+
+	if *adminKey != "" {
+		adminSpec := mustParseKeySpec("admin-key", *adminKey)
+		updateTxn = updateTxn.SetAdminKey(adminSpec.PublicKey())
+		requirements = append(requirements, signatureRequirement{Name: "new admin key", Keys: adminSpec})
+		changes = append(changes, fmt.Sprintf("admin key %v", adminSpec))
+	}
+
+	if *submitKey != "" {
+		submitSpec := mustParseKeySpec("submit-key", *submitKey)
+		updateTxn = updateTxn.SetSubmitKey(submitSpec.PublicKey())
+		changes = append(changes, fmt.Sprintf("submit key %v", submitSpec))
+	}
+
+	builtTxn, err := updateTxn.Build(newClient())
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to build HCS Topic Update transaction: %v\n", err))
+	}
+
+	writeTransactionFile(transactionFile{
+		Kind:               "topicUpdate",
+		Description:        fmt.Sprintf("update topic %v: %v", topic, strings.Join(changes, ", ")),
+		RequiredSignatures: requirements,
+	}, builtTxn, outFile)
+	fmt.Printf("Wrote unsigned topic update transaction %v to %v\n", builtTxn.ID(), outFile)
+}
+
+//This command builds an unsigned topic delete transaction and writes it to a file for offline signing
+func buildTopicDeleteCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("build-topic-delete", flag.ExitOnError)
+	topicString := flags.String("topic", os.Getenv("TOPIC_ID"), "the topic to delete (defaults to TOPIC_ID)")
+	txnId, outFile := parseBuildFlags(flags, args)
+	topic := mustParseTopicFlag(*topicString)
+
+	builtTxn, err := hedera.NewConsensusTopicDeleteTransaction().
+		SetTopicID(topic).
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
+		SetTransactionID(txnId).
+		SetTransactionValidDuration(maxTransactionValidDuration).
+		Build(newClient())
+
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to build HCS Topic Delete transaction: %v\n", err))
+	}
+
+	writeTransactionFile(transactionFile{
+		Kind:               "topicDelete",
+		Description:        fmt.Sprintf("delete topic %v", topic),
+		RequiredSignatures: currentAdminRequirement(),
+	}, builtTxn, outFile)
+	fmt.Printf("Wrote unsigned topic delete transaction %v to %v\n", builtTxn.ID(), outFile)
+}
+
+//This command signs a transaction file with a private key. It is intended to be run on an air-gapped machine, so it
+// never loads the rest of the configuration or talks to the network. The transaction is printed before signing so
+// the signer can check what they are approving
+func signTransactionCommand(args []string) {
+	flags := flag.NewFlagSet("sign-transaction", flag.ExitOnError)
+	inFile := flags.String("in", "", "the transaction file to sign")
+	outFile := flags.String("out", "", "file to write the signed transaction to (defaults to overwriting --in)")
+	keyFile := flags.String("key-file", "", "file containing the Ed25519 private key to sign with")
+	assumeYes := flags.Bool("yes", false, "sign without asking for confirmation")
+	_ = flags.Parse(args)
+
+	if *inFile == "" || *keyFile == "" {
+		panic(fmt.Errorf("Please provide the transaction with --in and the signing key with --key-file\n"))
+	}
+
+	if *outFile == "" {
+		*outFile = *inFile
+	}
+
+	keyContents, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read private key from %v. Error: %v\n", *keyFile, err))
+	}
+
+	privateKey, err := hedera.Ed25519PrivateKeyFromString(strings.TrimSpace(string(keyContents)))
+	if err != nil {
+		panic(fmt.Errorf("Unable to convert the contents of %v into Hedera Ed25519 Private Key.\n", *keyFile))
+	}
+
+	file, txn := readTransactionFile(*inFile)
+	publicKey := privateKey.PublicKey().String()
+
+	if len(transactionSignedBy(txn, []string{publicKey})) > 0 {
+		fmt.Printf("Transaction %v has already been signed by %v.\n", txn.ID(), publicKey)
+		return
+	}
+
+	progress, _ := file.signatureProgress(txn)
+	fmt.Printf("Transaction %v (%v):\n%v\n\nSignatures so far:\n  %v\n\nSigning with public key %v\n", txn.ID(), file.Description, txn.String(), strings.Join(progress, "\n  "), publicKey)
+	if !*assumeYes && !confirm("Sign this transaction?") {
+		fmt.Printf("Not signing.\n")
+		return
+	}
+
+	signedTxn, err := signTransaction(txn, newLocalSigner(privateKey))
+	if err != nil {
+		panic(fmt.Errorf("Unable to sign transaction %v. Error: %v\n", txn.ID(), err))
+	}
+
+	file.SignedBy = append(file.SignedBy, publicKey)
+	writeTransactionFile(file, signedTxn, *outFile)
+
+	progress, complete := file.signatureProgress(signedTxn)
+	fmt.Printf("Wrote signed transaction to %v\n  %v\n", *outFile, strings.Join(progress, "\n  "))
+	if !complete {
+		fmt.Printf("More signatures are required before this transaction can be submitted.\n")
+	}
+}
+
+//This command adds the operator's signature (as the fee payer) to a signed transaction file and submits it, as long as
+// all of the required signatures have been collected
+func submitTransactionCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("submit-transaction", flag.ExitOnError)
+	inFile := flags.String("in", "", "the signed transaction file to submit")
+	force := flags.Bool("force", false, "submit even if not all of the required signatures have been recorded")
+	_ = flags.Parse(args)
+
+	if *inFile == "" {
+		panic(fmt.Errorf("Please provide the signed transaction with --in\n"))
+	}
+
+	file, txn := readTransactionFile(*inFile)
+
+	//the requirements in the file could have been edited on the way round, so the current admin key is taken from
+	// TOPIC_ADMIN_KEYS instead
+	if file.Kind != "topicCreate" {
+		requirements := currentAdminRequirement()
+		for _, requirement := range file.RequiredSignatures {
+			if requirement.Name != "current admin key" {
+				requirements = append(requirements, requirement)
+			}
+		}
+		file.RequiredSignatures = requirements
+	}
+
+	progress, complete := file.signatureProgress(txn)
+	if !complete && !*force {
+		panic(fmt.Errorf("Transaction %v does not have enough signatures yet:\n  %v\n", txn.ID(), strings.Join(progress, "\n  ")))
+	}
+
+	txn, err := signTransaction(txn, operatorSigner)
+	if err != nil {
+		panic(fmt.Errorf("Unable to sign transaction with the operator key. Error: %v\n", err))
+	}
+
+	client := newClient()
+
+	txnId, err := txn.Execute(client)
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to execute transaction %v: %v\n", txn.ID(), err))
+	}
+
+	receipt, err := txnId.GetReceipt(client)
+	if err != nil {
+		panic(fmt.Errorf("Error when retrieving receipt for transaction %v. Error: %v\n", txnId.String(), err))
+	}
+
+	if receipt.Status != hedera.StatusSuccess {
+		panic(fmt.Errorf("Transaction %v failed (receipt shows non-Success status %v)\n", txnId, receipt.Status))
+	}
+
+	fmt.Printf("Transaction %v (%v) reached consensus with status %v\n", txnId, file.Description, receipt.Status)
+
+	if file.Kind == "topicCreate" {
+		fmt.Printf("Created topic %v. Set TOPIC_ID and TOPIC_ADMIN_KEYS in the demo.env file to start using it.\n", receipt.GetConsensusTopicID())
+	}
+}
+
+//Transaction files are JSON, with the transaction bytes hex encoded so they can be easily copied between machines
+func writeTransactionFile(file transactionFile, txn hedera.Transaction, filepath string) {
+	txnBytes, err := txn.MarshalBinary()
+	if err != nil {
+		panic(fmt.Errorf("Unable to serialise transaction %v. Error: %v\n", txn.ID(), err))
+	}
+
+	file.Transaction = hex.EncodeToString(txnBytes)
+
+	fileContents, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	writeFileAtomically(filepath, fileContents, 0600)
+}
+
+func readTransactionFile(filepath string) (transactionFile, hedera.Transaction) {
+	var file transactionFile
+	var txn hedera.Transaction
+
+	fileContents, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read transaction file %v. Error: %v\n", filepath, err))
+	}
+
+	err = json.Unmarshal(fileContents, &file)
+	if err != nil {
+		panic(fmt.Errorf("Unable to decode transaction file %v. Error: %v\n", filepath, err))
+	}
+
+	txnBytes, err := hex.DecodeString(file.Transaction)
+	if err != nil {
+		panic(fmt.Errorf("Transaction file %v does not contain hex encoded transaction bytes. Error: %v\n", filepath, err))
+	}
+
+	err = txn.UnmarshalBinary(txnBytes)
+	if err != nil {
+		panic(fmt.Errorf("Unable to decode transaction in %v. Error: %v\n", filepath, err))
+	}
+
+	return file, txn
+}
+
+//This function writes a file by writing to a temporary file alongside it and then renaming it into place, so a crash
+// part way through never leaves a half written file behind
+func writeFileAtomically(filepath string, contents []byte, perm os.FileMode) {
+	tempPath := filepath + ".tmp"
+
+	err := ioutil.WriteFile(tempPath, contents, perm)
+	if err == nil {
+		err = os.Rename(tempPath, filepath)
+	}
+
+	if err != nil {
+		panic(fmt.Errorf("An error occured when attempting to write file (%v). Error: %v\n", filepath, err))
+	}
+}
+
+func parsePublicKey(publicKey string) hedera.Ed25519PublicKey {
+	key, err := hedera.Ed25519PublicKeyFromString(publicKey)
+	if err != nil {
+		panic(fmt.Errorf("Unable to convert %v into Hedera Ed25519 Public Key. Error: %v\n", publicKey, err))
+	}
+	return key
+}
+
+//This function asks a yes/no question on the terminal. The question goes to stderr, so stdout stays machine readable
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%v [y/N] ", question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//A single mirror node is a single point of trust: it could drop, delay or alter messages. With MIRROR_ADDRESSES set
+// to a comma separated list of mirror nodes, every topic is followed on all of them at once, and a message is only
+// handled once MIRROR_QUORUM of them (a majority by default) have delivered it with the same content, running hash
+// and consensus timestamp. Each message is handled once, in sequence number order, however many mirrors deliver it.
+//
+//A mirror that delivers something different from the others is reported with a mirror_divergence alert and counted
+// in hcs_mirror_divergence_total. If every mirror still subscribed has delivered a message but no quorum agrees on it,
+// a critical mirror_quorum alert is raised and the topic waits. A mirror whose subscription fails is dropped, which is
+// only fatal once fewer than a quorum remain. The addresses can be any mix of public and local mirror nodes
+const maxRetainedQuorumVotes = 1000
+
+type mirrorQuorum struct {
+	mutex     sync.Mutex
+	addresses []string
+	quorum    int
+	failed    map[string]bool
+	topics    map[string]*quorumTopic
+
+	//called with each message once a quorum agrees on it, in sequence number order, along with the mirrors that agreed
+	onAgreed func(t *tenant, topic hedera.ConsensusTopicID, source string, response hedera.MirrorConsensusTopicResponse)
+}
+
+//a quorumTopic tracks the votes for one of a tenant's topics
+type quorumTopic struct {
+	t     *tenant
+	topic hedera.ConsensusTopicID
+
+	//the next sequence number to hand on, or 0 until the first message reaches a quorum
+	next uint64
+
+	//map[sequenceNumber]map[digest] the candidate delivered by one or more mirrors
+	votes map[uint64]map[string]*quorumCandidate
+
+	//the digest agreed for each recent sequence number, so that mirrors which deliver it later can be checked
+	agreed map[uint64]string
+
+	//messages which have reached a quorum, waiting for the messages before them
+	ready map[uint64]*quorumCandidate
+
+	//map[sequenceNumber] whether the lack of a quorum has been reported
+	reported map[uint64]bool
+}
+
+type quorumCandidate struct {
+	response hedera.MirrorConsensusTopicResponse
+	mirrors  map[string]bool
+}
+
+//This function subscribes to every topic on each of the MIRROR_ADDRESSES, returning false if there aren't any so the
+// single MIRROR_ADDR is used instead
+func subscribeWithQuorum() bool {
+	var addresses []string
+	for _, address := range strings.Split(getEnv("MIRROR_ADDRESSES", ""), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return false
+	}
+
+	quorum := len(addresses)/2 + 1
+	if quorumString := getEnv("MIRROR_QUORUM", ""); quorumString != "" {
+		var err error
+		quorum, err = strconv.Atoi(quorumString)
+		if err != nil || quorum < 1 || quorum > len(addresses) {
+			panic(fmt.Errorf("MIRROR_QUORUM in demo.env should be a number from 1 to %v (the number of MIRROR_ADDRESSES).\n", len(addresses)))
+		}
+	}
+
+	q := newMirrorQuorum(addresses, quorum, tenants, hcsMessageResponseHandler)
+
+	log.Printf("Subscribing to %v mirror nodes, handling messages once %v of them agree\n", len(addresses), quorum)
+
+	for _, address := range addresses {
+		mirrorClient, err := hedera.NewMirrorClient(address)
+		if err != nil {
+			panic(fmt.Errorf("Unable to connect to mirror node %v. Error: %v\n", address, err))
+		}
+
+		for _, qt := range q.topics {
+			mirror, topic := address, qt.topic
+			_, err := resumeTopicQuery(topic).
+				Subscribe(mirrorClient, func(response hedera.MirrorConsensusTopicResponse) {
+					q.vote(mirror, topic, response)
+				}, func(err error) {
+					q.fail(mirror, err)
+				})
+
+			if err != nil {
+				panic(fmt.Errorf("Unable to subscribe to topic %v on mirror node %v. Error: %v\n", topic, mirror, err))
+			}
+		}
+		metrics.setGauge(series("hcs_mirror_subscribed", "mirror", address), "Whether the subscription to a mirror node is still running", 1)
+	}
+
+	return true
+}
+
+//This function sets up the votes for each of the tenants' topics
+func newMirrorQuorum(addresses []string, quorum int, tenants []*tenant, onAgreed func(t *tenant, topic hedera.ConsensusTopicID, source string, response hedera.MirrorConsensusTopicResponse)) *mirrorQuorum {
+	q := &mirrorQuorum{
+		addresses: addresses,
+		quorum:    quorum,
+		failed:    make(map[string]bool),
+		topics:    make(map[string]*quorumTopic),
+		onAgreed:  onAgreed,
+	}
+
+	for _, t := range tenants {
+		for _, topic := range t.topics {
+			q.topics[topic.topicId.String()] = &quorumTopic{
+				t:        t,
+				topic:    topic.topicId,
+				votes:    make(map[uint64]map[string]*quorumCandidate),
+				agreed:   make(map[uint64]string),
+				ready:    make(map[uint64]*quorumCandidate),
+				reported: make(map[uint64]bool),
+			}
+		}
+	}
+
+	return q
+}
+
+//This function records a mirror's delivery of a message, handing on any messages that now have a quorum
+func (q *mirrorQuorum) vote(mirror string, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	qt := q.topics[topic.String()]
+	if qt == nil || q.failed[mirror] {
+		return
+	}
+
+	sequenceNumber := response.SequenceNumber
+	digest := quorumDigest(response)
+
+	//a message that has already been agreed only needs checking against what was agreed
+	if agreed, exists := qt.agreed[sequenceNumber]; exists {
+		if digest != agreed {
+			q.diverged(mirror, topic, sequenceNumber, "it differs from the message agreed by the other mirror nodes")
+		}
+		return
+	}
+	if qt.next != 0 && sequenceNumber < qt.next {
+		return
+	}
+
+	candidates := qt.votes[sequenceNumber]
+	if candidates == nil {
+		candidates = make(map[string]*quorumCandidate)
+		qt.votes[sequenceNumber] = candidates
+	}
+	for otherDigest, candidate := range candidates {
+		if otherDigest != digest && !candidate.mirrors[mirror] {
+			q.diverged(mirror, topic, sequenceNumber, fmt.Sprintf("it differs from the message delivered by %v", strings.Join(sortedKeys(candidate.mirrors), ", ")))
+		}
+	}
+
+	candidate := candidates[digest]
+	if candidate == nil {
+		candidate = &quorumCandidate{response: response, mirrors: make(map[string]bool)}
+		candidates[digest] = candidate
+	}
+	candidate.mirrors[mirror] = true //a mirror delivering the same message twice only counts once
+
+	if len(candidate.mirrors) < q.quorum {
+		q.checkStalled(qt, sequenceNumber)
+		return
+	}
+
+	delete(qt.votes, sequenceNumber)
+	delete(qt.reported, sequenceNumber)
+	qt.agreed[sequenceNumber] = digest
+	qt.ready[sequenceNumber] = candidate
+	if qt.next == 0 {
+		qt.next = sequenceNumber
+	}
+
+	//hand on every message that is now in order. This is done whilst holding the mutex, so that messages are handled
+	// one at a time in sequence number order
+	for {
+		ready, exists := qt.ready[qt.next]
+		if !exists {
+			break
+		}
+		delete(qt.ready, qt.next)
+		q.onAgreed(qt.t, qt.topic, "mirror nodes "+strings.Join(sortedKeys(ready.mirrors), ", "), ready.response)
+		qt.next++
+	}
+
+	for agreedSequenceNumber := range qt.agreed {
+		if agreedSequenceNumber+maxRetainedQuorumVotes < qt.next {
+			delete(qt.agreed, agreedSequenceNumber)
+		}
+	}
+}
+
+//This function raises a critical alert if every mirror still subscribed has delivered a message without agreeing on it.
+// It must be called with the mutex held
+func (q *mirrorQuorum) checkStalled(qt *quorumTopic, sequenceNumber uint64) {
+	voted := make(map[string]bool)
+	for _, candidate := range qt.votes[sequenceNumber] {
+		for mirror := range candidate.mirrors {
+			voted[mirror] = true
+		}
+	}
+
+	if len(voted) < len(q.addresses)-len(q.failed) || qt.reported[sequenceNumber] {
+		return
+	}
+	qt.reported[sequenceNumber] = true
+
+	go raiseAlert("mirror_quorum", "critical", "No %v of the mirror nodes agree on message %v on topic %v, so the topic is waiting", q.quorum, sequenceNumber, qt.topic)
+}
+
+//This function reports a mirror that delivered something different from the others. It must be called with the mutex
+// held
+func (q *mirrorQuorum) diverged(mirror string, topic hedera.ConsensusTopicID, sequenceNumber uint64, reason string) {
+	metrics.addCounter(series("hcs_mirror_divergence_total", "mirror", mirror), "Messages where a mirror node disagreed with the others", 1)
+	go raiseAlert("mirror_divergence", "warning", "Mirror node %v delivered a different message %v on topic %v: %v", mirror, sequenceNumber, topic, reason)
+}
+
+//This function drops a mirror whose subscription has failed, which is only fatal once there are too few left to reach
+// a quorum
+func (q *mirrorQuorum) fail(mirror string, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.failed[mirror] {
+		return
+	}
+	q.failed[mirror] = true
+
+	if len(q.addresses)-len(q.failed) < q.quorum {
+		panic(fmt.Errorf("Received HCS subscriber error from mirror node %v, leaving too few mirror nodes for a quorum of %v: %v\n", mirror, q.quorum, err))
+	}
+
+	metrics.setGauge(series("hcs_mirror_subscribed", "mirror", mirror), "Whether the subscription to a mirror node is still running", 0)
+	go raiseAlert("mirror_subscription", "warning", "The subscription to mirror node %v failed, leaving %v of %v: %v", mirror, len(q.addresses)-len(q.failed), len(q.addresses), err)
+
+	//a message may now be waiting on a mirror that will never deliver it
+	for _, qt := range q.topics {
+		for sequenceNumber := range qt.votes {
+			q.checkStalled(qt, sequenceNumber)
+		}
+	}
+}
+
+//This function returns what the mirrors must agree on: the message, its running hash and its consensus timestamp
+func quorumDigest(response hedera.MirrorConsensusTopicResponse) string {
+	messageHash := sha512.Sum384(response.Message)
+	return fmt.Sprintf("%x:%x:%v", messageHash, response.RunningHash, response.ConsensusTimeStamp.UnixNano())
+}
+
+func sortedKeys(values map[string]bool) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
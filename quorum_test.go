@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"reflect"
+	"testing"
+)
+
+func TestMirrorQuorumVote(t *testing.T) {
+	te := testTenant("0.0.1234")
+	_, responses := testConsensus(t, "0.0.1234", 3)
+
+	altered := responses[0]
+	altered.Message = testEvent(testTransactionId(1), "complete")
+
+	type delivery struct {
+		mirror   string
+		response hedera.MirrorConsensusTopicResponse
+	}
+
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		handled    []string //sequence number from the mirrors that agreed on it, in the order handed on
+		diverged   []string //the mirrors reported as diverging
+	}{
+		{
+			name:       "a single mirror isn't a quorum",
+			deliveries: []delivery{{"a", responses[0]}},
+		},
+		{
+			name:       "a mirror delivering twice only counts once",
+			deliveries: []delivery{{"a", responses[0]}, {"a", responses[0]}},
+		},
+		{
+			name:       "a quorum agrees and the message is handed on once",
+			deliveries: []delivery{{"a", responses[0]}, {"b", responses[0]}, {"c", responses[0]}},
+			handled:    []string{"1 from mirror nodes a, b"},
+		},
+		{
+			name:       "messages are handed on in sequence number order",
+			deliveries: []delivery{{"a", responses[0]}, {"b", responses[0]}, {"a", responses[2]}, {"c", responses[2]}, {"b", responses[1]}, {"c", responses[1]}},
+			handled:    []string{"1 from mirror nodes a, b", "2 from mirror nodes b, c", "3 from mirror nodes a, c"},
+		},
+		{
+			name:       "a mirror that disagrees before the quorum is reached",
+			deliveries: []delivery{{"a", responses[0]}, {"c", altered}, {"b", responses[0]}},
+			handled:    []string{"1 from mirror nodes a, b"},
+			diverged:   []string{"b", "c"}, //until the quorum is reached, b and c have each delivered something different
+		},
+		{
+			name:       "a mirror that disagrees after the quorum is reached",
+			deliveries: []delivery{{"a", responses[0]}, {"b", responses[0]}, {"c", altered}},
+			handled:    []string{"1 from mirror nodes a, b"},
+			diverged:   []string{"c"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			divergences := func(mirror string) float64 {
+				metrics.mutex.Lock()
+				defer metrics.mutex.Unlock()
+				return metrics.values[series("hcs_mirror_divergence_total", "mirror", mirror)]
+			}
+			before := make(map[string]float64)
+			for _, mirror := range []string{"a", "b", "c"} {
+				before[mirror] = divergences(mirror)
+			}
+
+			var handled []string
+			q := newMirrorQuorum([]string{"a", "b", "c"}, 2, []*tenant{te}, func(t *tenant, topic hedera.ConsensusTopicID, source string, response hedera.MirrorConsensusTopicResponse) {
+				handled = append(handled, fmt.Sprintf("%v from %v", response.SequenceNumber, source))
+			})
+
+			for _, delivery := range test.deliveries {
+				q.vote(delivery.mirror, te.topics[0].topicId, delivery.response)
+			}
+
+			if !reflect.DeepEqual(handled, test.handled) {
+				t.Errorf("handed on %v, expected %v", handled, test.handled)
+			}
+
+			var diverged []string
+			for _, mirror := range []string{"a", "b", "c"} {
+				if divergences(mirror) > before[mirror] {
+					diverged = append(diverged, mirror)
+				}
+			}
+			if !reflect.DeepEqual(diverged, test.diverged) {
+				t.Errorf("mirrors %v diverged, expected %v", diverged, test.diverged)
+			}
+		})
+	}
+}
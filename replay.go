@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"time"
+)
+
+//A replay reads a topic's messages afresh from the mirror node, rather than from what the web-server has already
+// processed. The mirror subscription never ends by itself, so the replay stops once it reaches the topic's current
+// sequence number (or the end of the time range). If the mirror goes quiet for REPLAY_IDLE_TIMEOUT before then, a
+// replay up to the latest message fails rather than returning a truncated topic. A replay up to a time has no sequence
+// number to reach, and nor does a replay from a time that nothing has been sent since, so these end quietly once the
+// mirror has gone quiet
+
+//This function replays the messages on a topic with consensus timestamps from from (inclusive) to to (exclusive),
+// calling onMessage for each one in order. A zero from replays from the start of the topic, and a zero to replays up
+// to the latest message
+func replayTopic(topic hedera.ConsensusTopicID, from time.Time, to time.Time, onMessage func(response hedera.MirrorConsensusTopicResponse)) error {
+	info, err := getTopicInfo(newClient(), topic)
+	if err != nil {
+		return fmt.Errorf("unable to query info for topic %v: %v", topic, err)
+	}
+	if info.SequenceNumber == 0 {
+		return nil
+	}
+
+	mirrorClient, err := hedera.NewMirrorClient(mirrorAddress)
+	if err != nil {
+		return fmt.Errorf("unable to connect to mirror node %v: %v", mirrorAddress, err)
+	}
+	defer mirrorClient.Close()
+
+	//the mirror node's start time defaults to now, so the start of the topic has to be asked for explicitly
+	fromStart := from.IsZero()
+	if fromStart {
+		from = time.Unix(0, 0)
+	}
+
+	query := hedera.NewMirrorConsensusTopicQuery().
+		SetTopicID(topic).
+		SetStartTime(from)
+	if !to.IsZero() {
+		query = query.SetEndTime(to)
+	}
+
+	responses := make(chan hedera.MirrorConsensusTopicResponse, 1000)
+	failures := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	handle, err := query.Subscribe(mirrorClient, func(response hedera.MirrorConsensusTopicResponse) {
+		select {
+		case responses <- response:
+		case <-done:
+		}
+	}, func(err error) {
+		select {
+		case failures <- err:
+		default:
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to topic %v: %v", topic, err)
+	}
+	defer handle.Unsubscribe()
+
+	idleTimeout := parseDurationEnv("REPLAY_IDLE_TIMEOUT", 10*time.Second)
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+
+	var lastSequenceNumber uint64
+	for {
+		select {
+		case response := <-responses:
+			if !to.IsZero() && !response.ConsensusTimeStamp.Before(to) {
+				return nil
+			}
+
+			onMessage(response)
+			lastSequenceNumber = response.SequenceNumber
+
+			if response.SequenceNumber >= info.SequenceNumber {
+				return nil
+			}
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(idleTimeout)
+
+		case err := <-failures:
+			return fmt.Errorf("mirror subscription to topic %v failed: %v", topic, err)
+
+		case <-idle.C:
+			//every message after the first one replayed is in range, but a replay from a time may have nothing in it
+			if to.IsZero() && (fromStart || lastSequenceNumber > 0) {
+				return fmt.Errorf("the mirror node went quiet for %v at message %v on topic %v, which has %v messages", idleTimeout, lastSequenceNumber, topic, info.SequenceNumber)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//A /retrieve request waits for its event to reach consensus for up to RETRIEVE_TIMEOUT, or for the timeout parameter
+// if that is shorter, and then responds with a 202 so the client can ask again. Transaction IDs that we never
+// submitted (or that belong to another tenant) get a 404 straight away.
+//
+//Many transaction IDs can be looked up at once by POSTing them to /retrieve as {"transactionIds": ["...", "..."]}.
+// The response lists whichever events are confirmed, along with those still pending and those that are unknown. With
+// a timeout parameter, it waits up to that long for the pending events first
+const maxRetrieveBatchSize = 1000
+
+//This function returns how long a /retrieve request should wait, given its timeout parameter
+func retrieveTimeout(timeoutParam string) (time.Duration, error) {
+	limit := parseDurationEnv("RETRIEVE_TIMEOUT", 30*time.Second)
+	if timeoutParam == "" {
+		return limit, nil
+	}
+
+	timeout, err := time.ParseDuration(timeoutParam)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout %q, should be a duration such as 5s", timeoutParam)
+	}
+
+	if timeout > limit {
+		timeout = limit
+	}
+	return timeout, nil
+}
+
+type retrieveBatchRequest struct {
+	TransactionIds []string `json:"transactionIds"`
+}
+
+type retrieveBatchResponse struct {
+	Confirmed map[string]json.RawMessage `json:"confirmed"` //the same {"url", "message"} as a single /retrieve
+	Pending   []string                   `json:"pending"`
+	Unknown   []string                   `json:"unknown"`
+}
+
+func retrieveBatchHandler(rw http.ResponseWriter, r *http.Request, t *tenant) {
+	var request retrieveBatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<20)).Decode(&request)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("unable to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(request.TransactionIds) > maxRetrieveBatchSize {
+		http.Error(rw, fmt.Sprintf("no more than %v transaction IDs can be retrieved at once", maxRetrieveBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	wait := time.Duration(0)
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		wait, err = retrieveTimeout(timeoutParam)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	response := retrieveBatchResponse{Confirmed: make(map[string]json.RawMessage), Pending: []string{}, Unknown: []string{}}
+	for _, transactionId := range request.TransactionIds {
+		hcsResponse, pending, tenantId := eventStore.lookup(transactionId)
+		if hcsResponse != "" && tenantId == t.id {
+			response.Confirmed[transactionId] = json.RawMessage(retrieveResponse(hcsResponse))
+			continue
+		}
+
+		if !pending || tenantId != t.id {
+			response.Unknown = append(response.Unknown, transactionId)
+			continue
+		}
+
+		//every pending event shares the same deadline
+		if hcsResponse, exists := eventStore.waitFor(ctx, transactionId); exists {
+			response.Confirmed[transactionId] = json.RawMessage(retrieveResponse(hcsResponse))
+		} else {
+			response.Pending = append(response.Pending, transactionId)
+		}
+	}
+
+	if r.Context().Err() != nil {
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(response)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"strings"
+)
+
+//By default every event is submitted to the single TOPIC_ID, however events can also be routed to other topics based
+// on the contents of the message, so that each advertiser, campaign or class of event gets its own ordered stream.
+// Routes are configured in the JSON file named by ROUTES_FILE, e.g.
+//
+//	{
+//	  "topics": [
+//	    {"name": "acme", "topicId": "0.0.1234", "submitKey": "302e..."},
+//	    {"name": "completions", "topicId": "0.0.5678"}
+//	  ],
+//	  "rules": [
+//	    {"match": {"private.advertiser": "acme"}, "topic": "acme"},
+//	    {"match": {"public.event": "complete"}, "topic": "completions"}
+//	  ]
+//	}
+//
+//Rules are checked in order and the first rule where every field matches (case-insensitively) wins. Fields are gjson
+// paths into the message before its private section is encrypted. Events that don't match any rule go to TOPIC_ID,
+// which is always named "default". Each topic can have its own submitKey (a comma separated list of private keys, as
+// with TOPIC_SUBMIT_KEY), otherwise the TOPIC_SUBMIT_KEY signers are used. The submitKey is loaded through the SIGNER,
+// so with a signing daemon or plugin it names the key to sign with instead, e.g. "submitKey": "acme-submit"
+type routesFile struct {
+	Topics []struct {
+		Name      string `json:"name"`
+		TopicId   string `json:"topicId"`
+		SubmitKey string `json:"submitKey"`
+	} `json:"topics"`
+	Rules []routeRule `json:"rules"`
+}
+
+type routeRule struct {
+	Match map[string]string `json:"match"`
+	Topic string            `json:"topic"`
+}
+
+//a routedTopic is one of the topics we submit messages to and subscribe to
+type routedTopic struct {
+	name          string
+	topicId       hedera.ConsensusTopicID
+	submitSigners []Signer
+}
+
+//the name of the topic configured with TOPIC_ID
+const defaultTopicName = "default"
+
+//every topic we know about, starting with the default topic, and the rules used to pick between them
+var routedTopics []routedTopic
+var routeRules []routeRule
+
+//This function loads the routing configuration. It must be called after loadConfig, as the default topic and submit
+// keys are used for any events that don't match a rule
+func loadRoutes() {
+	routedTopics = []routedTopic{{name: defaultTopicName, topicId: topicId, submitSigners: submitSigners}}
+	routeRules = nil
+
+	//shards are added to the routed topics once the routes have been loaded
+	defer loadShards()
+
+	routesFilePath := getEnv("ROUTES_FILE", "")
+	if routesFilePath == "" {
+		return
+	}
+
+	fileContents, err := ioutil.ReadFile(routesFilePath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read routes from %v. Error: %v\n", routesFilePath, err))
+	}
+
+	var routes routesFile
+	err = json.Unmarshal(fileContents, &routes)
+	if err != nil {
+		panic(fmt.Errorf("Unable to decode routes in %v. Error: %v\n", routesFilePath, err))
+	}
+
+	for _, topic := range routes.Topics {
+		if topic.Name == "" || topic.Name == defaultTopicName {
+			panic(fmt.Errorf("Every topic in %v needs a name other than %v\n", routesFilePath, defaultTopicName))
+		}
+
+		if _, exists := findRoutedTopicByName(topic.Name); exists {
+			panic(fmt.Errorf("Topic name %v is used more than once in %v\n", topic.Name, routesFilePath))
+		}
+
+		id, err := hedera.TopicIDFromString(topic.TopicId)
+		if err != nil {
+			panic(fmt.Errorf("Unable to convert topicId %v for topic %v in %v into Hedera TopicID.\n", topic.TopicId, topic.Name, routesFilePath))
+		}
+
+		signers := submitSigners
+		if topic.SubmitKey != "" {
+			signers, err = loadSignersFrom(topic.SubmitKey, topic.SubmitKey, fmt.Sprintf("the submitKey for topic %v in %v", topic.Name, routesFilePath))
+			if err != nil {
+				panic(fmt.Errorf("Unable to load the submit key for topic %v. Error: %v\n", topic.Name, err))
+			}
+		}
+
+		routedTopics = append(routedTopics, routedTopic{name: topic.Name, topicId: id, submitSigners: signers})
+	}
+
+	for _, rule := range routes.Rules {
+		if _, exists := findRoutedTopicByName(rule.Topic); !exists {
+			panic(fmt.Errorf("A rule in %v routes to unknown topic %v\n", routesFilePath, rule.Topic))
+		}
+		routeRules = append(routeRules, rule)
+	}
+}
+
+//This function picks the topic for a message, given as its JSON before the private section is encrypted
+func routeMessage(messageJson string) routedTopic {
+	for _, rule := range routeRules {
+		if rule.matches(messageJson) {
+			topic, _ := findRoutedTopicByName(rule.Topic)
+			return topic
+		}
+	}
+
+	//in sharded mode, anything that isn't routed elsewhere is spread across the shards
+	if shardRing != nil {
+		return shardMessage(messageJson)
+	}
+
+	return routedTopics[0]
+}
+
+func (rule routeRule) matches(messageJson string) bool {
+	for path, expected := range rule.Match {
+		if !strings.EqualFold(gjson.Get(messageJson, path).String(), expected) {
+			return false
+		}
+	}
+	return true
+}
+
+func findRoutedTopicByName(name string) (routedTopic, bool) {
+	for _, topic := range routedTopics {
+		if topic.name == name {
+			return topic, true
+		}
+	}
+	return routedTopic{}, false
+}
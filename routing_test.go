@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/hashgraph/hedera-sdk-go"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRoutesSignsThroughTheSigner(t *testing.T) {
+	privateKeys, publicKeys := testKeys(t, 1)
+	privateKey, err := hedera.Ed25519PrivateKeyFromString(privateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(signerDaemonHandler(map[string]hedera.Ed25519PrivateKey{"acme-submit": privateKey}, ""))
+	defer server.Close()
+
+	routesFilePath := filepath.Join(t.TempDir(), "routes.json")
+	contents := `{"topics":[{"name":"acme","topicId":"0.0.1234","submitKey":"acme-submit"}],"rules":[{"match":{"private.advertiser":"acme"},"topic":"acme"}]}`
+	if err := ioutil.WriteFile(routesFilePath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	savedTopics, savedRules := routedTopics, routeRules
+	t.Cleanup(func() { routedTopics, routeRules = savedTopics, savedRules })
+	t.Setenv("ROUTES_FILE", routesFilePath)
+	t.Setenv("SIGNER", server.URL)
+	loadRoutes()
+
+	acme, exists := findRoutedTopicByName("acme")
+	if !exists || len(acme.submitSigners) != 1 {
+		t.Fatalf("expected the acme topic with a single submit signer, got %v signers", len(acme.submitSigners))
+	}
+	if publicKey := acme.submitSigners[0].PublicKey().String(); publicKey != publicKeys[0] {
+		t.Errorf("the acme topic signs with %v, expected the daemon's acme-submit key %v", publicKey, publicKeys[0])
+	}
+}
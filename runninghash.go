@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Every message on a topic carries a running hash, which chains it to every message before it. With version 3 of the
+// running hash (used by the Hedera network since 2020), it is the SHA-384 hash of:
+//
+//	the previous running hash (48 zero bytes before the first message)
+//	the running hash version, 3                          int64
+//	the payer's shard, realm and account number           int64 each
+//	the topic's shard, realm and topic number             int64 each
+//	the consensus timestamp's seconds                     int64
+//	the consensus timestamp's nanoseconds                 int32
+//	the sequence number                                   int64
+//	the SHA-384 hash of the message                       48 bytes
+//
+//all big-endian, so anyone holding the messages can recompute the chain and prove that none were altered, removed or
+// reordered
+const (
+	runningHashVersion = 3
+	runningHashSize    = sha512.Size384
+
+	//the longest we spend fetching the messages a mirror node skipped over
+	runningHashGapTimeout = 30 * time.Second
+)
+
+//an entityId is the shard, realm and number of an account or topic
+type entityId struct {
+	shard, realm, num int64
+}
+
+func parseEntityId(id string) (entityId, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 3 {
+		return entityId{}, fmt.Errorf("invalid entity ID %q", id)
+	}
+
+	var values [3]int64
+	for i, part := range parts {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return entityId{}, fmt.Errorf("invalid entity ID %q", id)
+		}
+		values[i] = value
+	}
+
+	return entityId{values[0], values[1], values[2]}, nil
+}
+
+//This function splits a transaction ID such as 0.0.1234@1590000000.123456789 into its payer account and valid start
+func parseTransactionId(transactionId string) (entityId, time.Time, error) {
+	parts := strings.Split(transactionId, "@")
+	if len(parts) != 2 {
+		return entityId{}, time.Time{}, fmt.Errorf("invalid transaction ID %q", transactionId)
+	}
+
+	payer, err := parseEntityId(parts[0])
+	if err != nil {
+		return entityId{}, time.Time{}, fmt.Errorf("invalid transaction ID %q", transactionId)
+	}
+
+	validStart, err := parseConsensusTimestamp(parts[1])
+	if err != nil {
+		return entityId{}, time.Time{}, fmt.Errorf("invalid transaction ID %q", transactionId)
+	}
+
+	return payer, validStart, nil
+}
+
+//This function parses a timestamp in the seconds.nanoseconds form used by the mirror node and transaction IDs
+func parseConsensusTimestamp(timestamp string) (time.Time, error) {
+	parts := strings.SplitN(timestamp, ".", 2)
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+
+	var nanoseconds int64
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000000")[:9]
+		nanoseconds, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+	}
+
+	return time.Unix(seconds, nanoseconds).UTC(), nil
+}
+
+func formatConsensusTimestamp(timestamp time.Time) string {
+	return fmt.Sprintf("%d.%09d", timestamp.Unix(), timestamp.Nanosecond())
+}
+
+//This function computes the version 3 running hash of a message from the running hash of the message before it
+func computeRunningHash(previousRunningHash []byte, payer entityId, topic entityId, consensusTimestamp time.Time, sequenceNumber uint64, message []byte) []byte {
+	if len(previousRunningHash) == 0 {
+		previousRunningHash = make([]byte, runningHashSize)
+	}
+
+	messageHash := sha512.Sum384(message)
+
+	var buffer bytes.Buffer
+	buffer.Write(previousRunningHash)
+	for _, value := range []int64{runningHashVersion, payer.shard, payer.realm, payer.num, topic.shard, topic.realm, topic.num, consensusTimestamp.Unix()} {
+		_ = binary.Write(&buffer, binary.BigEndian, value)
+	}
+	_ = binary.Write(&buffer, binary.BigEndian, int32(consensusTimestamp.Nanosecond()))
+	_ = binary.Write(&buffer, binary.BigEndian, int64(sequenceNumber))
+	buffer.Write(messageHash[:])
+
+	runningHash := sha512.Sum384(buffer.Bytes())
+	return runningHash[:]
+}
+
+//The subscribers don't take the mirror node's word for anything: every message is checked against the running hash
+// the mirror node reports for it, recomputed from the running hash of the message before, before it is stored. A
+// message whose running hash doesn't match, or which doesn't follow on from the last verified message, is rejected
+// and raises a critical running_hash alert, so a lying or buggy mirror node can't silently alter the audit trail.
+// When a mirror node skips some messages, they are fetched from MIRROR_REST_URL (if set) before the message after
+// them is checked, and the gap is only reported once however many messages arrive behind it. A message that has
+// already been verified, and can't be checked again, is dropped as a duplicate rather than trusted.
+//
+//The last verified link of each topic's chain is kept in memory, and if RUNNING_HASH_FILE is set every verified link
+// is appended to it as a line of JSON. Only the last link of each topic is ever read back, so the file is rewritten to
+// hold just those when it is loaded and after every runningHashCompactLinks links, writing it alongside and renaming
+// it into place so a crash part way through leaves the old file whole. After a restart, a topic with a saved chain is replayed from its first message
+// (see resumeTopicQuery), rebuilding the chain as it goes, which must arrive back at the saved link before the chain
+// carries on
+type runningHashLink struct {
+	TopicId            string `json:"topicId"`
+	SequenceNumber     uint64 `json:"sequenceNumber"`
+	ConsensusTimestamp int64  `json:"consensusTimestamp"` //unix nanoseconds
+	RunningHash        string `json:"runningHash"`        //hex encoded
+}
+
+type runningHashChain struct {
+	mutex   sync.Mutex
+	heads   map[string]runningHashLink
+	replays map[string]runningHashLink //the chain being rebuilt behind the head after a restart
+	gaps    map[string]uint64          //the head each topic's reported gap follows on from
+	file    *os.File
+
+	filePath string
+	appended int //the links appended to the file since it was last rewritten
+}
+
+//how many links are appended to RUNNING_HASH_FILE before it is rewritten to hold only each topic's last link
+var runningHashCompactLinks = 1000
+
+var runningHashes = newRunningHashChain()
+
+func newRunningHashChain() *runningHashChain {
+	return &runningHashChain{heads: make(map[string]runningHashLink), replays: make(map[string]runningHashLink), gaps: make(map[string]uint64)}
+}
+
+//This function loads the last verified link of each topic's chain from RUNNING_HASH_FILE, and opens it to append to
+func loadRunningHashChain() {
+	chainFilePath := getEnv("RUNNING_HASH_FILE", "")
+	if chainFilePath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(chainFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		panic(fmt.Errorf("Unable to open running hash chain %v. Error: %v\n", chainFilePath, err))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var link runningHashLink
+		err = json.Unmarshal(scanner.Bytes(), &link)
+		if err != nil {
+			panic(fmt.Errorf("Unable to decode line %v of running hash chain %v. Error: %v\n", line, chainFilePath, err))
+		}
+		runningHashes.heads[link.TopicId] = link
+	}
+	if err = scanner.Err(); err != nil {
+		panic(fmt.Errorf("Unable to read running hash chain %v. Error: %v\n", chainFilePath, err))
+	}
+
+	runningHashes.filePath = chainFilePath
+	if err = runningHashes.compact(); err != nil {
+		panic(fmt.Errorf("Unable to rewrite running hash chain %v. Error: %v\n", chainFilePath, err))
+	}
+}
+
+//This function rewrites RUNNING_HASH_FILE to hold only the last link of each topic's chain, and reopens it to append
+// to. It must be called with the mutex held, or before the chain is in use
+func (c *runningHashChain) compact() error {
+	topics := make([]string, 0, len(c.heads))
+	for topic := range c.heads {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var contents []byte
+	for _, topic := range topics {
+		line, err := json.Marshal(c.heads[topic])
+		if err != nil {
+			return err
+		}
+		contents = append(append(contents, line...), '\n')
+	}
+
+	tempPath := c.filePath + ".tmp"
+	temp, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(contents)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, c.filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	file, err := os.OpenFile(c.filePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if c.file != nil {
+		_ = c.file.Close()
+	}
+	c.file = file
+	c.appended = 0
+	return nil
+}
+
+//This function returns the last verified link of a topic's chain
+func (c *runningHashChain) head(topic string) (runningHashLink, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	link, exists := c.heads[topic]
+	return link, exists
+}
+
+//This function checks a message from a mirror node against its running hash, returning whether it can be trusted. The
+// source is the mirror node (or nodes, or file) the message came from, for the alert if it is rejected
+func (c *runningHashChain) verify(source string, topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	topicId := topic.String()
+	head, exists := c.heads[topicId]
+	replaying := exists && response.SequenceNumber <= head.SequenceNumber
+
+	reject := func(format string, args ...interface{}) bool {
+		metrics.addCounter(series("hcs_running_hash_mismatches_total", "topic", topicId), "Messages rejected because they did not match the topic's running hash chain", 1)
+		go raiseAlert("running_hash", "critical", "Rejected message %v on topic %v from %v: %v", response.SequenceNumber, topic, source, fmt.Sprintf(format, args...))
+		return false
+	}
+
+	var previousRunningHash []byte
+	switch {
+	case replaying:
+		//a message we have verified before, delivered again. After a restart the topic is replayed from its first
+		// message, and the chain is rebuilt as it goes and must arrive back at the same head
+		replay, rebuilding := c.replays[topicId]
+		switch {
+		case response.SequenceNumber == 1:
+		case rebuilding && response.SequenceNumber == replay.SequenceNumber+1:
+			previousRunningHash, _ = hex.DecodeString(replay.RunningHash)
+		case rebuilding && response.SequenceNumber > replay.SequenceNumber+1:
+			return reject("messages %v to %v are missing from the replay", replay.SequenceNumber+1, response.SequenceNumber-1)
+		case response.SequenceNumber == head.SequenceNumber && hex.EncodeToString(response.RunningHash) != head.RunningHash:
+			return reject("it has running hash %x, but was verified with %v", response.RunningHash, head.RunningHash)
+		default:
+			//without the message before it we can't check it again, and we already have it
+			return c.duplicate(topicId)
+		}
+
+	case exists && response.SequenceNumber != head.SequenceNumber+1:
+		if c.gaps[topicId] == head.SequenceNumber {
+			metrics.addCounter(series("hcs_running_hash_mismatches_total", "topic", topicId), "Messages rejected because they did not match the topic's running hash chain", 1)
+			return false
+		}
+		c.gaps[topicId] = head.SequenceNumber
+		return reject("messages %v to %v are missing", head.SequenceNumber+1, response.SequenceNumber-1)
+
+	case exists:
+		previousRunningHash, _ = hex.DecodeString(head.RunningHash)
+
+	case response.SequenceNumber != 1:
+		//without the chain so far (e.g. no RUNNING_HASH_FILE), we have to start from the mirror node's word
+		log.Printf("No running hash chain for topic %v, so starting it from message %v\n", topic, response.SequenceNumber)
+		return c.extend(newRunningHashLink(topic, response))
+	}
+
+	payer, _, err := parseTransactionId(gjson.GetBytes(response.Message, "public.transactionId").String())
+	if err != nil {
+		return reject("the payer can't be found, so the running hash can't be verified (%v)", err)
+	}
+
+	topicEntity, _ := parseEntityId(topicId)
+	expected := computeRunningHash(previousRunningHash, payer, topicEntity, response.ConsensusTimeStamp, response.SequenceNumber, response.Message)
+	if !bytes.Equal(expected, response.RunningHash) {
+		return reject("it has running hash %x, but should have %x", response.RunningHash, expected)
+	}
+
+	if replaying {
+		delete(c.replays, topicId)
+		if response.SequenceNumber < head.SequenceNumber {
+			c.replays[topicId] = newRunningHashLink(topic, response)
+		} else if hex.EncodeToString(response.RunningHash) != head.RunningHash {
+			return reject("the rebuilt chain ends at running hash %x, but was verified with %v", response.RunningHash, head.RunningHash)
+		}
+		return true
+	}
+
+	return c.extend(newRunningHashLink(topic, response))
+}
+
+//This function drops a message that has already been verified. It must be called with the mutex held
+func (c *runningHashChain) duplicate(topicId string) bool {
+	metrics.addCounter(series("hcs_running_hash_duplicates_total", "topic", topicId), "Messages dropped because they had already been verified", 1)
+	return false
+}
+
+//This function fetches the messages a mirror node skipped over, between the head of the topic's chain and the message
+// with the given sequence number, from MIRROR_REST_URL and handles them ahead of that message. Anything that can't be
+// fetched is left for verify to reject
+func fillRunningHashGap(t *tenant, topic hedera.ConsensusTopicID, sequenceNumber uint64) {
+	head, exists := runningHashes.head(topic.String())
+	if !exists || sequenceNumber <= head.SequenceNumber+1 {
+		return
+	}
+
+	client := newMirrorRestClient()
+	if client.baseUrl == "" {
+		return
+	}
+
+	log.Printf("Messages %v to %v on topic %v are missing, so fetching them from %v\n", head.SequenceNumber+1, sequenceNumber-1, topic, client.baseUrl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), runningHashGapTimeout)
+	defer cancel()
+
+	params := url.Values{"sequencenumber": {fmt.Sprintf("gt:%v", head.SequenceNumber)}}
+	err := client.eachTopicMessage(ctx, topic.String(), params, func(message mirrorTopicMessage) bool {
+		if message.SequenceNumber >= sequenceNumber {
+			return false
+		}
+		_, missing, err := message.response()
+		return err == nil && handleTopicResponse(t, topic, client.baseUrl, missing)
+	})
+	if err != nil {
+		log.Printf("Unable to fetch the missing messages on topic %v from %v. Error: %v\n", topic, client.baseUrl, err)
+	}
+}
+
+func newRunningHashLink(topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) runningHashLink {
+	return runningHashLink{
+		TopicId:            topic.String(),
+		SequenceNumber:     response.SequenceNumber,
+		ConsensusTimestamp: response.ConsensusTimeStamp.UnixNano(),
+		RunningHash:        hex.EncodeToString(response.RunningHash),
+	}
+}
+
+//This function starts a topic's chain from a link that was verified elsewhere, such as the saved chain's head
+func (c *runningHashChain) seed(link runningHashLink) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.heads[link.TopicId] = link
+}
+
+//This function adds a verified message to the end of a topic's chain. It must be called with the mutex held
+func (c *runningHashChain) extend(link runningHashLink) bool {
+	c.heads[link.TopicId] = link
+	metrics.setGauge(series("hcs_running_hash_verified_sequence_number", "topic", link.TopicId), "The sequence number of the last message verified against the topic's running hash", float64(link.SequenceNumber))
+
+	if c.file != nil {
+		line, err := json.Marshal(link)
+		if err == nil {
+			_, err = c.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			log.Printf("Unable to save running hash for message %v on topic %v. Error: %v\n", link.SequenceNumber, link.TopicId, err)
+		}
+
+		//if the file can't be rewritten, the links carry on being appended to it and it is tried again later
+		if c.appended++; c.appended >= runningHashCompactLinks {
+			if err = c.compact(); err != nil {
+				log.Printf("Unable to rewrite running hash chain %v. Error: %v\n", c.filePath, err)
+				c.appended = 0
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunningHashChainVerify(t *testing.T) {
+	topic, _ := hedera.TopicIDFromString("0.0.1234")
+	_, responses := testConsensus(t, "0.0.1234", 4)
+
+	altered := responses[1]
+	altered.Message = testEvent(testTransactionId(2), "complete")
+
+	rehashed := responses[2]
+	rehashed.RunningHash = append([]byte(nil), rehashed.RunningHash...)
+	rehashed.RunningHash[0] ^= 0x01
+
+	tests := []struct {
+		name       string
+		head       int //the message the saved chain ends at, or 0 for no chain
+		deliveries []hedera.MirrorConsensusTopicResponse
+		accepted   []bool
+	}{
+		{
+			name:       "messages in order",
+			deliveries: responses,
+			accepted:   []bool{true, true, true, true},
+		},
+		{
+			name:       "an altered message",
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[0], altered},
+			accepted:   []bool{true, false},
+		},
+		{
+			name:       "a gap is rejected until it is filled",
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[0], responses[2], responses[3], responses[1], responses[2]},
+			accepted:   []bool{true, false, false, true, true},
+		},
+		{
+			name:       "a duplicate is dropped, unless it can be checked again from the start",
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[0], responses[1], responses[1], responses[0]},
+			accepted:   []bool{true, true, false, true},
+		},
+		{
+			name:       "without a chain, the first message is taken on trust",
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[2], responses[3]},
+			accepted:   []bool{true, true},
+		},
+		{
+			name:       "a restart replays from the start and carries on from the saved head",
+			head:       3,
+			deliveries: responses,
+			accepted:   []bool{true, true, true, true},
+		},
+		{
+			name:       "an altered message is rejected when replayed",
+			head:       3,
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[0], altered},
+			accepted:   []bool{true, false},
+		},
+		{
+			name:       "a gap in the replay is rejected",
+			head:       3,
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[0], responses[2]},
+			accepted:   []bool{true, false},
+		},
+		{
+			name:       "a message behind the head that can't be checked again is dropped",
+			head:       3,
+			deliveries: []hedera.MirrorConsensusTopicResponse{responses[1], responses[3]},
+			accepted:   []bool{false, true},
+		},
+		{
+			name:       "the head delivered with a different running hash",
+			head:       3,
+			deliveries: []hedera.MirrorConsensusTopicResponse{rehashed},
+			accepted:   []bool{false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := newRunningHashChain()
+			if test.head > 0 {
+				chain.heads[topic.String()] = newRunningHashLink(topic, responses[test.head-1])
+			}
+
+			var accepted []bool
+			for _, response := range test.deliveries {
+				accepted = append(accepted, chain.verify("mirror node test", topic, response))
+			}
+			if !reflect.DeepEqual(accepted, test.accepted) {
+				t.Errorf("accepted %v, expected %v", accepted, test.accepted)
+			}
+		})
+	}
+}
+
+func TestRestartWithSavedHeadAndGap(t *testing.T) {
+	te := testTenant("0.0.1234")
+	topic := te.topics[0].topicId
+	consensus, responses := testConsensus(t, "0.0.1234", 6)
+	useTestPipeline(t, te.topics)
+
+	//the chain was saved at message 3 before the restart
+	chainFile := filepath.Join(t.TempDir(), "running-hashes.ndjson")
+	line, _ := json.Marshal(newRunningHashLink(topic, responses[2]))
+	if err := ioutil.WriteFile(chainFile, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RUNNING_HASH_FILE", chainFile)
+	loadRunningHashChain()
+	defer runningHashes.file.Close()
+
+	//the mirror REST API has every message, but the subscription drops message 5
+	server := httptest.NewServer(http.HandlerFunc(consensus.restHandler))
+	defer server.Close()
+	t.Setenv("MIRROR_REST_URL", server.URL)
+
+	for _, i := range []int{1, 2, 3, 4, 6} {
+		hcsMessageResponseHandler(te, topic, "mirror node test", responses[i-1])
+	}
+
+	for i := 1; i <= 6; i++ {
+		if _, exists := eventStore.get(testTransactionId(i)); !exists {
+			t.Errorf("event %v is missing from the store", i)
+		}
+	}
+	if head, _ := runningHashes.head(topic.String()); head.SequenceNumber != 6 {
+		t.Errorf("the chain ends at message %v, expected 6", head.SequenceNumber)
+	}
+}
+
+func TestRunningHashFileKeepsOnlyHeads(t *testing.T) {
+	topicA, _ := hedera.TopicIDFromString("0.0.1")
+	topicB, _ := hedera.TopicIDFromString("0.0.2")
+	_, responsesA := testConsensus(t, "0.0.1", 9)
+	_, responsesB := testConsensus(t, "0.0.2", 2)
+	useTestPipeline(t, testTopics("0.0.1", "0.0.2"))
+
+	savedCompactLinks := runningHashCompactLinks
+	t.Cleanup(func() {
+		runningHashCompactLinks = savedCompactLinks
+	})
+	runningHashCompactLinks = 3
+
+	//the file was appended to by an earlier run, message by message
+	chainFile := filepath.Join(t.TempDir(), "running-hashes.ndjson")
+	var contents []byte
+	for _, link := range []runningHashLink{
+		newRunningHashLink(topicA, responsesA[0]), newRunningHashLink(topicB, responsesB[0]), newRunningHashLink(topicA, responsesA[1]),
+		newRunningHashLink(topicA, responsesA[2]), newRunningHashLink(topicB, responsesB[1]), newRunningHashLink(topicA, responsesA[3]),
+		newRunningHashLink(topicA, responsesA[4]),
+	} {
+		line, _ := json.Marshal(link)
+		contents = append(append(contents, line...), '\n')
+	}
+	if err := ioutil.WriteFile(chainFile, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//This function reads back the links in the file
+	savedLinks := func() []runningHashLink {
+		contents, err := ioutil.ReadFile(chainFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var links []runningHashLink
+		for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			var link runningHashLink
+			if err = json.Unmarshal([]byte(line), &link); err != nil {
+				t.Fatal(err)
+			}
+			links = append(links, link)
+		}
+		return links
+	}
+	extend := func(response hedera.MirrorConsensusTopicResponse) {
+		runningHashes.mutex.Lock()
+		defer runningHashes.mutex.Unlock()
+		runningHashes.extend(newRunningHashLink(topicA, response))
+	}
+
+	t.Setenv("RUNNING_HASH_FILE", chainFile)
+	loadRunningHashChain()
+	defer func() { runningHashes.file.Close() }()
+
+	//loading it leaves only each topic's head
+	expected := []runningHashLink{newRunningHashLink(topicA, responsesA[4]), newRunningHashLink(topicB, responsesB[1])}
+	if links := savedLinks(); !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected the loaded file to hold %+v, got %+v", expected, links)
+	}
+
+	//links are appended until there are runningHashCompactLinks of them, when it is rewritten again
+	extend(responsesA[5])
+	extend(responsesA[6])
+	if links := savedLinks(); len(links) != 4 {
+		t.Errorf("expected 4 links before the file is rewritten, got %+v", links)
+	}
+	extend(responsesA[7])
+	expected = []runningHashLink{newRunningHashLink(topicA, responsesA[7]), newRunningHashLink(topicB, responsesB[1])}
+	if links := savedLinks(); !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected the rewritten file to hold %+v, got %+v", expected, links)
+	}
+	extend(responsesA[8])
+	if links := savedLinks(); len(links) != 3 || !reflect.DeepEqual(links[2], newRunningHashLink(topicA, responsesA[8])) {
+		t.Errorf("expected the next link to be appended to the rewritten file, got %+v", links)
+	}
+
+	//after a restart, the heads are the last links saved
+	runningHashes.file.Close()
+	runningHashes = newRunningHashChain()
+	loadRunningHashChain()
+	for topic, response := range map[string]hedera.MirrorConsensusTopicResponse{"0.0.1": responsesA[8], "0.0.2": responsesB[1]} {
+		if head, _ := runningHashes.head(topic); head.SequenceNumber != response.SequenceNumber {
+			t.Errorf("expected topic %v's head to be message %v, got %v", topic, response.SequenceNumber, head.SequenceNumber)
+		}
+	}
+}
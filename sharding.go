@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+//A single topic is a single ordered stream, which puts a ceiling on how many events we can track. In sharded mode,
+// events that aren't routed to a specific topic are instead spread across several shard topics using consistent
+// hashing on a key from the message (such as the viewing session or campaign), so that every event for the same key
+// lands on the same shard in order. Sharding is configured in the demo.env file with:
+//
+//	SHARD_TOPICS  a comma separated list of topic IDs to shard across
+//	SHARD_KEY     the gjson path of the key to hash on (defaults to private.session)
+//
+//The subscriber merges the shards back into a single view ordered by consensus timestamp (see merge.go)
+
+//the number of points each shard gets on the hash ring. More points spreads the keys more evenly between the shards
+const virtualNodesPerShard = 128
+
+type hashRing struct {
+	points []uint64
+	shards []int //shards[i] owns points[i]
+}
+
+func newHashRing(shardCount int) *hashRing {
+	ring := &hashRing{}
+
+	type ringPoint struct {
+		point uint64
+		shard int
+	}
+	var ringPoints []ringPoint
+
+	for shard := 0; shard < shardCount; shard++ {
+		for node := 0; node < virtualNodesPerShard; node++ {
+			ringPoints = append(ringPoints, ringPoint{point: hashKey(fmt.Sprintf("shard-%v-%v", shard, node)), shard: shard})
+		}
+	}
+
+	sort.Slice(ringPoints, func(i, j int) bool { return ringPoints[i].point < ringPoints[j].point })
+
+	for _, p := range ringPoints {
+		ring.points = append(ring.points, p.point)
+		ring.shards = append(ring.shards, p.shard)
+	}
+
+	return ring
+}
+
+//This function returns the shard that owns the key, which is the first point on the ring at or after the key's hash
+func (r *hashRing) shardFor(key string) int {
+	keyHash := hashKey(key)
+
+	index := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= keyHash })
+	if index == len(r.points) {
+		index = 0
+	}
+
+	return r.shards[index]
+}
+
+func hashKey(key string) uint64 {
+	digest := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(digest[:8])
+}
+
+//the shard topics (in the order they were configured), the ring used to pick between them and the key to hash on
+var shardTopics []routedTopic
+var shardRing *hashRing
+var shardKey string
+
+//events without a shard key are spread across the shards in turn
+var unkeyedShardCounter uint64
+
+//This function loads the shard configuration, adding each shard to the topics we submit to and subscribe to. It is
+// called by loadRoutes
+func loadShards() {
+	shardTopics = nil
+	shardRing = nil
+
+	shardTopicsSetting := getEnv("SHARD_TOPICS", "")
+	if shardTopicsSetting == "" {
+		return
+	}
+
+	for index, topicString := range strings.Split(shardTopicsSetting, ",") {
+		id, err := hedera.TopicIDFromString(strings.TrimSpace(topicString))
+		if err != nil {
+			panic(fmt.Errorf("Unable to convert %v in SHARD_TOPICS into Hedera TopicID.\n", topicString))
+		}
+
+		shard := routedTopic{name: fmt.Sprintf("shard-%v", index), topicId: id, submitSigners: submitSigners}
+		shardTopics = append(shardTopics, shard)
+		routedTopics = append(routedTopics, shard)
+	}
+
+	shardRing = newHashRing(len(shardTopics))
+	shardKey = getEnv("SHARD_KEY", "private.session")
+}
+
+//This function picks the shard topic for a message that hasn't been routed anywhere else
+func shardMessage(messageJson string) routedTopic {
+	key := gjson.Get(messageJson, shardKey).String()
+	if key == "" {
+		return shardTopics[atomic.AddUint64(&unkeyedShardCounter, 1)%uint64(len(shardTopics))]
+	}
+
+	return shardTopics[shardRing.shardFor(key)]
+}
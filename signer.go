@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A Signer produces Ed25519 signatures for a single public key. The demo originally signed everything with private keys
+// held in process memory, but by going through this interface the keys can instead live in a separate signing daemon
+// (reached over a Unix socket or HTTP) or behind an external plugin such as a PKCS#11 / HSM bridge, meaning the
+// web-facing process never needs to see the raw private keys
+type Signer interface {
+	PublicKey() hedera.Ed25519PublicKey
+	Sign(message []byte) ([]byte, error)
+}
+
+//the names used to look up keys from a remote signer. These match the names used by the signer-daemon command
+const (
+	operatorKeyName = "operator"
+	adminKeyName    = "admin"
+	submitKeyName   = "submit"
+)
+
+//localSigner is the simplest Signer, and just wraps a private key held in memory
+type localSigner struct {
+	privateKey hedera.Ed25519PrivateKey
+}
+
+func newLocalSigner(privateKey hedera.Ed25519PrivateKey) Signer {
+	return localSigner{privateKey: privateKey}
+}
+
+func (s localSigner) PublicKey() hedera.Ed25519PublicKey {
+	return s.privateKey.PublicKey()
+}
+
+func (s localSigner) Sign(message []byte) ([]byte, error) {
+	return s.privateKey.Sign(message), nil
+}
+
+//remoteSigner asks a signing daemon to sign on our behalf. The daemon can be reached either over HTTP or a Unix
+// socket, with both using the same small JSON protocol (see signerdaemon.go)
+type remoteSigner struct {
+	httpClient *http.Client
+	baseUrl    string
+	keyName    string
+	token      string //sent to the daemon with every request, if set (see signerdaemon.go)
+	publicKey  hedera.Ed25519PublicKey
+}
+
+//the request and response bodies used when talking to a signing daemon
+type signRequest struct {
+	Key     string `json:"key"`
+	Message string `json:"message"` //hex encoded
+}
+
+type signResponse struct {
+	PublicKey string `json:"publicKey,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//This function creates a Signer backed by a signing daemon. The address can either be an http(s):// URL or a
+// unix:/path/to/socket address. The public key is fetched from the daemon up front so that we fail early if the daemon
+// doesn't hold the key we need
+func newRemoteSigner(address string, keyName string) (Signer, error) {
+	signer := remoteSigner{keyName: keyName, token: getEnv("SIGNER_TOKEN", "")}
+
+	if strings.HasPrefix(address, "unix:") {
+		socketPath := strings.TrimPrefix(address, "unix:")
+		signer.baseUrl = "http://signer"
+		signer.httpClient = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+	} else {
+		signer.baseUrl = strings.TrimSuffix(address, "/")
+		signer.httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	response, err := signer.call("/publicKey", signRequest{Key: keyName})
+	if err != nil {
+		return nil, err
+	}
+
+	signer.publicKey, err = hedera.Ed25519PublicKeyFromString(response.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("signer at %v returned an invalid public key for %v: %v", address, keyName, err)
+	}
+
+	return signer, nil
+}
+
+func (s remoteSigner) PublicKey() hedera.Ed25519PublicKey {
+	return s.publicKey
+}
+
+func (s remoteSigner) Sign(message []byte) ([]byte, error) {
+	response, err := s.call("/sign", signRequest{Key: s.keyName, Message: hex.EncodeToString(message)})
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(response.Signature)
+}
+
+//This function posts a request to the signing daemon and decodes the response
+func (s remoteSigner) call(path string, request signRequest) (signResponse, error) {
+	var response signResponse
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, s.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	httpResponse, err := s.httpClient.Do(httpRequest)
+	if err != nil {
+		return response, fmt.Errorf("unable to reach signer for key %v: %v", request.Key, err)
+	}
+	defer httpResponse.Body.Close()
+
+	err = json.NewDecoder(httpResponse.Body).Decode(&response)
+	if err != nil {
+		return response, fmt.Errorf("unable to decode signer response for key %v: %v", request.Key, err)
+	}
+
+	if response.Error != "" || httpResponse.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("signer refused request for key %v (status %v): %v", request.Key, httpResponse.StatusCode, response.Error)
+	}
+
+	return response, nil
+}
+
+//pluginSigner shells out to an external program for every signature. This keeps the plugin contract simple enough to
+// wrap a PKCS#11 module, cloud KMS or hardware wallet in a few lines of script:
+//
+//	<plugin> public-key <keyName>        prints the hex/DER public key on stdout
+//	<plugin> sign <keyName>              reads the hex message on stdin, prints the hex signature on stdout
+type pluginSigner struct {
+	pluginPath string
+	keyName    string
+	publicKey  hedera.Ed25519PublicKey
+}
+
+func newPluginSigner(pluginPath string, keyName string) (Signer, error) {
+	signer := pluginSigner{pluginPath: pluginPath, keyName: keyName}
+
+	output, err := signer.run(nil, "public-key", keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer.publicKey, err = hedera.Ed25519PublicKeyFromString(output)
+	if err != nil {
+		return nil, fmt.Errorf("signing plugin %v returned an invalid public key for %v: %v", pluginPath, keyName, err)
+	}
+
+	return signer, nil
+}
+
+func (s pluginSigner) PublicKey() hedera.Ed25519PublicKey {
+	return s.publicKey
+}
+
+func (s pluginSigner) Sign(message []byte) ([]byte, error) {
+	output, err := s.run([]byte(hex.EncodeToString(message)), "sign", s.keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(output)
+}
+
+//This function runs the plugin with the given arguments and returns its trimmed stdout
+func (s pluginSigner) run(stdin []byte, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.pluginPath, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("signing plugin %v %v failed: %v (%v)", s.pluginPath, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+//This function builds the Signer for a named key based on the SIGNER setting in the demo.env file:
+//
+//	SIGNER=""                          use the private key from the demo.env file (the default)
+//	SIGNER="unix:/tmp/hcs-signer.sock" use a signing daemon listening on a Unix socket
+//	SIGNER="http://127.0.0.1:5601"     use a signing daemon listening over HTTP
+//	SIGNER="plugin:/path/to/binary"    use an external signing plugin
+//
+//For the local signer the private key is read from the environment variable named by envKey
+func loadSigner(keyName string, envKey string) (Signer, error) {
+	signerSetting := strings.TrimSpace(getEnv("SIGNER", "local"))
+
+	switch {
+	case signerSetting == "local":
+		privateKeyString := getEnv(envKey, "")
+		if privateKeyString == "" {
+			return nil, fmt.Errorf("%v is not set in the demo.env file", envKey)
+		}
+
+		privateKey, err := hedera.Ed25519PrivateKeyFromString(privateKeyString)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert %v in demo.env into Hedera Ed25519 Private Key. Please check the format in the demo.env file", envKey)
+		}
+
+		return newLocalSigner(privateKey), nil
+	case strings.HasPrefix(signerSetting, "plugin:"):
+		return newPluginSigner(strings.TrimPrefix(signerSetting, "plugin:"), keyName)
+	case strings.HasPrefix(signerSetting, "unix:"), strings.HasPrefix(signerSetting, "http://"), strings.HasPrefix(signerSetting, "https://"):
+		return newRemoteSigner(signerSetting, keyName)
+	}
+
+	return nil, fmt.Errorf("unrecognised SIGNER value %v (expected local, unix:<path>, http(s)://<host> or plugin:<path>)", signerSetting)
+}
+
+//This function loads one or more signers for a named key. When signing locally, the environment variable can hold a
+// comma separated list of private keys (e.g. when a threshold key needs several signatures). Remote signers and
+// plugins hold the keys themselves, so SIGNER_<NAME>_KEYS (e.g. SIGNER_SUBMIT_KEYS) gives how many they hold. When it
+// is more than one, the keys are asked for by index as <name>-0, <name>-1 and so on
+func loadSigners(keyName string, envKey string) ([]Signer, error) {
+	return loadSignersFrom(keyName, getEnv(envKey, ""), envKey+" in the demo.env file")
+}
+
+//This function loads one or more signers for a named key as loadSigners does, but with the local private keys given
+// directly rather than read from demo.env. The source describes where they came from, for the errors
+func loadSignersFrom(keyName string, privateKeys string, source string) ([]Signer, error) {
+	if getEnv("SIGNER", "local") != "local" {
+		countKey := "SIGNER_" + signerEnvName(keyName) + "_KEYS"
+		count, err := strconv.Atoi(getEnv(countKey, "1"))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("%v in demo.env should be the number of %v keys the signer holds", countKey, keyName)
+		}
+
+		if count == 1 {
+			signer, err := loadSigner(keyName, "")
+			if err != nil {
+				return nil, err
+			}
+			return []Signer{signer}, nil
+		}
+
+		var signers []Signer
+		for index := 0; index < count; index++ {
+			signer, err := loadSigner(fmt.Sprintf("%v-%v", keyName, index), "")
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, signer)
+		}
+		return signers, nil
+	}
+
+	var signers []Signer
+	for _, privateKeyString := range strings.Split(privateKeys, ",") {
+		privateKeyString = strings.TrimSpace(privateKeyString)
+		if privateKeyString == "" {
+			continue
+		}
+
+		privateKey, err := hedera.Ed25519PrivateKeyFromString(privateKeyString)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert %v into Hedera Ed25519 Private Key. Please check its format", source)
+		}
+		signers = append(signers, newLocalSigner(privateKey))
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("%v is not set", source)
+	}
+
+	return signers, nil
+}
+
+//This function returns a key name as it appears in an environment variable, so that the count for the acme-submit key
+// is SIGNER_ACME_SUBMIT_KEYS
+func signerEnvName(keyName string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(keyName))
+}
+
+//This function signs a transaction with each of the given signers. The SDK's SignWith expects a signing function that
+// can't fail, so we capture any error from the signer and report it once SignWith returns
+func signTransaction(txn hedera.Transaction, signers ...Signer) (hedera.Transaction, error) {
+	for _, signer := range signers {
+		var signErr error
+
+		txn = txn.SignWith(signer.PublicKey(), func(message []byte) []byte {
+			signature, err := signer.Sign(message)
+			if err != nil {
+				signErr = err
+			}
+			return signature
+		})
+
+		if signErr != nil {
+			return txn, signErr
+		}
+	}
+
+	return txn, nil
+}
+
+//This function returns a testnet client with the operator set up to sign through our operator Signer, so that
+// queries requiring payment also go through the same signing path as our transactions
+func newClient() *hedera.Client {
+	client := hedera.ClientForTestnet()
+	client.SetOperatorWith(operatorAccount, operatorSigner.PublicKey(), func(message []byte) []byte {
+		signature, err := operatorSigner.Sign(message)
+		if err != nil {
+			panic(fmt.Errorf("Unable to sign with the operator key. Error: %v\n", err))
+		}
+		return signature
+	})
+
+	return client
+}
+
+//This small helper reads an environment variable, falling back to a default value if it is blank
+func getEnv(key string, defaultValue string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/joho/godotenv"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+//This is a reference signing daemon for local testing. It holds the operator, topic admin and topic submit keys (and
+// the keys of any tenants and routed topics in the TENANTS_FILE and ROUTES_FILE named in its env file) and signs on
+// request, so the web-facing process can be started with SIGNER="unix:..." or SIGNER="http://..." and never load the
+// raw private keys. It reads its keys from its own env file (SIGNER_DAEMON_ENV, defaulting to demo.env) and listens on
+// SIGNER_DAEMON_LISTEN, which can be either a unix:/path/to/socket or a host:port address.
+//
+//A unix socket is only accessible to its owner, whilst over TCP every caller has to send the shared SIGNER_TOKEN (which
+// is also checked on a unix socket if it is set). In production you would want this to run as a separate user (or on a
+// separate host) with access to an HSM, and behind TLS when it is reached over the network
+func signerDaemonCommand(args []string) {
+	envFile := getEnv("SIGNER_DAEMON_ENV", "demo.env")
+	if len(args) > 0 {
+		envFile = args[0]
+	}
+
+	keyFile, err := godotenv.Read(envFile)
+	if err != nil {
+		panic(fmt.Errorf("Unable to load signing keys from %v. Error:\n%v\n", envFile, err))
+	}
+
+	//load whichever keys are present in the env file. Not every daemon has to hold every key. A comma separated list of
+	// keys (for a threshold key) is served by index as <name>-0, <name>-1 and so on, with the first also served as <name>
+	keys := make(map[string]hedera.Ed25519PrivateKey)
+	addKeys := func(keyName string, privateKeys string, source string) {
+		for index, privateKeyString := range strings.Split(privateKeys, ",") {
+			privateKey, err := hedera.Ed25519PrivateKeyFromString(strings.TrimSpace(privateKeyString))
+			if err != nil {
+				panic(fmt.Errorf("Unable to convert %v into Hedera Ed25519 Private Key.\n", source))
+			}
+
+			indexedName := fmt.Sprintf("%v-%v", keyName, index)
+			keys[indexedName] = privateKey
+			if index == 0 {
+				keys[keyName] = privateKey
+			}
+			fmt.Printf("Loaded %v key %v\n", indexedName, privateKey.PublicKey().String())
+		}
+	}
+
+	for keyName, envKey := range map[string]string{operatorKeyName: "OPERATOR_KEY", adminKeyName: "TOPIC_ADMIN_KEY", submitKeyName: "TOPIC_SUBMIT_KEY"} {
+		if keyFile[envKey] != "" {
+			addKeys(keyName, keyFile[envKey], fmt.Sprintf("%v in %v", envKey, envFile))
+		}
+	}
+
+	//the tenants' own submit and payer keys (see tenants.go) are served as <id>-submit and <id>-payer
+	if tenantsFilePath := keyFile["TENANTS_FILE"]; tenantsFilePath != "" {
+		fileContents, err := ioutil.ReadFile(tenantsFilePath)
+		if err != nil {
+			panic(fmt.Errorf("Unable to read tenants from %v. Error: %v\n", tenantsFilePath, err))
+		}
+
+		var file tenantsFile
+		if err = json.Unmarshal(fileContents, &file); err != nil {
+			panic(fmt.Errorf("Unable to decode tenants in %v. Error: %v\n", tenantsFilePath, err))
+		}
+
+		for _, config := range file.Tenants {
+			if config.SubmitKey != "" {
+				addKeys(config.Id+"-"+submitKeyName, config.SubmitKey, fmt.Sprintf("the submitKey for tenant %v in %v", config.Id, tenantsFilePath))
+			}
+			if config.PayerKey != "" {
+				addKeys(config.Id+"-payer", config.PayerKey, fmt.Sprintf("the payerKey for tenant %v in %v", config.Id, tenantsFilePath))
+			}
+		}
+	}
+
+	//the routed topics' submit keys (see routing.go) are served as <name>-submit
+	if routesFilePath := keyFile["ROUTES_FILE"]; routesFilePath != "" {
+		fileContents, err := ioutil.ReadFile(routesFilePath)
+		if err != nil {
+			panic(fmt.Errorf("Unable to read routes from %v. Error: %v\n", routesFilePath, err))
+		}
+
+		var routes routesFile
+		if err = json.Unmarshal(fileContents, &routes); err != nil {
+			panic(fmt.Errorf("Unable to decode routes in %v. Error: %v\n", routesFilePath, err))
+		}
+
+		for _, topic := range routes.Topics {
+			if topic.SubmitKey != "" {
+				addKeys(topic.Name+"-"+submitKeyName, topic.SubmitKey, fmt.Sprintf("the submitKey for topic %v in %v", topic.Name, routesFilePath))
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		panic(fmt.Errorf("No keys were found in %v, so the signing daemon has nothing to sign with.\n", envFile))
+	}
+
+	//the daemon hands out signatures to anyone who can reach it, so over TCP (where any local user, or any host if it
+	// isn't bound to localhost, can connect) its callers have to present the shared SIGNER_TOKEN
+	token := getEnv("SIGNER_TOKEN", keyFile["SIGNER_TOKEN"])
+	handler := signerDaemonHandler(keys, token)
+
+	listenAddress := getEnv("SIGNER_DAEMON_LISTEN", "unix:/tmp/hcs-signer.sock")
+
+	var listener net.Listener
+	if strings.HasPrefix(listenAddress, "unix:") {
+		socketPath := strings.TrimPrefix(listenAddress, "unix:")
+
+		//remove any stale socket left behind by a previous run
+		_ = os.Remove(socketPath)
+
+		//the socket is created with the umask's permissions, so it is restricted to its owner from the start rather than
+		// being chmod'ed afterwards, which would leave a moment where anyone could connect
+		previousUmask := syscall.Umask(0177)
+		listener, err = net.Listen("unix", socketPath)
+		syscall.Umask(previousUmask)
+	} else {
+		if token == "" {
+			panic(fmt.Errorf("Please set SIGNER_TOKEN before listening on %v, so that only the web-server can ask the signing daemon for signatures.\n", listenAddress))
+		}
+		listener, err = net.Listen("tcp", listenAddress)
+	}
+
+	if err != nil {
+		panic(fmt.Errorf("Unable to listen on %v. Error: %v\n", listenAddress, err))
+	}
+
+	fmt.Printf("Signing daemon listening on %v\n", listenAddress)
+	log.Fatal(http.Serve(listener, handler))
+}
+
+//This function serves the daemon's endpoints, signing with the given keys. If token is set, every request must carry it
+// as an "Authorization: Bearer <token>" header
+func signerDaemonHandler(keys map[string]hedera.Ed25519PrivateKey, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publicKey", func(rw http.ResponseWriter, r *http.Request) {
+		request, privateKey, ok := decodeSignRequest(rw, r, keys)
+		if !ok {
+			return
+		}
+		writeSignResponse(rw, http.StatusOK, signResponse{PublicKey: privateKey.PublicKey().String()})
+		log.Printf("signer-daemon: served public key for %v\n", request.Key)
+	})
+	mux.HandleFunc("/sign", func(rw http.ResponseWriter, r *http.Request) {
+		request, privateKey, ok := decodeSignRequest(rw, r, keys)
+		if !ok {
+			return
+		}
+
+		message, err := hex.DecodeString(request.Message)
+		if err != nil {
+			writeSignResponse(rw, http.StatusBadRequest, signResponse{Error: "message must be hex encoded"})
+			return
+		}
+
+		writeSignResponse(rw, http.StatusOK, signResponse{Signature: hex.EncodeToString(privateKey.Sign(message))})
+		log.Printf("signer-daemon: signed %v byte message with %v key\n", len(message), request.Key)
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeSignResponse(rw, http.StatusUnauthorized, signResponse{Error: "missing or incorrect signer token"})
+			log.Printf("signer-daemon: refused a request without the signer token from %v\n", r.RemoteAddr)
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+//This function decodes an incoming daemon request and looks up the key it refers to, writing an error response if
+// either step fails
+func decodeSignRequest(rw http.ResponseWriter, r *http.Request, keys map[string]hedera.Ed25519PrivateKey) (signRequest, hedera.Ed25519PrivateKey, bool) {
+	var request signRequest
+
+	if r.Method != http.MethodPost {
+		writeSignResponse(rw, http.StatusMethodNotAllowed, signResponse{Error: "requests must be POSTed"})
+		return request, hedera.Ed25519PrivateKey{}, false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeSignResponse(rw, http.StatusBadRequest, signResponse{Error: "unable to decode request"})
+		return request, hedera.Ed25519PrivateKey{}, false
+	}
+
+	privateKey, exists := keys[request.Key]
+	if !exists {
+		writeSignResponse(rw, http.StatusNotFound, signResponse{Error: fmt.Sprintf("this daemon does not hold the %v key", request.Key)})
+		return request, hedera.Ed25519PrivateKey{}, false
+	}
+
+	return request, privateKey, true
+}
+
+func writeSignResponse(rw http.ResponseWriter, status int, response signResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(response)
+}
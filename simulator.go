@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go/proto"
+	"github.com/hashgraph/hedera-sdk-go/proto/mirror"
+	"github.com/tidwall/gjson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The mirror-simulator command runs a local stand-in for a mirror node, speaking the same ConsensusService gRPC
+// protocol, so the subscribers (and the SDK's mirror client) can be exercised without the testnet:
+//
+//	go run . mirror-simulator --listen 127.0.0.1:5600 --fixtures topic.json --delay 500ms --reorder 0.1 --duplicate 0.1 --disconnect-after 50
+//
+//and then MIRROR_ADDR="127.0.0.1:5600" (or one of the MIRROR_ADDRESSES) in the web-server's demo.env file.
+//
+//Its messages come from an in-memory consensus fake, which can be loaded with recorded fixtures (a mirror REST dump,
+// as read by the verify command, or a MIRROR_RECORD_FILE recording) and fed with new messages by POSTing their bytes to
+// http://<http-listen>/topics/<topicId>/messages. The fake gives each new message the next sequence number, a
+// consensus timestamp and a proper running hash (with the payer taken from public.transactionId), so the messages
+// pass the subscriber's running hash check. The same listener serves the fake's messages through the mirror REST API,
+// so MIRROR_REST_URL="http://127.0.0.1:5700" makes it the stand-in for that too.
+//
+//To test how the subscribers cope with a misbehaving mirror node, each stream can be made to:
+//
+//	--delay             wait up to this long (at random) before sending each message
+//	--reorder           send a message after the one following it, with this probability
+//	--duplicate         send a message twice, with this probability
+//	--disconnect-after  fail with UNAVAILABLE after sending this many messages
+//	--corrupt           alter a message's content, with this probability (which its running hash will then expose)
+type simulatedMessage struct {
+	consensusTimestamp time.Time
+	sequenceNumber     uint64
+	message            []byte
+	runningHash        []byte
+	transactionId      string //the transaction that carried the message, from its public.transactionId
+}
+
+//memoryConsensus is the in-memory consensus fake. Streams wait on changed, which is closed and replaced whenever a
+// message is added
+type memoryConsensus struct {
+	mutex   sync.Mutex
+	topics  map[string][]simulatedMessage
+	changed chan struct{}
+}
+
+func newMemoryConsensus() *memoryConsensus {
+	return &memoryConsensus{topics: make(map[string][]simulatedMessage), changed: make(chan struct{})}
+}
+
+//This function loads recorded messages as they are, running hashes and all
+func (c *memoryConsensus) load(messages []mirrorTopicMessage) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, message := range messages {
+		consensusTimestamp, err := parseConsensusTimestamp(message.ConsensusTimestamp)
+		if err != nil {
+			return err
+		}
+		c.topics[message.TopicId] = append(c.topics[message.TopicId], simulatedMessage{
+			consensusTimestamp: consensusTimestamp,
+			sequenceNumber:     message.SequenceNumber,
+			message:            message.Message,
+			runningHash:        message.RunningHash,
+			transactionId:      gjson.GetBytes(message.Message, "public.transactionId").String(),
+		})
+	}
+
+	for topic, topicMessages := range c.topics {
+		for i := 1; i < len(topicMessages); i++ {
+			if topicMessages[i].sequenceNumber <= topicMessages[i-1].sequenceNumber {
+				return fmt.Errorf("the messages for topic %v are not in sequence number order", topic)
+			}
+		}
+	}
+
+	return nil
+}
+
+//This function reaches consensus on a new message, returning it
+func (c *memoryConsensus) submit(topic string, message []byte) (simulatedMessage, error) {
+	topicEntity, err := parseEntityId(topic)
+	if err != nil {
+		return simulatedMessage{}, err
+	}
+	transactionId := gjson.GetBytes(message, "public.transactionId").String()
+	payer, _, err := parseTransactionId(transactionId)
+	if err != nil {
+		return simulatedMessage{}, fmt.Errorf("the message needs a public.transactionId to take the payer from: %v", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	simulated := simulatedMessage{consensusTimestamp: time.Now().UTC(), sequenceNumber: 1, message: message, transactionId: transactionId}
+	topicMessages := c.topics[topic]
+	if len(topicMessages) > 0 {
+		last := topicMessages[len(topicMessages)-1]
+		simulated.sequenceNumber = last.sequenceNumber + 1
+		if !simulated.consensusTimestamp.After(last.consensusTimestamp) {
+			simulated.consensusTimestamp = last.consensusTimestamp.Add(time.Nanosecond)
+		}
+		simulated.runningHash = computeRunningHash(last.runningHash, payer, topicEntity, simulated.consensusTimestamp, simulated.sequenceNumber, message)
+	} else {
+		simulated.runningHash = computeRunningHash(nil, payer, topicEntity, simulated.consensusTimestamp, simulated.sequenceNumber, message)
+	}
+
+	c.topics[topic] = append(topicMessages, simulated)
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	return simulated, nil
+}
+
+//This function returns the topic's messages from the given index onwards, along with a channel that is closed when
+// another message arrives
+func (c *memoryConsensus) messagesFrom(topic string, index int) ([]simulatedMessage, chan struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	topicMessages := c.topics[topic]
+	if index >= len(topicMessages) {
+		return nil, c.changed
+	}
+	return append([]simulatedMessage(nil), topicMessages[index:]...), c.changed
+}
+
+//This function returns a message in the mirror REST API's JSON
+func (simulated simulatedMessage) restMessage(topic string) mirrorTopicMessage {
+	message := mirrorTopicMessage{
+		ConsensusTimestamp: formatConsensusTimestamp(simulated.consensusTimestamp),
+		TopicId:            topic,
+		Message:            simulated.message,
+		RunningHash:        simulated.runningHash,
+		RunningHashVersion: runningHashVersion,
+		SequenceNumber:     simulated.sequenceNumber,
+	}
+	if payer, _, err := parseTransactionId(simulated.transactionId); err == nil {
+		message.PayerAccountId = fmt.Sprintf("%d.%d.%d", payer.shard, payer.realm, payer.num)
+	}
+	return message
+}
+
+//This function serves the parts of the mirror REST API that mirrorRestClient uses (see mirrorrest.go) from the
+// consensus fake:
+//
+//	GET /api/v1/topics/{topicId}
+//	GET /api/v1/topics/{topicId}/messages?sequencenumber=gt:N&limit=N
+//	GET /api/v1/topics/{topicId}/messages/{sequenceNumber}
+//	GET /api/v1/topics/messages/{consensusTimestamp}
+//	GET /api/v1/transactions/{transactionId}
+func (c *memoryConsensus) restHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "the mirror REST API is read only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var body interface{}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	switch {
+	case len(path) == 3 && path[0] == "topics" && path[1] == "messages":
+		for topic, topicMessages := range c.topics {
+			for _, simulated := range topicMessages {
+				if formatConsensusTimestamp(simulated.consensusTimestamp) == path[2] {
+					body = simulated.restMessage(topic)
+				}
+			}
+		}
+
+	case len(path) == 2 && path[0] == "topics":
+		if _, exists := c.topics[path[1]]; exists {
+			body = mirrorTopicInfo{TopicId: path[1], Memo: "mirror-simulator"}
+		}
+
+	case len(path) == 3 && path[0] == "topics" && path[2] == "messages":
+		after, limit, err := topicMessagesPageParams(r.URL.Query())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page := mirrorTopicMessagesPage{Messages: []mirrorTopicMessage{}}
+		for _, simulated := range c.topics[path[1]] {
+			if simulated.sequenceNumber > after && len(page.Messages) < limit {
+				page.Messages = append(page.Messages, simulated.restMessage(path[1]))
+			}
+		}
+		if len(page.Messages) == limit {
+			next := fmt.Sprintf("/api/v1/topics/%v/messages?sequencenumber=gt:%v&limit=%v", path[1], page.Messages[limit-1].SequenceNumber, limit)
+			page.Links.Next = &next
+		}
+		body = page
+
+	case len(path) == 4 && path[0] == "topics" && path[2] == "messages":
+		for _, simulated := range c.topics[path[1]] {
+			if fmt.Sprint(simulated.sequenceNumber) == path[3] {
+				body = simulated.restMessage(path[1])
+			}
+		}
+
+	case len(path) == 2 && path[0] == "transactions":
+		page := mirrorTransactionsPage{}
+		for topic, topicMessages := range c.topics {
+			for _, simulated := range topicMessages {
+				if simulated.transactionId == "" || restTransactionId(simulated.transactionId) != restTransactionId(path[1]) {
+					continue
+				}
+				_, validStart, _ := parseTransactionId(simulated.transactionId)
+				page.Transactions = append(page.Transactions, mirrorTransaction{
+					ConsensusTimestamp:  formatConsensusTimestamp(simulated.consensusTimestamp),
+					TransactionId:       restTransactionId(simulated.transactionId),
+					ValidStartTimestamp: formatConsensusTimestamp(validStart),
+					Name:                "CONSENSUSSUBMITMESSAGE",
+					Result:              "SUCCESS",
+					EntityId:            topic,
+				})
+			}
+		}
+		if len(page.Transactions) > 0 {
+			body = page
+		}
+	}
+
+	if body == nil {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+type simulatorFaults struct {
+	delay           time.Duration
+	reorder         float64
+	duplicate       float64
+	corrupt         float64
+	disconnectAfter int
+
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+func (f *simulatorFaults) chance(probability float64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return probability > 0 && f.random.Float64() < probability
+}
+
+func (f *simulatorFaults) wait() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.delay <= 0 {
+		return 0
+	}
+	return time.Duration(f.random.Int63n(int64(f.delay)))
+}
+
+//mirrorSimulator implements the mirror node's ConsensusService
+type mirrorSimulator struct {
+	consensus *memoryConsensus
+	faults    *simulatorFaults
+}
+
+func (s *mirrorSimulator) SubscribeTopic(query *mirror.ConsensusTopicQuery, stream mirror.ConsensusService_SubscribeTopicServer) error {
+	if query.GetTopicID() == nil {
+		return status.Error(codes.InvalidArgument, "a topic ID is required")
+	}
+	topicId := query.GetTopicID()
+	topic := fmt.Sprintf("%d.%d.%d", topicId.GetShardNum(), topicId.GetRealmNum(), topicId.GetTopicNum())
+
+	var startTime, endTime time.Time
+	if start := query.GetConsensusStartTime(); start != nil {
+		startTime = time.Unix(start.GetSeconds(), int64(start.GetNanos()))
+	}
+	if end := query.GetConsensusEndTime(); end != nil {
+		endTime = time.Unix(end.GetSeconds(), int64(end.GetNanos()))
+	}
+
+	log.Printf("mirror-simulator: subscription to topic %v from %v\n", topic, startTime)
+
+	sent := 0
+	send := func(message simulatedMessage) error {
+		if s.faults.disconnectAfter > 0 && sent >= s.faults.disconnectAfter {
+			log.Printf("mirror-simulator: disconnecting subscription to topic %v after %v messages\n", topic, sent)
+			return status.Error(codes.Unavailable, "simulated disconnect")
+		}
+
+		time.Sleep(s.faults.wait())
+
+		content := message.message
+		if s.faults.chance(s.faults.corrupt) && len(content) > 0 {
+			content = append([]byte(nil), content...)
+			content[len(content)/2] ^= 0x01
+		}
+
+		response := &mirror.ConsensusTopicResponse{
+			ConsensusTimestamp: &proto.Timestamp{Seconds: message.consensusTimestamp.Unix(), Nanos: int32(message.consensusTimestamp.Nanosecond())},
+			Message:            content,
+			RunningHash:        message.runningHash,
+			SequenceNumber:     message.sequenceNumber,
+			RunningHashVersion: runningHashVersion,
+		}
+
+		copies := 1
+		if s.faults.chance(s.faults.duplicate) {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+		sent++
+		return nil
+	}
+
+	var held *simulatedMessage
+	index := 0
+	limit := query.GetLimit()
+	for {
+		messages, changed := s.consensus.messagesFrom(topic, index)
+		index += len(messages)
+
+		for i := range messages {
+			message := messages[i]
+			if message.consensusTimestamp.Before(startTime) {
+				continue
+			}
+			if !endTime.IsZero() && !message.consensusTimestamp.Before(endTime) {
+				return nil
+			}
+
+			//a reordered message is held back and sent straight after the one following it
+			if held == nil && s.faults.chance(s.faults.reorder) {
+				held = &message
+				continue
+			}
+			if err := send(message); err != nil {
+				return err
+			}
+			if held != nil {
+				if err := send(*held); err != nil {
+					return err
+				}
+				held = nil
+			}
+
+			if limit > 0 && uint64(sent) >= limit {
+				return nil
+			}
+		}
+
+		//don't hold a message back whilst waiting for the next one, which may never come
+		if held != nil {
+			if err := send(*held); err != nil {
+				return err
+			}
+			held = nil
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+//This function runs the mirror-simulator command
+func mirrorSimulatorCommand(args []string) {
+	flags := flag.NewFlagSet("mirror-simulator", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:5600", "the address to serve the mirror node's gRPC API on")
+	httpListen := flags.String("http-listen", "127.0.0.1:5700", "the address to serve the mirror REST API and accept new messages for the consensus fake on (blank to disable)")
+	var fixtures stringList
+	flags.Var(&fixtures, "fixtures", "a mirror REST dump or recording of messages to serve (can be repeated)")
+	faults := &simulatorFaults{}
+	flags.DurationVar(&faults.delay, "delay", 0, "the longest to wait (at random) before sending each message")
+	flags.Float64Var(&faults.reorder, "reorder", 0, "the probability of sending a message after the one following it")
+	flags.Float64Var(&faults.duplicate, "duplicate", 0, "the probability of sending a message twice")
+	flags.Float64Var(&faults.corrupt, "corrupt", 0, "the probability of altering a message's content")
+	flags.IntVar(&faults.disconnectAfter, "disconnect-after", 0, "fail each subscription with UNAVAILABLE after sending this many messages (0 never)")
+	seed := flags.Int64("seed", 0, "the random seed for the faults, so a run can be repeated (defaults to the time)")
+	_ = flags.Parse(args)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	faults.random = rand.New(rand.NewSource(*seed))
+
+	consensus := newMemoryConsensus()
+	for _, fixture := range fixtures {
+		messages, err := readTopicMessages(fixture, "")
+		if err == nil {
+			err = consensus.load(messages)
+		}
+		if err != nil {
+			panic(fmt.Errorf("Unable to load fixtures from %v. Error: %v\n", fixture, err))
+		}
+		fmt.Printf("Loaded %v messages from %v\n", len(messages), fixture)
+	}
+
+	if *httpListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/", consensus.restHandler)
+		mux.HandleFunc("/topics/", func(rw http.ResponseWriter, r *http.Request) {
+			topic := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/topics/"), "/messages")
+			if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/messages") {
+				http.Error(rw, "POST a message to /topics/<topicId>/messages", http.StatusNotFound)
+				return
+			}
+
+			message, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 1<<20))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			simulated, err := consensus.submit(topic, message)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"topicId":            topic,
+				"sequenceNumber":     simulated.sequenceNumber,
+				"consensusTimestamp": formatConsensusTimestamp(simulated.consensusTimestamp),
+			})
+		})
+
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpListen, mux))
+		}()
+		fmt.Printf("Accepting new messages on http://%v/topics/<topicId>/messages and serving the mirror REST API on http://%v/api/v1/\n", *httpListen, *httpListen)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		panic(fmt.Errorf("Unable to listen on %v. Error: %v\n", *listen, err))
+	}
+
+	server := grpc.NewServer()
+	mirror.RegisterConsensusServiceServer(server, &mirrorSimulator{consensus: consensus, faults: faults})
+
+	fmt.Printf("Mirror simulator listening on %v (fault seed %v)\n", *listen, *seed)
+	log.Fatal(server.Serve(listener))
+}
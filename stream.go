@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//GET /events/stream is a Server-Sent Events stream of every event as it reaches consensus and is processed by the
+// subscriber, so a client can watch for its events over one connection rather than a /retrieve request per event.
+// It takes the same topic, event, session and tenant filters as the other event endpoints (see events.go).
+//
+//Each event's ID is the stream's position in every topic it has seen so far, e.g. "0.0.1234:57,0.0.5678:12", which
+// browsers send back as the Last-Event-ID header when they reconnect so that the stream resumes without missing or
+// repeating anything. A batch message carries several events with the same sequence number, so part way through one
+// the position also holds the index of the last event sent from it, e.g. "0.0.1234:57.3". A plain sequence number
+// (e.g. "57") resumes every topic from that sequence number, and the position can also be given with the lastEventId
+// parameter.
+//
+//A client that falls too far behind is disconnected, and can then resume from where it got to
+const (
+	streamBuffer            = 256
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+//a streamCursor is the last event sent from each topic
+type streamCursor struct {
+	positions map[string]streamPosition
+	fallback  uint64 //for topics without a position of their own
+}
+
+//a streamPosition is the sequence number of the last message sent from a topic and, if only some of the events in a
+// batch message have been sent, the index of the last of them
+type streamPosition struct {
+	sequenceNumber uint64
+	batchIndex     int //-1 once every event in the message has been sent
+}
+
+func parseStreamCursor(id string) (streamCursor, error) {
+	cursor := streamCursor{positions: make(map[string]streamPosition)}
+
+	for _, part := range strings.Split(id, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		topic := ""
+		if separator := strings.LastIndex(part, ":"); separator >= 0 {
+			topic, part = part[:separator], part[separator+1:]
+		}
+
+		position := streamPosition{batchIndex: -1}
+		if separator := strings.Index(part, "."); separator >= 0 && topic != "" {
+			batchIndex, err := strconv.Atoi(part[separator+1:])
+			if err != nil || batchIndex < 0 {
+				return streamCursor{}, fmt.Errorf("invalid Last-Event-ID %q", id)
+			}
+			position.batchIndex = batchIndex
+			part = part[:separator]
+		}
+
+		var err error
+		position.sequenceNumber, err = strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return streamCursor{}, fmt.Errorf("invalid Last-Event-ID %q", id)
+		}
+
+		if topic == "" {
+			cursor.fallback = position.sequenceNumber
+		} else {
+			cursor.positions[topic] = position
+		}
+	}
+
+	return cursor, nil
+}
+
+//This function returns the position of the last event sent from the topic
+func (c streamCursor) at(topic string) streamPosition {
+	if position, exists := c.positions[topic]; exists {
+		return position
+	}
+	return streamPosition{sequenceNumber: c.fallback, batchIndex: -1}
+}
+
+//This function returns the sequence number that the topic's unsent messages start after, which for a batch message
+// that has only been partly sent is the one before it
+func (c streamCursor) after(topic string) uint64 {
+	position := c.at(topic)
+	if position.batchIndex >= 0 && position.sequenceNumber > 0 {
+		return position.sequenceNumber - 1
+	}
+	return position.sequenceNumber
+}
+
+//This function moves the cursor on to an event, returning false if it has already been sent
+func (c streamCursor) advance(messageJson string) bool {
+	topic := gjson.Get(messageJson, "hcs.topicId").String()
+	next := streamPosition{sequenceNumber: gjson.Get(messageJson, "hcs.sequenceNumber").Uint(), batchIndex: -1}
+
+	//the events in a batch are numbered on from the batch's transaction ID (see batch.go)
+	if batchTransactionId := gjson.Get(messageJson, "hcs.batchTransactionId").String(); batchTransactionId != "" {
+		transactionId := gjson.Get(messageJson, "public.transactionId").String()
+		batchIndex, err := strconv.Atoi(strings.TrimPrefix(transactionId, batchTransactionId+"-"))
+		if err == nil {
+			next.batchIndex = batchIndex
+		}
+	}
+
+	position := c.at(topic)
+	if next.sequenceNumber < position.sequenceNumber {
+		return false
+	}
+	if next.sequenceNumber == position.sequenceNumber && (position.batchIndex < 0 || next.batchIndex <= position.batchIndex) {
+		return false
+	}
+
+	c.positions[topic] = next
+	return true
+}
+
+func (c streamCursor) String() string {
+	var parts []string
+	if c.fallback > 0 {
+		parts = append(parts, strconv.FormatUint(c.fallback, 10))
+	}
+	for topic, position := range c.positions {
+		if position.batchIndex >= 0 {
+			parts = append(parts, fmt.Sprintf("%v:%v.%v", topic, position.sequenceNumber, position.batchIndex))
+		} else {
+			parts = append(parts, fmt.Sprintf("%v:%v", topic, position.sequenceNumber))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func eventStreamHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	filter, err := parseEventFilter(t, r.URL.Query())
+	if err != nil {
+		writeEventFilterError(rw, err)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	cursor, err := parseStreamCursor(lastEventId)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	//subscribe before replaying what the client missed, so nothing can arrive in between. The cursor drops anything
+	// that turns up in both
+	subscription := eventStore.subscribe(t.id, streamBuffer)
+	defer eventStore.unsubscribe(subscription)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(messageJson string) {
+		if !filter.matches(messageJson) || !cursor.advance(messageJson) {
+			return
+		}
+		fmt.Fprintf(rw, "id: %v\ndata: %v\n\n", cursor, retrieveResponse(messageJson))
+	}
+
+	if lastEventId != "" {
+		for _, messageJson := range eventStore.confirmedAfter(cursor.after) {
+			send(messageJson)
+		}
+		flusher.Flush()
+	}
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case messageJson, open := <-subscription:
+			if !open {
+				//we fell too far behind, so the client should reconnect and resume
+				return
+			}
+			send(messageJson)
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+//This function returns a processed message as the subscriber stores it, with the batch's transaction ID if it is one
+// of a batch's events
+func testStreamMessage(sequenceNumber uint64, transactionId string, batchTransactionId string) string {
+	messageJson := fmt.Sprintf(`{"public":{"transactionId":"%v"},"hcs":{"tenant":"default","topicId":"0.0.1","sequenceNumber":%v,"consensusTimestamp":%v`, transactionId, sequenceNumber, sequenceNumber)
+	if batchTransactionId != "" {
+		messageJson += fmt.Sprintf(`,"batchTransactionId":"%v"`, batchTransactionId)
+	}
+	return messageJson + "}}"
+}
+
+func TestStreamCursorResumes(t *testing.T) {
+	store := newMemoryEventStore()
+	store.putConfirmed("0.0.1", "a", testStreamMessage(1, "a", ""))
+	for index := 0; index < 3; index++ {
+		id := fmt.Sprintf("b-%v", index)
+		store.putConfirmed("0.0.1", id, testStreamMessage(2, id, "b"))
+	}
+	store.putConfirmed("0.0.1", "c", testStreamMessage(3, "c", ""))
+
+	tests := []struct {
+		lastEventId string
+		expected    []string
+		next        string
+	}{
+		{lastEventId: "0", expected: []string{"a", "b-0", "b-1", "b-2", "c"}, next: "0.0.1:3"},
+		{lastEventId: "0.0.1:1", expected: []string{"b-0", "b-1", "b-2", "c"}, next: "0.0.1:3"},
+		{lastEventId: "0.0.1:2.0", expected: []string{"b-1", "b-2", "c"}, next: "0.0.1:3"},
+		{lastEventId: "0.0.1:2.2", expected: []string{"c"}, next: "0.0.1:3"},
+		{lastEventId: "0.0.1:2", expected: []string{"c"}, next: "0.0.1:3"},
+		{lastEventId: "0.0.1:3", expected: nil, next: "0.0.1:3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.lastEventId, func(t *testing.T) {
+			cursor, err := parseStreamCursor(test.lastEventId)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sent []string
+			for _, messageJson := range store.confirmedAfter(cursor.after) {
+				if cursor.advance(messageJson) {
+					sent = append(sent, orderedKeyOf(messageJson).TransactionId)
+				}
+			}
+			if !reflect.DeepEqual(sent, test.expected) {
+				t.Errorf("resuming from %q sent %v, expected %v", test.lastEventId, sent, test.expected)
+			}
+			if cursor.String() != test.next {
+				t.Errorf("the cursor is %q, expected %q", cursor, test.next)
+			}
+		})
+	}
+
+	//part way through a batch, the cursor gives the index of the last event sent
+	cursor, _ := parseStreamCursor("0.0.1:1")
+	cursor.advance(testStreamMessage(2, "b-0", "b"))
+	if cursor.String() != "0.0.1:2.0" {
+		t.Errorf("the cursor is %q, expected %q", cursor, "0.0.1:2.0")
+	}
+
+	for _, lastEventId := range []string{"0.0.1:x", "0.0.1:2.x", "0.0.1:2.-1"} {
+		if _, err := parseStreamCursor(lastEventId); err == nil {
+			t.Errorf("expected Last-Event-ID %q to be invalid", lastEventId)
+		}
+	}
+}
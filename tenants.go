@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//Tenants let several customers share one server whilst keeping their events completely separate. Each tenant has its
+// own topic, its own encryption keyring and optionally its own account to pay for its transactions. Requests pick
+// their tenant by API key (the X-Api-Key header or apiKey parameter), and a tenant can only ever retrieve events that
+// arrived on its own topics, decrypted with its own keys. The Host header is chosen by the client, so a hostname can
+// only pick the tenant for submitting events (/track and /ws), never for reading them back.
+//
+//Tenants are configured in the JSON file named by TENANTS_FILE, e.g.
+//
+//	{
+//	  "tenants": [
+//	    {
+//	      "id": "acme",
+//	      "apiKeys": ["a-long-random-string"],
+//	      "hostnames": ["acme.example.com"],
+//	      "topicId": "0.0.1234",
+//	      "submitKey": "302e...",
+//	      "encryptionKeys": {"2020-01": "A32-ByteEncryptionKeyForAES-256!"},
+//	      "activeEncryptionKey": "2020-01",
+//	      "payerAccountId": "0.0.5678",
+//	      "payerKey": "302e...",
+//	      "dailyBudgetHbar": 50
+//	    }
+//	  ]
+//	}
+//
+//The submitKey (which can be a comma separated list, for a threshold key) and payerKey are loaded through the SIGNER
+// in the same way as the keys in demo.env. With a signing daemon or plugin they hold the names the signer knows the
+// keys by rather than the private keys, e.g. "submitKey": "acme-submit", and SIGNER_ACME_SUBMIT_KEYS gives how many
+// submit keys it holds under that name.
+//
+//Without a TENANTS_FILE, every request belongs to the "default" tenant made up of the TOPIC_* settings in demo.env
+// (including any routed or sharded topics)
+type tenantsFile struct {
+	Tenants []struct {
+		Id                  string            `json:"id"`
+		ApiKeys             []string          `json:"apiKeys"`
+		Hostnames           []string          `json:"hostnames"`
+		TopicId             string            `json:"topicId"`
+		SubmitKey           string            `json:"submitKey"`
+		EncryptionKeys      map[string]string `json:"encryptionKeys"`
+		ActiveEncryptionKey string            `json:"activeEncryptionKey"`
+		PayerAccountId      string            `json:"payerAccountId"`
+		PayerKey            string            `json:"payerKey"`
+		DailyBudgetHbar     *float64          `json:"dailyBudgetHbar"`
+	} `json:"tenants"`
+}
+
+type tenant struct {
+	id        string
+	apiKeys   []string
+	hostnames []string
+
+	//the topics this tenant submits to and subscribes to, and the function used to pick between them
+	topics []routedTopic
+	route  func(messageJson string) routedTopic
+
+	keyring keyring
+
+	//the account that pays for this tenant's transactions, which defaults to the operator
+	payerAccount hedera.AccountID
+	payerSigner  Signer
+
+	//the most this tenant can spend on fees in a day, overriding FEE_BUDGET_PER_TENANT_PER_DAY_HBAR if set
+	dailyBudget *float64
+}
+
+//A keyring holds a tenant's encryption keys by ID, so keys can be rotated without losing the ability to decrypt older
+// messages. New messages are encrypted with the active key and record its ID in public.keyId
+type keyring struct {
+	activeKeyId string
+	keys        map[string]string
+}
+
+func (k keyring) encrypt(message string) (string, []byte) {
+	return k.activeKeyId, encryptText(message, k.keys[k.activeKeyId])
+}
+
+func (k keyring) decrypt(keyId string, encryptedText []byte) (string, error) {
+	key, exists := k.keys[keyId]
+	if !exists {
+		return "", fmt.Errorf("no encryption key with ID %q in this keyring", keyId)
+	}
+	return tryDecryptText(encryptedText, key)
+}
+
+//the name of the tenant made up from the demo.env settings
+const defaultTenantId = "default"
+
+var tenants []*tenant
+
+//This function loads the tenants. It must be called after loadConfig and loadRoutes, as the default tenant is built
+// from their settings when there is no TENANTS_FILE
+func loadTenants() {
+	tenantsFilePath := getEnv("TENANTS_FILE", "")
+	if tenantsFilePath == "" {
+		tenants = []*tenant{{
+			id:           defaultTenantId,
+			topics:       routedTopics,
+			route:        routeMessage,
+			keyring:      keyring{activeKeyId: "", keys: map[string]string{"": encryptionKey}},
+			payerAccount: operatorAccount,
+			payerSigner:  operatorSigner,
+		}}
+		return
+	}
+
+	fileContents, err := ioutil.ReadFile(tenantsFilePath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read tenants from %v. Error: %v\n", tenantsFilePath, err))
+	}
+
+	var file tenantsFile
+	err = json.Unmarshal(fileContents, &file)
+	if err != nil {
+		panic(fmt.Errorf("Unable to decode tenants in %v. Error: %v\n", tenantsFilePath, err))
+	}
+
+	tenants = nil
+	seenTopics := make(map[string]string)
+	seenSelectors := make(map[string]string)
+
+	for _, config := range file.Tenants {
+		if config.Id == "" || config.Id == defaultTenantId {
+			panic(fmt.Errorf("Every tenant in %v needs an id other than %v\n", tenantsFilePath, defaultTenantId))
+		}
+
+		for i, hostname := range config.Hostnames {
+			config.Hostnames[i] = strings.ToLower(hostname)
+		}
+
+		//strict isolation relies on every topic, API key and hostname belonging to exactly one tenant
+		if owner, exists := seenTopics[config.TopicId]; exists {
+			panic(fmt.Errorf("Tenants %v and %v in %v share topic %v\n", owner, config.Id, tenantsFilePath, config.TopicId))
+		}
+		seenTopics[config.TopicId] = config.Id
+
+		for _, selector := range append(append([]string{}, config.ApiKeys...), config.Hostnames...) {
+			if owner, exists := seenSelectors[selector]; exists {
+				panic(fmt.Errorf("Tenants %v and %v in %v share the API key or hostname %v\n", owner, config.Id, tenantsFilePath, selector))
+			}
+			seenSelectors[selector] = config.Id
+		}
+
+		id, err := hedera.TopicIDFromString(config.TopicId)
+		if err != nil {
+			panic(fmt.Errorf("Unable to convert topicId for tenant %v in %v into Hedera TopicID.\n", config.Id, tenantsFilePath))
+		}
+
+		if _, exists := config.EncryptionKeys[config.ActiveEncryptionKey]; !exists {
+			panic(fmt.Errorf("The activeEncryptionKey for tenant %v in %v isn't one of its encryptionKeys\n", config.Id, tenantsFilePath))
+		}
+
+		signers := submitSigners
+		if config.SubmitKey != "" {
+			signers, err = loadSignersFrom(config.SubmitKey, config.SubmitKey, fmt.Sprintf("the submitKey for tenant %v in %v", config.Id, tenantsFilePath))
+			if err != nil {
+				panic(fmt.Errorf("Unable to load the submit key for tenant %v. Error: %v\n", config.Id, err))
+			}
+		}
+
+		topic := routedTopic{name: config.Id, topicId: id, submitSigners: signers}
+		t := &tenant{
+			id:           config.Id,
+			apiKeys:      config.ApiKeys,
+			hostnames:    config.Hostnames,
+			topics:       []routedTopic{topic},
+			route:        func(string) routedTopic { return topic },
+			keyring:      keyring{activeKeyId: config.ActiveEncryptionKey, keys: config.EncryptionKeys},
+			payerAccount: operatorAccount,
+			payerSigner:  operatorSigner,
+			dailyBudget:  config.DailyBudgetHbar,
+		}
+
+		if config.PayerAccountId != "" {
+			t.payerAccount, err = hedera.AccountIDFromString(config.PayerAccountId)
+			if err != nil {
+				panic(fmt.Errorf("Unable to convert payerAccountId for tenant %v in %v into Hedera AccountID.\n", config.Id, tenantsFilePath))
+			}
+
+			payerSigners, err := loadSignersFrom(config.PayerKey, config.PayerKey, fmt.Sprintf("the payerKey for tenant %v in %v", config.Id, tenantsFilePath))
+			if err != nil {
+				panic(fmt.Errorf("Unable to load the payer key for tenant %v. Error: %v\n", config.Id, err))
+			}
+			if len(payerSigners) != 1 {
+				panic(fmt.Errorf("The payerKey for tenant %v in %v should be a single key\n", config.Id, tenantsFilePath))
+			}
+			t.payerSigner = payerSigners[0]
+		}
+
+		tenants = append(tenants, t)
+	}
+}
+
+//This function picks the tenant for a request by API key, and then by hostname if byHostname is set. When running
+// without a TENANTS_FILE every request belongs to the default tenant
+func tenantForRequest(r *http.Request, byHostname bool) (*tenant, bool) {
+	if len(tenants) == 1 && tenants[0].id == defaultTenantId {
+		return tenants[0], true
+	}
+
+	apiKey := r.Header.Get("X-Api-Key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("apiKey")
+	}
+
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+
+	for _, t := range tenants {
+		if apiKey != "" && containsString(t.apiKeys, apiKey) {
+			return t, true
+		}
+	}
+
+	//only fall back to the hostname if no API key was given, so a bad API key is never silently ignored
+	if byHostname && apiKey == "" {
+		for _, t := range tenants {
+			if containsString(t.hostnames, strings.ToLower(hostname)) {
+				return t, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+//This function returns the tenant for a request by its API key, writing a 401 response if there isn't one. Every
+// endpoint that reads events back (or administers them) uses this, as anyone can send any Host header
+func requireTenant(rw http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	t, found := tenantForRequest(r, false)
+	if !found {
+		http.Error(rw, "unknown tenant: please provide a valid API key", http.StatusUnauthorized)
+	}
+	return t, found
+}
+
+//This function returns the tenant for a request that submits events, which can also be picked by the hostname the
+// request was sent to, writing a 401 response if there isn't one
+func requireSubmittingTenant(rw http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	t, found := tenantForRequest(r, true)
+	if !found {
+		http.Error(rw, "unknown tenant: please provide a valid API key", http.StatusUnauthorized)
+	}
+	return t, found
+}
+
+func tenantById(id string) (*tenant, bool) {
+	for _, t := range tenants {
+		if t.id == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+//This function returns every topic across all of the tenants
+func allTopics() []routedTopic {
+	var topics []routedTopic
+	for _, t := range tenants {
+		topics = append(topics, t.topics...)
+	}
+	return topics
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParsePrivateKey(privateKey string, description string) hedera.Ed25519PrivateKey {
+	key, err := hedera.Ed25519PrivateKeyFromString(strings.TrimSpace(privateKey))
+	if err != nil {
+		panic(fmt.Errorf("Unable to convert %v into Hedera Ed25519 Private Key.\n", description))
+	}
+	return key
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTenantsSigners(t *testing.T) {
+	privateKeys, publicKeys := testKeys(t, 3)
+
+	tenantsFilePath := filepath.Join(t.TempDir(), "tenants.json")
+	contents := fmt.Sprintf(`{"tenants":[{"id":"acme","apiKeys":["acme-key"],"topicId":"0.0.1234","submitKey":"%v","encryptionKeys":{"":"%v"},"activeEncryptionKey":"","payerAccountId":"0.0.5678","payerKey":"%v"}]}`, strings.Join(privateKeys[:2], ","), testEncryptionKey, privateKeys[2])
+	if err := ioutil.WriteFile(tenantsFilePath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := tenants
+	t.Cleanup(func() { tenants = saved })
+	t.Setenv("TENANTS_FILE", tenantsFilePath)
+	t.Setenv("SIGNER", "local")
+	loadTenants()
+
+	acme, _ := tenantById("acme")
+	var submitKeys []string
+	for _, signer := range acme.topics[0].submitSigners {
+		submitKeys = append(submitKeys, signer.PublicKey().String())
+	}
+	if strings.Join(submitKeys, ",") != strings.Join(publicKeys[:2], ",") {
+		t.Errorf("the submit signers hold %v, expected %v", submitKeys, publicKeys[:2])
+	}
+	if payerKey := acme.payerSigner.PublicKey().String(); payerKey != publicKeys[2] {
+		t.Errorf("the payer signer holds %v, expected %v", payerKey, publicKeys[2])
+	}
+}
+
+func TestTenantForRequest(t *testing.T) {
+	saved := tenants
+	t.Cleanup(func() { tenants = saved })
+	tenants = []*tenant{
+		{id: "acme", apiKeys: []string{"acme-key"}, hostnames: []string{"acme.example.com"}},
+		{id: "globex", apiKeys: []string{"globex-key"}, hostnames: []string{"globex.example.com"}},
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		apiKey     string
+		byHostname bool
+		tenant     string //the tenant picked, or blank if none is
+	}{
+		{name: "by API key", host: "globex.example.com", apiKey: "acme-key", tenant: "acme"},
+		{name: "by API key when submitting", host: "globex.example.com", apiKey: "acme-key", byHostname: true, tenant: "acme"},
+		{name: "by hostname when submitting", host: "globex.example.com:8080", byHostname: true, tenant: "globex"},
+		{name: "not by hostname when reading", host: "globex.example.com"},
+		{name: "not by hostname with a bad API key", host: "globex.example.com", apiKey: "wrong-key", byHostname: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/retrieve", nil)
+			r.Host = test.host
+			if test.apiKey != "" {
+				r.Header.Set("X-Api-Key", test.apiKey)
+			}
+
+			picked, found := tenantForRequest(r, test.byHostname)
+			if found != (test.tenant != "") || (found && picked.id != test.tenant) {
+				t.Errorf("expected tenant %q, found %v %v", test.tenant, found, picked)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//These are the topic lifecycle commands, run as "go run . topic <subcommand>". Each of them prints its result as JSON
+// on stdout, and any changes to the topic configuration are written back to the demo.env file atomically once the
+// network has confirmed them.
+//
+//Commands that change the topic need to be signed by the admin key, which is passed in with one or more
+// --admin-key-file flags (one per signer when the topic has a threshold admin key). If the admin key is kept on an
+// offline machine, use the build-topic-* commands instead
+var topicSubcommands = map[string]command{
+	"create": {
+		description: "create a new topic with freshly generated keys and save it to demo.env",
+		run:         topicCreateCommand,
+	},
+	"info": {
+		description: "show the memo, keys, expiry, auto-renew settings and sequence number of a topic",
+		run:         topicInfoCommand,
+	},
+	"update": {
+		description: "update the topic memo, admin key or submit key",
+		run:         topicUpdateCommand,
+	},
+	"rotate-submit-key": {
+		description: "generate a new submit key, set it on the topic and save it to demo.env",
+		run:         topicRotateSubmitKeyCommand,
+	},
+	"delete": {
+		description: "delete the topic and clear it from demo.env",
+		run:         topicDeleteCommand,
+	},
+}
+
+//This function runs one of the topic subcommands
+func topicCommand(args []string) {
+	if len(args) > 0 {
+		if subcommand, exists := topicSubcommands[args[0]]; exists {
+			subcommand.run(args[1:])
+			return
+		}
+	}
+
+	names := make([]string, 0, len(topicSubcommands))
+	for name := range topicSubcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Usage: go run . topic <subcommand> [arguments]\n\n")
+	for _, name := range names {
+		fmt.Printf("  %-24v %v\n", name, topicSubcommands[name].description)
+	}
+	os.Exit(2)
+}
+
+//the JSON output of the topic info command
+type topicInfoOutput struct {
+	TopicId                string    `json:"topicId"`
+	Memo                   string    `json:"memo"`
+	AdminKey               string    `json:"adminKey,omitempty"`
+	SubmitKey              string    `json:"submitKey,omitempty"`
+	ExpirationTime         time.Time `json:"expirationTime"`
+	SecondsUntilExpiry     int64     `json:"secondsUntilExpiry"`
+	AutoRenewPeriodSeconds int64     `json:"autoRenewPeriodSeconds"`
+	AutoRenewAccount       string    `json:"autoRenewAccount,omitempty"`
+	SequenceNumber         uint64    `json:"sequenceNumber"`
+	RunningHash            string    `json:"runningHash"`
+}
+
+//This function queries the network for the current state of a topic
+func getTopicInfo(client *hedera.Client, topic hedera.ConsensusTopicID) (hedera.ConsensusTopicInfo, error) {
+	return hedera.NewConsensusTopicInfoQuery().
+		SetTopicID(topic).
+		SetMaxQueryPayment(hedera.HbarFromTinybar(100000000)).
+		Execute(client)
+}
+
+func topicCreateCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("topic create", flag.ExitOnError)
+	memo := flags.String("memo", "AdsDax HCS demo topic", "the topic memo")
+	includeAdminKey := flags.Bool("include-admin-private-key", false, "return the private admin key as the adminPrivateKey field instead of showing it on stderr")
+	_ = flags.Parse(args)
+
+	if os.Getenv("TOPIC_ID") != "" && !confirm(fmt.Sprintf("demo.env already uses topic %v. Replace it with a new topic?", os.Getenv("TOPIC_ID"))) {
+		return
+	}
+
+	adminKey := createTopic(*memo)
+
+	output := map[string]string{
+		"topicId":   topicId.String(),
+		"adminKey":  adminKey.PublicKey().String(),
+		"submitKey": submitSigners[0].PublicKey().String(),
+	}
+	if *includeAdminKey {
+		output["adminPrivateKey"] = adminKey.String()
+	} else {
+		printAdminKeyWarning(adminKey)
+	}
+	printJSON(output)
+}
+
+func topicInfoCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("topic info", flag.ExitOnError)
+	topicString := flags.String("topic", os.Getenv("TOPIC_ID"), "the topic to inspect (defaults to TOPIC_ID)")
+	_ = flags.Parse(args)
+
+	topic := mustParseTopicFlag(*topicString)
+
+	info, err := getTopicInfo(newClient(), topic)
+	if err != nil {
+		panic(fmt.Errorf("Unable to query info for topic %v. Error: %v\n", topic, err))
+	}
+
+	output := topicInfoOutput{
+		TopicId:                topic.String(),
+		Memo:                   info.Memo,
+		ExpirationTime:         info.ExpirationTime,
+		SecondsUntilExpiry:     int64(time.Until(info.ExpirationTime).Seconds()),
+		AutoRenewPeriodSeconds: int64(info.AutoRenewPeriod.Seconds()),
+		SequenceNumber:         info.SequenceNumber,
+		RunningHash:            hex.EncodeToString(info.RunningHash),
+	}
+
+	if info.AdminKey != nil {
+		output.AdminKey = fmt.Sprint(info.AdminKey)
+	}
+	if info.SubmitKey != nil {
+		output.SubmitKey = fmt.Sprint(info.SubmitKey)
+	}
+	if info.AutoRenewAccountID != nil {
+		output.AutoRenewAccount = info.AutoRenewAccountID.String()
+	}
+
+	printJSON(output)
+}
+
+func topicUpdateCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("topic update", flag.ExitOnError)
+	topicString := flags.String("topic", os.Getenv("TOPIC_ID"), "the topic to update (defaults to TOPIC_ID)")
+	memo := flags.String("memo", "", "the new topic memo")
+	adminKey := flags.String("admin-key", "", "the new admin key spec")
+	submitKey := flags.String("submit-key", "", "the new submit key spec")
+	var adminKeyFiles, submitKeyFiles stringList
+	flags.Var(&adminKeyFiles, "admin-key-file", "file containing an admin private key to sign with (can be repeated)")
+	flags.Var(&submitKeyFiles, "submit-key-file", "file containing a private key of the new submit key, to save to TOPIC_SUBMIT_KEY (can be repeated)")
+	_ = flags.Parse(args)
+
+	topic := mustParseTopicFlag(*topicString)
+
+	updateTxn := hedera.NewConsensusTopicUpdateTransaction().
+		SetTopicID(topic).
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000))
+
+	writeMap := make(map[string]string)
+	output := map[string]string{"topicId": topic.String()}
+
+	if *memo != "" {
+		updateTxn = updateTxn.SetTopicMemo(*memo)
+		output["memo"] = *memo
+	}
+
+	if *adminKey != "" {
+		adminSpec := mustParseKeySpec("admin-key", *adminKey)
+		updateTxn = updateTxn.SetAdminKey(adminSpec.PublicKey())
+		writeMap["TOPIC_ADMIN_KEYS"] = adminSpec.String()
+		output["adminKey"] = adminSpec.String()
+	}
+
+	if *submitKey != "" || len(submitKeyFiles) > 0 {
+		submitSpec, privateKeys := newSubmitKey(*submitKey, submitKeyFiles)
+		updateTxn = updateTxn.SetSubmitKey(submitSpec.PublicKey())
+		output["submitKey"] = submitSpec.String()
+		if len(privateKeys) > 0 {
+			writeMap["TOPIC_SUBMIT_KEY"] = strings.Join(privateKeys, ",")
+		}
+	}
+
+	if len(output) == 1 {
+		panic(fmt.Errorf("Please provide at least one of --memo, --admin-key or --submit-key\n"))
+	}
+
+	output["transactionId"] = executeAdminTransaction(updateTxn, adminKeyFiles).String()
+
+	//demo.env only describes TOPIC_ID, so the keys of any other topic are left for the caller to keep
+	if len(writeMap) > 0 && isConfiguredTopic(topic) {
+		niceWrite(writeMap, "demo.env")
+	} else if len(writeMap) > 0 {
+		log.Printf("Topic %v isn't TOPIC_ID, so its new keys haven't been saved to demo.env.\n", topic)
+	}
+
+	if output["submitKey"] != "" && writeMap["TOPIC_SUBMIT_KEY"] == "" {
+		log.Printf("The submit key for topic %v has changed, so make sure the signer (SIGNER) holds the new key.\n", topic)
+	}
+
+	printJSON(output)
+}
+
+//This function reads the new submit key for topic update. The private keys given with --submit-key-file are saved to
+// TOPIC_SUBMIT_KEY once the update has succeeded, so they must be able to meet the key spec's threshold. When signing
+// locally they are required, as the web-server couldn't submit without them
+func newSubmitKey(spec string, keyFiles []string) (keySpec, []string) {
+	var publicKeys, privateKeys []string
+	for _, keyFile := range keyFiles {
+		privateKey := readPrivateKeyFile(keyFile)
+		publicKeys = append(publicKeys, privateKey.PublicKey().String())
+		privateKeys = append(privateKeys, privateKey.String())
+	}
+
+	var submitSpec keySpec
+	switch {
+	case spec != "":
+		submitSpec = mustParseKeySpec("submit-key", spec)
+	case len(publicKeys) == 1:
+		submitSpec = keySpec{Threshold: 1, Keys: publicKeys}
+	default:
+		panic(fmt.Errorf("Please give the new submit key spec with --submit-key when passing more than one --submit-key-file\n"))
+	}
+
+	if len(privateKeys) == 0 {
+		if getEnv("SIGNER", "local") == "local" {
+			panic(fmt.Errorf("Please give the new submit key's private keys with --submit-key-file, so that they can be saved to TOPIC_SUBMIT_KEY (or use topic rotate-submit-key)\n"))
+		}
+		return submitSpec, nil
+	}
+
+	if signed := submitSpec.signedCount(publicKeys); signed < submitSpec.Threshold || signed < len(publicKeys) {
+		panic(fmt.Errorf("The keys given with --submit-key-file must all be part of the new submit key, and meet its threshold of %v\n", submitSpec.Threshold))
+	}
+
+	return submitSpec, privateKeys
+}
+
+//This function checks whether a topic is the one configured in demo.env, whose keys the config describes
+func isConfiguredTopic(topic hedera.ConsensusTopicID) bool {
+	configured, err := hedera.TopicIDFromString(os.Getenv("TOPIC_ID"))
+	return err == nil && configured == topic
+}
+
+func topicRotateSubmitKeyCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("topic rotate-submit-key", flag.ExitOnError)
+	var adminKeyFiles stringList
+	flags.Var(&adminKeyFiles, "admin-key-file", "file containing an admin private key to sign with (can be repeated)")
+	_ = flags.Parse(args)
+
+	//the new key is saved to TOPIC_SUBMIT_KEY, so only TOPIC_ID's submit key can be rotated
+	topic := mustParseTopicFlag(os.Getenv("TOPIC_ID"))
+
+	if getEnv("SIGNER", "local") != "local" {
+		panic(fmt.Errorf("The submit key can only be rotated automatically when SIGNER is local. Generate the new key where your keys are held and use topic update --submit-key instead.\n"))
+	}
+
+	newSubmitKey, err := hedera.GenerateEd25519PrivateKey()
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to generate a private topic submit key. Err: %v\n", err))
+	}
+
+	//keep a copy of the new key on disk until it has been saved to demo.env, so that it isn't lost if something goes
+	// wrong between the topic being updated and the config being written
+	pendingKeyFile := "demo.env.pending-submit-key"
+	writeFileAtomically(pendingKeyFile, []byte(newSubmitKey.String()+"\n"), 0600)
+
+	updateTxn := hedera.NewConsensusTopicUpdateTransaction().
+		SetTopicID(topic).
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000)).
+		SetSubmitKey(newSubmitKey.PublicKey())
+
+	txnId := executeAdminTransaction(updateTxn, adminKeyFiles)
+
+	niceWrite(map[string]string{"TOPIC_SUBMIT_KEY": newSubmitKey.String()}, "demo.env")
+	_ = os.Remove(pendingKeyFile)
+
+	log.Printf("The submit key for topic %v has been rotated. Any running servers need restarting to pick up the new key.\n", topic)
+
+	printJSON(map[string]string{
+		"topicId":       topic.String(),
+		"submitKey":     newSubmitKey.PublicKey().String(),
+		"transactionId": txnId.String(),
+	})
+}
+
+func topicDeleteCommand(args []string) {
+	loadOperatorConfig()
+
+	flags := flag.NewFlagSet("topic delete", flag.ExitOnError)
+	topicString := flags.String("topic", os.Getenv("TOPIC_ID"), "the topic to delete (defaults to TOPIC_ID)")
+	assumeYes := flags.Bool("yes", false, "delete without asking for confirmation")
+	var adminKeyFiles stringList
+	flags.Var(&adminKeyFiles, "admin-key-file", "file containing an admin private key to sign with (can be repeated)")
+	_ = flags.Parse(args)
+
+	topic := mustParseTopicFlag(*topicString)
+
+	if !*assumeYes && !confirm(fmt.Sprintf("Delete topic %v? This cannot be undone.", topic)) {
+		return
+	}
+
+	deleteTxn := hedera.NewConsensusTopicDeleteTransaction().
+		SetTopicID(topic).
+		SetMaxTransactionFee(hedera.HbarFromTinybar(100000000))
+
+	txnId := executeAdminTransaction(deleteTxn, adminKeyFiles)
+
+	if isConfiguredTopic(topic) {
+		niceWrite(map[string]string{"TOPIC_ID": "", "TOPIC_SUBMIT_KEY": "", "TOPIC_ADMIN_KEY": "", "TOPIC_ADMIN_KEYS": ""}, "demo.env")
+	}
+
+	printJSON(map[string]string{
+		"topicId":       topic.String(),
+		"deleted":       "true",
+		"transactionId": txnId.String(),
+	})
+}
+
+//the builder types for the admin transactions we submit, all of which share the same Build method
+type adminTransactionBuilder interface {
+	Build(client *hedera.Client) (hedera.Transaction, error)
+}
+
+//This function builds an admin transaction, signs it with the operator and the given admin key files and then submits
+// it, panicking unless the transaction succeeds
+func executeAdminTransaction(builder adminTransactionBuilder, adminKeyFiles []string) hedera.TransactionID {
+	if len(adminKeyFiles) == 0 {
+		panic(fmt.Errorf("Please provide the admin key to sign with using --admin-key-file (or use the build-topic-* commands to sign offline)\n"))
+	}
+
+	signers := []Signer{operatorSigner}
+	for _, keyFile := range adminKeyFiles {
+		signers = append(signers, newLocalSigner(readPrivateKeyFile(keyFile)))
+	}
+
+	client := newClient()
+
+	builtTxn, err := builder.Build(client)
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to build topic admin transaction: %v\n", err))
+	}
+
+	signedTxn, err := signTransaction(builtTxn, signers...)
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to sign topic admin transaction: %v\n", err))
+	}
+
+	txnId, err := signedTxn.Execute(client)
+	if err != nil {
+		panic(fmt.Errorf("Error when attempting to execute topic admin transaction: %v\n", err))
+	}
+
+	receipt, err := txnId.GetReceipt(client)
+	if err != nil {
+		panic(fmt.Errorf("Error when retrieving receipt for transaction %v. Error: %v\n", txnId.String(), err))
+	}
+
+	if receipt.Status != hedera.StatusSuccess {
+		panic(fmt.Errorf("Topic admin transaction %v failed (receipt shows non-Success status %v)\n", txnId, receipt.Status))
+	}
+
+	return txnId
+}
+
+//This function reads an Ed25519 private key from a file
+func readPrivateKeyFile(keyFile string) hedera.Ed25519PrivateKey {
+	keyContents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read private key from %v. Error: %v\n", keyFile, err))
+	}
+
+	privateKey, err := hedera.Ed25519PrivateKeyFromString(strings.TrimSpace(string(keyContents)))
+	if err != nil {
+		panic(fmt.Errorf("Unable to convert the contents of %v into Hedera Ed25519 Private Key.\n", keyFile))
+	}
+	return privateKey
+}
+
+//stringList is a flag that can be passed more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+//This function prints a value as indented JSON on stdout
+func printJSON(value interface{}) {
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(output))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Alongside the decoded events, the event store keeps every topic message exactly as it arrived from the mirror node,
+// so that anyone auditing us can check the messages against their running hashes (see verify.go). They are served
+// from /api/v1/topics/{topicId}/messages in the same JSON as the mirror node's REST API, so a dump of our store and
+// a dump of a public mirror node can be checked in exactly the same way, e.g.
+//
+//	GET /api/v1/topics/0.0.1234/messages?sequencenumber=gt:100&limit=100
+//
+//Only the tenant's own topics can be read, and the messages are still encrypted
+const maxTopicMessagesPage = 100
+
+//a mirrorTopicMessage is a topic message in the mirror node REST API's JSON. The message and running hash are base64
+// encoded
+type mirrorTopicMessage struct {
+	ConsensusTimestamp string `json:"consensus_timestamp"`
+	TopicId            string `json:"topic_id"`
+	Message            []byte `json:"message"`
+	PayerAccountId     string `json:"payer_account_id,omitempty"`
+	RunningHash        []byte `json:"running_hash"`
+	RunningHashVersion int    `json:"running_hash_version"`
+	SequenceNumber     uint64 `json:"sequence_number"`
+	ChunkInfo          *struct {
+		InitialTransactionId struct {
+			AccountId             string `json:"account_id"`
+			TransactionValidStart string `json:"transaction_valid_start"`
+		} `json:"initial_transaction_id"`
+		Number int `json:"number"`
+		Total  int `json:"total"`
+	} `json:"chunk_info,omitempty"`
+}
+
+type mirrorTopicMessagesPage struct {
+	Messages []mirrorTopicMessage `json:"messages"`
+	Links    struct {
+		Next *string `json:"next"`
+	} `json:"links"`
+}
+
+//This function builds the mirror REST form of a message we received from the mirror node's gRPC API. The gRPC API
+// doesn't tell us who paid for the message, so we take the payer from the public.transactionId inside it
+func newMirrorTopicMessage(topic hedera.ConsensusTopicID, response hedera.MirrorConsensusTopicResponse) mirrorTopicMessage {
+	message := mirrorTopicMessage{
+		ConsensusTimestamp: formatConsensusTimestamp(response.ConsensusTimeStamp),
+		TopicId:            topic.String(),
+		Message:            response.Message,
+		RunningHash:        response.RunningHash,
+		RunningHashVersion: runningHashVersion,
+		SequenceNumber:     response.SequenceNumber,
+	}
+
+	if payer, _, err := parseTransactionId(gjson.GetBytes(response.Message, "public.transactionId").String()); err == nil {
+		message.PayerAccountId = fmt.Sprintf("%d.%d.%d", payer.shard, payer.realm, payer.num)
+	}
+
+	return message
+}
+
+//This function turns a topic message back into the response the mirror node's gRPC API would have sent for it
+func (m mirrorTopicMessage) response() (hedera.ConsensusTopicID, hedera.MirrorConsensusTopicResponse, error) {
+	topic, err := hedera.TopicIDFromString(m.TopicId)
+	if err != nil {
+		return hedera.ConsensusTopicID{}, hedera.MirrorConsensusTopicResponse{}, fmt.Errorf("invalid topic ID %q", m.TopicId)
+	}
+
+	consensusTimestamp, err := parseConsensusTimestamp(m.ConsensusTimestamp)
+	if err != nil {
+		return hedera.ConsensusTopicID{}, hedera.MirrorConsensusTopicResponse{}, err
+	}
+
+	return topic, hedera.MirrorConsensusTopicResponse{
+		ConsensusTimeStamp: consensusTimestamp,
+		Message:            m.Message,
+		RunningHash:        m.RunningHash,
+		SequenceNumber:     m.SequenceNumber,
+	}, nil
+}
+
+//This function stores a topic message as it arrived from the mirror node, in its place by sequence number (replacing
+// the message with the same sequence number if there is one)
+func (s *memoryEventStore) putTopicMessage(message mirrorTopicMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := s.topicMessages[message.TopicId]
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].SequenceNumber >= message.SequenceNumber
+	})
+	if i < len(messages) && messages[i].SequenceNumber == message.SequenceNumber {
+		messages[i] = message
+		return
+	}
+
+	messages = append(messages, mirrorTopicMessage{})
+	copy(messages[i+1:], messages[i:])
+	messages[i] = message
+	s.topicMessages[message.TopicId] = messages
+}
+
+//This function returns up to limit of a topic's messages with sequence numbers after the given one
+func (s *memoryEventStore) topicMessagesAfter(topic string, sequenceNumber uint64, limit int) []mirrorTopicMessage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := s.topicMessages[topic]
+	start := sort.Search(len(messages), func(i int) bool {
+		return messages[i].SequenceNumber > sequenceNumber
+	})
+
+	end := start + limit
+	if end > len(messages) {
+		end = len(messages)
+	}
+
+	return append([]mirrorTopicMessage(nil), messages[start:end]...)
+}
+
+//This function returns a topic message as it arrived from the mirror node
+func (s *memoryEventStore) topicMessage(topic string, sequenceNumber uint64) (mirrorTopicMessage, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := s.topicMessages[topic]
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].SequenceNumber >= sequenceNumber
+	})
+	if i < len(messages) && messages[i].SequenceNumber == sequenceNumber {
+		return messages[i], true
+	}
+	return mirrorTopicMessage{}, false
+}
+
+//This function returns how many of a topic's messages are stored, along with the latest of them
+func (s *memoryEventStore) lastTopicMessage(topic string) (mirrorTopicMessage, int, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := s.topicMessages[topic]
+	if len(messages) == 0 {
+		return mirrorTopicMessage{}, 0, false
+	}
+	return messages[len(messages)-1], len(messages), true
+}
+
+func topicMessagesHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/topics/")
+	if !strings.HasSuffix(path, "/messages") {
+		http.NotFound(rw, r)
+		return
+	}
+	topic, err := hedera.TopicIDFromString(strings.TrimSuffix(path, "/messages"))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid topic ID %q", strings.TrimSuffix(path, "/messages")), http.StatusBadRequest)
+		return
+	}
+	if _, err := resolveExportTopic([]*tenant{t}, topic.String()); err != nil {
+		http.Error(rw, fmt.Sprintf("topic %v does not belong to this tenant", topic), http.StatusForbidden)
+		return
+	}
+
+	after, limit, err := topicMessagesPageParams(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := mirrorTopicMessagesPage{Messages: eventStore.topicMessagesAfter(topic.String(), after, limit)}
+	if page.Messages == nil {
+		page.Messages = []mirrorTopicMessage{}
+	}
+	if len(page.Messages) == limit {
+		next := fmt.Sprintf("/api/v1/topics/%v/messages?sequencenumber=gt:%v&limit=%v", topic, page.Messages[len(page.Messages)-1].SequenceNumber, limit)
+		page.Links.Next = &next
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(page)
+}
+
+//This function reads the paging parameters of a request for topic messages: the sequence number to start after and
+// the most to return
+func topicMessagesPageParams(params url.Values) (uint64, int, error) {
+	limit := maxTopicMessagesPage
+	if limitParam := params.Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", limitParam)
+		}
+		if limit > maxTopicMessagesPage {
+			limit = maxTopicMessagesPage
+		}
+	}
+
+	//like the mirror node, the sequence number can be given as gt:N, gte:N or just N (which is the same as gte:N)
+	after := uint64(0)
+	if sequenceParam := params.Get("sequencenumber"); sequenceParam != "" {
+		operator, value := "gte", sequenceParam
+		if parts := strings.SplitN(sequenceParam, ":", 2); len(parts) == 2 {
+			operator, value = parts[0], parts[1]
+		}
+
+		sequenceNumber, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || (operator != "gt" && operator != "gte") {
+			return 0, 0, fmt.Errorf("invalid sequencenumber %q, should be gt:N or gte:N", sequenceParam)
+		}
+
+		after = sequenceNumber
+		if operator == "gte" && sequenceNumber > 0 {
+			after = sequenceNumber - 1
+		}
+	}
+
+	return after, limit, nil
+}
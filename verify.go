@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The verify command checks a dump of topic messages offline, so an auditor can confirm that the audit trail is
+// complete and untampered without trusting this web-server. The dump is in the mirror node REST API's JSON, and can
+// come from a public mirror node or from our own store (see topicmessages.go), either as a saved file or fetched
+// page by page from a URL, e.g.
+//
+//	go run . verify --in https://testnet.mirrornode.hedera.com/api/v1/topics/0.0.1234/messages --key 2020-01=... --out report.json
+//
+//For every topic in the dump it checks that:
+//
+//	sequence     the sequence numbers run on from each other, with none missing or repeated
+//	runningHash  each running hash follows from the message and the running hash before it
+//	transaction  each public.transactionId was paid for by the account that paid for the message, and was valid when
+//	             the message reached consensus (batched events must be numbered on from the batch's transaction ID)
+//	private      each private section decrypts with the key named by public.keyId, and agrees with the public section
+//	             (a batch's private sections decrypt together, with the key named by the batch's public.keyId)
+//
+//The report is signed with the --signing-key (or the operator's signer), and the command exits with status 1 if any
+// check failed. The verify-report command checks a report's signature
+type verifyFailure struct {
+	TopicId        string `json:"topicId"`
+	SequenceNumber uint64 `json:"sequenceNumber"`
+	TransactionId  string `json:"transactionId,omitempty"`
+	Check          string `json:"check"`
+	Detail         string `json:"detail"`
+}
+
+type verifyTopicSummary struct {
+	TopicId             string `json:"topicId"`
+	FirstSequenceNumber uint64 `json:"firstSequenceNumber"`
+	LastSequenceNumber  uint64 `json:"lastSequenceNumber"`
+	Messages            int    `json:"messages"`
+	Events              int    `json:"events"`
+
+	//the running hash of the last message, which anyone can compare against the network to extend the check
+	LastRunningHash string `json:"lastRunningHash"`
+}
+
+type verifyReport struct {
+	Source      string               `json:"source"`
+	GeneratedAt string               `json:"generatedAt"`
+	Result      string               `json:"result"` //pass or fail
+	Topics      []verifyTopicSummary `json:"topics"`
+	Failures    []verifyFailure      `json:"failures"`
+}
+
+//a signedVerifyReport holds the report exactly as it was signed, alongside the signature over those bytes
+type signedVerifyReport struct {
+	Report    json.RawMessage `json:"report"`
+	PublicKey string          `json:"publicKey"`
+	Signature string          `json:"signature"`
+}
+
+//This function runs the verify command
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	in := flags.String("in", "", "the mirror REST dump to verify, as a file or a URL to fetch page by page")
+	apiKey := flags.String("api-key", "", "the API key to send when fetching from our own web-server")
+	var keys stringList
+	flags.Var(&keys, "key", "an encryption key as keyId=key, or just the key for messages without a keyId (can be repeated)")
+	signingKey := flags.String("signing-key", "", "the Ed25519 private key to sign the report with (defaults to the operator's signer)")
+	outFile := flags.String("out", "", "the file to write the signed report to (defaults to standard output)")
+	_ = flags.Parse(args)
+
+	if *in == "" {
+		panic(fmt.Errorf("Please give the dump to verify with --in\n"))
+	}
+
+	decryptionKeys := keyring{keys: make(map[string]string)}
+	for _, key := range keys {
+		keyId, value := "", key
+		if parts := strings.SplitN(key, "=", 2); len(parts) == 2 {
+			keyId, value = parts[0], parts[1]
+		}
+		decryptionKeys.keys[keyId] = value
+	}
+
+	var signer Signer
+	if *signingKey != "" {
+		signer = newLocalSigner(mustParsePrivateKey(*signingKey, "--signing-key"))
+	} else {
+		loadOperatorConfig()
+		signer = operatorSigner
+	}
+
+	messages, err := readTopicMessages(*in, *apiKey)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read topic messages from %v. Error: %v\n", *in, err))
+	}
+
+	report := verifyTopicMessages(messages, decryptionKeys)
+	report.Source = *in
+
+	signed, err := signVerifyReport(report, signer)
+	if err != nil {
+		panic(fmt.Errorf("Unable to sign the report. Error: %v\n", err))
+	}
+
+	//the report is written compactly, as re-indenting it would change the bytes that were signed
+	signedJson, err := json.Marshal(signed)
+	if err != nil {
+		panic(err)
+	}
+	signedJson = append(signedJson, '\n')
+
+	if *outFile != "" {
+		writeFileAtomically(*outFile, signedJson, 0644)
+	} else {
+		_, _ = os.Stdout.Write(signedJson)
+	}
+
+	fmt.Fprintf(os.Stderr, "Verified %v topic(s): %v with %v failure(s)\n", len(report.Topics), strings.ToUpper(report.Result), len(report.Failures))
+	if report.Result != "pass" {
+		os.Exit(1)
+	}
+}
+
+//This function runs the verify-report command, which checks the signature on a report written by verify
+func verifyReportCommand(args []string) {
+	flags := flag.NewFlagSet("verify-report", flag.ExitOnError)
+	publicKey := flags.String("public-key", "", "the Ed25519 public key the report must be signed by (defaults to whichever key it names)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		panic(fmt.Errorf("Usage: go run . verify-report [--public-key key] report.json\n"))
+	}
+
+	fileContents, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		panic(fmt.Errorf("Unable to read report %v. Error: %v\n", flags.Arg(0), err))
+	}
+
+	var signed signedVerifyReport
+	err = json.Unmarshal(fileContents, &signed)
+	if err != nil {
+		panic(fmt.Errorf("Unable to decode report %v. Error: %v\n", flags.Arg(0), err))
+	}
+
+	if *publicKey != "" && parsePublicKey(*publicKey).String() != parsePublicKey(signed.PublicKey).String() {
+		fmt.Printf("The report is signed by %v, not %v\n", signed.PublicKey, *publicKey)
+		os.Exit(1)
+	}
+
+	signature, err := hex.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(parsePublicKey(signed.PublicKey).Bytes()), signed.Report, signature) {
+		fmt.Printf("The signature on the report is NOT valid\n")
+		os.Exit(1)
+	}
+
+	fmt.Printf("The signature on the report is valid (signed by %v). Result: %v\n", signed.PublicKey, gjson.GetBytes(signed.Report, "result").String())
+}
+
+func signVerifyReport(report verifyReport, signer Signer) (signedVerifyReport, error) {
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		return signedVerifyReport{}, err
+	}
+
+	signature, err := signer.Sign(reportJson)
+	if err != nil {
+		return signedVerifyReport{}, err
+	}
+
+	return signedVerifyReport{
+		Report:    reportJson,
+		PublicKey: signer.PublicKey().String(),
+		Signature: hex.EncodeToString(signature),
+	}, nil
+}
+
+//This function reads topic messages in the mirror REST API's JSON from a file or URL. A file can hold a single page
+// ({"messages": [...]}), an array of messages or one message per line. A URL is fetched page by page by following
+// links.next
+func readTopicMessages(source string, apiKey string) ([]mirrorTopicMessage, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		fileContents, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return decodeTopicMessages(fileContents)
+	}
+
+	//a URL is fetched page by page, following links.next
+	client := &mirrorRestClient{baseUrl: source, apiKey: apiKey, httpClient: http.DefaultClient}
+	var messages []mirrorTopicMessage
+	err := client.eachTopicMessageFrom(context.Background(), source, nil, func(message mirrorTopicMessage) bool {
+		messages = append(messages, message)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func decodeTopicMessages(contents []byte) ([]mirrorTopicMessage, error) {
+	trimmed := bytes.TrimSpace(contents)
+
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var messages []mirrorTopicMessage
+		err := json.Unmarshal(trimmed, &messages)
+		return messages, err
+
+	case gjson.GetBytes(trimmed, "messages").IsArray():
+		var page mirrorTopicMessagesPage
+		err := json.Unmarshal(trimmed, &page)
+		return page.Messages, err
+	}
+
+	var messages []mirrorTopicMessage
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var message mirrorTopicMessage
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, scanner.Err()
+}
+
+//This function runs every check over the topic messages, which may come from several topics and in any order
+func verifyTopicMessages(messages []mirrorTopicMessage, keys keyring) verifyReport {
+	report := verifyReport{GeneratedAt: time.Now().UTC().Format(time.RFC3339), Failures: []verifyFailure{}}
+
+	byTopic := make(map[string][]mirrorTopicMessage)
+	for _, message := range messages {
+		byTopic[message.TopicId] = append(byTopic[message.TopicId], message)
+	}
+
+	topicIds := make([]string, 0, len(byTopic))
+	for topicId := range byTopic {
+		topicIds = append(topicIds, topicId)
+	}
+	sort.Strings(topicIds)
+
+	for _, topicId := range topicIds {
+		summary, failures := verifyTopic(topicId, byTopic[topicId], keys)
+		report.Topics = append(report.Topics, summary)
+		report.Failures = append(report.Failures, failures...)
+	}
+
+	report.Result = "pass"
+	if len(report.Failures) > 0 || len(report.Topics) == 0 {
+		report.Result = "fail"
+	}
+	return report
+}
+
+func verifyTopic(topicId string, messages []mirrorTopicMessage, keys keyring) (verifyTopicSummary, []verifyFailure) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].SequenceNumber < messages[j].SequenceNumber
+	})
+
+	summary := verifyTopicSummary{
+		TopicId:             topicId,
+		FirstSequenceNumber: messages[0].SequenceNumber,
+		LastSequenceNumber:  messages[len(messages)-1].SequenceNumber,
+		Messages:            len(messages),
+		LastRunningHash:     hex.EncodeToString(messages[len(messages)-1].RunningHash),
+	}
+
+	var failures []verifyFailure
+	fail := func(message mirrorTopicMessage, transactionId string, check string, format string, args ...interface{}) {
+		failures = append(failures, verifyFailure{
+			TopicId:        topicId,
+			SequenceNumber: message.SequenceNumber,
+			TransactionId:  transactionId,
+			Check:          check,
+			Detail:         fmt.Sprintf(format, args...),
+		})
+	}
+
+	topic, err := parseEntityId(topicId)
+	if err != nil {
+		fail(messages[0], "", "sequence", "%v", err)
+		return summary, failures
+	}
+
+	//the first message in the dump can only be checked against its running hash if it is the first on the topic, as
+	// otherwise we don't have the running hash before it
+	var previousRunningHash []byte
+	for i, message := range messages {
+		if i > 0 {
+			previous := messages[i-1]
+			switch {
+			case message.SequenceNumber == previous.SequenceNumber:
+				fail(message, "", "sequence", "sequence number %v appears more than once", message.SequenceNumber)
+				continue
+			case message.SequenceNumber != previous.SequenceNumber+1:
+				fail(message, "", "sequence", "sequence numbers %v to %v are missing", previous.SequenceNumber+1, message.SequenceNumber-1)
+				previousRunningHash = nil
+			}
+		}
+
+		consensusTimestamp, err := parseConsensusTimestamp(message.ConsensusTimestamp)
+		if err != nil {
+			fail(message, "", "sequence", "%v", err)
+			previousRunningHash = nil
+			continue
+		}
+
+		transactionId := gjson.GetBytes(message.Message, "public.transactionId").String()
+		payer, validStart, transactionErr := parseTransactionId(transactionId)
+
+		//the payer is the account that paid for the message, which the mirror REST API gives us directly. Without it
+		// we take the payer from public.transactionId, which is what our own messages record
+		messagePayer := payer
+		if message.PayerAccountId != "" {
+			messagePayer, err = parseEntityId(message.PayerAccountId)
+			if err != nil {
+				fail(message, transactionId, "transaction", "%v", err)
+			}
+		}
+
+		switch {
+		case message.RunningHashVersion != runningHashVersion:
+			fail(message, transactionId, "runningHash", "running hash version %v can't be verified, only version %v", message.RunningHashVersion, runningHashVersion)
+		case previousRunningHash == nil && message.SequenceNumber != 1:
+			//nothing to check against
+		case message.PayerAccountId == "" && transactionErr != nil:
+			fail(message, transactionId, "runningHash", "the payer is unknown, so the running hash can't be verified")
+		default:
+			expected := computeRunningHash(previousRunningHash, messagePayer, topic, consensusTimestamp, message.SequenceNumber, message.Message)
+			if !bytes.Equal(expected, message.RunningHash) {
+				fail(message, transactionId, "runningHash", "the running hash is %x, but should be %x", message.RunningHash, expected)
+			}
+		}
+		previousRunningHash = message.RunningHash
+
+		if transactionErr != nil {
+			fail(message, transactionId, "transaction", "%v", transactionErr)
+		} else {
+			verifyCarryingTransaction(message, payer, messagePayer, validStart, consensusTimestamp, func(format string, args ...interface{}) {
+				fail(message, transactionId, "transaction", format, args...)
+			})
+		}
+
+		//a batch message carries several events, numbered on from the batch's own transaction ID, with their private
+		// sections encrypted together in the batch's (see batch.go)
+		events := []gjson.Result{gjson.ParseBytes(message.Message)}
+		var privates []gjson.Result
+		var privatesErr error
+		batch := gjson.GetBytes(message.Message, "batch")
+		if batch.IsArray() {
+			events = batch.Array()
+			for index, event := range events {
+				if eventId := event.Get("public.transactionId").String(); eventId != fmt.Sprintf("%v-%v", transactionId, index) {
+					fail(message, eventId, "transaction", "batched event %v should have the transaction ID %v-%v", index, transactionId, index)
+				}
+			}
+
+			privates, privatesErr = batchPrivateSections(keys, gjson.ParseBytes(message.Message))
+			if privatesErr != nil {
+				fail(message, transactionId, "private", "%v", privatesErr)
+			}
+		}
+
+		for index, event := range events {
+			//an audit log anchor has no private section, and is checked by verify-audit-log instead
+			if event.Get("public.event").String() == auditAnchorEvent {
+				continue
+			}
+
+			summary.Events++
+			eventId := event.Get("public.transactionId").String()
+
+			var err error
+			switch {
+			case !batch.IsArray():
+				err = verifyPrivateSection(event, keys)
+			case privatesErr != nil:
+				//the batch's private section has already been reported
+			default:
+				if err = verifyPublicSection(event); err == nil {
+					err = verifyDecryptedSection(event, privates[index].Raw)
+				}
+			}
+			if err != nil {
+				fail(message, eventId, "private", "%v", err)
+			}
+		}
+	}
+
+	return summary, failures
+}
+
+//This function checks that public.transactionId is the transaction that carried the message: it must have been paid
+// for by the same account, must have been valid when the message reached consensus and, when the mirror node gives
+// us the transaction ID, must match it exactly
+func verifyCarryingTransaction(message mirrorTopicMessage, payer entityId, messagePayer entityId, validStart time.Time, consensusTimestamp time.Time, fail func(format string, args ...interface{})) {
+	if payer != messagePayer {
+		fail("the transaction was paid for by %v, not %d.%d.%d", message.PayerAccountId, payer.shard, payer.realm, payer.num)
+	}
+
+	if !validStart.Before(consensusTimestamp) || consensusTimestamp.Sub(validStart) > maxTransactionValidDuration {
+		fail("the transaction's valid start %v is not within %v before its consensus timestamp %v", formatConsensusTimestamp(validStart), maxTransactionValidDuration, message.ConsensusTimestamp)
+	}
+
+	if message.ChunkInfo != nil {
+		initial := message.ChunkInfo.InitialTransactionId
+		carrying := fmt.Sprintf("%v@%v", initial.AccountId, initial.TransactionValidStart)
+		if initialPayer, initialValidStart, err := parseTransactionId(carrying); err != nil || initialPayer != payer || !initialValidStart.Equal(validStart) {
+			fail("the message was carried by transaction %v", carrying)
+		}
+	}
+}
+
+//the fields every event carries in each section (see HcsMessageStruct in main.go)
+var (
+	requiredPublicFields  = []string{"event", "timestamp", "tzOffset", "transactionId"}
+	requiredPrivateFields = []string{"secretMessage", "videoCurrentTime", "videoDuration", "videoUrl", "userAgent"}
+)
+
+//This function checks that an event has the fields every event carries, that its private section decrypts with the
+// key named by public.keyId and that its video position is within the video. The transaction ID is checked against
+// the carrying transaction by verifyCarryingTransaction
+func verifyPrivateSection(event gjson.Result, keys keyring) error {
+	if err := verifyPublicSection(event); err != nil {
+		return err
+	}
+
+	//a message written with one of several keys has to say which
+	keyId := event.Get("public.keyId")
+	if _, unnamed := keys.keys[""]; !unnamed && keyId.String() == "" {
+		return fmt.Errorf("public.keyId is missing, and there is no key for messages without one")
+	}
+
+	encrypted, err := hex.DecodeString(event.Get("private").String())
+	if err != nil {
+		return fmt.Errorf("the private section is not hex encoded: %v", err)
+	}
+
+	decrypted, err := keys.decrypt(keyId.String(), encrypted)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt the private section with key %q: %v", keyId.String(), strings.TrimSpace(err.Error()))
+	}
+
+	return verifyDecryptedSection(event, decrypted)
+}
+
+//This function checks that an event has every public field
+func verifyPublicSection(event gjson.Result) error {
+	for _, field := range requiredPublicFields {
+		if !event.Get("public." + field).Exists() {
+			return fmt.Errorf("public.%v is missing", field)
+		}
+	}
+	if event.Get("public.event").String() == "" {
+		return fmt.Errorf("public.event is missing")
+	}
+	return nil
+}
+
+//This function checks an event's decrypted private section
+func verifyDecryptedSection(event gjson.Result, decrypted string) error {
+	private := gjson.Parse(decrypted)
+	if !gjson.Valid(decrypted) || !private.IsObject() {
+		return fmt.Errorf("the private section does not decrypt to a JSON object")
+	}
+
+	for _, field := range requiredPrivateFields {
+		if !private.Get(field).Exists() {
+			return fmt.Errorf("the private section has no %v", field)
+		}
+	}
+
+	//a complete event is sent at the end of the video, and every other event part way through it
+	currentTime, currentErr := strconv.ParseFloat(private.Get("videoCurrentTime").String(), 64)
+	duration, durationErr := strconv.ParseFloat(private.Get("videoDuration").String(), 64)
+	if currentErr != nil || durationErr != nil {
+		return fmt.Errorf("the private section's videoCurrentTime %q and videoDuration %q should be numbers", private.Get("videoCurrentTime").String(), private.Get("videoDuration").String())
+	}
+	if currentTime < 0 || currentTime > duration {
+		return fmt.Errorf("the %v event is at %v seconds into a %v second video", event.Get("public.event").String(), currentTime, duration)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashgraph/hedera-sdk-go"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyTopicMessages(t *testing.T) {
+	//This function returns the topic's messages as the mirror REST API gives them, after count events have reached
+	// consensus and then each of the extra messages
+	topicMessages := func(t *testing.T, count int, extra ...[]byte) []mirrorTopicMessage {
+		consensus, _ := testConsensus(t, "0.0.1234", count)
+		for _, message := range extra {
+			if _, err := consensus.submit("0.0.1234", message); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		simulated, _ := consensus.messagesFrom("0.0.1234", 0)
+		var messages []mirrorTopicMessage
+		for _, message := range simulated {
+			messages = append(messages, message.restMessage("0.0.1234"))
+		}
+		return messages
+	}
+
+	te := testTenant("0.0.1234")
+	private := `{"secretMessage":"","videoCurrentTime":"1","videoDuration":"10","videoUrl":"video.mp4","userAgent":"test"}`
+	batchMessageWith := func(eventIds ...string) []byte {
+		txnId := hedera.NewTransactionID(hedera.AccountID{Account: 5})
+		var events, privates []string
+		for i, eventId := range eventIds {
+			if eventId == "" {
+				eventId = fmt.Sprintf("%v-%v", txnId, i)
+			}
+			events = append(events, fmt.Sprintf(`{"public":{"event":"progress","timestamp":"1590000000000","tzOffset":"0","transactionId":"%v"}}`, eventId))
+			privates = append(privates, private)
+		}
+		return []byte(batchMessage(te, txnId, events, privates))
+	}
+
+	tests := []struct {
+		name     string
+		messages func(t *testing.T) []mirrorTopicMessage
+		keys     keyring
+		failures []string //each failure's check and sequence number
+		events   int
+	}{
+		{
+			name:     "an unbroken topic",
+			messages: func(t *testing.T) []mirrorTopicMessage { return topicMessages(t, 4) },
+			events:   4,
+		},
+		{
+			name: "a gap",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				messages := topicMessages(t, 4)
+				return append(messages[:1], messages[2:]...)
+			},
+			failures: []string{"sequence 3"},
+			events:   3,
+		},
+		{
+			name: "a duplicate",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				messages := topicMessages(t, 3)
+				return append(messages, messages[1])
+			},
+			failures: []string{"sequence 2"},
+			events:   3,
+		},
+		{
+			name: "an altered running hash",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				messages := topicMessages(t, 4)
+				messages[2].RunningHash = append([]byte(nil), messages[2].RunningHash...)
+				messages[2].RunningHash[0] ^= 1
+				return messages
+			},
+			//the message after it is chained on from the altered running hash, so it fails too
+			failures: []string{"runningHash 3", "runningHash 4"},
+			events:   4,
+		},
+		{
+			name: "an altered message",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				messages := topicMessages(t, 3)
+				messages[1].Message = testEvent(testTransactionId(2), "complete")
+				return messages
+			},
+			failures: []string{"runningHash 2"},
+			events:   3,
+		},
+		{
+			name: "a payer mismatch",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				messages := topicMessages(t, 3)
+				messages[1].PayerAccountId = "0.0.6"
+				return messages
+			},
+			failures: []string{"runningHash 2", "transaction 2"},
+			events:   3,
+		},
+		{
+			name:     "a batch",
+			messages: func(t *testing.T) []mirrorTopicMessage { return topicMessages(t, 1, batchMessageWith("", "", "")) },
+			events:   4,
+		},
+		{
+			name:     "a batch numbered out of order",
+			messages: func(t *testing.T) []mirrorTopicMessage { return topicMessages(t, 1, batchMessageWith("", testTransactionId(9)+"-1")) },
+			failures: []string{"transaction 2"},
+			events:   3,
+		},
+		{
+			name: "an undecryptable private section",
+			messages: func(t *testing.T) []mirrorTopicMessage {
+				return topicMessages(t, 1, []byte(fmt.Sprintf(`{"public":{"event":"start","timestamp":"1590000000000","tzOffset":"0","transactionId":"%v"},"private":"00ff"}`, testTransactionId(2))))
+			},
+			failures: []string{"private 2"},
+			events:   2,
+		},
+		{
+			name:     "an undecryptable batch",
+			messages: func(t *testing.T) []mirrorTopicMessage { return topicMessages(t, 1, batchMessageWith("", "")) },
+			keys:     keyring{activeKeyId: "", keys: map[string]string{"": "Another32-ByteEncryptionKey1234!"}},
+			failures: []string{"private 1", "private 2"},
+			events:   3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := test.keys
+			if keys.keys == nil {
+				keys = te.keyring
+			}
+
+			report := verifyTopicMessages(test.messages(t), keys)
+
+			var failures []string
+			for _, failure := range report.Failures {
+				failures = append(failures, fmt.Sprintf("%v %v", failure.Check, failure.SequenceNumber))
+			}
+			if !reflect.DeepEqual(failures, test.failures) {
+				t.Errorf("failed %v, expected %v: %+v", failures, test.failures, report.Failures)
+			}
+
+			expectedResult := "pass"
+			if len(test.failures) > 0 {
+				expectedResult = "fail"
+			}
+			if report.Result != expectedResult || len(report.Topics) != 1 || report.Topics[0].Events != test.events {
+				t.Errorf("the report is %v with %+v, expected %v with %v events", report.Result, report.Topics, expectedResult, test.events)
+			}
+		})
+	}
+}
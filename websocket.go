@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+//The /ws endpoint lets a publisher track events and hear back about them over a single WebSocket connection, rather
+// than a GET to /track and a long-poll to /retrieve for every event. Every frame is a JSON object with a type:
+//
+//	{"type":"track","id":"1","event":{"event":"start","localTimestamp":"...", ...}}   (client) the /track parameters
+//	{"type":"ack","id":"1","transactionId":"0.0.1234@...","message":{...}}           (server) the event was submitted
+//	{"type":"error","id":"1","error":"...","retryAfter":30}                          (server) the event was not
+//	{"type":"confirmed","transactionId":"...","topicId":"...","sequenceNumber":57,
+//	 "consensusTimestamp":"...","url":"https://..."}                                  (server) the event reached consensus
+//	{"type":"anchored","transactionId":"..."}                                         (server) the event was anchored locally
+//	{"type":"expired","transactionId":"..."}                                          (server) see below
+//	{"type":"resume","transactionIds":["...","..."]}                                  (client) see below
+//
+//Backpressure: track frames are submitted one at a time on their own goroutine, so a publisher sending faster than we
+// can submit is slowed down by the connection itself whilst confirmations keep flowing. Once maxUnconfirmedEvents are
+// waiting for consensus further events are refused with an error until some are confirmed. A connection that can't
+// keep up with its confirmations is closed.
+//
+//Reconnecting: a publisher should keep the transaction IDs that have been acknowledged but not yet confirmed, and send
+// them in a resume frame when it reconnects. Any that were confirmed in the meantime are sent straight away and the
+// rest as they arrive.
+//
+//A transaction ID that isn't confirmed within RETRIEVE_TIMEOUT (such as one whose batch had to be anchored locally,
+// or one resumed that was never submitted at all) is given up on with an expired frame, so that it stops counting
+// towards maxUnconfirmedEvents. The publisher can still look it up with /retrieve, or resume it to keep waiting
+const (
+	maxUnconfirmedEvents = 1000
+	socketSendBuffer     = 256
+	socketWriteWait      = 10 * time.Second
+	socketPongWait       = 60 * time.Second
+	socketPingInterval   = 30 * time.Second
+	socketMaxFrameBytes  = 64 * 1024
+)
+
+type socketFrame struct {
+	Type               string            `json:"type"`
+	Id                 string            `json:"id,omitempty"`
+	Event              map[string]string `json:"event,omitempty"`
+	TransactionIds     []string          `json:"transactionIds,omitempty"`
+	TransactionId      string            `json:"transactionId,omitempty"`
+	TopicId            string            `json:"topicId,omitempty"`
+	SequenceNumber     uint64            `json:"sequenceNumber,omitempty"`
+	ConsensusTimestamp string            `json:"consensusTimestamp,omitempty"`
+	Url                string            `json:"url,omitempty"`
+	Message            json.RawMessage   `json:"message,omitempty"`
+	Error              string            `json:"error,omitempty"`
+	RetryAfter         int               `json:"retryAfter,omitempty"`
+}
+
+//the player is embedded on publishers' own sites, so connections are accepted from any origin. Requests are tied to a
+// tenant by API key rather than by anything the browser sends automatically
+var socketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+//a trackingSocket is one publisher's connection. Frames are only ever written by its writer goroutine
+type trackingSocket struct {
+	t          *tenant
+	connection *websocket.Conn
+	send       chan socketFrame
+	closed     chan struct{}
+
+	//the transaction IDs that have been acknowledged but not yet confirmed, and when. Only used by the reader
+	// goroutine, which keeps unconfirmed up to date for the tracking goroutine
+	pending        map[string]time.Time
+	pendingTimeout time.Duration
+	unconfirmed    int64
+}
+
+var errTooManyUnconfirmed = fmt.Errorf("there are already %v events waiting for consensus", maxUnconfirmedEvents)
+
+//a trackedEvent is the result of submitting a track frame, passed from the tracking goroutine back to the reader
+type trackedEvent struct {
+	frame      socketFrame
+	jsonString string
+	err        error
+}
+
+func trackingSocketHandler(rw http.ResponseWriter, r *http.Request) {
+	t, ok := requireSubmittingTenant(rw, r)
+	if !ok {
+		return
+	}
+
+	connection, err := socketUpgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		//the upgrader has already written the error response
+		return
+	}
+
+	socket := &trackingSocket{
+		t:          t,
+		connection: connection,
+		send:       make(chan socketFrame, socketSendBuffer),
+		closed:     make(chan struct{}),
+		pending:    make(map[string]time.Time),
+
+		pendingTimeout: parseDurationEnv("RETRIEVE_TIMEOUT", 30*time.Second),
+	}
+
+	go socket.writeFrames()
+	socket.readFrames()
+}
+
+//This function handles the frames from the publisher along with the confirmations from the event store, until the
+// connection is closed
+func (s *trackingSocket) readFrames() {
+	defer close(s.closed)
+	defer s.connection.Close()
+
+	confirmations := eventStore.subscribe(s.t.id, socketSendBuffer)
+	defer eventStore.unsubscribe(confirmations)
+
+	s.connection.SetReadLimit(socketMaxFrameBytes)
+	_ = s.connection.SetReadDeadline(time.Now().Add(socketPongWait))
+	s.connection.SetPongHandler(func(string) error {
+		return s.connection.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	//frames are read on their own goroutine so that confirmations can be handled whilst waiting for the next one, and
+	// track frames are handed straight to the tracking goroutine, so that a slow submit doesn't hold up confirmations
+	frames := make(chan socketFrame)
+	tracks := make(chan socketFrame)
+	tracked := make(chan trackedEvent)
+	go func() {
+		defer close(frames)
+		defer close(tracks)
+		for {
+			var frame socketFrame
+			if err := s.connection.ReadJSON(&frame); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Printf("Tracking socket for tenant %v closed. Error: %v\n", s.t.id, err)
+				}
+				return
+			}
+
+			destination := frames
+			if frame.Type == "track" {
+				destination = tracks
+			}
+
+			select {
+			case destination <- frame:
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+	go s.trackFrames(tracks, tracked)
+
+	expiry := time.NewTicker(time.Second)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case frame, open := <-frames:
+			if !open {
+				return
+			}
+			if !s.handleFrame(frame) {
+				return
+			}
+
+		case event := <-tracked:
+			if !s.acknowledge(event) {
+				return
+			}
+
+		case messageJson, open := <-confirmations:
+			if !open {
+				//we fell too far behind the event store, so the publisher should reconnect and resume
+				s.closeWith(websocket.CloseTryAgainLater, "too far behind, please reconnect and resume")
+				return
+			}
+			if !s.confirm(messageJson) {
+				return
+			}
+
+		case <-expiry.C:
+			if !s.expirePending(time.Now()) {
+				return
+			}
+		}
+	}
+}
+
+//This function submits the publisher's track frames one at a time, passing each result back to the reader goroutine
+func (s *trackingSocket) trackFrames(tracks chan socketFrame, tracked chan trackedEvent) {
+	for frame := range tracks {
+		event := trackedEvent{frame: frame}
+		if atomic.LoadInt64(&s.unconfirmed) >= maxUnconfirmedEvents {
+			event.err = errTooManyUnconfirmed
+		} else {
+			params := url.Values{}
+			for name, value := range frame.Event {
+				params.Set(name, value)
+			}
+			event.jsonString, event.err = trackEvent(s.t, params)
+		}
+
+		select {
+		case tracked <- event:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+//This function acknowledges a submitted event, or reports why it couldn't be submitted, returning false if the
+// connection should be closed
+func (s *trackingSocket) acknowledge(event trackedEvent) bool {
+	if event.err != nil {
+		reply := socketFrame{Type: "error", Id: event.frame.Id, Error: event.err.Error()}
+		if exceeded, ok := event.err.(budgetExceededError); ok {
+			reply.RetryAfter = exceeded.retryAfter()
+		} else if event.err == errTooManyUnconfirmed {
+			reply.RetryAfter = 1
+		}
+		return s.queue(reply)
+	}
+
+	transactionId := gjson.Get(event.jsonString, "public.transactionId").String()
+	s.setPending(transactionId, true)
+	if !s.queue(socketFrame{Type: "ack", Id: event.frame.Id, TransactionId: transactionId, Message: json.RawMessage(event.jsonString)}) {
+		return false
+	}
+
+	//events anchored locally are already in the event store, and others may have been confirmed whilst being submitted
+	return s.confirmFromStore(transactionId)
+}
+
+//This function handles a frame from the publisher other than track frames, returning false if the connection should
+// be closed
+func (s *trackingSocket) handleFrame(frame socketFrame) bool {
+	switch frame.Type {
+	case "resume":
+		for _, transactionId := range frame.TransactionIds {
+			if len(s.pending) >= maxUnconfirmedEvents {
+				break
+			}
+			s.setPending(transactionId, true)
+			if !s.confirmFromStore(transactionId) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return s.queue(socketFrame{Type: "error", Id: frame.Id, Error: fmt.Sprintf("unknown frame type %q", frame.Type)})
+}
+
+//This function records whether a transaction ID is waiting for consensus, keeping the count for the tracking goroutine
+func (s *trackingSocket) setPending(transactionId string, pending bool) {
+	if pending {
+		s.pending[transactionId] = time.Now()
+	} else {
+		delete(s.pending, transactionId)
+	}
+	atomic.StoreInt64(&s.unconfirmed, int64(len(s.pending)))
+}
+
+//This function gives up on the transaction IDs that have been waiting for consensus for longer than the timeout,
+// returning false if the connection should be closed
+func (s *trackingSocket) expirePending(now time.Time) bool {
+	for transactionId, since := range s.pending {
+		if now.Sub(since) < s.pendingTimeout {
+			continue
+		}
+		s.setPending(transactionId, false)
+		if !s.queue(socketFrame{Type: "expired", TransactionId: transactionId}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *trackingSocket) confirmFromStore(transactionId string) bool {
+	if messageJson, exists := tenantEvent(s.t, transactionId); exists {
+		return s.confirm(messageJson)
+	}
+	return true
+}
+
+//This function sends the confirmation for a processed message, if it is one this connection is waiting for
+func (s *trackingSocket) confirm(messageJson string) bool {
+	transactionId := gjson.Get(messageJson, "public.transactionId").String()
+	if _, waiting := s.pending[transactionId]; !waiting || gjson.Get(messageJson, "hcs.tenant").String() != s.t.id {
+		return true
+	}
+	s.setPending(transactionId, false)
+
+	if gjson.Get(messageJson, "hcs.anchor").String() == "local" {
+		return s.queue(socketFrame{Type: "anchored", TransactionId: transactionId})
+	}
+
+	return s.queue(socketFrame{
+		Type:               "confirmed",
+		TransactionId:      transactionId,
+		TopicId:            gjson.Get(messageJson, "hcs.topicId").String(),
+		SequenceNumber:     gjson.Get(messageJson, "hcs.sequenceNumber").Uint(),
+		ConsensusTimestamp: time.Unix(0, gjson.Get(messageJson, "hcs.consensusTimestamp").Int()).UTC().Format(time.RFC3339Nano),
+		Url:                explorerMessageUrl(messageJson),
+	})
+}
+
+//This function queues a frame for the writer, closing the connection if the publisher isn't reading them fast enough
+func (s *trackingSocket) queue(frame socketFrame) bool {
+	select {
+	case s.send <- frame:
+		return true
+	default:
+		s.closeWith(websocket.CloseTryAgainLater, "too many unread frames, please reconnect and resume")
+		return false
+	}
+}
+
+func (s *trackingSocket) closeWith(code int, reason string) {
+	_ = s.connection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(socketWriteWait))
+}
+
+//This function writes the queued frames and keeps the connection alive with pings, until the connection is closed
+func (s *trackingSocket) writeFrames() {
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case frame := <-s.send:
+			_ = s.connection.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := s.connection.WriteJSON(frame); err != nil {
+				_ = s.connection.Close()
+				return
+			}
+
+		case <-ping.C:
+			_ = s.connection.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := s.connection.WriteMessage(websocket.PingMessage, nil); err != nil {
+				_ = s.connection.Close()
+				return
+			}
+
+		case <-s.closed:
+			return
+		}
+	}
+}
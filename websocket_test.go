@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTrackingSocketExpirePending(t *testing.T) {
+	now := time.Now()
+	s := &trackingSocket{
+		t:              testTenant("0.0.1234"),
+		send:           make(chan socketFrame, socketSendBuffer),
+		pending:        make(map[string]time.Time),
+		pendingTimeout: 30 * time.Second,
+	}
+	s.pending[testTransactionId(1)] = now.Add(-time.Minute)      //its batch couldn't be submitted
+	s.pending[testTransactionId(2)] = now.Add(-30 * time.Second) //resumed, but never submitted
+	s.pending[testTransactionId(3)] = now.Add(-10 * time.Second) //still waiting
+	s.unconfirmed = int64(len(s.pending))
+
+	if !s.expirePending(now) {
+		t.Fatal("the connection was closed")
+	}
+	close(s.send)
+
+	var expired []string
+	for frame := range s.send {
+		if frame.Type != "expired" {
+			t.Errorf("sent a %v frame, expected expired", frame.Type)
+		}
+		expired = append(expired, frame.TransactionId)
+	}
+	sort.Strings(expired)
+
+	if expected := []string{testTransactionId(1), testTransactionId(2)}; !reflect.DeepEqual(expired, expected) {
+		t.Errorf("expired %v, expected %v", expired, expected)
+	}
+	if _, waiting := s.pending[testTransactionId(3)]; !waiting || s.unconfirmed != 1 {
+		t.Errorf("expected only %v to still be waiting, got %v unconfirmed", testTransactionId(3), s.unconfirmed)
+	}
+}